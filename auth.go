@@ -0,0 +1,91 @@
+package httpcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// AuthPolicy is how a shared cache handles requests with an Authorization
+// header
+type AuthPolicy string
+
+const (
+	// AuthNever never stores the responses to authorized requests
+	AuthNever AuthPolicy = "never"
+	// AuthStrict stores the responses to authorized requests that have a
+	// public, s-maxage or must-revalidate directive, as rfc7234 allows
+	// https://httpwg.github.io/specs/rfc7234.html#caching.authenticated.responses
+	AuthStrict AuthPolicy = "strict"
+	// AuthPartition stores the responses to requests with a principal under
+	// keys partitioned by a hash of it, so that they are only served to the
+	// same user, including private responses. The principal is the
+	// Authorization header unless Handler.PartitionHeader names another.
+	AuthPartition AuthPolicy = "partition"
+)
+
+// AuthPolicies are the policies for authorized requests
+var AuthPolicies = []AuthPolicy{AuthNever, AuthStrict, AuthPartition}
+
+// ParseAuthPolicy returns the policy for authorized requests with a name
+// such as strict
+func ParseAuthPolicy(name string) (AuthPolicy, error) {
+	for _, policy := range AuthPolicies {
+		if string(policy) == strings.ToLower(name) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown authorization policy %q", name)
+}
+
+// authPolicy returns the policy for authorized requests, defaulting to
+// AuthNever
+func (h *Handler) authPolicy() AuthPolicy {
+	if h.AuthPolicy == "" {
+		return AuthNever
+	}
+	return h.AuthPolicy
+}
+
+// principal returns the user that made a request, from the PartitionHeader
+// or else the Authorization header
+func (h *Handler) principal(r *cacheRequest) string {
+	name := h.PartitionHeader
+	if name == "" {
+		name = "Authorization"
+	}
+	return r.Header.Get(name)
+}
+
+// partitionKey partitions the key of a request with a principal by a hash
+// of it with AuthPartition
+func (h *Handler) partitionKey(r *cacheRequest) {
+	principal := h.principal(r)
+	if !h.Shared || h.authPolicy() != AuthPartition || principal == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(principal))
+	parts := append([]string(nil), r.Key.parts...)
+	r.Key = r.Key.withParts(append(parts, "user="+hex.EncodeToString(sum[:])))
+	r.partitioned = true
+}
+
+// authorizationReason returns why the response to an authorized request
+// can't be stored in a shared cache, or an empty string if it can
+func (h *Handler) authorizationReason(cc CacheControl, r *cacheRequest) string {
+	if !h.Shared || r.Header.Get("Authorization") == "" {
+		return ""
+	}
+	switch h.authPolicy() {
+	case AuthPartition:
+		if r.partitioned {
+			return ""
+		}
+	case AuthStrict:
+		if cc.Has("public") || cc.Has("s-maxage") || cc.Has("must-revalidate") {
+			return ""
+		}
+	}
+	return "request authorization"
+}
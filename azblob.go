@@ -0,0 +1,369 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureVersion = "2019-12-12"
+
+	// bodies are uploaded in blocks of this size, which is also the most body
+	// that is ever held in memory
+	azureBlockSize = 4 * 1024 * 1024
+
+	azureHeaderMeta = "X-Ms-Meta-Httpcache_header"
+	azureStaleMeta  = "X-Ms-Meta-Httpcache_stale"
+)
+
+// AzureBlobConfig describes an Azure Storage container to store resources in
+type AzureBlobConfig struct {
+	Account string
+	// Key is the base64 encoded shared key of the storage account
+	Key       string
+	Container string
+	// Prefix is prepended to every blob name
+	Prefix string
+	// Endpoint defaults to https://<account>.blob.core.windows.net
+	Endpoint string
+	Client   *http.Client
+}
+
+// azureBlobCache stores each resource as a block blob in an Azure Storage
+// container, with the status and headers kept in the blob's metadata
+type azureBlobCache struct {
+	AzureBlobConfig
+	key []byte
+}
+
+var _ Cache = (*azureBlobCache)(nil)
+
+// NewAzureBlobCache returns a cache backed by an Azure Storage container
+func NewAzureBlobCache(config AzureBlobConfig) (Cache, error) {
+	key, err := base64.StdEncoding.DecodeString(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure storage key: %s", err.Error())
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://" + config.Account + ".blob.core.windows.net"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &azureBlobCache{AzureBlobConfig: config, key: key}, nil
+}
+
+func (c *azureBlobCache) blobURL(key string, query url.Values) string {
+	u := strings.TrimSuffix(c.Endpoint, "/") + "/" + c.Container + "/" +
+		c.Prefix + formatPrefix + hashKey(key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do signs and sends a request, returning an error for any non-2xx response
+func (c *azureBlobCache) do(method, key string, query url.Values, h http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.blobURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	c.sign(req)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFoundInCache
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("azure %s %s failed with %s: %s", method, key, resp.Status, b)
+	}
+
+	return resp, nil
+}
+
+// sign adds a Shared Key Authorization header to the request
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (c *azureBlobCache) sign(req *http.Request) {
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	msHeaders := []string{}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk)
+		}
+	}
+	sort.Strings(msHeaders)
+
+	canonicalHeaders := &bytes.Buffer{}
+	for _, k := range msHeaders {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(req.Header.Get(k)))
+	}
+
+	canonicalResource := &bytes.Buffer{}
+	canonicalResource.WriteString("/" + c.Account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := []string{}
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vals := query[k]
+		sort.Strings(vals)
+		fmt.Fprintf(canonicalResource, "\n%s:%s", strings.ToLower(k), strings.Join(vals, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource.String(),
+	}, "\n")
+
+	h := hmac.New(sha256.New, c.key)
+	io.WriteString(h, stringToSign)
+	req.Header.Set("Authorization", "SharedKey "+c.Account+":"+
+		base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+func azureHeader(resp *http.Response) (Header, error) {
+	b, err := base64.StdEncoding.DecodeString(resp.Header.Get(azureHeaderMeta))
+	if err != nil {
+		return Header{}, err
+	}
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *azureBlobCache) Header(key string) (Header, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return Header{}, err
+	}
+	resp.Body.Close()
+	return azureHeader(resp)
+}
+
+// Store a resource against a number of keys. The body is streamed to the
+// blob for the first key in blocks and copied server-side for the rest.
+func (c *azureBlobCache) Store(res *Resource, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var r io.Reader = res
+	length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+	if err == nil {
+		r = io.LimitReader(res, length)
+	} else {
+		length = -1
+	}
+
+	meta := http.Header{
+		azureHeaderMeta: {base64.StdEncoding.EncodeToString(headerBytes(res.Status(), res.Header()))},
+	}
+
+	n, err := c.upload(keys[0], r, meta)
+	if err != nil {
+		return err
+	}
+	if length >= 0 && n != length {
+		c.delete(keys[0])
+		return io.ErrUnexpectedEOF
+	}
+
+	for _, key := range keys[1:] {
+		resp, err := c.do("PUT", key, nil, http.Header{
+			"X-Ms-Copy-Source": {c.blobURL(keys[0], nil)},
+		}, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+// upload streams r to a block blob one block at a time, committing the
+// block list with the provided metadata. The number of bytes uploaded is
+// returned.
+func (c *azureBlobCache) upload(key string, r io.Reader, meta http.Header) (int64, error) {
+	block := make([]byte, azureBlockSize)
+
+	var blockIDs []string
+	var total int64
+
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blockIDs))))
+			resp, err := c.do("PUT", key, url.Values{"comp": {"block"}, "blockid": {id}}, nil, block[:n])
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			blockIDs = append(blockIDs, id)
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	var blockList struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	blockList.Latest = blockIDs
+
+	b, err := xml.Marshal(blockList)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do("PUT", key, url.Values{"comp": {"blocklist"}}, meta, b)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return total, nil
+}
+
+func (c *azureBlobCache) delete(key string) {
+	if resp, err := c.do("DELETE", key, nil, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (c *azureBlobCache) setMetadata(key string, meta http.Header) error {
+	resp, err := c.do("PUT", key, url.Values{"comp": {"metadata"}}, meta, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *azureBlobCache) Retrieve(key string) (*Resource, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := azureHeader(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("azure returned no Content-Length for %s", key)
+	}
+
+	body := newRangeReader(resp.Body, resp.ContentLength, func(offset int64) (io.ReadCloser, error) {
+		resp, err := c.do("GET", key, nil, http.Header{
+			"Range": {fmt.Sprintf("bytes=%d-", offset)},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	})
+
+	res := NewResource(h.StatusCode, body, h.Header)
+	if stale := resp.Header.Get(azureStaleMeta); stale != "" {
+		staleNano, err := strconv.ParseInt(stale, 10, 64)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		staleTime := time.Unix(0, staleNano).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	}
+
+	return res, nil
+}
+
+func (c *azureBlobCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+	for _, key := range keys {
+		resp, err := c.do("HEAD", key, nil, nil, nil)
+		if err == ErrNotFoundInCache {
+			continue
+		} else if err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+			continue
+		}
+		resp.Body.Close()
+
+		if err := c.setMetadata(key, http.Header{
+			azureHeaderMeta: {resp.Header.Get(azureHeaderMeta)},
+			azureStaleMeta:  {strconv.FormatInt(Clock().UnixNano(), 10)},
+		}); err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *azureBlobCache) Freshen(res *Resource, keys ...string) error {
+	for _, key := range keys {
+		if h, err := c.Header(key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				if err := c.setMetadata(key, http.Header{
+					azureHeaderMeta: {base64.StdEncoding.EncodeToString(headerBytes(h.StatusCode, res.Header()))},
+				}); err != nil {
+					return err
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
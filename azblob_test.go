@@ -0,0 +1,187 @@
+package httpcache_test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+type azureBlob struct {
+	meta http.Header
+	body []byte
+}
+
+// fakeAzure implements just enough of the Azure Blob service to exercise the
+// azblob backend
+type fakeAzure struct {
+	sync.Mutex
+	blobs  map[string]azureBlob
+	blocks map[string][]byte
+}
+
+func azureMeta(h http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Ms-Meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (s *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey llamas:") {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "PUT" && query.Get("comp") == "block":
+		s.blocks[r.URL.Path+"/"+query.Get("blockid")], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		blob := azureBlob{meta: azureMeta(r.Header)}
+		for _, id := range blockList.Latest {
+			blob.body = append(blob.body, s.blocks[r.URL.Path+"/"+id]...)
+		}
+		s.blobs[r.URL.Path] = blob
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "metadata":
+		blob, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		blob.meta = azureMeta(r.Header)
+		s.blobs[r.URL.Path] = blob
+	case r.Method == "PUT" && r.Header.Get("X-Ms-Copy-Source") != "":
+		u, _ := url.Parse(r.Header.Get("X-Ms-Copy-Source"))
+		blob, ok := s.blobs[u.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.blobs[r.URL.Path] = blob
+		w.Header().Set("X-Ms-Copy-Status", "success")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "GET" || r.Method == "HEAD":
+		blob, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body := blob.body
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			body = body[offset:]
+			status = http.StatusPartialContent
+		}
+		for k, v := range blob.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	case r.Method == "DELETE":
+		delete(s.blobs, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func newTestAzureBlobCache(t *testing.T) (httpcache.Cache, func()) {
+	server := httptest.NewServer(&fakeAzure{
+		blobs:  map[string]azureBlob{},
+		blocks: map[string][]byte{},
+	})
+	cache, err := httpcache.NewAzureBlobCache(httpcache.AzureBlobConfig{
+		Endpoint:  server.URL,
+		Account:   "llamas",
+		Key:       base64.StdEncoding.EncodeToString([]byte("secret")),
+		Container: "alpacas",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, server.Close
+}
+
+func TestAzureBlobSaveResource(t *testing.T) {
+	cache, closer := newTestAzureBlobCache(t)
+	defer closer()
+
+	// spans several blocks
+	var body = strings.Repeat("llamas", 1500000)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas":         []string{"true"},
+		"Content-Length": []string{strconv.Itoa(len(body))},
+	})
+
+	if err := cache.Store(res, "azblob-testkey", "azblob-testkey-vary"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"azblob-testkey", "azblob-testkey-vary"} {
+		resOut, err := cache.Retrieve(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, res.Header(), resOut.Header())
+		require.True(t, body == readAllString(resOut))
+		resOut.Close()
+	}
+}
+
+func TestAzureBlobInvalidateAndFreshen(t *testing.T) {
+	cache, closer := newTestAzureBlobCache(t)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Date": []string{httpcache.Clock().Format(http.TimeFormat)},
+		"Etag": []string{`"llamas"`},
+	})
+	if err := cache.Store(res, "azblob-testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Invalidate("azblob-testkey")
+
+	resOut, err := cache.Retrieve("azblob-testkey")
+	require.NoError(t, err)
+	require.True(t, resOut.IsStale())
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	res.Header().Set("X-Llamas", "freshened")
+	require.NoError(t, cache.Freshen(res, "azblob-testkey"))
+
+	h, err := cache.Header("azblob-testkey")
+	require.NoError(t, err)
+	require.Equal(t, "freshened", h.Get("X-Llamas"))
+
+	_, err = cache.Header("azblob-missing")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
@@ -0,0 +1,287 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendFactory creates a Cache from the options of a backend spec
+type BackendFactory func(opts url.Values) (Cache, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes a cache backend available by name to OpenBackend. It
+// is intended to be called from the init function of packages that provide
+// a Cache implementation, and panics if the name is registered twice.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("httpcache: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("httpcache: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseBackendSpec splits a spec of the form name?key=val&key=val into the
+// backend name and its options
+func ParseBackendSpec(spec string) (string, url.Values, error) {
+	name, query := spec, ""
+	if i := strings.Index(spec, "?"); i >= 0 {
+		name, query = spec[:i], spec[i+1:]
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid options for backend %s: %s", name, err.Error())
+	}
+	return name, opts, nil
+}
+
+// OpenBackend creates a Cache from a spec of the form name?key=val&key=val,
+// where name is a registered backend
+func OpenBackend(spec string) (Cache, error) {
+	name, opts, err := ParseBackendSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return OpenBackendOptions(name, opts)
+}
+
+// OpenBackendOptions creates a Cache from a registered backend name and options
+func OpenBackendOptions(name string, opts url.Values) (Cache, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, expected one of %s",
+			name, strings.Join(Backends(), ", "))
+	}
+	return factory(opts)
+}
+
+// optGet returns the named option, or def if it isn't set
+func optGet(opts url.Values, name, def string) string {
+	if v := opts.Get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// optInt64 returns the named option as an int64, or def if it isn't set
+func optInt64(backend string, opts url.Values, name string, def int64) (int64, error) {
+	v := opts.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s for backend %s: %s", name, backend, err.Error())
+	}
+	return i, nil
+}
+
+// optRequire returns the named option, or an error if it isn't set
+func optRequire(backend string, opts url.Values, name string) (string, error) {
+	if v := opts.Get(name); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("backend %s requires the %s option", backend, name)
+}
+
+// openDiskBackend creates a disk cache from the dir, max-size, low-water,
+// eviction, tinylfu, verify, encryption-key-file, compress, compress-types and
+// bloom options, which are shared by the disk and tiered backends
+func openDiskBackend(opts url.Values) (Cache, error) {
+	maxSize, err := optInt64("disk", opts, "max-size", 0)
+	if err != nil {
+		return nil, err
+	}
+	lowWater, err := optInt64("disk", opts, "low-water", 0)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseEvictionPolicy(optGet(opts, "eviction", string(EvictLRU)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid eviction for backend disk: %s", err.Error())
+	}
+	tinyLFU, err := strconv.ParseBool(optGet(opts, "tinylfu", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tinylfu for backend disk: %s", err.Error())
+	}
+	verify, err := strconv.ParseBool(optGet(opts, "verify", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid verify for backend disk: %s", err.Error())
+	}
+	compress, err := strconv.ParseBool(optGet(opts, "compress", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compress for backend disk: %s", err.Error())
+	}
+	var compressTypes []string
+	if compress {
+		compressTypes = DefaultCompressTypes
+		if types := opts.Get("compress-types"); types != "" {
+			compressTypes = strings.Split(types, ",")
+		}
+	}
+	bloom, err := strconv.ParseBool(optGet(opts, "bloom", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bloom for backend disk: %s", err.Error())
+	}
+	var key []byte
+	if path := opts.Get("encryption-key-file"); path != "" {
+		if key, err = LoadEncryptionKey(path); err != nil {
+			return nil, err
+		}
+	}
+	return NewConfiguredDiskCache(optGet(opts, "dir", "./cachedata"), DiskCacheConfig{
+		MaxSize:         maxSize,
+		LowWater:        lowWater,
+		Eviction:        policy,
+		TinyLFU:         tinyLFU,
+		VerifyChecksums: verify,
+		EncryptionKey:   key,
+		CompressTypes:   compressTypes,
+		BloomFilter:     bloom,
+	})
+}
+
+func init() {
+	RegisterBackend("memory", func(opts url.Values) (Cache, error) {
+		maxSize, err := optInt64("memory", opts, "max-size", 0)
+		if err != nil {
+			return nil, err
+		}
+		maxEntries, err := optInt64("memory", opts, "max-entries", 0)
+		if err != nil {
+			return nil, err
+		}
+		if maxSize <= 0 && maxEntries <= 0 {
+			return NewMemoryCache(), nil
+		}
+		return NewLimitedMemoryCache(maxSize, int(maxEntries)), nil
+	})
+
+	RegisterBackend("disk", openDiskBackend)
+
+	RegisterBackend("tiered", func(opts url.Values) (Cache, error) {
+		memSize, err := optInt64("tiered", opts, "memory-size", 64*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		maxEntries, err := optInt64("tiered", opts, "memory-max-entries", 0)
+		if err != nil {
+			return nil, err
+		}
+		promoteHits, err := optInt64("tiered", opts, "promote-hits", 1)
+		if err != nil {
+			return nil, err
+		}
+		if promoteHits > MaxPromoteHits {
+			return nil, fmt.Errorf("invalid promote-hits for backend tiered: at most %d requests are counted", MaxPromoteHits)
+		}
+		demoteIdle, err := time.ParseDuration(optGet(opts, "demote-idle", "0s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid demote-idle for backend tiered: %s", err.Error())
+		}
+		disk, err := openDiskBackend(opts)
+		if err != nil {
+			return nil, err
+		}
+		hot := NewLimitedMemoryCache(memSize, int(maxEntries))
+		return NewConfiguredTieredCache(hot, disk, TieredConfig{
+			PromoteHits: int(promoteHits),
+			DemoteIdle:  demoteIdle,
+		}), nil
+	})
+
+	RegisterBackend("bolt", func(opts url.Values) (Cache, error) {
+		return NewBoltCache(optGet(opts, "path", "./httpcache.db"))
+	})
+
+	RegisterBackend("redis", func(opts url.Values) (Cache, error) {
+		addr, err := optRequire("redis", opts, "addr")
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := time.ParseDuration(optGet(opts, "ttl", "0s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl for backend redis: %s", err.Error())
+		}
+		return NewRedisCache(addr, ttl), nil
+	})
+
+	RegisterBackend("memcached", func(opts url.Values) (Cache, error) {
+		servers, err := optRequire("memcached", opts, "servers")
+		if err != nil {
+			return nil, err
+		}
+		return NewMemcacheCache(strings.Split(servers, ",")...), nil
+	})
+
+	RegisterBackend("s3", func(opts url.Values) (Cache, error) {
+		bucket, err := optRequire("s3", opts, "bucket")
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Cache(S3Config{
+			Endpoint:  optGet(opts, "endpoint", "https://s3.amazonaws.com"),
+			Region:    optGet(opts, "region", "us-east-1"),
+			Bucket:    bucket,
+			Prefix:    opts.Get("prefix"),
+			AccessKey: optGet(opts, "access-key", os.Getenv("AWS_ACCESS_KEY_ID")),
+			SecretKey: optGet(opts, "secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		})
+	})
+
+	RegisterBackend("gcs", func(opts url.Values) (Cache, error) {
+		bucket, err := optRequire("gcs", opts, "bucket")
+		if err != nil {
+			return nil, err
+		}
+		return NewGCSCache(GCSConfig{
+			Bucket:   bucket,
+			Prefix:   opts.Get("prefix"),
+			Endpoint: opts.Get("endpoint"),
+		})
+	})
+
+	RegisterBackend("azblob", func(opts url.Values) (Cache, error) {
+		container, err := optRequire("azblob", opts, "container")
+		if err != nil {
+			return nil, err
+		}
+		return NewAzureBlobCache(AzureBlobConfig{
+			Account:   optGet(opts, "account", os.Getenv("AZURE_STORAGE_ACCOUNT")),
+			Key:       optGet(opts, "key", os.Getenv("AZURE_STORAGE_KEY")),
+			Container: container,
+			Prefix:    opts.Get("prefix"),
+			Endpoint:  opts.Get("endpoint"),
+		})
+	})
+}
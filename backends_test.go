@@ -0,0 +1,67 @@
+package httpcache_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackendSpec(t *testing.T) {
+	name, opts, err := httpcache.ParseBackendSpec("redis?addr=localhost:6379&ttl=1h")
+	require.NoError(t, err)
+	require.Equal(t, "redis", name)
+	require.Equal(t, url.Values{"addr": {"localhost:6379"}, "ttl": {"1h"}}, opts)
+
+	name, opts, err = httpcache.ParseBackendSpec("memory")
+	require.NoError(t, err)
+	require.Equal(t, "memory", name)
+	require.Empty(t, opts)
+}
+
+func TestRegisterBackend(t *testing.T) {
+	var got url.Values
+	httpcache.RegisterBackend("test-llamas", func(opts url.Values) (httpcache.Cache, error) {
+		got = opts
+		return httpcache.NewMemoryCache(), nil
+	})
+
+	registered := map[string]bool{}
+	for _, name := range httpcache.Backends() {
+		registered[name] = true
+	}
+	require.True(t, registered["test-llamas"])
+
+	cache, err := httpcache.OpenBackend("test-llamas?size=large")
+	require.NoError(t, err)
+	require.NotNil(t, cache)
+	require.Equal(t, "large", got.Get("size"))
+
+	require.Panics(t, func() {
+		httpcache.RegisterBackend("test-llamas", nil)
+	})
+}
+
+func TestOpenUnknownBackend(t *testing.T) {
+	_, err := httpcache.OpenBackend("alpacas")
+	require.Error(t, err)
+}
+
+func TestOpenBackendMissingOption(t *testing.T) {
+	_, err := httpcache.OpenBackend("redis")
+	require.Error(t, err)
+}
+
+func TestOpenLimitedMemoryBackend(t *testing.T) {
+	cache, err := httpcache.OpenBackend("memory")
+	require.NoError(t, err)
+	_, ok := httpcache.Stats(cache)
+	require.False(t, ok)
+
+	cache, err = httpcache.OpenBackend("memory?max-size=1500&max-entries=10")
+	require.NoError(t, err)
+	stats, ok := httpcache.Stats(cache)
+	require.True(t, ok)
+	require.Equal(t, int64(1500), stats.MaxBytes)
+}
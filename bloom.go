@@ -0,0 +1,141 @@
+package httpcache
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+)
+
+const (
+	// bloomHashes is the number of bits set for each key in a bloomFilter,
+	// which with bloomBitsPerKey gives a false positive rate of about 1%
+	bloomHashes     = 7
+	bloomBitsPerKey = 10
+	// minBloomKeys is the fewest keys a bloomFilter is sized for
+	minBloomKeys = 1 << 16
+)
+
+// bloomFilter is a set of the hashes of keys that may have false positives
+// but never false negatives, so that lookups of keys it doesn't contain
+// don't need to touch the disk. The hashes are sha-256, so the bits of each
+// key are taken from its hash rather than hashing it again.
+type bloomFilter struct {
+	bits     []uint64
+	capacity int
+	count    int
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	if capacity < minBloomKeys {
+		capacity = minBloomKeys
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (capacity*bloomBitsPerKey+63)/64),
+		capacity: capacity,
+	}
+}
+
+// positions returns the bits of a hash, by double hashing with the first
+// sixteen bytes of it
+func (f *bloomFilter) positions(hash string) [bloomHashes]uint64 {
+	var pos [bloomHashes]uint64
+	if len(hash) < 32 {
+		return pos
+	}
+	b, err := hex.DecodeString(hash[:32])
+	if err != nil {
+		return pos
+	}
+	h1, h2 := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	n := uint64(len(f.bits) * 64)
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % n
+	}
+	return pos
+}
+
+func (f *bloomFilter) add(hash string) {
+	for _, p := range f.positions(hash) {
+		f.bits[p/64] |= 1 << (p % 64)
+	}
+	f.count++
+}
+
+func (f *bloomFilter) mayContain(hash string) bool {
+	for _, p := range f.positions(hash) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// keyFilter is the bloom filter of the keys stored in a vfs cache, which is
+// rebuilt from the stored keys twice as large once it fills up, as keys
+// can't be removed from it. Keys are added before they are stored, and to
+// the filter being rebuilt as well, so only keys stored while the filter is
+// swapped can be missed, which only misses the cache.
+type keyFilter struct {
+	sync.RWMutex
+	filter *bloomFilter
+	next   *bloomFilter
+	// list returns the hashes of the stored keys
+	list func() []string
+}
+
+func newKeyFilter(list func() []string) *keyFilter {
+	hashes := list()
+	f := &keyFilter{filter: newBloomFilter(2 * len(hashes)), list: list}
+	for _, hash := range hashes {
+		f.filter.add(hash)
+	}
+	debugf("bloom filter holds %d stored keys", len(hashes))
+	return f
+}
+
+// add adds the hash of a key that is about to be stored
+func (f *keyFilter) add(hash string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.filter.add(hash)
+	if f.next != nil {
+		f.next.add(hash)
+	} else if f.filter.count > f.filter.capacity {
+		f.next = newBloomFilter(2 * f.filter.capacity)
+		go f.rebuild()
+	}
+}
+
+// rebuild fills next with the stored keys and replaces the filter with it
+func (f *keyFilter) rebuild() {
+	hashes := f.list()
+
+	f.Lock()
+	defer f.Unlock()
+	for _, hash := range hashes {
+		f.next.add(hash)
+	}
+	debugf("rebuilt bloom filter of %d stored keys for %d", len(hashes), f.next.capacity)
+	f.filter, f.next = f.next, nil
+}
+
+// mayContain returns false if a key definitely isn't stored
+func (f *keyFilter) mayContain(hash string) bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.filter.mayContain(hash)
+}
+
+// storedHashes returns the hashes of the keys with stored headers
+func (c *cache) storedHashes() []string {
+	infos, err := c.fs.ReadDir(headerPrefix + formatPrefix)
+	if err != nil {
+		return nil
+	}
+	hashes := make([]string, 0, len(infos))
+	for _, info := range infos {
+		hashes = append(hashes, info.Name())
+	}
+	return hashes
+}
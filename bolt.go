@@ -0,0 +1,173 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltHeaderBucket = []byte(headerPrefix + formatPrefix)
+	boltBodyBucket   = []byte(bodyPrefix + formatPrefix)
+	boltStaleBucket  = []byte("stale/" + formatPrefix)
+)
+
+// boltCache stores resources in a single bbolt database file
+type boltCache struct {
+	db *bolt.DB
+}
+
+var _ Cache = (*boltCache)(nil)
+
+// NewBoltCache returns a cache backed by a bbolt database at path, which is
+// created if it doesn't exist. The returned cache implements io.Closer and
+// should be closed when no longer used.
+func NewBoltCache(path string) (Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltHeaderBucket, boltBodyBucket, boltStaleBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltCache{db: db}, nil
+}
+
+// Close releases the underlying database file
+func (c *boltCache) Close() error {
+	return c.db.Close()
+}
+
+// boltGet returns a copy of a value, as values are only valid during a transaction
+func boltGet(tx *bolt.Tx, bucket []byte, key string) []byte {
+	v := tx.Bucket(bucket).Get([]byte(hashKey(key)))
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *boltCache) Header(key string) (Header, error) {
+	var b []byte
+	c.db.View(func(tx *bolt.Tx) error {
+		b = boltGet(tx, boltHeaderBucket, key)
+		return nil
+	})
+	if b == nil {
+		return Header{}, ErrNotFoundInCache
+	}
+
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// Store a resource against a number of keys
+func (c *boltCache) Store(res *Resource, keys ...string) error {
+	buf, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	hb := headerBytes(res.Status(), res.Header())
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			k := []byte(hashKey(key))
+			if err := tx.Bucket(boltStaleBucket).Delete(k); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBodyBucket).Put(k, buf.Bytes()); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltHeaderBucket).Put(k, hb); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *boltCache) Retrieve(key string) (*Resource, error) {
+	var body, hb, stale []byte
+	c.db.View(func(tx *bolt.Tx) error {
+		body = boltGet(tx, boltBodyBucket, key)
+		hb = boltGet(tx, boltHeaderBucket, key)
+		stale = boltGet(tx, boltStaleBucket, key)
+		return nil
+	})
+	// empty bodies may be stored as nil, so only the header signals existence
+	if hb == nil {
+		return nil, ErrNotFoundInCache
+	}
+
+	h, err := readHeaders(bufio.NewReader(bytes.NewReader(hb)))
+	if err != nil {
+		return nil, err
+	}
+
+	res := NewResourceBytes(h.StatusCode, body, h.Header)
+	if len(stale) == 8 {
+		staleTime := time.Unix(0, int64(binary.BigEndian.Uint64(stale))).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	}
+	return res, nil
+}
+
+func (c *boltCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+
+	stale := make([]byte, 8)
+	binary.BigEndian.PutUint64(stale, uint64(Clock().UnixNano()))
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := tx.Bucket(boltStaleBucket).Put([]byte(hashKey(key)), stale); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("error invalidating %q: %s", keys, err.Error())
+	}
+}
+
+func (c *boltCache) Freshen(res *Resource, keys ...string) error {
+	for _, key := range keys {
+		if h, err := c.Header(key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				err := c.db.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(boltHeaderBucket).Put(
+						[]byte(hashKey(key)), headerBytes(h.StatusCode, res.Header()))
+				})
+				if err != nil {
+					return err
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package httpcache_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltCachePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var body = strings.Repeat("llamas", 5000)
+	var path = filepath.Join(dir, "httpcache.db")
+
+	cache, err := httpcache.NewBoltCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas": []string{"true"},
+	})
+
+	if err := cache.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = httpcache.NewBoltCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.(io.Closer).Close()
+
+	resOut, err := cache.Retrieve("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, res.Header(), resOut.Header())
+	require.Equal(t, body, readAllString(resOut))
+
+	if _, err := cache.Retrieve("missingkey"); err != httpcache.ErrNotFoundInCache {
+		t.Fatalf("expected ErrNotFoundInCache, got %v", err)
+	}
+}
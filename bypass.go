@@ -0,0 +1,37 @@
+package httpcache
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// BypassRule marks the requests whose Host and path match it as never
+// cached, passing them straight to the upstream without looking them up or
+// storing their responses
+type BypassRule struct {
+	// Host is a pattern for the Host of requests, in which * matches
+	// anything, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests in the same way, or if
+	// PathRegexp is set it is matched against paths instead
+	Path       string
+	PathRegexp *regexp.Regexp
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule BypassRule) Matches(r *http.Request) bool {
+	if rule.PathRegexp == nil {
+		return matchHostPath(rule.Host, rule.Path, r)
+	}
+	return matchHostPath(rule.Host, "", r) && rule.PathRegexp.MatchString(r.URL.Path)
+}
+
+// neverCached returns whether one of the NeverCache rules matches a request
+func (h *Handler) neverCached(r *http.Request) bool {
+	for _, rule := range h.NeverCache {
+		if rule.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
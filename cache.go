@@ -3,7 +3,9 @@ package httpcache
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -12,8 +14,11 @@ import (
 	"net/textproto"
 	"os"
 	pathutil "path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rainycape/vfs"
@@ -23,8 +28,14 @@ const (
 	headerPrefix = "header/"
 	bodyPrefix   = "body/"
 	formatPrefix = "v1/"
+	// tmpPrefix is where bodies are written before they are linked to keys
+	tmpPrefix = "tmp/"
 )
 
+// checksumHeader is stored with the headers of resources in vfs caches,
+// holding the sha-256 of their bodies so that they can be verified when read
+const checksumHeader = "X-Httpcache-Body-Sha256"
+
 // Returned when a resource doesn't exist
 var ErrNotFoundInCache = errors.New("Not found in cache")
 
@@ -38,8 +49,38 @@ type Cache interface {
 
 // cache provides a storage mechanism for cached Resources
 type cache struct {
-	fs    vfs.VFS
-	stale map[string]time.Time
+	fs vfs.VFS
+	// locks guard the header and body files of keys, so that they are
+	// written and read together
+	locks keyLocks
+	// tmpSeq numbers the temporary files that bodies are written to
+	tmpSeq uint64
+
+	staleMu sync.Mutex
+	stale   map[string]time.Time
+
+	// verify checks bodies against their checksums when they are retrieved
+	verify bool
+	// encryptionKey encrypts the files of the cache if set, each with a key
+	// derived from it
+	encryptionKey []byte
+	// compressTypes are the content types of bodies to compress
+	compressTypes []string
+	// link replaces newpath with a hard link to oldpath, if the filesystem
+	// supports it, so that bodies with the same content are stored once and
+	// freed once no key links to them
+	link func(oldpath, newpath string) error
+
+	blobsMu sync.Mutex
+	// blobs is the path of a body stored with each content, by blobID, and
+	// blobPaths is the blobID of each of those paths, so that they can be
+	// forgotten when the body at the path is removed
+	blobs     map[string]string
+	blobPaths map[string]string
+
+	// filter holds the keys that may be stored if set, so that lookups of
+	// others don't touch the filesystem
+	filter *keyFilter
 }
 
 var _ Cache = (*cache)(nil)
@@ -61,9 +102,19 @@ func NewMemoryCache() Cache {
 
 // NewDiskCache returns a disk-backed cache
 func NewDiskCache(dir string) (Cache, error) {
+	c, err := newDiskCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newDiskCache(dir string) (*cache, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
+	// bodies left half written by a crash
+	os.RemoveAll(filepath.Join(dir, bodyPrefix+tmpPrefix))
 	fs, err := vfs.FS(dir)
 	if err != nil {
 		return nil, err
@@ -72,78 +123,352 @@ func NewDiskCache(dir string) (Cache, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewVFSCache(chfs), nil
+	link := func(oldpath, newpath string) error {
+		tmp := filepath.Join(dir, filepath.FromSlash(newpath)+".link")
+		if err := os.Link(filepath.Join(dir, filepath.FromSlash(oldpath)), tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, filepath.FromSlash(newpath))); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	return &cache{fs: chfs, stale: map[string]time.Time{}, link: link, blobs: map[string]string{}, blobPaths: map[string]string{}}, nil
+}
+
+// vfsCreate creates a file, encrypting what is written to it if the cache is
+// encrypted, which is only complete once it is closed. Existing files are
+// replaced rather than truncated, as they may be linked to by other keys.
+func (c *cache) vfsCreate(path string) (io.WriteCloser, error) {
+	f, err := c.createFile(path)
+	if err != nil || c.encryptionKey == nil {
+		return f, err
+	}
+
+	w, err := newSealWriter(f, c.encryptionKey, sealedAAD(path))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
-func (c *cache) vfsWrite(path string, r io.Reader) error {
+// createFile creates a file to be written as it is, replacing any existing one
+func (c *cache) createFile(path string) (vfs.WFile, error) {
 	if err := vfs.MkdirAll(c.fs, pathutil.Dir(path), 0700); err != nil {
-		return err
+		return nil, err
 	}
-	f, err := c.fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	c.fs.Remove(path)
+	return c.fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+}
+
+func (c *cache) vfsWrite(path string, r io.Reader) (int64, error) {
+	w, err := c.vfsCreate(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer f.Close()
-	if _, err := io.Copy(f, r); err != nil {
-		return err
+	n, err := io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
 	}
-	return nil
+	return n, err
+}
+
+// writeBody writes a body to a file, compressing it with gzip if compress
+// is set, and returns its uncompressed length
+func (c *cache) writeBody(path string, r io.Reader, compress bool) (int64, error) {
+	if !compress {
+		return c.vfsWrite(path, r)
+	}
+
+	w, err := c.vfsCreate(path)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(w)
+	n, err := io.Copy(zw, r)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// vfsOpen opens a file written by vfsWrite, decrypting it if the cache is
+// encrypted. Files that can't be decrypted are treated as not existing.
+func (c *cache) vfsOpen(path string) (ReadSeekCloser, error) {
+	f, err := c.fs.Open(path)
+	if err != nil || c.encryptionKey == nil {
+		return f, err
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	var r ReadSeekCloser
+	if err == nil {
+		r, err = newOpenReader(f, size, c.encryptionKey, sealedAAD(path))
+	}
+	if err != nil {
+		f.Close()
+		if err == errUndecryptable {
+			debugf("%s %s", path, err.Error())
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return r, nil
 }
 
 // Retrieve the Status and Headers for a given key path
 func (c *cache) Header(key string) (Header, error) {
-	path := headerPrefix + formatPrefix + hashKey(key)
-	f, err := c.fs.Open(path)
+	if c.filter != nil && !c.filter.mayContain(hashKey(key)) {
+		return Header{}, ErrNotFoundInCache
+	}
+	unlock := c.locks.lock(hashKey(key))
+	defer unlock()
+
+	h, _, err := c.storedHeader(key)
+	return h, err
+}
+
+// peek retrieves a resource from cache without counting it as used by the
+// eviction policies of memory and disk caches or the tiers of a tiered cache
+func peek(cache Cache, key string) (*Resource, error) {
+	switch c := cache.(type) {
+	case *IndexedCache:
+		return peek(c.Cache, key)
+	case *namespacedCache:
+		return peek(c.cache, c.namespace+key)
+	case *tieredCache:
+		if res, err := peek(c.hot, key); err == nil {
+			return res, nil
+		}
+		return peek(c.cold, key)
+	case *diskCache:
+		return c.cache.Retrieve(key)
+	case *lruCache:
+		return c.peek(key)
+	}
+	return cache.Retrieve(key)
+}
+
+// storedBody is how the body of a resource in a vfs cache is stored, which
+// is recorded in the headers stored with it
+type storedBody struct {
+	// sum is the sha-256 of the body, or empty if it isn't known
+	sum string
+	// gzipLength is the uncompressed length of the body if it is stored
+	// compressed, or -1
+	gzipLength int64
+	// salt is the hex salt of the body if it is encrypted, or empty
+	salt string
+}
+
+// setHeaders records how the body is stored in h
+func (b storedBody) setHeaders(h http.Header) {
+	if b.sum != "" {
+		h.Set(checksumHeader, b.sum)
+	}
+	if b.gzipLength >= 0 {
+		h.Set(gzipLengthHeader, strconv.FormatInt(b.gzipLength, 10))
+	}
+	if b.salt != "" {
+		h.Set(saltHeader, b.salt)
+	}
+}
+
+// storedHeader returns the headers stored for a key, without those that
+// record how its body is stored, which is returned separately
+func (c *cache) storedHeader(key string) (Header, storedBody, error) {
+	return c.readStoredHeader(headerPrefix + formatPrefix + hashKey(key))
+}
+
+// readStoredHeader reads a header file like storedHeader
+func (c *cache) readStoredHeader(path string) (Header, storedBody, error) {
+	body := storedBody{gzipLength: -1}
+	f, err := c.vfsOpen(path)
 	if err != nil {
 		if vfs.IsNotExist(err) {
-			return Header{}, ErrNotFoundInCache
+			return Header{}, body, ErrNotFoundInCache
 		}
-		return Header{}, err
+		return Header{}, body, err
 	}
+	defer f.Close()
 
-	return readHeaders(bufio.NewReader(f))
+	h, err := readHeaders(bufio.NewReader(f))
+	if err != nil {
+		return h, body, err
+	}
+	body.sum = h.Get(checksumHeader)
+	if length, err := strconv.ParseInt(h.Get(gzipLengthHeader), 10, 64); err == nil {
+		body.gzipLength = length
+	}
+	body.salt = h.Get(saltHeader)
+	h.Del(checksumHeader)
+	h.Del(gzipLengthHeader)
+	h.Del(saltHeader)
+	return h, body, nil
 }
 
-// Store a resource against a number of keys
+// Store a resource against a number of keys, streaming its body to a
+// temporary file and linking the keys to it, so that it isn't buffered and
+// the keys aren't locked while it is streamed. Bodies with a content type in
+// compressTypes are compressed.
 func (c *cache) Store(res *Resource, keys ...string) error {
-	var buf = &bytes.Buffer{}
+	return c.store(res, keys, func(tmp string, link func() error) error {
+		return link()
+	})
+}
 
-	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
-		if _, err = io.CopyN(buf, res, length); err != nil {
-			return err
+// store stores a resource like Store, calling locked with the locks of the
+// keys held to link them to the temporary file the body was streamed to
+func (c *cache) store(res *Resource, keys []string, locked func(tmp string, link func() error) error) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var r io.Reader = res
+	length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+	if err == nil {
+		r = io.LimitReader(res, length)
+	} else {
+		length = -1
+	}
+
+	hashes := make([]string, len(keys))
+	for i, key := range keys {
+		hashes[i] = hashKey(key)
+		if c.filter != nil {
+			c.filter.add(hashes[i])
 		}
-	} else if _, err = io.Copy(buf, res); err != nil {
+	}
+	tmp := fmt.Sprintf("%s%s.%d", bodyPrefix+tmpPrefix, hashes[0], atomic.AddUint64(&c.tmpSeq, 1))
+	defer c.fs.Remove(tmp)
+
+	sum := sha256.New()
+	compress := compressible(c.compressTypes, res.Header())
+	n, err := c.writeBody(tmp, io.TeeReader(r, sum), compress)
+	if err == nil && length >= 0 && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
 		return err
 	}
 
-	for _, key := range keys {
-		delete(c.stale, key)
+	body := storedBody{sum: fmt.Sprintf("%x", sum.Sum(nil)), gzipLength: -1}
+	if compress {
+		body.gzipLength = n
+	}
+	c.dedupe(tmp, body)
+	if body.salt, err = c.fileSalt(tmp); err != nil {
+		return err
+	}
+	header := cloneHeader(res.Header())
+	body.setHeaders(header)
 
-		if err := c.storeBody(buf, key); err != nil {
-			return err
-		}
+	unlock := c.locks.lock(hashes...)
+	defer unlock()
 
-		if err := c.storeHeader(res.Status(), res.Header(), key); err != nil {
-			return err
+	err = locked(tmp, func() error {
+		for _, key := range keys {
+			c.staleMu.Lock()
+			delete(c.stale, key)
+			c.staleMu.Unlock()
+
+			c.forgetBlob(bodyPrefix + formatPrefix + hashKey(key))
+			if err := c.copyBody(tmp, key); err != nil {
+				return err
+			}
+
+			if err := c.storeHeader(res.Status(), header, key); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	c.rememberBlob(bodyPrefix+formatPrefix+hashes[0], body)
 	return nil
 }
 
-func (c *cache) storeBody(r io.Reader, key string) error {
-	if err := c.vfsWrite(bodyPrefix+formatPrefix+hashKey(key), r); err != nil {
+// readBody buffers the body of a resource, honoring Content-Length if present
+func readBody(res *Resource) (*bytes.Buffer, error) {
+	var buf = &bytes.Buffer{}
+
+	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
+		if _, err = io.CopyN(buf, res, length); err != nil {
+			return nil, err
+		}
+	} else if _, err = io.Copy(buf, res); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// copyBody links a stored body to the body of key, so that it is written
+// once however many keys it is stored under, or copies it if the filesystem
+// doesn't support links
+func (c *cache) copyBody(path, key string) error {
+	dst := bodyPrefix + formatPrefix + hashKey(key)
+	if dst == path {
+		return nil
+	}
+	if c.link != nil {
+		err := c.link(path, dst)
+		if err == nil {
+			return nil
+		}
+		debugf("copying body %s to %s, linking failed with error: %s", path, dst, err.Error())
+	}
+	// bodies are copied as they are, so that encrypted ones keep the salt
+	// that their headers record
+	f, err := c.fs.Open(path)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer f.Close()
+	w, err := c.createFile(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fileSalt returns the salt that the file at path was encrypted with, or
+// an empty string if the cache isn't encrypted
+func (c *cache) fileSalt(path string) (string, error) {
+	if c.encryptionKey == nil {
+		return "", nil
+	}
+	f, err := c.fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	salt := make([]byte, sealedSaltSize)
+	if _, err := io.ReadFull(f, salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
 }
 
 func (c *cache) storeHeader(code int, h http.Header, key string) error {
-	hb := &bytes.Buffer{}
-	hb.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))))
-	headersToWriter(h, hb)
+	hb := headerBytes(code, h)
 
-	if err := c.vfsWrite(headerPrefix+formatPrefix+hashKey(key), bytes.NewReader(hb.Bytes())); err != nil {
+	if _, err := c.vfsWrite(headerPrefix+formatPrefix+hashKey(key), bytes.NewReader(hb)); err != nil {
 		return err
 	}
 	return nil
@@ -151,22 +476,55 @@ func (c *cache) storeHeader(code int, h http.Header, key string) error {
 
 // Retrieve returns a cached Resource for the given key
 func (c *cache) Retrieve(key string) (*Resource, error) {
-	f, err := c.fs.Open(bodyPrefix + formatPrefix + hashKey(key))
+	hash := hashKey(key)
+	if c.filter != nil && !c.filter.mayContain(hash) {
+		return nil, ErrNotFoundInCache
+	}
+	stripe := c.locks.stripe(hash)
+	stripe.Lock()
+	f, err := c.vfsOpen(bodyPrefix + formatPrefix + hash)
+	var h Header
+	var body storedBody
+	if err == nil {
+		h, body, err = c.storedHeader(key)
+		if r, ok := f.(*openReader); ok && err == nil && hex.EncodeToString(r.salt) != body.salt {
+			debugf("body of %s isn't the one stored with its headers", key)
+			err = ErrNotFoundInCache
+		}
+		if err != nil {
+			f.Close()
+		}
+	}
+	stripe.Unlock()
 	if err != nil {
 		if vfs.IsNotExist(err) {
 			return nil, ErrNotFoundInCache
 		}
 		return nil, err
 	}
-	h, err := c.Header(key)
-	if err != nil {
-		if vfs.IsNotExist(err) {
+	// files on disk can be closed without the lock, and are left as they
+	// are so that they can be sent with sendfile
+	if _, onDisk := f.(*os.File); !onDisk {
+		f = &lockedCloser{ReadSeekCloser: f, lock: stripe}
+	}
+
+	c.rememberBlob(bodyPrefix+formatPrefix+hash, body)
+	if body.gzipLength >= 0 {
+		f = newGzipReadSeeker(f, body.gzipLength)
+	}
+	if c.verify && body.sum != "" {
+		if err := verifyBody(f, body.sum); err != nil {
+			f.Close()
+			errorf("removing %s from the cache, %s", key, err.Error())
+			c.removeCorrupt(key, body.sum)
 			return nil, ErrNotFoundInCache
 		}
-		return nil, err
 	}
 	res := NewResource(h.StatusCode, f, h.Header)
-	if staleTime, exists := c.stale[key]; exists {
+	c.staleMu.Lock()
+	staleTime, exists := c.stale[key]
+	c.staleMu.Unlock()
+	if exists {
 		if !res.DateAfter(staleTime) {
 			log.Printf("stale marker of %s found", staleTime)
 			res.MarkStale()
@@ -175,8 +533,24 @@ func (c *cache) Retrieve(key string) (*Resource, error) {
 	return res, nil
 }
 
+// removeCorrupt removes the files of key, unless it has been stored again
+// since its body with sum was found to be corrupt
+func (c *cache) removeCorrupt(key, sum string) {
+	hash := hashKey(key)
+	unlock := c.locks.lock(hash)
+	defer unlock()
+
+	if _, body, err := c.storedHeader(key); err == nil && body.sum == sum {
+		c.fs.Remove(headerPrefix + formatPrefix + hash)
+		c.fs.Remove(bodyPrefix + formatPrefix + hash)
+		c.forgetBlob(bodyPrefix + formatPrefix + hash)
+	}
+}
+
 func (c *cache) Invalidate(keys ...string) {
 	log.Printf("invalidating %q", keys)
+	c.staleMu.Lock()
+	defer c.staleMu.Unlock()
 	for _, key := range keys {
 		c.stale[key] = Clock()
 	}
@@ -184,27 +558,61 @@ func (c *cache) Invalidate(keys ...string) {
 
 func (c *cache) Freshen(res *Resource, keys ...string) error {
 	for _, key := range keys {
-		if h, err := c.Header(key); err == nil {
-			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
-				debugf("freshening key %s", key)
-				if err := c.storeHeader(h.StatusCode, res.Header(), key); err != nil {
-					return err
-				}
-			} else {
-				debugf("freshen failed, invalidating %s", key)
-				c.Invalidate(key)
-			}
+		if err := c.freshen(res, key); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (c *cache) freshen(res *Resource, key string) error {
+	unlock := c.locks.lock(hashKey(key))
+	defer unlock()
+
+	h, body, err := c.storedHeader(key)
+	if err != nil {
+		return nil
+	}
+	if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+		debugf("freshening key %s", key)
+		header := cloneHeader(res.Header())
+		body.setHeaders(header)
+		return c.storeHeader(h.StatusCode, header, key)
+	}
+	debugf("freshen failed, invalidating %s", key)
+	c.Invalidate(key)
+	return nil
+}
+
+// verifyBody checks a stored body against its checksum, seeking back to
+// its start if it matches
+func verifyBody(body ReadSeekCloser, sum string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != sum {
+		return errors.New("body doesn't match its checksum")
+	}
+	_, err := body.Seek(0, io.SeekStart)
+	return err
+}
+
 func hashKey(key string) string {
 	h := sha256.New()
 	io.WriteString(h, key)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// headerBytes serializes a status code and headers in the same format
+// that readHeaders expects
+func headerBytes(code int, h http.Header) []byte {
+	hb := &bytes.Buffer{}
+	hb.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))))
+	headersToWriter(h, hb)
+	return hb.Bytes()
+}
+
 func readHeaders(r *bufio.Reader) (Header, error) {
 	tp := textproto.NewReader(r)
 	line, err := tp.ReadLine()
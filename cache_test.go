@@ -1,8 +1,10 @@
 package httpcache_test
 
 import (
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/lox/httpcache"
@@ -49,3 +51,50 @@ func TestSaveResourceWithIncorrectContentLength(t *testing.T) {
 		t.Fatal("Entry shouldn't have been cached")
 	}
 }
+
+func TestSaveResourceUnderSeveralKeys(t *testing.T) {
+	var body = strings.Repeat("llamas", 5000)
+	var cache = httpcache.NewMemoryCache()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas": []string{"true"},
+	})
+
+	require.NoError(t, cache.Store(res, "testkey1", "testkey2"))
+
+	for _, key := range []string{"testkey1", "testkey2"} {
+		resOut, err := cache.Retrieve(key)
+		require.NoError(t, err)
+		require.Equal(t, body, readAllString(resOut))
+	}
+}
+
+func TestConcurrentStoresAndRetrievesOfAKey(t *testing.T) {
+	var cache = httpcache.NewMemoryCache()
+	var bodies = []string{strings.Repeat("llamas", 5000), strings.Repeat("alpacas", 5000)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if (i+j)%3 == 0 {
+					res := httpcache.NewResourceBytes(http.StatusOK, []byte(bodies[j%2]), http.Header{})
+					require.NoError(t, cache.Store(res, "testkey"))
+					continue
+				}
+				res, err := cache.Retrieve("testkey")
+				if err == httpcache.ErrNotFoundInCache {
+					continue
+				}
+				require.NoError(t, err)
+				b, err := ioutil.ReadAll(res)
+				require.NoError(t, err)
+				require.True(t, string(b) == bodies[0] || string(b) == bodies[1])
+				require.NoError(t, res.Close())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// parseACL parses a comma separated list of IP addresses and CIDR ranges
+func parseACL(acl string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range strings.Split(acl, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowACL returns a function that allows requests from clients in acl
+func allowACL(acl []*net.IPNet) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range acl {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// forceCacheHosts returns a function that matches requests whose host
+// matches one of a comma separated list of patterns such as *.example.com,
+// or every request if there are no patterns
+func forceCacheHosts(patterns string) (func(r *http.Request) bool, error) {
+	hosts := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		hosts = append(hosts, pattern)
+	}
+
+	return func(r *http.Request) bool {
+		if len(hosts) == 0 {
+			return true
+		}
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, pattern := range hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
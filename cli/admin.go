@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lox/httpcache"
+)
+
+// started is when the process started, for the uptime in /stats
+var started = time.Now()
+
+// adminAPI serves the admin api on -admin-listen
+type adminAPI struct {
+	cache    *httpcache.IndexedCache
+	reloader *reloadHandler
+}
+
+// newAdminHandler returns the handler for the admin api, served on
+// -admin-listen and requiring -admin-token if it is set
+func newAdminHandler(cache *httpcache.IndexedCache, reloader *reloadHandler) http.Handler {
+	api := &adminAPI{cache: cache, reloader: reloader}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/origins", serveOrigins)
+	mux.HandleFunc("/purge", api.purge)
+	mux.HandleFunc("/stats", api.stats)
+	mux.HandleFunc("/config", api.config)
+	mux.HandleFunc("/flags", api.setFlags)
+	mux.HandleFunc("/maintenance", api.toggle("maintenance"))
+	mux.HandleFunc("/serve-stale", api.toggle("serve-stale"))
+	mux.HandleFunc("/explain", api.explain)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, cache)
+	})
+
+	if pprofAdmin {
+		log.Printf("serving profiles on /debug/pprof/ of the admin api")
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if adminToken == "" {
+		log.Printf("the admin api has no -admin-token, so anyone who can reach -admin-listen can use it")
+		return mux
+	}
+	return requireToken(adminToken, mux)
+}
+
+// requireToken only passes requests with an Authorization header of
+// "Bearer token" to next
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="httpcache"`)
+			http.Error(w, "invalid or missing admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveOrigins shows the health of each replica of the current origins
+func serveOrigins(w http.ResponseWriter, r *http.Request) {
+	statuses := []replicaStatus{}
+	for _, pool := range activePools() {
+		for _, replica := range pool.replicas {
+			statuses = append(statuses, replica.status(pool))
+		}
+	}
+	writeJSON(w, statuses)
+}
+
+// purge invalidates cached resources, by Surrogate-Key or Cache-Tag with
+// POST /purge?tag=name, by url along with its Vary variants with
+// POST /purge?url=http://host/path, or every resource under a url with
+// POST /purge?prefix=http://host/path/. Urls can also be matched with a glob,
+// where * matches anything, with POST /purge?pattern=http://host/assets/*, or
+// cache keys with a regular expression with POST /purge?regex=\.js$
+func (api *adminAPI) purge(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	query := r.URL.Query()
+	if len(query["tag"]) == 0 && len(query["url"]) == 0 && len(query["prefix"]) == 0 &&
+		len(query["pattern"]) == 0 && len(query["regex"]) == 0 {
+		http.Error(w, "purge requires a tag, url, prefix, pattern or regex", http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	for _, tag := range query["tag"] {
+		purged += api.cache.PurgeTag(tag)
+	}
+	for _, rawurl := range query["url"] {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid url %q", rawurl), http.StatusBadRequest)
+			return
+		}
+		for _, key := range api.keys(u) {
+			purged += api.cache.PurgeVariants(key)
+		}
+	}
+	for _, prefix := range query["prefix"] {
+		u, err := url.Parse(prefix)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid prefix %q", prefix), http.StatusBadRequest)
+			return
+		}
+		for _, key := range api.keys(u) {
+			purged += api.cache.PurgePrefix(key)
+		}
+	}
+	for _, pattern := range query["pattern"] {
+		u, err := url.Parse(pattern)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid pattern %q", pattern), http.StatusBadRequest)
+			return
+		}
+		globs := []*regexp.Regexp{}
+		for _, key := range api.keys(u) {
+			globs = append(globs, globRegexp(key))
+		}
+		purged += api.cache.PurgeMatching(func(key string) bool {
+			for _, glob := range globs {
+				if glob.MatchString(key) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	for _, expr := range query["regex"] {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid regex %q: %s", expr, err.Error()), http.StatusBadRequest)
+			return
+		}
+		purged += api.cache.PurgeMatching(re.MatchString)
+	}
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+// keys returns the keys that a url may be cached under. Requests from
+// intercepted tunnels are cached by absolute url, and others by path, within
+// the namespace of their host if it has a route.
+func (api *adminAPI) keys(u *url.URL) []string {
+	path := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if path.Path == "" {
+		path.Path = "/"
+	}
+
+	keys := []string{}
+	for _, method := range []string{"GET", "HEAD"} {
+		pathKey := httpcache.NewKey(method, path, nil).String()
+		keys = append(keys, pathKey)
+		if u.IsAbs() {
+			keys = append(keys, httpcache.NewKey(method, u, nil).String())
+			if host := u.Hostname(); api.reloader.hasHostRoute(host) {
+				keys = append(keys, strings.ToLower(host)+"/"+pathKey)
+			}
+		}
+	}
+	return keys
+}
+
+// explain shows how GET /explain?url=http://host/path would be served from
+// the cache, without contacting the origin. Requests can have a method and
+// headers, such as &method=HEAD&header=Accept:+text/html
+func (api *adminAPI) explain(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	query := r.URL.Query()
+	u, err := url.Parse(query.Get("url"))
+	if err != nil || !u.IsAbs() {
+		http.Error(w, "explain requires an absolute url", http.StatusBadRequest)
+		return
+	}
+	method := query.Get("method")
+	if method == "" {
+		method = "GET"
+	}
+
+	path := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if path.Path == "" {
+		path.Path = "/"
+	}
+	req, err := http.NewRequest(method, path.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Host = u.Host
+	req.RemoteAddr = r.RemoteAddr
+	for _, header := range query["header"] {
+		idx := strings.Index(header, ":")
+		if idx == -1 {
+			http.Error(w, fmt.Sprintf("invalid header %q", header), http.StatusBadRequest)
+			return
+		}
+		req.Header.Add(strings.TrimSpace(header[:idx]), strings.TrimSpace(header[idx+1:]))
+	}
+
+	api.reloader.ServeHTTP(w, req.WithContext(httpcache.WithExplain(r.Context())))
+}
+
+// globRegexp returns a regexp matching a key and its Vary variants, where *
+// in the key matches anything
+func globRegexp(key string) *regexp.Regexp {
+	expr := strings.Replace(regexp.QuoteMeta(key), `\*`, ".*", -1)
+	return regexp.MustCompile("^" + expr + "(::.*)?$")
+}
+
+// stats shows the size of the cache, the hit ratio and the busiest hosts
+func (api *adminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, collectStats(api.cache))
+}
+
+// config shows the current value of every flag, without the admin token
+func (api *adminAPI) config(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	values := api.reloader.flags()
+	if values["admin-token"] != "" {
+		values["admin-token"] = "REDACTED"
+	}
+	writeJSON(w, values)
+}
+
+// setFlags changes reloadable flags from the form values of POST /flags,
+// such as v=true, until the config file is next reloaded
+func (api *adminAPI) setFlags(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values := map[string]string{}
+	for name := range r.Form {
+		values[name] = r.Form.Get(name)
+	}
+	if len(values) == 0 {
+		http.Error(w, "no flags to set", http.StatusBadRequest)
+		return
+	}
+
+	if err := api.reloader.setFlags(api.cache, values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, values)
+}
+
+// toggle returns a handler that shows whether a bool flag such as
+// -maintenance is on with GET, turns it on with POST and off with DELETE,
+// until the config file is next reloaded
+func (api *adminAPI) toggle(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "POST", "DELETE":
+			on := strconv.FormatBool(r.Method == "POST")
+			if err := api.reloader.setFlags(api.cache, map[string]string{name: on}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, fmt.Sprintf("%s requires GET, POST or DELETE", r.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+
+		on, _ := strconv.ParseBool(api.reloader.flags()[name])
+		writeJSON(w, map[string]bool{name: on})
+	}
+}
+
+// requireMethod returns whether a request has the method, responding with a
+// 405 if it doesn't
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == "GET" && r.Method == "HEAD") {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, fmt.Sprintf("%s requires %s", r.URL.Path, method), http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
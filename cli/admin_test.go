@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("llamas", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for auth, status := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"llamas":         http.StatusUnauthorized,
+		"Bearer alpacas": http.StatusUnauthorized,
+		"Bearer llamas ": http.StatusUnauthorized,
+		"Bearer llamas":  http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/stats", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, status, w.Code, auth)
+		if status == http.StatusUnauthorized {
+			require.Equal(t, `Bearer realm="httpcache"`, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	for _, test := range []struct {
+		glob, key string
+		match     bool
+	}{
+		{"GET:/assets/*", "GET:/assets/app.js", true},
+		{"GET:/assets/*", "GET:/assets/app.js::Accept-Encoding=gzip", true},
+		{"GET:/assets/*", "GET:/images/llama.png", false},
+		{"GET:/*.js", "GET:/assets/app.js", true},
+		{"GET:/*.js", "GET:/assets/app.json", false},
+		{"GET:/llamas", "GET:/llamas", true},
+		{"GET:/llamas", "GET:/llamas/alpacas", false},
+		// only * is special
+		{"GET:/llamas?q=1", "GET:/llamasXq=1", false},
+	} {
+		require.Equal(t, test.match, globRegexp(test.glob).MatchString(test.key), "%s %s", test.glob, test.key)
+	}
+}
+
+// pathKey returns the key that GET requests for path are cached by
+func pathKey(path string) string {
+	u, _ := url.Parse(path)
+	return httpcache.NewKey("GET", u, nil).String()
+}
+
+func TestAdminPurge(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		status int
+		purged int
+	}{
+		{"url=http://example.com/llamas", http.StatusOK, 2},
+		{"url=/alpacas", http.StatusOK, 1},
+		{"prefix=http://example.com/assets/", http.StatusOK, 2},
+		{"pattern=http://example.com/*.js", http.StatusOK, 1},
+		{"regex=llamas", http.StatusOK, 2},
+		{"tag=animals", http.StatusOK, 2},
+		{"tag=animals&url=/assets/app.css", http.StatusOK, 3},
+		{"url=/vicunas", http.StatusOK, 0},
+		{"", http.StatusBadRequest, 0},
+		{"llamas=true", http.StatusBadRequest, 0},
+		{"regex=(", http.StatusBadRequest, 0},
+		{"url=http%3A%2F%2F%5B%3A%3A1", http.StatusBadRequest, 0},
+	} {
+		cache := httpcache.NewIndexedCache(httpcache.NewMemoryCache())
+		for key, tags := range map[string]string{
+			pathKey("/llamas"): "animals",
+			pathKey("/llamas") + "::Accept-Encoding=gzip": "",
+			pathKey("/alpacas"):                           "animals",
+			pathKey("/assets/app.js"):                     "",
+			pathKey("/assets/app.css"):                    "",
+		} {
+			h := http.Header{}
+			if tags != "" {
+				h.Set("Surrogate-Key", tags)
+			}
+			require.NoError(t, cache.Store(httpcache.NewResourceBytes(http.StatusOK, nil, h), key))
+		}
+		api := &adminAPI{cache: cache, reloader: &reloadHandler{}}
+
+		w := httptest.NewRecorder()
+		api.purge(w, httptest.NewRequest("POST", "/purge?"+test.query, nil))
+		require.Equal(t, test.status, w.Code, test.query)
+		if test.status == http.StatusOK {
+			var purged map[string]int
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &purged))
+			require.Equal(t, map[string]int{"purged": test.purged}, purged, test.query)
+		}
+	}
+
+	api := &adminAPI{cache: httpcache.NewIndexedCache(httpcache.NewMemoryCache()), reloader: &reloadHandler{}}
+	w := httptest.NewRecorder()
+	api.purge(w, httptest.NewRequest("GET", "/purge?url=/llamas", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "POST", w.Header().Get("Allow"))
+}
+
+func TestAdminKeys(t *testing.T) {
+	defer func(routes map[string]route) { hostRoutes = routes }(hostRoutes)
+	hostRoutes = map[string]route{"routed.example": {}}
+	api := &adminAPI{reloader: &reloadHandler{}}
+
+	head := func(path string) string {
+		u, _ := url.Parse(path)
+		return httpcache.NewKey("HEAD", u, nil).String()
+	}
+	mustParse := func(rawurl string) *url.URL {
+		u, err := url.Parse(rawurl)
+		require.NoError(t, err)
+		return u
+	}
+
+	require.Equal(t, []string{pathKey("/"), head("/")}, api.keys(mustParse("")))
+	require.Equal(t, []string{pathKey("/llamas?q=1"), head("/llamas?q=1")}, api.keys(mustParse("/llamas?q=1")))
+
+	// absolute urls may also have been intercepted, or be routed to the
+	// namespace of their host
+	require.Equal(t, []string{
+		pathKey("/llamas"), pathKey("https://example.com/llamas"),
+		head("/llamas"), head("https://example.com/llamas"),
+	}, api.keys(mustParse("https://example.com/llamas")))
+	require.Equal(t, []string{
+		pathKey("/llamas"), pathKey("http://Routed.example/llamas"), "routed.example/" + pathKey("/llamas"),
+		head("/llamas"), head("http://Routed.example/llamas"), "routed.example/" + head("/llamas"),
+	}, api.keys(mustParse("http://Routed.example/llamas")))
+}
+
+func TestAdminConfigRedactsToken(t *testing.T) {
+	defer restoreFlags()()
+	api := &adminAPI{reloader: &reloadHandler{}}
+
+	w := httptest.NewRecorder()
+	api.config(w, httptest.NewRequest("GET", "/config", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, strings.Contains(w.Body.String(), `"admin-token": ""`))
+
+	require.NoError(t, flag.Set("admin-token", "llamas"))
+	w = httptest.NewRecorder()
+	api.config(w, httptest.NewRequest("GET", "/config", nil))
+	require.True(t, strings.Contains(w.Body.String(), `"admin-token": "REDACTED"`))
+	require.False(t, strings.Contains(w.Body.String(), "llamas"))
+}
+
+func TestAdminToggle(t *testing.T) {
+	defer restoreFlags()()
+	api := &adminAPI{reloader: &reloadHandler{}}
+	toggle := api.toggle("maintenance")
+
+	w := httptest.NewRecorder()
+	toggle(w, httptest.NewRequest("GET", "/maintenance", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var on map[string]bool
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &on))
+	require.Equal(t, map[string]bool{"maintenance": false}, on)
+
+	w = httptest.NewRecorder()
+	toggle(w, httptest.NewRequest("PUT", "/maintenance", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET, POST, DELETE", w.Header().Get("Allow"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	roundRobin       = "round-robin"
+	leastConnections = "least-connections"
+)
+
+// replica is one of the addresses of a pooled origin
+type replica struct {
+	url       *url.URL
+	proxy     http.Handler
+	active    int64
+	unhealthy int32
+
+	sync.Mutex
+	lastCheck time.Time
+	lastError string
+}
+
+// originPool balances requests across the healthy replicas of an origin,
+// either in turn or to the replica with the fewest requests in progress
+type originPool struct {
+	name      string
+	replicas  []*replica
+	transport http.RoundTripper
+	breaker   *breaker
+	leastConn bool
+	health    healthConfig
+	next      uint64
+	stop      chan struct{}
+}
+
+// newOriginPool returns a reverse proxy to a pool of origins, balanced by
+// either round-robin or least-connections
+func newOriginPool(name string, origins []string, balance string, transport http.RoundTripper) (*originPool, error) {
+	if err := checkBalance(balance); err != nil {
+		return nil, err
+	}
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("no origins given")
+	}
+
+	pool := &originPool{
+		name:      name,
+		transport: transport,
+		leastConn: balance == leastConnections,
+		health:    newHealthConfig(),
+		stop:      make(chan struct{}),
+	}
+
+	// retries happen within the breaker, so that a request counts once
+	upstream := newRetryTransport(measureOrigin(transport))
+	if pool.breaker = newBreaker(name, upstream); pool.breaker != nil {
+		upstream = pool.breaker
+	}
+
+	for _, origin := range origins {
+		if err := checkURL(origin); err != nil {
+			return nil, err
+		}
+		u, _ := url.Parse(origin)
+		pool.replicas = append(pool.replicas, &replica{url: u, proxy: newOriginProxy(u, upstream)})
+	}
+
+	addPool(pool)
+	return pool, nil
+}
+
+func checkBalance(balance string) error {
+	if balance != roundRobin && balance != leastConnections {
+		return fmt.Errorf("unknown balance %q, expected %s or %s", balance, roundRobin, leastConnections)
+	}
+	return nil
+}
+
+// splitOrigins splits a comma separated list of origins
+func splitOrigins(origins string) []string {
+	split := []string{}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			split = append(split, origin)
+		}
+	}
+	return split
+}
+
+// pick returns the replica to send the next request to. If every replica
+// is unhealthy they are all used, rather than failing every request.
+func (p *originPool) pick() *replica {
+	replicas := make([]*replica, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if r.isHealthy() {
+			replicas = append(replicas, r)
+		}
+	}
+	if len(replicas) == 0 {
+		replicas = p.replicas
+	}
+
+	// start from a different replica each time, so that ties are spread out
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(len(replicas)))
+	best := replicas[start]
+	if !p.leastConn {
+		return best
+	}
+	for i := 1; i < len(replicas); i++ {
+		r := replicas[(start+i)%len(replicas)]
+		if atomic.LoadInt64(&r.active) < atomic.LoadInt64(&best.active) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (p *originPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	replica := p.pick()
+	atomic.AddInt64(&replica.active, 1)
+	defer atomic.AddInt64(&replica.active, -1)
+
+	replica.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// roundTripperFunc is a fake transport
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestPool returns a pool of three replicas whose requests are counted
+// by host rather than sent
+func newTestPool(t *testing.T, balance string) (*originPool, map[string]int) {
+	hosts := map[string]int{}
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		hosts[r.URL.Host]++
+		return httptest.NewRecorder().Result(), nil
+	})
+	origins := []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"}
+	pool, err := newOriginPool("llamas", origins, balance, transport)
+	require.NoError(t, err)
+	resetPools()
+	return pool, hosts
+}
+
+func TestOriginPoolRoundRobin(t *testing.T) {
+	pool, hosts := newTestPool(t, roundRobin)
+	for i := 0; i < 30; i++ {
+		pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	require.Equal(t, map[string]int{"10.0.0.1": 10, "10.0.0.2": 10, "10.0.0.3": 10}, hosts)
+}
+
+func TestOriginPoolSkipsUnhealthyReplicas(t *testing.T) {
+	for _, balance := range []string{roundRobin, leastConnections} {
+		pool, hosts := newTestPool(t, balance)
+		atomic.StoreInt32(&pool.replicas[1].unhealthy, 1)
+		for i := 0; i < 20; i++ {
+			pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		require.Equal(t, map[string]int{"10.0.0.1": 10, "10.0.0.3": 10}, hosts, balance)
+
+		// if every replica is unhealthy, they are all used rather than
+		// failing every request
+		for _, r := range pool.replicas {
+			atomic.StoreInt32(&r.unhealthy, 1)
+		}
+		for i := 0; i < 30; i++ {
+			pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		require.Equal(t, map[string]int{"10.0.0.1": 20, "10.0.0.2": 10, "10.0.0.3": 20}, hosts, balance)
+	}
+}
+
+func TestOriginPoolLeastConnections(t *testing.T) {
+	pool, _ := newTestPool(t, leastConnections)
+	atomic.StoreInt64(&pool.replicas[0].active, 5)
+	atomic.StoreInt64(&pool.replicas[2].active, 3)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, pool.replicas[1], pool.pick())
+	}
+
+	// ties are spread across the replicas with the fewest requests
+	atomic.StoreInt64(&pool.replicas[0].active, 0)
+	picked := map[*replica]int{}
+	for i := 0; i < 10; i++ {
+		picked[pool.pick()]++
+	}
+	require.Equal(t, 2, len(picked))
+	require.True(t, picked[pool.replicas[0]] > 0 && picked[pool.replicas[1]] > 0)
+}
+
+func TestNewOriginPoolErrors(t *testing.T) {
+	_, err := newOriginPool("llamas", []string{"http://10.0.0.1"}, "random", http.DefaultTransport)
+	require.EqualError(t, err, `unknown balance "random", expected round-robin or least-connections`)
+	_, err = newOriginPool("llamas", nil, roundRobin, http.DefaultTransport)
+	require.EqualError(t, err, "no origins given")
+	_, err = newOriginPool("llamas", []string{"10.0.0.1"}, roundRobin, http.DefaultTransport)
+	require.Error(t, err)
+	resetPools()
+}
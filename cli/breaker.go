@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breaker is a circuit breaker for an origin. Once the proportion of
+// failed requests in a window reaches the threshold it opens, and requests
+// get a 503 without being sent upstream. After the open time a single
+// request is let through to probe the origin, closing the breaker if it
+// succeeds and opening it again if it fails.
+type breaker struct {
+	name        string
+	next        http.RoundTripper
+	threshold   float64
+	minRequests int
+	window      time.Duration
+	openTime    time.Duration
+
+	sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	probing     bool
+}
+
+// newBreaker wraps t with a circuit breaker configured by the -breaker
+// flags, or returns nil if -breaker-threshold isn't set
+func newBreaker(name string, t http.RoundTripper) *breaker {
+	if breakerThreshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		name:        name,
+		next:        t,
+		threshold:   breakerThreshold,
+		minRequests: breakerMinRequests,
+		window:      breakerWindow,
+		openTime:    breakerOpenTime,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+// allow returns whether a request can be sent upstream, and if it is the
+// probe of a half-open breaker
+func (b *breaker) allow() (bool, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// record counts the outcome of a request, opening or closing the breaker
+func (b *breaker) record(failed, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if probe {
+		b.probing = false
+		if failed {
+			b.trip()
+		} else {
+			log.Printf("circuit breaker for %s closed", b.name)
+			b.state = breakerClosed
+			b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+		}
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+	if time.Since(b.windowStart) > b.window {
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.threshold {
+		b.trip()
+	}
+}
+
+// trip opens the breaker, callers must hold the lock
+func (b *breaker) trip() {
+	log.Printf("circuit breaker for %s opened for %s after %d of %d requests failed",
+		b.name, b.openTime, b.failures, b.requests)
+	b.state = breakerOpen
+	b.openUntil = time.Now().Add(b.openTime)
+}
+
+// State returns whether the breaker is closed, open or half-open
+func (b *breaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+func (b *breaker) RoundTrip(r *http.Request) (*http.Response, error) {
+	allowed, probe := b.allow()
+	if !allowed {
+		return b.openResponse(r), nil
+	}
+
+	resp, err := b.next.RoundTrip(r)
+	if err != nil && r.Context().Err() != nil {
+		// the client went away, which says nothing about the origin
+		b.release(probe)
+		return resp, err
+	}
+	b.record(err != nil || resp.StatusCode >= 500, probe)
+	return resp, err
+}
+
+// release lets another request probe a half-open breaker, if probe didn't
+// finish
+func (b *breaker) release(probe bool) {
+	if !probe {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+}
+
+// openResponse is the synthetic response to requests made while the breaker
+// is open
+func (b *breaker) openResponse(r *http.Request) *http.Response {
+	body := fmt.Sprintf("circuit breaker for %s is open\n", b.name)
+
+	b.Lock()
+	retryAfter := int(time.Until(b.openUntil)/time.Second) + 1
+	b.Unlock()
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(body))},
+			"Retry-After":    {strconv.Itoa(retryAfter)},
+		},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
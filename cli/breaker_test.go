@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// outcomeTransport answers each request with the next of outcomes, a status
+// or 0 for a connection error
+func outcomeTransport(outcomes ...int) roundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		status := outcomes[0]
+		outcomes = outcomes[1:]
+		if status == 0 {
+			return nil, errors.New("connection refused")
+		}
+		w := httptest.NewRecorder()
+		w.WriteHeader(status)
+		return w.Result(), nil
+	}
+}
+
+func newTestBreaker(next http.RoundTripper, openTime time.Duration) *breaker {
+	return &breaker{
+		name:        "llamas",
+		next:        next,
+		threshold:   0.5,
+		minRequests: 4,
+		window:      time.Minute,
+		openTime:    openTime,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+func roundTrip(b *breaker) int {
+	resp, err := b.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func TestBreakerTrips(t *testing.T) {
+	for _, test := range []struct {
+		outcomes []int
+		state    string
+	}{
+		// too few requests to judge the origin by
+		{[]int{0, 500, 502}, breakerClosed},
+		{[]int{200, 0, 200, 503}, breakerOpen},
+		{[]int{200, 200, 404, 500}, breakerClosed},
+		{[]int{500, 500, 500, 200}, breakerOpen},
+		{[]int{200, 200, 200, 200, 500, 500, 500}, breakerClosed},
+		{[]int{200, 200, 200, 200, 500, 500, 500, 500}, breakerOpen},
+	} {
+		b := newTestBreaker(outcomeTransport(test.outcomes...), time.Hour)
+		for range test.outcomes {
+			roundTrip(b)
+		}
+		require.Equal(t, test.state, b.State(), "%v", test.outcomes)
+	}
+
+	// requests aren't sent upstream while it is open
+	b := newTestBreaker(outcomeTransport(500, 500, 500, 500), time.Hour)
+	for i := 0; i < 4; i++ {
+		roundTrip(b)
+	}
+	resp, err := b.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "3600", resp.Header.Get("Retry-After"))
+}
+
+func TestBreakerProbes(t *testing.T) {
+	for _, test := range []struct {
+		probe int
+		state string
+	}{
+		{200, breakerClosed},
+		{404, breakerClosed},
+		{500, breakerOpen},
+		{0, breakerOpen},
+	} {
+		release := make(chan struct{})
+		outcomes := outcomeTransport(500, 500, 500, 500, test.probe)
+		b := newTestBreaker(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Header.Get("X-Probe") != "" {
+				<-release
+			}
+			return outcomes(r)
+		}), 0)
+		for i := 0; i < 4; i++ {
+			roundTrip(b)
+		}
+		require.Equal(t, breakerOpen, b.State())
+
+		// once the open time has passed, a single request probes the origin
+		probed := make(chan struct{})
+		go func() {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.Header.Set("X-Probe", "true")
+			b.RoundTrip(r)
+			close(probed)
+		}()
+		for b.State() != breakerHalfOpen {
+			time.Sleep(time.Millisecond)
+		}
+		require.Equal(t, http.StatusServiceUnavailable, roundTrip(b))
+		close(release)
+		<-probed
+
+		require.Equal(t, test.state, b.State(), "probe of %d", test.probe)
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, r.Context().Err()
+	})
+
+	b := newTestBreaker(cancelled, 0)
+	for i := 0; i < 10; i++ {
+		b.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+	}
+	require.Equal(t, breakerClosed, b.State())
+
+	// nor does a cancelled probe decide whether the origin has recovered,
+	// leaving the next request to probe it
+	b.next = outcomeTransport(500, 500, 500, 500)
+	for i := 0; i < 4; i++ {
+		roundTrip(b)
+	}
+	b.next = cancelled
+	b.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+	require.Equal(t, breakerHalfOpen, b.State())
+
+	b.next = outcomeTransport(200)
+	require.Equal(t, http.StatusOK, roundTrip(b))
+	require.Equal(t, breakerClosed, b.State())
+}
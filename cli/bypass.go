@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseNeverCache parses a comma separated list of patterns such as
+// "/admin/*" or "example.com/api/auth/*", of a host and path or a path alone
+// to match any host, or regular expressions for paths that start with ~
+// such as "~^/users/[0-9]+/settings$"
+func parseNeverCache(patterns string) ([]httpcache.BypassRule, error) {
+	parsed := []httpcache.BypassRule{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+
+		if strings.HasPrefix(pattern, "~") {
+			re, err := regexp.Compile(strings.TrimSpace(pattern[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %s", pattern, err.Error())
+			}
+			parsed = append(parsed, httpcache.BypassRule{PathRegexp: re})
+			continue
+		}
+
+		rule := httpcache.BypassRule{Path: pattern}
+		if i := strings.Index(pattern, "/"); i != 0 {
+			if i == -1 {
+				return nil, fmt.Errorf("invalid pattern %q, expected host/path or /path", pattern)
+			}
+			rule.Host, rule.Path = pattern[:i], pattern[i:]
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
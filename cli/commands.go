@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// commands are run with "httpcache [flags] command [args]" instead of serving,
+// and mostly talk to a running instance through the admin api on
+// -admin-listen
+var commands = map[string]func(args []string) error{
+	"purge": purgeCommand,
+	"stats": statsCommand,
+}
+
+// runCommand runs the command named by the first argument, if there is one
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+	return true, command(args[1:])
+}
+
+// purgeCommand purges the cached resources that match url patterns, where
+// * matches anything, or with -regex the cache keys matching expressions
+func purgeCommand(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	regex := fs.Bool("regex", false, "match cache keys, such as GET:/assets/app.js, with regular expressions rather than urls with globs")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] purge [-regex] pattern...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	param := "pattern"
+	if *regex {
+		param = "regex"
+	}
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := adminRequest("POST", "/purge", url.Values{param: fs.Args()}, &result); err != nil {
+		return err
+	}
+	fmt.Printf("purged %d keys\n", result.Purged)
+	return nil
+}
+
+// adminRequest makes a request to the admin api of the instance on
+// -admin-listen, decoding its json response into v
+func adminRequest(method, path string, query url.Values, v interface{}) error {
+	if adminListen == "" {
+		return fmt.Errorf("commands require the -admin-listen of a running instance")
+	}
+	host, port, err := net.SplitHostPort(adminListen)
+	if err != nil {
+		return fmt.Errorf("invalid -admin-listen: %s", err.Error())
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	u := &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s %s failed with %s: %s", method, path, res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/lox/httpcache"
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys maps the keys of a config file, with sections separated by
+// dots, onto the flags that they set
+var configKeys = map[string]string{
+	"listen":                            "listen",
+	"shutdown-timeout":                  "shutdown-timeout",
+	"upstream":                          "upstream",
+	"origin":                            "origin",
+	"balance":                           "balance",
+	"retry.count":                       "retries",
+	"retry.backoff":                     "retry-backoff",
+	"retry.max-backoff":                 "retry-max-backoff",
+	"error-pages":                       "error-pages",
+	"breaker.threshold":                 "breaker-threshold",
+	"breaker.min-requests":              "breaker-min-requests",
+	"breaker.window":                    "breaker-window",
+	"breaker.open-time":                 "breaker-open-time",
+	"health.path":                       "health-path",
+	"health.interval":                   "health-interval",
+	"health.healthy-threshold":          "health-healthy-threshold",
+	"health.unhealthy-threshold":        "health-unhealthy-threshold",
+	"upstream-tls.ca":                   "upstream-ca",
+	"upstream-tls.cert":                 "upstream-cert",
+	"upstream-tls.key":                  "upstream-key",
+	"upstream-tls.insecure-skip-verify": "upstream-insecure-skip-verify",
+	"tls.cert":                          "tls-cert",
+	"tls.key":                           "tls-key",
+	"tls.client-ca":                     "tls-client-ca",
+	"http2.enabled":                     "http2",
+	"http2.h2c":                         "h2c",
+	"http2.upstream-h2c":                "upstream-h2c",
+	"limits.max-header-bytes":           "max-header-bytes",
+	"limits.max-request-body":           "max-request-body",
+	"limits.max-response-size":          "max-response-size",
+	"acme.enabled":                      "acme",
+	"acme.hosts":                        "acme-hosts",
+	"acme.email":                        "acme-email",
+	"acme.dir":                          "acme-dir",
+	"acme.http-listen":                  "acme-http-listen",
+	"cache.private":                     "private",
+	"cache.serve-stale-on-error":        "serve-stale-on-error",
+	"cache.offline":                     "offline",
+	"cache.serve-stale":                 "serve-stale",
+	"cache.maintenance.enabled":         "maintenance",
+	"cache.maintenance.page":            "maintenance-page",
+	"cache.ttl-rules":                   "ttl-rules",
+	"cache.methods":                     "cache-methods",
+	"cache.authorization":               "authorization",
+	"cache.partition-header":            "partition-header",
+	"cache.never-cache":                 "never-cache",
+	"cache.esi":                         "esi",
+	"cache.cookie-rules":                "cookie-rules",
+	"cache.header-rules":                "header-rules",
+	"cache.rewrites":                    "rewrites",
+	"cache.strip-query":                 "strip-query",
+	"cache.strip-query-upstream":        "strip-query-upstream",
+	"cache.key-rules":                   "key-rules",
+	"cache.min-ttl":                     "min-ttl",
+	"cache.max-ttl":                     "max-ttl",
+	"cache.negative-ttl":                "negative-ttl",
+	"cache.vary-ignore":                 "vary-ignore",
+	"cache.normalize-accept-encoding":   "normalize-accept-encoding",
+	"cache.store-gzip":                  "store-gzip",
+	"cache.gzip.enabled":                "gzip-responses",
+	"cache.gzip.types":                  "gzip-types",
+	"cache.gzip.min-size":               "gzip-min-size",
+	"cache.partial":                     "cache-partial",
+	"cache.buffer-dir":                  "buffer-dir",
+	"cache.max-object-size":             "max-object-size",
+	"cache.heuristic.percent":           "heuristic-percent",
+	"cache.heuristic.max":               "heuristic-max",
+	"cache.force-cache.enabled":         "force-cache",
+	"cache.force-cache.hosts":           "force-cache-hosts",
+	"cache.revalidate-workers":          "revalidate-workers",
+	"cache.purge-acl":                   "purge-acl",
+	"cache.warmup":                      "warmup",
+	"cache.warmup-concurrency":          "warmup-concurrency",
+	"cache.write-behind.bytes":          "write-behind-bytes",
+	"cache.write-behind.workers":        "write-behind-workers",
+	"cache.sweep.interval":              "sweep-interval",
+	"cache.sweep.grace":                 "sweep-grace",
+	"backend.type":                      "backend",
+	"backend.dir":                       "dir",
+	"backend.max-size":                  "disk-max-size",
+	"backend.low-water":                 "disk-low-water",
+	"backend.eviction":                  "disk-eviction",
+	"backend.tinylfu":                   "disk-tinylfu",
+	"backend.verify-checksums":          "verify-checksums",
+	"backend.encryption-key-file":       "encryption-key-file",
+	"backend.compress":                  "disk-compress",
+	"backend.compress-types":            "disk-compress-types",
+	"backend.bloom-filter":              "disk-bloom-filter",
+	"backend.index-file":                "index-file",
+	"backend.memory-size":               "memory-size",
+	"backend.memory-max-entries":        "memory-max-entries",
+	"backend.promote-hits":              "tiered-promote-hits",
+	"backend.demote-idle":               "tiered-demote-idle",
+	"backend.bolt-path":                 "bolt-path",
+	"backend.redis.addr":                "redis",
+	"backend.redis.ttl":                 "redis-ttl",
+	"backend.memcached":                 "memcached-servers",
+	"backend.s3.endpoint":               "s3-endpoint",
+	"backend.s3.region":                 "s3-region",
+	"backend.s3.bucket":                 "s3-bucket",
+	"backend.s3.prefix":                 "s3-prefix",
+	"backend.gcs.bucket":                "gcs-bucket",
+	"backend.gcs.prefix":                "gcs-prefix",
+	"backend.azblob.container":          "azblob-container",
+	"backend.azblob.prefix":             "azblob-prefix",
+	"backend.azblob.endpoint":           "azblob-endpoint",
+	"mitm.enabled":                      "mitm",
+	"mitm.ca-cert":                      "ca-cert",
+	"mitm.ca-key":                       "ca-key",
+	"peers.urls":                        "peers",
+	"peers.self":                        "peer-self",
+	"admin.listen":                      "admin-listen",
+	"admin.token":                       "admin-token",
+	"admin.pprof":                       "pprof",
+	"admin.stats-file":                  "stats-file",
+	"log.verbose":                       "v",
+	"log.dump-http":                     "dumphttp",
+	"log.dump-http-redact":              "dumphttp-redact",
+	"log.dump-http-dir":                 "dumphttp-dir",
+	"log.dump-http-keep":                "dumphttp-keep",
+	"log.dump-http-har":                 "dumphttp-har",
+	"log.format":                        "log-format",
+	"log.syslog.enabled":                "log-syslog",
+	"log.syslog.facility":               "syslog-facility",
+	"log.syslog.tag":                    "syslog-tag",
+	"log.access-log.path":               "access-log",
+	"log.access-log.max-size":           "access-log-max-size",
+	"log.access-log.rotate":             "access-log-rotate",
+	"log.access-log.keep":               "access-log-keep",
+}
+
+// configSections are sections of the config file that can't be expressed
+// as flags, which are loaded by their own functions
+var configSections = map[string]func(path string, n *yaml.Node) error{
+	"hosts":     loadHostRoutes,
+	"routes":    loadPathRoutes,
+	"responses": loadSyntheticResponses,
+}
+
+// configChecks validate config values beyond what their flags check
+var configChecks = map[string]func(string) error{
+	"upstream": checkURL,
+	"origin": func(v string) error {
+		for _, origin := range splitOrigins(v) {
+			if err := checkURL(origin); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"balance":    checkBalance,
+	"log.format": checkLogFormat,
+	"error-pages": func(v string) error {
+		_, err := loadErrorPages(v)
+		return err
+	},
+	"cache.ttl-rules": func(v string) error {
+		_, err := parseTTLRules(v)
+		return err
+	},
+	"cache.authorization": func(v string) error {
+		_, err := httpcache.ParseAuthPolicy(v)
+		return err
+	},
+	"cache.never-cache": func(v string) error {
+		_, err := parseNeverCache(v)
+		return err
+	},
+	"cache.cookie-rules": func(v string) error {
+		_, err := parseCookieRules(v)
+		return err
+	},
+	"cache.header-rules": func(v string) error {
+		_, err := parseHeaderRules(v)
+		return err
+	},
+	"cache.rewrites": func(v string) error {
+		_, err := parseRewrites(v)
+		return err
+	},
+	"cache.key-rules": func(v string) error {
+		_, err := parseKeyRules(v)
+		return err
+	},
+	"cache.methods": func(v string) error {
+		_, err := parseMethodRules(v)
+		return err
+	},
+	"cache.vary-ignore": func(v string) error {
+		_, err := parseVaryIgnore(v)
+		return err
+	},
+	"backend.type": func(v string) error {
+		name, _, err := httpcache.ParseBackendSpec(v)
+		if err != nil {
+			return err
+		}
+		for _, b := range httpcache.Backends() {
+			if b == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown backend %q, expected one of %s",
+			name, strings.Join(httpcache.Backends(), ", "))
+	},
+}
+
+func checkURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute url", v)
+	}
+	return nil
+}
+
+// loadConfig reads a yaml config file and sets the flags for each of its
+// keys, except for flags that were given on the command-line
+func loadConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	hostRoutes = map[string]route{}
+	pathRoutes = []pathRoute{}
+	syntheticResponses = []httpcache.SyntheticResponse{}
+
+	if len(root.Content) == 0 {
+		return nil
+	}
+
+	return applyConfig(path, "", root.Content[0])
+}
+
+func applyConfig(path, prefix string, n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return configError(path, n, strings.TrimSuffix(prefix, "."), "expected a mapping")
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		key := prefix + k.Value
+
+		if load, ok := configSections[key]; ok {
+			if err := load(path, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if v.Kind == yaml.MappingNode {
+			if err := applyConfig(path, key+".", v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, ok := configKeys[key]
+		if !ok {
+			return configError(path, k, key, "unknown key")
+		}
+
+		var value string
+		switch v.Kind {
+		case yaml.ScalarNode:
+			value = v.Value
+		case yaml.SequenceNode:
+			values := []string{}
+			for _, item := range v.Content {
+				if item.Kind != yaml.ScalarNode {
+					return configError(path, item, key, "expected a list of values")
+				}
+				values = append(values, item.Value)
+			}
+			value = strings.Join(values, ",")
+		default:
+			return configError(path, v, key, "expected a value")
+		}
+
+		if check, ok := configChecks[key]; ok {
+			if err := check(value); err != nil {
+				return configError(path, v, key, err.Error())
+			}
+		}
+
+		// flags given on the command-line override the config file
+		if cmdlineFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return configError(path, v, key, fmt.Sprintf("invalid value %q: %s", value, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// checkConfigKeys returns an error for the first key in a mapping that isn't
+// one of allowed
+func checkConfigKeys(path, prefix string, n *yaml.Node, allowed ...string) error {
+	if n.Kind != yaml.MappingNode {
+		return configError(path, n, strings.TrimSuffix(prefix, "."), "expected a mapping")
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k := n.Content[i]
+		found := false
+		for _, key := range allowed {
+			found = found || k.Value == key
+		}
+		if !found {
+			return configError(path, k, prefix+k.Value, "unknown key")
+		}
+	}
+	return nil
+}
+
+func configError(path string, n *yaml.Node, key, msg string) error {
+	return fmt.Errorf("%s:%d: %s: %s", path, n.Line, key, msg)
+}
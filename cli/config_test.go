@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// restoreFlags replaces the command-line flags with a copy that has none
+// set, returning a func that puts them back with their current values
+func restoreFlags() func() {
+	commandLine := flag.CommandLine
+	values := map[string]string{}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	commandLine.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+		flag.CommandLine.Var(f.Value, f.Name, f.Usage)
+	})
+	return func() {
+		for name, value := range values {
+			flag.Set(name, value)
+		}
+		flag.CommandLine = commandLine
+		cmdlineFlags = map[string]bool{}
+	}
+}
+
+// writeConfig writes a config file to a temp dir, returning its path
+func writeConfig(t *testing.T, config string) (string, func()) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "httpcache.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestConfigKeysSetFlags(t *testing.T) {
+	for key, name := range configKeys {
+		require.NotNil(t, flag.Lookup(name), "%s sets -%s, which isn't a flag", key, name)
+	}
+	for key := range configChecks {
+		_, ok := configKeys[key]
+		require.True(t, ok, "%s is checked but isn't a key", key)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, test := range []struct {
+		config  string
+		flags   map[string]string
+		err     string
+		cmdline map[string]bool
+	}{
+		{
+			config: "listen: 127.0.0.1:9090\nupstream: http://127.0.0.1:8000\n",
+			flags:  map[string]string{"listen": "127.0.0.1:9090", "upstream": "http://127.0.0.1:8000"},
+		},
+		{
+			// nested sections are joined with dots, and lists with commas
+			config: "peers:\n  urls: [http://10.0.0.1:8080, \"http://10.0.0.2:8080\"]\n  self: http://10.0.0.1:8080\n",
+			flags:  map[string]string{"peers": "http://10.0.0.1:8080,http://10.0.0.2:8080", "peer-self": "http://10.0.0.1:8080"},
+		},
+		{
+			config: "backend:\n  redis:\n    addr: 127.0.0.1:6379\n    ttl: 1h\n",
+			flags:  map[string]string{"redis": "127.0.0.1:6379", "redis-ttl": "1h0m0s"},
+		},
+		{
+			// flags given on the command-line override the config file
+			config:  "listen: 127.0.0.1:9090\nbackend:\n  max-size: 1024\n",
+			cmdline: map[string]bool{"listen": true},
+			flags:   map[string]string{"listen": defaultListen, "disk-max-size": "1024"},
+		},
+		{
+			config: "backend:\n  max-sizes: 1024\n",
+			err:    "httpcache.yaml:2: backend.max-sizes: unknown key",
+		},
+		{
+			config: "llamas: true\n",
+			err:    "httpcache.yaml:1: llamas: unknown key",
+		},
+		{
+			config: "cache: true\n",
+			err:    "httpcache.yaml:1: cache: unknown key",
+		},
+		{
+			config: "upstream: /llamas\n",
+			err:    `httpcache.yaml:1: upstream: "/llamas" is not an absolute url`,
+		},
+		{
+			config: "backend:\n  max-size: lots\n",
+			err:    `httpcache.yaml:2: backend.max-size: invalid value "lots"`,
+		},
+		{
+			config: "peers:\n  urls:\n    - [http://10.0.0.1:8080]\n",
+			err:    "httpcache.yaml:3: peers.urls: expected a list of values",
+		},
+	} {
+		restore := restoreFlags()
+		for name := range test.cmdline {
+			cmdlineFlags[name] = true
+		}
+		path, remove := writeConfig(t, test.config)
+		err := loadConfig(path)
+		remove()
+
+		if test.err != "" {
+			require.Error(t, err, test.config)
+			require.True(t, strings.Contains(err.Error(), test.err), "%q doesn't contain %q", err.Error(), test.err)
+		} else {
+			require.NoError(t, err, test.config)
+			for name, value := range test.flags {
+				require.Equal(t, value, flag.Lookup(name).Value.String(), test.config)
+			}
+		}
+		restore()
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	defer restoreFlags()()
+	require.NoError(t, loadConfig("../httpcache.example.yaml"))
+}
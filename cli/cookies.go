@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseCookieRules parses a comma separated list of rules such as
+// "/static/* strip" or "example.com/* bypass=sessionid", where the pattern
+// is a host and path, or a path alone to match any host, followed by
+// whether to strip cookies and the cookies that bypass the cache
+func parseCookieRules(rules string) ([]httpcache.CookieRule, error) {
+	parsed := []httpcache.CookieRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule := httpcache.CookieRule{Path: fields[0]}
+		if i := strings.Index(fields[0], "/"); i != 0 {
+			if i == -1 {
+				return nil, fmt.Errorf("invalid rule %q, expected a pattern of host/path or /path", entry)
+			}
+			rule.Host, rule.Path = fields[0][:i], fields[0][i:]
+		}
+
+		for _, field := range fields[1:] {
+			switch {
+			case field == "strip":
+				rule.Strip = true
+			case strings.HasPrefix(field, "bypass=") && field != "bypass=":
+				rule.Bypass = append(rule.Bypass, strings.TrimPrefix(field, "bypass="))
+			default:
+				return nil, fmt.Errorf("invalid rule %q, unknown option %q", entry, field)
+			}
+		}
+		if !rule.Strip && len(rule.Bypass) == 0 {
+			return nil, fmt.Errorf("invalid rule %q, expected strip or bypass=cookie", entry)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
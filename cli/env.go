@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "HTTPCACHE_"
+
+// envName returns the environment variable for a flag, so that -redis-ttl
+// is read from HTTPCACHE_REDIS_TTL
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets each flag that has its environment variable set.
+// Flags set this way take precedence over the config file, and are in turn
+// overridden by the command-line.
+func setFlagsFromEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %s", value, envName(f.Name), setErr.Error())
+			}
+		}
+	})
+	return err
+}
+
+// loadFlags sets the flags from the environment, args and the config file.
+// args take precedence over the environment, which takes precedence over
+// the config file.
+func loadFlags(args []string) error {
+	if err := setFlagsFromEnv(); err != nil {
+		return err
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+
+	if config != "" {
+		return loadConfig(config)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands, which use the admin api of the instance on -admin-listen:\n"+
+		"  purge [-regex] pattern...\n"+
+		"    \tpurge urls matching globs, such as 'https://example.com/assets/*'\n"+
+		"  stats [-json]\n"+
+		"    \tshow the hit ratio, size and busiest hosts of the cache, or those saved to -stats-file\n")
+	fmt.Fprintf(os.Stderr, "\nEvery flag can also be set with an environment variable, "+
+		"e.g. -redis-ttl with %s\n", envName("redis-ttl"))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	require.Equal(t, "HTTPCACHE_REDIS_TTL", envName("redis-ttl"))
+	require.Equal(t, "HTTPCACHE_V", envName("v"))
+}
+
+// setenv sets environment variables, returning a func that unsets them
+func setenv(vars map[string]string) func() {
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestLoadFlagsPrecedence(t *testing.T) {
+	defer restoreFlags()()
+	path, remove := writeConfig(t, "listen: 127.0.0.1:1\nupstream: http://config.example\nbackend:\n  max-size: 1024\n")
+	defer remove()
+	defer setenv(map[string]string{
+		"HTTPCACHE_CONFIG":   path,
+		"HTTPCACHE_LISTEN":   "127.0.0.1:2",
+		"HTTPCACHE_UPSTREAM": "http://env.example",
+	})()
+
+	// the command-line overrides the environment, which overrides the
+	// config file
+	require.NoError(t, loadFlags([]string{"-listen", "127.0.0.1:3"}))
+	require.Equal(t, "127.0.0.1:3", flag.Lookup("listen").Value.String())
+	require.Equal(t, "http://env.example", flag.Lookup("upstream").Value.String())
+	require.Equal(t, "1024", flag.Lookup("disk-max-size").Value.String())
+	require.Equal(t, "0s", flag.Lookup("redis-ttl").Value.String())
+}
+
+func TestLoadFlagsInvalidEnv(t *testing.T) {
+	defer restoreFlags()()
+	defer setenv(map[string]string{"HTTPCACHE_REDIS_TTL": "lots"})()
+
+	err := loadFlags(nil)
+	require.Error(t, err)
+	require.Equal(t, `invalid value "lots" for HTTPCACHE_REDIS_TTL: parse error`, err.Error())
+}
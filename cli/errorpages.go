@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorPages are the templates of the pages served when origins can't be
+// reached and nothing is cached, by status, loaded from -error-pages
+var errorPages map[int]*template.Template
+
+// errorPage is what error page templates are executed with, such as
+// {{.Status}} {{.StatusText}} or {{.URL}}, which is the path and query
+// that the client requested
+type errorPage struct {
+	Status     int
+	StatusText string
+	Method     string
+	Host       string
+	Path       string
+	URL        string
+	Error      string
+	Time       time.Time
+}
+
+// loadErrorPages parses a comma separated list of statuses and the files
+// of the go html templates of their pages, such as
+// "502=/etc/httpcache/502.html,504=/etc/httpcache/504.html"
+func loadErrorPages(pages string) (map[int]*template.Template, error) {
+	loaded := map[int]*template.Template{}
+	for _, entry := range strings.Split(pages, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid page %q, expected status=file", entry)
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(entry[:i]))
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid page %q, expected an error status", entry)
+		}
+		t, err := template.ParseFiles(strings.TrimSpace(entry[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		loaded[status] = t
+	}
+	return loaded, nil
+}
+
+// proxyStatus returns the status of a failed proxy request, a 504 if the
+// origin timed out or a 502 otherwise
+func proxyStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// serveError answers a request with an empty response of status, or the
+// page of one of pages for it
+func serveError(pages map[int]*template.Template, w http.ResponseWriter, r *http.Request, status int, err error) {
+	t, ok := pages[status]
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	// the request is the one sent upstream, which an origin proxy sends
+	// with the origin's host
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+
+	buf := &bytes.Buffer{}
+	execErr := t.Execute(buf, errorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Method:     r.Method,
+		Host:       host,
+		Path:       r.URL.Path,
+		URL:        r.URL.RequestURI(),
+		Error:      err.Error(),
+		Time:       time.Now(),
+	})
+	if execErr != nil {
+		log.Printf("error executing %d error page: %v", status, execErr)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
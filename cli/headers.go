@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseHeaderRules parses a comma separated list of rules such as
+// "/* response remove Server" or "example.com/* request set
+// X-Forwarded-Proto: https", where the pattern is a host and path, or a path
+// alone to match any host, followed by whether to change requests or
+// responses, how, and the header with any value. Values can't contain
+// commas.
+func parseHeaderRules(rules string) ([]httpcache.HeaderRule, error) {
+	parsed := []httpcache.HeaderRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid rule %q, expected a pattern, request or response, add, set or remove, and a header", entry)
+		}
+
+		rule := httpcache.HeaderRule{Path: fields[0]}
+		if i := strings.Index(fields[0], "/"); i != 0 {
+			if i == -1 {
+				return nil, fmt.Errorf("invalid rule %q, expected a pattern of host/path or /path", entry)
+			}
+			rule.Host, rule.Path = fields[0][:i], fields[0][i:]
+		}
+
+		change := httpcache.HeaderChange{Op: httpcache.HeaderOp(fields[2])}
+		header := strings.Join(fields[3:], " ")
+		if i := strings.Index(header, ":"); i != -1 {
+			change.Name, change.Value = header[:i], strings.TrimSpace(header[i+1:])
+		} else {
+			change.Name = header
+		}
+		switch {
+		case change.Name == "" || strings.ContainsAny(change.Name, " \t"):
+			return nil, fmt.Errorf("invalid rule %q, invalid header %q", entry, change.Name)
+		case change.Op == httpcache.HeaderRemove:
+			if change.Value != "" {
+				return nil, fmt.Errorf("invalid rule %q, remove takes a header without a value", entry)
+			}
+		case change.Op != httpcache.HeaderAdd && change.Op != httpcache.HeaderSet:
+			return nil, fmt.Errorf("invalid rule %q, unknown change %q, expected add, set or remove", entry, fields[2])
+		}
+
+		switch fields[1] {
+		case "request":
+			rule.Request = []httpcache.HeaderChange{change}
+		case "response":
+			rule.Response = []httpcache.HeaderChange{change}
+		default:
+			return nil, fmt.Errorf("invalid rule %q, expected request or response, not %q", entry, fields[1])
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// originPools are the pools of the current handler, which are health checked
+// and shown on the admin listener. Pools created by newHandler are pending
+// until activatePools is called, so that a failed reload leaves the current
+// pools in place.
+var originPools struct {
+	sync.Mutex
+	pending []*originPool
+	active  []*originPool
+}
+
+// resetPools discards pools that haven't been activated
+func resetPools() {
+	originPools.Lock()
+	defer originPools.Unlock()
+	originPools.pending = nil
+}
+
+// addPool records a pool created for the handler being built
+func addPool(pool *originPool) {
+	originPools.Lock()
+	defer originPools.Unlock()
+	originPools.pending = append(originPools.pending, pool)
+}
+
+// activatePools stops health checking the previous pools and starts
+// checking the pending ones, if -health-path is set and not -offline or
+// -maintenance
+func activatePools() {
+	originPools.Lock()
+	defer originPools.Unlock()
+
+	for _, pool := range originPools.active {
+		close(pool.stop)
+	}
+	originPools.active, originPools.pending = originPools.pending, nil
+
+	if offline || maintenance {
+		return
+	}
+	for _, pool := range originPools.active {
+		if pool.health.path == "" {
+			continue
+		}
+		for _, r := range pool.replicas {
+			go pool.checkHealth(r)
+		}
+	}
+}
+
+// activePools returns the pools of the current handler
+func activePools() []*originPool {
+	originPools.Lock()
+	defer originPools.Unlock()
+	return originPools.active
+}
+
+// healthConfig is how the replicas of a pool are health checked, which is
+// copied from the flags when the pool is created so that reloads don't
+// change it under the checks in progress
+type healthConfig struct {
+	path               string
+	interval           time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+func newHealthConfig() healthConfig {
+	return healthConfig{
+		path:               healthPath,
+		interval:           healthInterval,
+		healthyThreshold:   healthHealthyThreshold,
+		unhealthyThreshold: healthUnhealthyThreshold,
+	}
+}
+
+// replicaStatus is the health of a replica, as shown on the admin listener
+type replicaStatus struct {
+	Pool      string     `json:"pool"`
+	Origin    string     `json:"origin"`
+	Healthy   bool       `json:"healthy"`
+	Active    int64      `json:"active"`
+	Breaker   string     `json:"breaker,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.unhealthy) == 0
+}
+
+func (r *replica) status(pool *originPool) replicaStatus {
+	r.Lock()
+	defer r.Unlock()
+	status := replicaStatus{
+		Pool:      pool.name,
+		Origin:    r.url.String(),
+		Healthy:   r.isHealthy(),
+		Active:    atomic.LoadInt64(&r.active),
+		LastError: r.lastError,
+	}
+	if pool.breaker != nil {
+		status.Breaker = pool.breaker.State()
+	}
+	if !r.lastCheck.IsZero() {
+		lastCheck := r.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+// checkHealth probes a replica every -health-interval until the pool is
+// stopped, taking it out of rotation after -health-unhealthy-threshold
+// failed probes in a row and back after -health-healthy-threshold successes
+func (p *originPool) checkHealth(r *replica) {
+	config := p.health
+	client := &http.Client{
+		Transport: p.transport,
+		Timeout:   config.interval,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	probe := strings.TrimSuffix(r.url.String(), "/") + "/" + strings.TrimPrefix(config.path, "/")
+	ticker := time.NewTicker(config.interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		err := probeHealth(client, probe)
+
+		r.Lock()
+		r.lastCheck = time.Now()
+		r.lastError = ""
+		if err != nil {
+			r.lastError = err.Error()
+		}
+		r.Unlock()
+
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !r.isHealthy() && successes >= config.healthyThreshold {
+				log.Printf("%s is healthy, returning it to rotation", r.url)
+				atomic.StoreInt32(&r.unhealthy, 0)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if r.isHealthy() && failures >= config.unhealthyThreshold {
+				log.Printf("%s is unhealthy, removing it from rotation: %s", r.url, err.Error())
+				atomic.StoreInt32(&r.unhealthy, 1)
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeHealth makes a request to url, which is healthy if it responds with
+// a 2xx or 3xx status
+func probeHealth(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHealthMovesReplicasOutOfAndBackIntoRotation(t *testing.T) {
+	var failing, failed, succeeded int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			atomic.AddInt32(&failed, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&succeeded, 1)
+	}))
+	defer origin.Close()
+
+	u, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+	r := &replica{url: u}
+	pool := &originPool{
+		replicas:  []*replica{r},
+		transport: http.DefaultTransport,
+		health: healthConfig{
+			path:               "health",
+			interval:           5 * time.Millisecond,
+			healthyThreshold:   2,
+			unhealthyThreshold: 3,
+		},
+		stop: make(chan struct{}),
+	}
+	go pool.checkHealth(r)
+	defer close(pool.stop)
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for r.isHealthy() != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("replica didn't become healthy=%t", healthy)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// replicas are taken out of rotation after the unhealthy threshold of
+	// failed probes in a row
+	atomic.StoreInt32(&failing, 1)
+	waitFor(false)
+	require.True(t, atomic.LoadInt32(&failed) >= 3)
+	status := r.status(pool)
+	require.False(t, status.Healthy)
+	require.Equal(t, "health check returned 503 Service Unavailable", status.LastError)
+	require.NotNil(t, status.LastCheck)
+
+	// and back after the healthy threshold of successful ones
+	atomic.StoreInt32(&succeeded, 0)
+	atomic.StoreInt32(&failing, 0)
+	waitFor(true)
+	require.True(t, atomic.LoadInt32(&succeeded) >= 2)
+	require.Equal(t, "", r.status(pool).LastError)
+}
+
+func TestOriginPoolsKeepTheirHealthConfig(t *testing.T) {
+	defer func(path string, interval time.Duration) {
+		healthPath, healthInterval = path, interval
+	}(healthPath, healthInterval)
+	healthPath, healthInterval = "/health", time.Second
+
+	pool, err := newOriginPool("llamas", []string{"http://127.0.0.1:1"}, roundRobin, http.DefaultTransport)
+	require.NoError(t, err)
+	resetPools()
+
+	// a reload changing the flags doesn't change the checks of pools that
+	// have already been created
+	healthPath, healthInterval = "/alpacas", time.Minute
+	require.Equal(t, "/health", pool.health.path)
+	require.Equal(t, time.Second, pool.health.interval)
+}
@@ -2,37 +2,309 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lox/httpcache"
 	"github.com/lox/httpcache/httplog"
 )
 
 const (
-	defaultListen = "0.0.0.0:8080"
-	defaultDir    = "./cachedata"
+	defaultListen   = "0.0.0.0:8080"
+	defaultUpstream = "http://127.0.0.1:80"
+	defaultDir      = "./cachedata"
 )
 
 var (
-	listen   string
-	useDisk  bool
-	private  bool
-	dir      string
-	dumpHttp bool
-	verbose  bool
+	config        string
+	listen        string
+	upstream      string
+	origin        string
+	balance       string
+	backend       string
+	useDisk       bool
+	private       bool
+	staleOnError  bool
+	offline       bool
+	maintenance   bool
+	serveStale    bool
+	maintPage     string
+	ttlRules      string
+	cacheMethods  string
+	keyRules      string
+	authPolicy    string
+	partitionBy   string
+	neverCache    string
+	esi           bool
+	cookieRules   string
+	headerRules   string
+	rewrites      string
+	errPages      string
+	stripParams   string
+	stripUp       bool
+	minTTL        time.Duration
+	forceCache    bool
+	varyIgnore    string
+	normalizeAE   bool
+	storeGzip     bool
+	gzipResp      bool
+	gzipTypes     string
+	gzipMinSize   int64
+	cachePartial  bool
+	bufferDir     string
+	maxObjSize    int64
+	maxHeader     int
+	maxReqBody    int64
+	maxRespSize   int64
+	negativeTTL   time.Duration
+	heurPercent   int
+	heurMax       time.Duration
+	forceHosts    string
+	maxTTL        time.Duration
+	revalWorkers  int
+	behindBytes   int64
+	behindWorkers int
+	purgeACL      string
+	dir           string
+	dumpHttp      bool
+	dumpRedact    string
+	dumpDir       string
+	dumpKeep      int
+	dumpHAR       bool
+	verbose       bool
+	logFormat     string
+	logSyslog     bool
+	redis         string
+	redisTTL      time.Duration
+	memcached     string
+	s3Config      httpcache.S3Config
+	gcsConfig     httpcache.GCSConfig
+	azConfig      httpcache.AzureBlobConfig
+	boltPath      string
+	memSize       int64
+	memEntries    int
+	promoteHits   int
+	demoteIdle    time.Duration
+	diskMax       int64
+	diskLow       int64
+	diskEvict     string
+	diskTinyLFU   bool
+	diskVerify    bool
+	diskKeyFile   string
+	diskCompress  bool
+	diskCompTypes string
+	diskBloom     bool
+	indexFile     string
+	peers         string
+	peerSelf      string
+	tlsCert       string
+	tlsKey        string
+	tlsCA         string
+	http2         bool
+	h2c           bool
+	acme          bool
+	acmeHosts     string
+	acmeEmail     string
+	acmeDir       string
+	acmeHTTP      string
+	mitm          bool
+	caCert        string
+	caKey         string
+
+	upstreamTLS upstreamTLSConfig
+
+	healthPath               string
+	healthInterval           time.Duration
+	healthHealthyThreshold   int
+	healthUnhealthyThreshold int
+
+	retries         int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+
+	breakerThreshold   float64
+	breakerMinRequests int
+	breakerWindow      time.Duration
+	breakerOpenTime    time.Duration
+
+	shutdownTimeout time.Duration
+
+	accessLog         string
+	accessLogMaxSize  int64
+	accessLogInterval time.Duration
+	accessLogKeep     int
+
+	syslogFacility string
+	syslogTag      string
+
+	adminListen string
+	adminToken  string
+	pprofAdmin  bool
+	statsFile   string
+
+	warmup            string
+	warmupConcurrency int
+
+	sweepInterval time.Duration
+	sweepGrace    time.Duration
+
+	// cmdlineFlags are the flags given on the command-line or in the
+	// environment
+	cmdlineFlags = map[string]bool{}
 )
 
 func init() {
+	flag.StringVar(&config, "config", "", "a yaml config file to read settings from, which flags override")
 	flag.StringVar(&listen, "listen", defaultListen, "the host and port to bind to")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for requests in flight and cache writes to finish on SIGTERM or SIGINT")
+	flag.StringVar(&upstream, "upstream", defaultUpstream, "the base url of the upstream server to proxy to, passing the Host header through")
+	flag.StringVar(&origin, "origin", "", "the base url of an origin to reverse proxy to, rewriting the Host header to match it, or a comma separated list of replicas")
+	flag.StringVar(&balance, "balance", roundRobin, "how to balance requests across -origin replicas, either round-robin or least-connections")
+	flag.StringVar(&healthPath, "health-path", "", "a path to probe origins with every -health-interval, taking replicas that fail out of rotation")
+	flag.DurationVar(&healthInterval, "health-interval", 10*time.Second, "how often to probe origins with -health-path")
+	flag.IntVar(&healthHealthyThreshold, "health-healthy-threshold", 2, "the number of successful probes in a row before an unhealthy replica is used again")
+	flag.IntVar(&healthUnhealthyThreshold, "health-unhealthy-threshold", 3, "the number of failed probes in a row before a replica is taken out of rotation")
+	flag.IntVar(&retries, "retries", 0, "how many times to retry GET, HEAD and OPTIONS requests that fail to connect upstream or get a 502, 503 or 504")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "how long to wait before the first retry, which doubles with each retry")
+	flag.DurationVar(&retryMaxBackoff, "retry-max-backoff", 5*time.Second, "the longest to wait between retries")
+	flag.StringVar(&errPages, "error-pages", "", "a comma separated list of statuses and go html templates, such as \"502=/etc/httpcache/502.html,504=/etc/httpcache/504.html\", of the pages to serve when origins can't be reached or time out and nothing is cached, executed with .Status, .StatusText, .Method, .Host, .Path, .URL, .Error and .Time")
+	flag.Float64Var(&breakerThreshold, "breaker-threshold", 0, "the proportion of failed requests to an origin, from 0 to 1, that opens its circuit breaker, or 0 to disable it")
+	flag.IntVar(&breakerMinRequests, "breaker-min-requests", 20, "the fewest requests in -breaker-window before the circuit breaker can open")
+	flag.DurationVar(&breakerWindow, "breaker-window", 10*time.Second, "the window that failed requests are counted over")
+	flag.DurationVar(&breakerOpenTime, "breaker-open-time", 30*time.Second, "how long the circuit breaker stays open before probing the origin again")
+	flag.StringVar(&upstreamTLS.CA, "upstream-ca", "", "a pem encoded CA bundle to verify upstream certificates with, instead of the system roots")
+	flag.StringVar(&upstreamTLS.Cert, "upstream-cert", "", "a pem encoded client certificate file to present to upstream, requires -upstream-key")
+	flag.StringVar(&upstreamTLS.Key, "upstream-key", "", "the pem encoded private key file for -upstream-cert")
+	flag.BoolVar(&upstreamTLS.InsecureSkipVerify, "upstream-insecure-skip-verify", false, "don't verify upstream certificates, which is insecure and only meant for testing")
+	flag.BoolVar(&upstreamTLS.H2C, "upstream-h2c", false, "speak HTTP/2 without TLS to an http upstream, which must support it")
+	flag.StringVar(&tlsCert, "tls-cert", "", "a pem encoded certificate file to serve https with, requires -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "the pem encoded private key file for -tls-cert")
+	flag.StringVar(&tlsCA, "tls-client-ca", "", "a pem encoded CA bundle that clients must present a certificate signed by, with -tls-cert or -acme")
+	flag.BoolVar(&http2, "http2", true, "serve HTTP/2 to clients that support it over https")
+	flag.BoolVar(&h2c, "h2c", false, "accept HTTP/2 without TLS from clients with prior knowledge of it")
+	flag.BoolVar(&acme, "acme", false, "serve https with certificates obtained automatically from let's encrypt for -acme-hosts")
+	flag.StringVar(&acmeHosts, "acme-hosts", "", "a comma separated list of the hostnames to obtain certificates for with -acme")
+	flag.StringVar(&acmeEmail, "acme-email", "", "an optional contact email address for the acme account")
+	flag.StringVar(&acmeDir, "acme-dir", "", "the dir to store acme certificates in, defaults to acme/ in -dir")
+	flag.StringVar(&acmeHTTP, "acme-http-listen", "", "an optional host and port to answer acme http-01 challenges on, usually port 80")
+	flag.StringVar(&backend, "backend", "", "the cache backend to use as name?key=val&key=val, where name is one of "+strings.Join(httpcache.Backends(), ", "))
 	flag.StringVar(&dir, "dir", defaultDir, "the dir to store cache data in, implies -disk")
 	flag.BoolVar(&useDisk, "disk", false, "whether to store cache data to disk")
+	flag.Int64Var(&diskMax, "disk-max-size", 0, "the most bytes to store on disk before evicting resources by -disk-eviction, or 0 for no limit")
+	flag.Int64Var(&diskLow, "disk-low-water", 0, "the number of bytes to evict down to once -disk-max-size is exceeded, defaults to 90% of it")
+	flag.StringVar(&diskEvict, "disk-eviction", string(httpcache.EvictLRU), "the order to evict resources from disk in once -disk-max-size is exceeded, one of "+evictionPolicies())
+	flag.BoolVar(&diskVerify, "verify-checksums", false, "check the bodies of resources read from disk against the checksums they were stored with, removing rather than serving corrupt ones")
+	flag.StringVar(&diskKeyFile, "encryption-key-file", "", "a file holding a 256 bit key, in hex or base64, to encrypt resources stored on disk with AES-GCM, such as for a -private cache on a shared disk")
+	flag.BoolVar(&diskCompress, "disk-compress", false, "compress the bodies of resources stored on disk with gzip, if they have one of -disk-compress-types and no Content-Encoding")
+	flag.StringVar(&diskCompTypes, "disk-compress-types", strings.Join(httpcache.DefaultCompressTypes, ","), "the comma separated content types, such as text/*, to compress with -disk-compress")
+	flag.BoolVar(&diskBloom, "disk-bloom-filter", false, "keep a bloom filter of the keys stored on disk in memory, so that looking up keys that aren't stored doesn't touch the disk")
+	flag.BoolVar(&diskTinyLFU, "disk-tinylfu", false, "once the disk is nearly full, only store new resources that have been requested more often recently than the next to be evicted, so that crawls don't evict popular resources")
+	flag.StringVar(&indexFile, "index-file", "", "a file to journal the index of stored keys to, so that they can be purged by tag or prefix after a restart")
+	flag.Int64Var(&memSize, "memory-size", 64*1024*1024, "the number of bytes of resources to keep in memory with -backend=memory, or of hot resources with -backend=tiered, evicting the least recently used")
+	flag.IntVar(&memEntries, "memory-max-entries", 0, "the most keys to keep in memory with -backend=memory, or of the hottest resources with -backend=tiered, evicting the least recently used, or 0 for no limit")
+	flag.IntVar(&promoteHits, "tiered-promote-hits", 1, "how many times, up to 15, a resource must have been requested recently with -backend=tiered before it is copied into memory, leaving less requested resources on disk")
+	flag.DurationVar(&demoteIdle, "tiered-demote-idle", 0, "remove resources from memory with -backend=tiered that haven't been requested for this long, leaving them on disk, or 0 to only evict them once memory is full")
+	flag.StringVar(&boltPath, "bolt-path", "./httpcache.db", "the bbolt database file to store cache data in")
+	flag.StringVar(&redis, "redis", "", "the host and port of a redis server to store cache data in")
+	flag.DurationVar(&redisTTL, "redis-ttl", 0, "how long cache data lives in redis, or 0 for no expiry")
+	flag.StringVar(&memcached, "memcached-servers", "", "a comma separated list of memcached servers to store cache data in")
+	flag.StringVar(&s3Config.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "the endpoint of an s3-compatible service to store cache data in")
+	flag.StringVar(&s3Config.Region, "s3-region", "us-east-1", "the region of the s3 bucket")
+	flag.StringVar(&s3Config.Bucket, "s3-bucket", "", "the s3 bucket to store cache data in, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&s3Config.Prefix, "s3-prefix", "", "a prefix for the names of objects stored in s3")
+	flag.StringVar(&gcsConfig.Bucket, "gcs-bucket", "", "the google cloud storage bucket to store cache data in, using application default credentials")
+	flag.StringVar(&gcsConfig.Prefix, "gcs-prefix", "", "a prefix for the names of objects stored in google cloud storage")
+	flag.StringVar(&azConfig.Container, "azblob-container", "", "the azure storage container to store cache data in, credentials are read from AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY")
+	flag.StringVar(&azConfig.Prefix, "azblob-prefix", "", "a prefix for the names of blobs stored in azure storage")
+	flag.StringVar(&azConfig.Endpoint, "azblob-endpoint", "", "the blob service endpoint, defaults to https://<account>.blob.core.windows.net")
+	flag.BoolVar(&mitm, "mitm", false, "intercept https CONNECT tunnels with certificates signed by -ca-cert, so that https origins are cached")
+	flag.StringVar(&caCert, "ca-cert", "", "the pem encoded CA certificate file used with -mitm, which clients must trust")
+	flag.StringVar(&caKey, "ca-key", "", "the pem encoded private key file for -ca-cert")
+	flag.StringVar(&peers, "peers", "", "a comma separated list of peer base urls to share cached resources with, including this instance")
+	flag.StringVar(&peerSelf, "peer-self", "", "the base url of this instance in -peers")
+	flag.StringVar(&adminListen, "admin-listen", "", "an optional host and port to serve the admin api on, which should not be public")
+	flag.StringVar(&adminToken, "admin-token", "", "a token that admin api requests must present as \"Authorization: Bearer token\"")
+	flag.BoolVar(&pprofAdmin, "pprof", false, "serve cpu, memory and goroutine profiles on /debug/pprof/ of the admin api")
+	flag.StringVar(&statsFile, "stats-file", "", "a file to save cache stats to every minute and on shutdown, for the stats command")
 	flag.BoolVar(&verbose, "v", false, "show verbose output and debugging")
+	flag.StringVar(&logFormat, "log-format", httplog.FormatText, "how to log, either text or json for a json object per request and message")
+	flag.BoolVar(&logSyslog, "log-syslog", false, "log to the local syslog daemon rather than stderr")
+	flag.StringVar(&syslogFacility, "syslog-facility", "daemon", "the facility to log to with -log-syslog, such as daemon or local0")
+	flag.StringVar(&syslogTag, "syslog-tag", "httpcache", "the tag to identify messages with in syslog")
+	flag.StringVar(&accessLog, "access-log", "", "a file to log requests to instead of stderr, or off to not log them")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 100*1024*1024, "the most bytes to write to -access-log before rotating it, or 0 for no limit")
+	flag.DurationVar(&accessLogInterval, "access-log-rotate", 24*time.Hour, "how often to rotate -access-log, or 0 to only rotate it by size")
+	flag.IntVar(&accessLogKeep, "access-log-keep", 7, "how many rotated access logs to keep")
 	flag.BoolVar(&private, "private", false, "make the cache private")
+	flag.DurationVar(&sweepInterval, "sweep-interval", 0, "how often to remove expired resources from memory and disk caches, rather than leaving them until evicted, or 0 to not")
+	flag.DurationVar(&sweepGrace, "sweep-grace", time.Hour, "how long after resources expire, and any stale-while-revalidate or stale-if-error allowance, -sweep-interval removes them, which should be longer than any ttl overrides")
+	flag.StringVar(&warmup, "warmup", "", "a file of urls, one per line, to request through the cache at startup before serving")
+	flag.IntVar(&warmupConcurrency, "warmup-concurrency", 8, "how many -warmup urls to request at once")
+	flag.IntVar(&revalWorkers, "revalidate-workers", httpcache.DefaultRevalidateWorkers, "how many stale-while-revalidate revalidations to run in the background at once")
+	flag.Int64Var(&behindBytes, "write-behind-bytes", 0, "store responses once they have been sent to clients rather than as they are streamed, not storing those that would leave more than this many bytes waiting to be stored, or 0 to store them as they are streamed")
+	flag.IntVar(&behindWorkers, "write-behind-workers", httpcache.DefaultWriteBehindWorkers, "how many responses to store at once with -write-behind-bytes")
+	flag.StringVar(&purgeACL, "purge-acl", "", "a comma separated list of the ip addresses and cidr ranges allowed to make PURGE requests, which are passed upstream if it is empty")
+	flag.BoolVar(&staleOnError, "serve-stale-on-error", false, "serve stale cached responses when upstream fails with a 5xx, even without stale-if-error")
+	flag.StringVar(&ttlRules, "ttl-rules", "", "a comma separated list of rules overriding the freshness lifetime of matching responses, such as \"example.com/api/* ttl=30s\" or \"/static/* ttl=7d if-missing\" to only apply without Cache-Control or Expires")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "the shortest freshness lifetime to cache responses for, even with max-age=0, or 0 for no minimum")
+	flag.DurationVar(&maxTTL, "max-ttl", 0, "the longest freshness lifetime to cache responses for, however long the origin allows, or 0 for no maximum")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 0, "how long to cache 404, 410 and 5xx responses without an expiration for, or 0 to not cache them")
+	flag.IntVar(&heurPercent, "heuristic-percent", httpcache.DefaultHeuristicPercent, "the percentage of the time since a response without an expiration was last modified to cache it for, or 0 to not cache such responses without revalidating")
+	flag.DurationVar(&heurMax, "heuristic-max", 0, "the longest to cache a response without an expiration for with -heuristic-percent, or 0 for no limit")
+	flag.BoolVar(&normalizeAE, "normalize-accept-encoding", true, "reduce the Accept-Encoding of requests to br, gzip or identity, so that responses varying by it are cached as few variants")
+	flag.BoolVar(&storeGzip, "store-gzip", false, "ask upstreams for gzip responses and cache a single copy of each, decoding it for clients that don't accept gzip")
+	flag.BoolVar(&gzipResp, "gzip-responses", false, "compress uncompressed responses from upstreams with one of -gzip-types with gzip before they are cached, decoding them for clients that don't accept gzip")
+	flag.StringVar(&gzipTypes, "gzip-types", strings.Join(httpcache.DefaultCompressTypes, ","), "the comma separated content types, such as text/*, to compress with -gzip-responses")
+	flag.Int64Var(&gzipMinSize, "gzip-min-size", httpcache.DefaultCompressMinSize, "the smallest response in bytes to compress with -gzip-responses")
+	flag.BoolVar(&cachePartial, "cache-partial", false, "store the ranges of partial responses, and cache the whole response once they cover it")
+	flag.StringVar(&bufferDir, "buffer-dir", "", "an existing dir to buffer responses from upstream in while they are stored, rather than memory")
+	flag.Int64Var(&maxObjSize, "max-object-size", 0, "the largest response in bytes to cache, larger ones are passed through, or 0 for no limit")
+	flag.IntVar(&maxHeader, "max-header-bytes", http.DefaultMaxHeaderBytes, "the most bytes of request headers to read, refusing larger ones with a 431")
+	flag.Int64Var(&maxReqBody, "max-request-body", 0, "the largest request body in bytes to accept, refusing larger ones with a 413, or 0 for no limit")
+	flag.Int64Var(&maxRespSize, "max-response-size", 0, "the largest response in bytes to accept from upstream, failing larger ones with a 502 or aborting them, or 0 for no limit")
+	flag.StringVar(&authPolicy, "authorization", string(httpcache.AuthNever), "how a shared cache handles requests with an Authorization header, never to not store their responses, strict to store those with public, s-maxage or must-revalidate, or partition to cache them apart for each user")
+	flag.StringVar(&partitionBy, "partition-header", "", "a request header, such as X-User-Id set by an authenticating gateway, holding the user to partition the cache by with -authorization=partition rather than the Authorization header")
+	flag.BoolVar(&esi, "esi", false, "process Edge Side Includes in uncompressed html responses, assembling them from the fragments of <esi:include> tags, which are cached apart, and removing <esi:remove> blocks")
+	flag.StringVar(&neverCache, "never-cache", "", "a comma separated list of patterns such as \"/admin/*\" or \"example.com/api/auth/*\", or regular expressions for paths starting with ~, for requests that are passed to origins without being looked up in the cache or stored")
+	flag.StringVar(&rewrites, "rewrites", "", "a comma separated list of rules that rewrite the paths of requests matching a regular expression before they are keyed and passed upstream, such as \"^/v1/(.*)$ -> /api/$1\", or redirect them with \"^/old/(.*)$ -> /new/$1 301\", optionally for the hosts matching host=example.com")
+	flag.StringVar(&headerRules, "header-rules", "", "a comma separated list of rules that change the headers of matching requests before they are passed upstream, or of responses as they are served, such as \"/* response remove Server\", \"/* request set X-Forwarded-Proto: https\" or \"example.com/* response add X-Frame-Options: DENY\"")
+	flag.StringVar(&cookieRules, "cookie-rules", "", "a comma separated list of rules such as \"/static/* strip\" to strip cookies from matching requests so that they are cached, or \"/* bypass=sessionid bypass=wp_*\" to bypass the cache for matching requests with the cookies")
+	flag.StringVar(&stripParams, "strip-query", strings.Join(httpcache.DefaultStripQuery, ","), "a comma separated list of query parameters, in which * matches anything, removed from urls before they are keyed so that tracking parameters don't fragment the cache")
+	flag.BoolVar(&stripUp, "strip-query-upstream", false, "remove the -strip-query parameters from requests passed to origins too")
+	flag.StringVar(&keyRules, "key-rules", "", "a comma separated list of rules such as \"example.com/api/* query=id header=Accept-Language cookie=currency\" or \"/static/* no-query\", giving the query parameters, request headers and cookies that form the cache keys of matching requests")
+	flag.StringVar(&cacheMethods, "cache-methods", "", "a comma separated list of rules such as \"POST example.com/api/search\" or \"OPTIONS\", caching responses with an explicit expiration to requests with the method whose host and path match, keyed by their body too")
+	flag.StringVar(&varyIgnore, "vary-ignore", "", "a comma separated list of rules such as \"* User-Agent\" or \"*.example.com Cookie\", giving the Vary headers to cache responses for matching hosts without varying by")
+	flag.BoolVar(&forceCache, "force-cache", false, "cache responses even if the origin sends no-cache or no-store, which isn't rfc7234 compliant and marks them with X-Cache-Forced")
+	flag.StringVar(&forceHosts, "force-cache-hosts", "", "a comma separated list of host patterns such as *.example.com that -force-cache applies to, rather than every host")
+	flag.BoolVar(&serveStale, "serve-stale", false, "serve cached responses however stale without revalidating them, for origin incidents, which POST /serve-stale on the admin api or SIGUSR1 turns on at runtime")
+	flag.BoolVar(&maintenance, "maintenance", false, "serve only from the cache without contacting origins, however stale, answering misses with a 503 and -maintenance-page, for planned origin downtime")
+	flag.StringVar(&maintPage, "maintenance-page", "", "a file, such as an html page, to serve with a 503 for requests that aren't cached in -maintenance mode")
+	flag.BoolVar(&offline, "offline", false, "serve only from the cache without contacting origins, however stale, failing misses with a 504")
 	flag.BoolVar(&dumpHttp, "dumphttp", false, "dumps http requests and responses to stdout")
-	flag.Parse()
+	flag.StringVar(&dumpRedact, "dumphttp-redact", strings.Join(httplog.DefaultRedactHeaders, ","), "a comma separated list of the headers whose values are redacted from -dumphttp")
+	flag.StringVar(&dumpDir, "dumphttp-dir", "", "a dir to dump each http exchange to a file of its own in, rather than to stderr")
+	flag.IntVar(&dumpKeep, "dumphttp-keep", 1000, "how many of the newest dumps to keep in -dumphttp-dir, or 0 to keep them all")
+	flag.BoolVar(&dumpHAR, "dumphttp-har", false, "dump to -dumphttp-dir as HAR archives rather than text")
+	flag.Usage = usage
+}
+
+// parseFlags sets the flags from the environment, the command-line and the
+// config file, and sets up logging with them
+func parseFlags() {
+	if err := loadFlags(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 
 	if verbose {
 		httpcache.DebugLogging = true
@@ -40,37 +312,410 @@ func init() {
 }
 
 func main() {
-	proxy := &httputil.ReverseProxy{
-		Director: func(r *http.Request) {
-			r.URL.Scheme = "http"
-			r.URL.Host = "127.0.0.1:80"
-		},
+	parseFlags()
+
+	if ran, err := runCommand(flag.Args()); ran {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	var cache httpcache.Cache
+	storage, err := newCache()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache := httpcache.NewIndexedCache(storage)
+	if indexFile != "" {
+		if cache, err = httpcache.NewJournaledIndexedCache(storage, indexFile); err != nil {
+			log.Fatal(err)
+		}
+		keys, _ := cache.Len()
+		log.Printf("recovered %d keys from the index in %s", keys, indexFile)
+	}
 
-	if useDisk && dir != "" {
-		log.Printf("storing cached resources in %s", dir)
-		if err := os.MkdirAll(dir, 0700); err != nil {
+	handler, err := newHandler(cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activatePools()
+
+	reloader := &reloadHandler{}
+	reloader.handler.Store(handler)
+	go reloader.reloadOnSignal(cache)
+	go reloader.toggleServeStaleOnSignal(cache)
+
+	server := &http.Server{Addr: listen, Handler: withClientCN(reloader), MaxHeaderBytes: maxHeader}
+	servers := []*http.Server{server}
+
+	adminSocket, err := listenSocket("admin", adminListen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pprofAdmin && adminSocket == nil {
+		log.Fatal("-pprof requires -admin-listen")
+	}
+	if adminSocket != nil {
+		admin := &http.Server{Addr: adminSocket.Addr().String(), Handler: newAdminHandler(cache, reloader)}
+		servers = append(servers, admin)
+		go func() {
+			log.Printf("serving admin api on http://%s", admin.Addr)
+			if err := admin.Serve(adminSocket); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if statsFile != "" {
+		go saveStatsEvery(cache, statsInterval)
+	}
+
+	if sweepInterval > 0 {
+		go sweepEvery(cache, sweepInterval, sweepGrace)
+	}
+
+	if warmup != "" {
+		if err := warmUp(reloader, warmup, warmupConcurrency); err != nil {
 			log.Fatal(err)
 		}
-		var err error
-		cache, err = httpcache.NewDiskCache(dir)
+	}
+
+	done := shutdownOnSignal(cache, servers...)
+	if err := serve(server); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// newHandler returns the proxy handler chain for the current flags, serving
+// resources from cache
+func newHandler(cache httpcache.Cache) (http.Handler, error) {
+	resetPools()
+
+	pages, err := loadErrorPages(errPages)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -error-pages: %s", err.Error())
+	}
+	errorPages = pages
+
+	transport, err := newUpstreamTransport(upstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newProxy(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if peers != "" {
+		log.Printf("sharing cached resources with peers %s", peers)
+	}
+
+	var handler http.Handler
+	if handler, err = newCacheHandler(cache, proxy); err != nil {
+		return nil, err
+	}
+
+	if len(pathRoutes) > 0 {
+		if handler, err = newPathRouter(cache, handler); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(hostRoutes) > 0 {
+		if handler, err = newHostRouter(cache, handler); err != nil {
+			return nil, err
+		}
+	}
+
+	chain := newResponseLogger(countRequests(limitRequests(handler)))
+
+	if mitm {
+		if origin != "" {
+			return nil, fmt.Errorf("-mitm can't be used with -origin")
+		}
+		if caCert == "" || caKey == "" {
+			return nil, fmt.Errorf("-mitm requires -ca-cert and -ca-key")
+		}
+		mitmHandler, err := configuredHandler(cache, newForwardProxy(newRetryTransport(measureOrigin(transport))))
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+
+		log.Printf("intercepting https with certificates signed by %s", caCert)
+		return newMITMProxy(caCert, caKey, newResponseLogger(countRequests(limitRequests(mitmHandler))), chain)
+	}
+
+	return chain, nil
+}
+
+// newCacheHandler returns a caching handler in front of proxy, which is
+// shared with any -peers
+func newCacheHandler(cache httpcache.Cache, proxy http.Handler) (*httpcache.Handler, error) {
+	next := proxy
+	if peers != "" {
+		if peerSelf == "" {
+			return nil, fmt.Errorf("-peers requires -peer-self")
+		}
+		pool, err := httpcache.NewPeerPool(peerSelf, strings.Split(peers, ","), proxy)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		cache = httpcache.NewMemoryCache()
+		next = pool
 	}
 
-	handler := httpcache.NewHandler(cache, proxy)
+	return configuredHandler(cache, next)
+}
+
+// configuredHandler returns a caching handler in front of next, configured
+// by the cache flags
+func configuredHandler(cache httpcache.Cache, next http.Handler) (*httpcache.Handler, error) {
+	acl, err := parseACL(purgeACL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -purge-acl: %s", err.Error())
+	}
+	if maxTTL > 0 && minTTL > maxTTL {
+		return nil, fmt.Errorf("-min-ttl of %s is longer than -max-ttl of %s", minTTL, maxTTL)
+	}
+	if heurPercent < 0 {
+		return nil, fmt.Errorf("-heuristic-percent can't be negative")
+	}
+	rules, err := parseTTLRules(ttlRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ttl-rules: %s", err.Error())
+	}
+	auth, err := httpcache.ParseAuthPolicy(authPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -authorization: %s", err.Error())
+	}
+	never, err := parseNeverCache(neverCache)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -never-cache: %s", err.Error())
+	}
+	rewritten, err := parseRewrites(rewrites)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -rewrites: %s", err.Error())
+	}
+	headered, err := parseHeaderRules(headerRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -header-rules: %s", err.Error())
+	}
+	cookied, err := parseCookieRules(cookieRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -cookie-rules: %s", err.Error())
+	}
+	keyed, err := parseKeyRules(keyRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -key-rules: %s", err.Error())
+	}
+	methodRules, err := parseMethodRules(cacheMethods)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -cache-methods: %s", err.Error())
+	}
+
+	handler := httpcache.NewHandler(cache, next)
 	handler.Shared = !private
+	handler.ServeStaleOnError = staleOnError
+	handler.Offline = offline
+	handler.ServeStale = serveStale
+	if maintenance {
+		page, err := maintenancePage(maintPage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -maintenance-page: %s", err.Error())
+		}
+		handler.Offline = true
+		handler.OfflinePage = page
+	}
+	handler.TTLRules = rules
+	handler.AuthPolicy = auth
+	handler.PartitionHeader = partitionBy
+	handler.NeverCache = never
+	handler.ESI = esi
+	handler.Rewrites = rewritten
+	handler.Synthetic = syntheticResponses
+	handler.HeaderRules = headered
+	handler.CookieRules = cookied
+	handler.StripQuery = splitHeaders(stripParams)
+	handler.StripQueryUpstream = stripUp
+	handler.KeyRules = keyed
+	handler.CacheMethods = methodRules
+	handler.MinTTL = minTTL
+	handler.NegativeTTL = negativeTTL
+	handler.NormalizeAcceptEncoding = normalizeAE
+	handler.StoreGzip = storeGzip
+	if gzipResp {
+		handler.CompressTypes = splitHeaders(gzipTypes)
+		handler.CompressMinSize = gzipMinSize
+	}
+	handler.CachePartial = cachePartial
+	handler.BufferDir = bufferDir
+	handler.MaxObjectSize = maxObjSize
+	if handler.IgnoreVary, err = parseVaryIgnore(varyIgnore); err != nil {
+		return nil, fmt.Errorf("invalid -vary-ignore: %s", err.Error())
+	}
+	handler.HeuristicPercent = heurPercent
+	handler.HeuristicMax = heurMax
+	handler.DisableHeuristic = heurPercent == 0
+	if forceCache {
+		if handler.ForceCache, err = forceCacheHosts(forceHosts); err != nil {
+			return nil, fmt.Errorf("invalid -force-cache-hosts: %s", err.Error())
+		}
+	}
+	handler.MaxTTL = maxTTL
+	handler.RevalidateWorkers = revalWorkers
+	handler.WriteBehindBytes = behindBytes
+	handler.WriteBehindWorkers = behindWorkers
+	if len(acl) > 0 {
+		handler.AllowPurge = allowACL(acl)
+	}
+	return handler, nil
+}
+
+func newResponseLogger(handler http.Handler) http.Handler {
+	// -dumphttp-dir dumps every exchange without -dumphttp
+	dump := dumpHttp || dumpDir != ""
 
 	respLogger := httplog.NewResponseLogger(handler)
-	respLogger.DumpRequests = dumpHttp
-	respLogger.DumpResponses = dumpHttp
-	respLogger.DumpErrors = dumpHttp
+	respLogger.DumpRequests = dump
+	respLogger.DumpResponses = dump
+	respLogger.DumpErrors = dump
+	respLogger.RedactHeaders = splitHeaders(dumpRedact)
+	respLogger.DumpDir = dumpDir
+	respLogger.DumpKeep = dumpKeep
+	respLogger.DumpHAR = dumpHAR
+	respLogger.Format = logFormat
+	if accessLogFile != nil {
+		respLogger.Output = accessLogFile
+	}
+	if accessLog == accessLogOff {
+		if !dump {
+			return handler
+		}
+		respLogger.Output = ioutil.Discard
+	}
+
+	// requests from the admin api's /explain aren't logged
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if httpcache.Explaining(r.Context()) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		respLogger.ServeHTTP(w, r)
+	})
+}
+
+// newCache returns the cache backend selected by the command-line flags,
+// falling back to inferring it from -redis, -disk and -dir if -backend isn't set
+func newCache() (httpcache.Cache, error) {
+	spec := backend
+	if spec == "" {
+		switch {
+		case redis != "":
+			spec = "redis"
+		case useDisk || flagSet("dir"):
+			spec = "disk"
+		default:
+			spec = "memory"
+		}
+	}
+
+	name, opts, err := httpcache.ParseBackendSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// options in the spec take precedence over the backend specific flags
+	for k, v := range flagOptions(name) {
+		if opts.Get(k) == "" {
+			opts[k] = v
+		}
+	}
+
+	log.Printf("storing cached resources in the %s backend", name)
+	return httpcache.OpenBackendOptions(name, opts)
+}
 
-	log.Printf("listening on http://%s", listen)
-	log.Fatal(http.ListenAndServe(listen, respLogger))
+// flagOptions returns backend options for the built-in backends from the
+// backend specific flags
+func flagOptions(name string) url.Values {
+	switch name {
+	case "memory":
+		return url.Values{
+			"max-size":    {strconv.FormatInt(memSize, 10)},
+			"max-entries": {strconv.Itoa(memEntries)},
+		}
+	case "disk":
+		return url.Values{
+			"dir":                 {dir},
+			"max-size":            {strconv.FormatInt(diskMax, 10)},
+			"low-water":           {strconv.FormatInt(diskLow, 10)},
+			"eviction":            {diskEvict},
+			"tinylfu":             {strconv.FormatBool(diskTinyLFU)},
+			"verify":              {strconv.FormatBool(diskVerify)},
+			"encryption-key-file": {diskKeyFile},
+			"compress":            {strconv.FormatBool(diskCompress)},
+			"compress-types":      {diskCompTypes},
+			"bloom":               {strconv.FormatBool(diskBloom)},
+		}
+	case "tiered":
+		return url.Values{
+			"dir":                 {dir},
+			"max-size":            {strconv.FormatInt(diskMax, 10)},
+			"low-water":           {strconv.FormatInt(diskLow, 10)},
+			"eviction":            {diskEvict},
+			"tinylfu":             {strconv.FormatBool(diskTinyLFU)},
+			"verify":              {strconv.FormatBool(diskVerify)},
+			"encryption-key-file": {diskKeyFile},
+			"compress":            {strconv.FormatBool(diskCompress)},
+			"compress-types":      {diskCompTypes},
+			"bloom":               {strconv.FormatBool(diskBloom)},
+			"memory-size":         {strconv.FormatInt(memSize, 10)},
+			"memory-max-entries":  {strconv.Itoa(memEntries)},
+			"promote-hits":        {strconv.Itoa(promoteHits)},
+			"demote-idle":         {demoteIdle.String()},
+		}
+	case "bolt":
+		return url.Values{"path": {boltPath}}
+	case "redis":
+		return url.Values{"addr": {redis}, "ttl": {redisTTL.String()}}
+	case "memcached":
+		return url.Values{"servers": {memcached}}
+	case "s3":
+		return url.Values{
+			"endpoint": {s3Config.Endpoint},
+			"region":   {s3Config.Region},
+			"bucket":   {s3Config.Bucket},
+			"prefix":   {s3Config.Prefix},
+		}
+	case "gcs":
+		return url.Values{"bucket": {gcsConfig.Bucket}, "prefix": {gcsConfig.Prefix}}
+	case "azblob":
+		return url.Values{
+			"container": {azConfig.Container},
+			"prefix":    {azConfig.Prefix},
+			"endpoint":  {azConfig.Endpoint},
+		}
+	}
+	return url.Values{}
+}
+
+// flagSet returns whether the named flag was given on the command-line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// evictionPolicies returns the names of the disk eviction policies
+func evictionPolicies() string {
+	names := []string{}
+	for _, policy := range httpcache.EvictionPolicies {
+		names = append(names, string(policy))
+	}
+	return strings.Join(names, ", ")
 }
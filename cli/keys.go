@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseKeyRules parses a comma separated list of rules such as
+// "example.com/api/* query=id query=page header=Accept-Language" or
+// "/static/* no-query cookie=currency", where the pattern is a host and
+// path, or a path alone to match any host, followed by the parts of
+// requests that form their cache keys
+func parseKeyRules(rules string) ([]httpcache.KeyRule, error) {
+	parsed := []httpcache.KeyRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule := httpcache.KeyRule{Path: fields[0]}
+		if i := strings.Index(fields[0], "/"); i != 0 {
+			if i == -1 {
+				return nil, fmt.Errorf("invalid rule %q, expected a pattern of host/path or /path", entry)
+			}
+			rule.Host, rule.Path = fields[0][:i], fields[0][i:]
+		}
+
+		for _, field := range fields[1:] {
+			name := field[strings.Index(field, "=")+1:]
+			switch {
+			case field == "no-query":
+				rule.IgnoreQuery = true
+			case strings.HasPrefix(field, "query=") && name != "":
+				rule.Query = append(rule.Query, name)
+			case strings.HasPrefix(field, "header=") && name != "":
+				rule.Headers = append(rule.Headers, name)
+			case strings.HasPrefix(field, "cookie=") && name != "":
+				rule.Cookies = append(rule.Cookies, name)
+			default:
+				return nil, fmt.Errorf("invalid rule %q, unknown option %q", entry, field)
+			}
+		}
+		if rule.IgnoreQuery && len(rule.Query) > 0 {
+			return nil, fmt.Errorf("invalid rule %q, no-query can't be used with query", entry)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+)
+
+// errResponseTooLarge fails upstream responses larger than -max-response-size
+var errResponseTooLarge = errors.New("response larger than max response size")
+
+// limitRequests wraps next to refuse requests with bodies larger than
+// -max-request-body with a 413. Bodies without a Content-Length fail once
+// they exceed it, which the proxy also answers with a 413.
+func limitRequests(next http.Handler) http.Handler {
+	if maxReqBody <= 0 {
+		return next
+	}
+	limit := maxReqBody
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitProxy makes a proxy fail upstream responses larger than
+// -max-response-size, with a 502 if their Content-Length gives them away,
+// otherwise by aborting them once they exceed it so that they aren't cached
+func limitProxy(p *httputil.ReverseProxy) *httputil.ReverseProxy {
+	pages := errorPages
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		proxyError(pages, w, r, err)
+	}
+	if maxRespSize <= 0 {
+		return p
+	}
+	limit := maxRespSize
+	p.ModifyResponse = func(resp *http.Response) error {
+		if resp.ContentLength > limit {
+			resp.Body.Close()
+			return errResponseTooLarge
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, left: limit}
+		return nil
+	}
+	return p
+}
+
+// proxyError answers requests that the proxy failed, with a 413 for request
+// bodies larger than -max-request-body, or else a 502 or 504 with any page
+// for it from -error-pages
+func proxyError(pages map[int]*template.Template, w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	serveError(pages, w, r, proxyStatus(err), err)
+}
+
+// limitedBody fails reads of a response body once more than left bytes
+// have been read
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n - 1, errResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lox/httpcache/httplog"
+)
+
+// accessLogOff is the -access-log that disables logging requests
+const accessLogOff = "off"
+
+// accessLogFile is where requests are logged with -access-log
+var accessLogFile *rotatingFile
+
+// ansiEscapes match the colours used in log messages meant for terminals
+var ansiEscapes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// checkLogFormat returns an error for unknown -log-format values
+func checkLogFormat(format string) error {
+	if format != httplog.FormatText && format != httplog.FormatJSON {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, httplog.FormatText, httplog.FormatJSON)
+	}
+	return nil
+}
+
+// splitHeaders splits a comma separated list of header names
+func splitHeaders(headers string) []string {
+	split := []string{}
+	for _, header := range strings.Split(headers, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			split = append(split, header)
+		}
+	}
+	return split
+}
+
+// setupLogging makes the log package write to syslog with -log-syslog and
+// json records with -log-format=json, and opens -access-log
+func setupLogging() error {
+	if err := checkLogFormat(logFormat); err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stderr
+	if logSyslog {
+		w, err := newSyslogWriter(syslogFacility, syslogTag)
+		if err != nil {
+			return err
+		}
+		// syslog timestamps messages itself
+		log.SetFlags(0)
+		output = w
+	}
+	if logFormat == httplog.FormatJSON {
+		log.SetFlags(0)
+		output = jsonLogWriter{output}
+	}
+	log.SetOutput(output)
+
+	if accessLog != "" && accessLog != accessLogOff {
+		f, err := openRotatingFile(accessLog, accessLogMaxSize, accessLogInterval, accessLogKeep)
+		if err != nil {
+			return err
+		}
+		accessLogFile = f
+	}
+	return nil
+}
+
+// jsonLogWriter writes each message from the log package as a json object
+// on a line of its own
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w jsonLogWriter) Write(b []byte) (int, error) {
+	msg := ansiEscapes.ReplaceAllString(strings.TrimSuffix(string(b), "\n"), "")
+	line, err := json.Marshal(struct {
+		Time string `json:"time"`
+		Msg  string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), msg})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
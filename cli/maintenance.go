@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/lox/httpcache"
+)
+
+// maintenanceRetryAfter is the Retry-After of the maintenance page, in
+// seconds
+const maintenanceRetryAfter = 300
+
+// maintenancePage returns the page served with a 503 in -maintenance mode
+// for requests that aren't cached, from the file -maintenance-page or else
+// a plain message
+func maintenancePage(path string) (httpcache.SyntheticResponse, error) {
+	page := httpcache.SyntheticResponse{
+		Status: http.StatusServiceUnavailable,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+			"Retry-After":  []string{strconv.Itoa(maintenanceRetryAfter)},
+		},
+		Body: []byte("down for maintenance\n"),
+	}
+	if path == "" {
+		return page, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return page, err
+	}
+	page.Body = b
+	page.Header.Set("Content-Type", "text/html; charset=utf-8")
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		page.Header.Set("Content-Type", ctype)
+	}
+	return page, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseMethodRules parses a comma separated list of rules such as
+// "POST example.com/api/search" or "OPTIONS", each a method followed by an
+// optional pattern of a host and path, or a path alone to match any host
+func parseMethodRules(rules string) ([]httpcache.MethodRule, error) {
+	parsed := []httpcache.MethodRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid rule %q, expected a method and an optional pattern", entry)
+		}
+
+		rule := httpcache.MethodRule{Method: strings.ToUpper(fields[0])}
+		switch rule.Method {
+		case "GET", "HEAD":
+			return nil, fmt.Errorf("invalid rule %q, %s requests are always cached", entry, rule.Method)
+		case "PURGE":
+			return nil, fmt.Errorf("invalid rule %q, PURGE requests can't be cached", entry)
+		}
+		if len(fields) == 2 {
+			rule.Path = fields[1]
+			if i := strings.Index(fields[1], "/"); i != 0 {
+				if i == -1 {
+					return nil, fmt.Errorf("invalid rule %q, expected a pattern of host/path or /path", entry)
+				}
+				rule.Host, rule.Path = fields[1][:i], fields[1][i:]
+			}
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
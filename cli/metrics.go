@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lox/httpcache"
+)
+
+// latencyBuckets are the upper bounds in seconds of the buckets of the
+// origin latency histograms
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// maxHosts limits the number of hosts that metrics are labelled with, as
+// clients choose the Host header, after which others are labelled "other"
+const maxHosts = 100
+
+// metrics are the counters exported in the prometheus text format on the
+// admin api's /metrics
+var metrics = &registry{
+	requests: map[requestLabels]int64{},
+	origins:  map[originLabels]*histogram{},
+	hosts:    map[string]bool{},
+}
+
+type requestLabels struct {
+	host, cache, status string
+}
+
+type originLabels struct {
+	host, status string
+}
+
+type histogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+type registry struct {
+	inFlight       int64
+	originInFlight int64
+	swept          int64
+	sweptBytes     int64
+
+	sync.Mutex
+	requests map[requestLabels]int64
+	origins  map[originLabels]*histogram
+	hosts    map[string]bool
+}
+
+// host returns the host label for a Host header, callers must hold the lock
+func (m *registry) host(hostport string) string {
+	host := strings.ToLower(hostport)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !m.hosts[host] {
+		if len(m.hosts) >= maxHosts {
+			return "other"
+		}
+		m.hosts[host] = true
+	}
+	return host
+}
+
+// statusClass returns the class of a status code, such as 2xx
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// cacheResult returns whether a response was a hit, miss, stale,
+// revalidated or bypassed the cache
+func cacheResult(h http.Header) string {
+	switch status := h.Get(httpcache.CacheHeader); status {
+	case httpcache.CacheHit, httpcache.CacheMiss, httpcache.CacheStale, httpcache.CacheRevalidated:
+		return strings.ToLower(status)
+	}
+	return "bypass"
+}
+
+// statusWriter records the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom lets the server send bodies that are files with sendfile
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countRequests wraps next to count requests by host, cache result and
+// status class
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests from the admin api's /explain aren't served
+		if httpcache.Explaining(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt64(&metrics.inFlight, 1)
+		defer atomic.AddInt64(&metrics.inFlight, -1)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		metrics.Lock()
+		defer metrics.Unlock()
+		metrics.requests[requestLabels{
+			host:   metrics.host(r.Host),
+			cache:  cacheResult(w.Header()),
+			status: statusClass(sw.status),
+		}]++
+	})
+}
+
+// originTransport records the latency of requests to origins
+type originTransport struct {
+	next http.RoundTripper
+}
+
+// measureOrigin wraps t to record the latency of each request to an origin,
+// by origin host and status class
+func measureOrigin(t http.RoundTripper) http.RoundTripper {
+	return originTransport{next: t}
+}
+
+func (t originTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&metrics.originInFlight, 1)
+	defer atomic.AddInt64(&metrics.originInFlight, -1)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	elapsed := time.Since(start).Seconds()
+
+	status := "error"
+	if err == nil {
+		status = statusClass(resp.StatusCode)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	labels := originLabels{host: metrics.host(r.URL.Host), status: status}
+	if metrics.origins[labels] == nil {
+		metrics.origins[labels] = &histogram{}
+	}
+	metrics.origins[labels].observe(elapsed)
+
+	return resp, err
+}
+
+// serveMetrics writes the metrics and the size of cache in the prometheus
+// text format
+func serveMetrics(w http.ResponseWriter, cache *httpcache.IndexedCache) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metric(w, "httpcache_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(w, "httpcache_requests_in_flight %d\n", atomic.LoadInt64(&metrics.inFlight))
+	metric(w, "httpcache_origin_requests_in_flight", "gauge", "Requests being made to origins.")
+	fmt.Fprintf(w, "httpcache_origin_requests_in_flight %d\n", atomic.LoadInt64(&metrics.originInFlight))
+
+	keys, _ := cache.Len()
+	metric(w, "httpcache_cache_entries", "gauge", "Keys stored in the cache since it started, or recovered from -index-file.")
+	fmt.Fprintf(w, "httpcache_cache_entries %d\n", keys)
+	if stats, ok := httpcache.Stats(cache); ok {
+		metric(w, "httpcache_cache_bytes", "gauge", "Bytes stored in the cache.")
+		fmt.Fprintf(w, "httpcache_cache_bytes %d\n", stats.Bytes)
+		if stats.MaxBytes > 0 {
+			metric(w, "httpcache_cache_max_bytes", "gauge", "The most bytes the cache stores before evicting resources.")
+			fmt.Fprintf(w, "httpcache_cache_max_bytes %d\n", stats.MaxBytes)
+		}
+		metric(w, "httpcache_cache_evictions_total", "counter", "Resources evicted from the cache to stay within its size limit, by eviction policy.")
+		fmt.Fprintf(w, "httpcache_cache_evictions_total{policy=%q} %d\n", stats.EvictionPolicy, stats.Evictions)
+		metric(w, "httpcache_cache_admission_rejections_total", "counter", "New resources not stored by the TinyLFU admission policy.")
+		fmt.Fprintf(w, "httpcache_cache_admission_rejections_total %d\n", stats.Rejections)
+	}
+	if sweepInterval > 0 {
+		metric(w, "httpcache_sweep_removed_total", "counter", "Expired resources removed by the sweeper.")
+		fmt.Fprintf(w, "httpcache_sweep_removed_total %d\n", atomic.LoadInt64(&metrics.swept))
+		metric(w, "httpcache_sweep_reclaimed_bytes_total", "counter", "Bytes reclaimed by the sweeper.")
+		fmt.Fprintf(w, "httpcache_sweep_reclaimed_bytes_total %d\n", atomic.LoadInt64(&metrics.sweptBytes))
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	requests := []requestLabels{}
+	for labels := range metrics.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		if a.cache != b.cache {
+			return a.cache < b.cache
+		}
+		return a.status < b.status
+	})
+
+	metric(w, "httpcache_requests_total", "counter", "Requests served, by host, cache result and status class.")
+	for _, labels := range requests {
+		fmt.Fprintf(w, "httpcache_requests_total{host=%s,cache=%s,status=%s} %d\n",
+			labelValue(labels.host), labelValue(labels.cache), labelValue(labels.status), metrics.requests[labels])
+	}
+
+	origins := []originLabels{}
+	for labels := range metrics.origins {
+		origins = append(origins, labels)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		a, b := origins[i], origins[j]
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		return a.status < b.status
+	})
+
+	metric(w, "httpcache_origin_request_duration_seconds", "histogram", "Latency of requests to origins, by origin host and status class.")
+	for _, labels := range origins {
+		h := metrics.origins[labels]
+		l := fmt.Sprintf("host=%s,status=%s", labelValue(labels.host), labelValue(labels.status))
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "httpcache_origin_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", l, le, h.buckets[i])
+		}
+		fmt.Fprintf(w, "httpcache_origin_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(w, "httpcache_origin_request_duration_seconds_sum{%s} %g\n", l, h.sum)
+		fmt.Fprintf(w, "httpcache_origin_request_duration_seconds_count{%s} %d\n", l, h.count)
+	}
+}
+
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelValue quotes a label value, escaping it for the prometheus text format
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+// resetMetrics replaces the metrics with empty ones, returning a func that
+// puts the previous ones back
+func resetMetrics() func() {
+	previous := metrics
+	metrics = &registry{
+		requests: map[requestLabels]int64{},
+		origins:  map[originLabels]*histogram{},
+		hosts:    map[string]bool{},
+	}
+	return func() {
+		metrics = previous
+	}
+}
+
+// scrapeMetrics returns the lines served on /metrics, without comments
+func scrapeMetrics() []string {
+	w := httptest.NewRecorder()
+	serveMetrics(w, httpcache.NewIndexedCache(httpcache.NewMemoryCache()))
+	lines := []string{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func hasLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStatusClass(t *testing.T) {
+	for status, class := range map[int]string{
+		http.StatusOK:                  "2xx",
+		http.StatusNoContent:           "2xx",
+		http.StatusNotModified:         "3xx",
+		http.StatusNotFound:            "4xx",
+		http.StatusServiceUnavailable:  "5xx",
+		http.StatusInternalServerError: "5xx",
+	} {
+		require.Equal(t, class, statusClass(status), "%d", status)
+	}
+}
+
+func TestCacheResult(t *testing.T) {
+	for status, result := range map[string]string{
+		httpcache.CacheHit:         "hit",
+		httpcache.CacheMiss:        "miss",
+		httpcache.CacheStale:       "stale",
+		httpcache.CacheRevalidated: "revalidated",
+		"":                         "bypass",
+		"SKIP":                     "bypass",
+	} {
+		h := http.Header{}
+		if status != "" {
+			h.Set(httpcache.CacheHeader, status)
+		}
+		require.Equal(t, result, cacheResult(h), status)
+	}
+}
+
+func TestMetricsHostLabel(t *testing.T) {
+	defer resetMetrics()()
+
+	require.Equal(t, "llamas.example.org", metrics.host("Llamas.Example.org:8080"))
+	require.Equal(t, "llamas.example.org", metrics.host("llamas.example.org"))
+
+	// hosts past the limit are labelled other, hosts already seen keep
+	// their own label
+	for i := 1; i < maxHosts; i++ {
+		require.Equal(t, fmt.Sprintf("host%d", i), metrics.host(fmt.Sprintf("host%d", i)))
+	}
+	require.Equal(t, "other", metrics.host("alpacas.example.org"))
+	require.Equal(t, "other", metrics.host("alpacas.example.org:8080"))
+	require.Equal(t, "llamas.example.org", metrics.host("llamas.example.org"))
+	require.Equal(t, maxHosts, len(metrics.hosts))
+}
+
+func TestCountRequests(t *testing.T) {
+	defer resetMetrics()()
+
+	handler := countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hit":
+			w.Header().Set(httpcache.CacheHeader, httpcache.CacheHit)
+			w.Write([]byte("llamas"))
+		case "/missing":
+			w.Header().Set(httpcache.CacheHeader, httpcache.CacheMiss)
+			w.WriteHeader(http.StatusNotFound)
+		}
+		// /empty writes nothing, which is a 200
+	}))
+
+	for _, path := range []string{"/hit", "/hit", "/missing", "/empty"} {
+		r := httptest.NewRequest("GET", "http://llamas.example.org"+path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("GET", "http://alpacas.example.org/hit", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	lines := scrapeMetrics()
+	for _, line := range []string{
+		`httpcache_requests_in_flight 0`,
+		`httpcache_requests_total{host="alpacas.example.org",cache="hit",status="2xx"} 1`,
+		`httpcache_requests_total{host="llamas.example.org",cache="bypass",status="2xx"} 1`,
+		`httpcache_requests_total{host="llamas.example.org",cache="hit",status="2xx"} 2`,
+		`httpcache_requests_total{host="llamas.example.org",cache="miss",status="4xx"} 1`,
+	} {
+		require.True(t, hasLine(lines, line), "%s not in\n%s", line, strings.Join(lines, "\n"))
+	}
+
+	// series are sorted by their labels
+	var series []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "httpcache_requests_total{") {
+			series = append(series, line)
+		}
+	}
+	require.Equal(t, 4, len(series))
+	require.True(t, strings.Contains(series[0], "alpacas.example.org"))
+}
+
+func TestMeasureOrigin(t *testing.T) {
+	defer resetMetrics()()
+
+	transport := measureOrigin(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/error" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+	for _, path := range []string{"/", "/", "/error"} {
+		transport.RoundTrip(httptest.NewRequest("GET", "http://origin.example.org:8080"+path, nil))
+	}
+
+	lines := scrapeMetrics()
+	for _, line := range []string{
+		`httpcache_origin_requests_in_flight 0`,
+		`httpcache_origin_request_duration_seconds_bucket{host="origin.example.org",status="2xx",le="10"} 2`,
+		`httpcache_origin_request_duration_seconds_bucket{host="origin.example.org",status="2xx",le="+Inf"} 2`,
+		`httpcache_origin_request_duration_seconds_count{host="origin.example.org",status="2xx"} 2`,
+		`httpcache_origin_request_duration_seconds_count{host="origin.example.org",status="error"} 1`,
+	} {
+		require.True(t, hasLine(lines, line), "%s not in\n%s", line, strings.Join(lines, "\n"))
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := &histogram{}
+	h.observe(0.003)
+	h.observe(0.2)
+	h.observe(30)
+
+	// buckets are cumulative, with the last only counted in +Inf
+	require.Equal(t, int64(1), h.buckets[0])
+	require.Equal(t, int64(1), h.buckets[4])
+	require.Equal(t, int64(2), h.buckets[5])
+	require.Equal(t, int64(2), h.buckets[len(latencyBuckets)-1])
+	require.Equal(t, int64(3), h.count)
+	require.InDelta(t, 30.203, h.sum, 1e-9)
+}
+
+func TestLabelValue(t *testing.T) {
+	require.Equal(t, `"llamas"`, labelValue("llamas"))
+	require.Equal(t, `"a\"b\\c\nd"`, labelValue("a\"b\\c\nd"))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// mitmMaxCerts is how many generated certificates are kept, beyond
+	// which the least recently used are forgotten
+	mitmMaxCerts = 1000
+	// mitmCertRate is how many certificates can be generated a second, with
+	// bursts of up to mitmCertBurst, as the hosts they are generated for are
+	// chosen by clients
+	mitmCertRate  = 10
+	mitmCertBurst = 50
+)
+
+// errTooManyCerts fails handshakes that would generate certificates faster
+// than mitmCertRate
+var errTooManyCerts = errors.New("generating too many certificates")
+
+// mitmProxy intercepts CONNECT tunnels, terminating TLS with certificates
+// signed by a local CA so that the decrypted requests can be served by a
+// caching handler. Other requests are passed to next.
+type mitmProxy struct {
+	ca      tls.Certificate
+	caCert  *x509.Certificate
+	handler http.Handler
+	next    http.Handler
+
+	sync.Mutex
+	// certs are the generated certificates by host, and lru their hosts
+	// from the most recently used
+	certs map[string]*list.Element
+	lru   *list.List
+	// tokens are how many certificates can be generated right now, as of
+	// refilled
+	tokens   float64
+	refilled time.Time
+}
+
+// mitmCert is a generated certificate in the lru of a mitmProxy
+type mitmCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+// newMITMProxy loads the CA certificate and key used to sign certificates
+// for intercepted hosts
+func newMITMProxy(certFile, keyFile string, handler, next http.Handler) (*mitmProxy, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	return &mitmProxy{
+		ca:      ca,
+		caCert:  caCert,
+		handler: handler,
+		next:    next,
+		certs:   map[string]*list.Element{},
+		lru:     list.New(),
+		tokens:  mitmCertBurst,
+	}, nil
+}
+
+func (p *mitmProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		p.next.ServeHTTP(w, r)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be intercepted", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("error hijacking connection for %s: %s", r.Host, err.Error())
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	connectHost := r.Host
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host, _, _ = net.SplitHostPort(connectHost)
+			}
+			return p.certificate(host)
+		},
+	})
+
+	p.serveTunnel(tlsConn, connectHost)
+}
+
+// serveTunnel serves the decrypted requests in a tunnel until it is closed
+func (p *mitmProxy) serveTunnel(conn net.Conn, connectHost string) {
+	l := &tunnelListener{conn: conn, done: make(chan struct{})}
+	server := &http.Server{
+		MaxHeaderBytes: maxHeader,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if r.URL.Host == "" {
+				r.URL.Host = connectHost
+			}
+			p.handler.ServeHTTP(w, r)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	server.Serve(l)
+}
+
+// certificate returns a certificate for host signed by the CA, generating
+// it the first time that host is seen
+func (p *mitmProxy) certificate(host string) (*tls.Certificate, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if el, ok := p.certs[host]; ok {
+		if cert := el.Value.(*mitmCert).cert; time.Now().Before(cert.Leaf.NotAfter) {
+			p.lru.MoveToFront(el)
+			return cert, nil
+		}
+	}
+	if !p.allowCert() {
+		log.Printf("not generating a certificate for %s, too many have been generated recently", host)
+		return nil, errTooManyCerts
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(7 * 24 * time.Hour)
+	if notAfter.After(p.caCert.NotAfter) {
+		notAfter = p.caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		log.Printf("generated certificate for %s", host)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, p.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	p.remember(host, cert)
+	return cert, nil
+}
+
+// allowCert returns whether a certificate can be generated without
+// exceeding mitmCertRate, taking a token if it can. It must be called with
+// the lock held.
+func (p *mitmProxy) allowCert() bool {
+	now := time.Now()
+	p.tokens += now.Sub(p.refilled).Seconds() * mitmCertRate
+	if p.tokens > mitmCertBurst {
+		p.tokens = mitmCertBurst
+	}
+	p.refilled = now
+
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// remember keeps the certificate for host, forgetting the least recently
+// used certificates beyond mitmMaxCerts. It must be called with the lock
+// held.
+func (p *mitmProxy) remember(host string, cert *tls.Certificate) {
+	if el, ok := p.certs[host]; ok {
+		p.lru.Remove(el)
+	}
+	p.certs[host] = p.lru.PushFront(&mitmCert{host: host, cert: cert})
+
+	for p.lru.Len() > mitmMaxCerts {
+		oldest := p.lru.Remove(p.lru.Back()).(*mitmCert)
+		delete(p.certs, oldest.host)
+	}
+}
+
+// tunnelListener is a net.Listener that accepts a single connection and
+// blocks further calls to Accept until it is closed
+type tunnelListener struct {
+	conn     net.Conn
+	accepted bool
+	once     sync.Once
+	done     chan struct{}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCA writes a CA certificate and key to dir, returning their paths
+// and the certificate
+func newTestCA(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpcache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
+
+func newTestMITMProxy(t *testing.T) (*mitmProxy, *x509.Certificate, func()) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	certFile, keyFile, ca := newTestCA(t, dir)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "intercepted %s", r.URL)
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "passed %s", r.URL)
+	})
+	p, err := newMITMProxy(certFile, keyFile, handler, next)
+	require.NoError(t, err)
+	return p, ca, func() { os.RemoveAll(dir) }
+}
+
+func TestMITMProxyInterceptsConnect(t *testing.T) {
+	p, ca, cleanup := newTestMITMProxy(t)
+	defer cleanup()
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxyURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	for _, host := range []string{"llamas.example", "alpacas.example", "llamas.example"} {
+		resp, err := client.Get("https://" + host + "/path?q=1")
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, "intercepted https://"+host+"/path?q=1", string(b))
+
+		// the minted leaf is for the requested host and chains to the CA
+		leaf := resp.TLS.PeerCertificates[0]
+		require.Equal(t, []string{host}, leaf.DNSNames)
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(p.certs))
+
+	// requests that aren't tunnels are passed on
+	resp, err := http.Get(server.URL + "/llamas")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "passed /llamas", string(b))
+}
+
+func TestMITMProxyCertificateCache(t *testing.T) {
+	p, _, cleanup := newTestMITMProxy(t)
+	defer cleanup()
+
+	leaf := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+	for i := 0; i < mitmMaxCerts; i++ {
+		p.remember(fmt.Sprintf("host-%d.example", i), &tls.Certificate{Leaf: leaf})
+	}
+
+	// using a certificate keeps it over those used less recently
+	cert, err := p.certificate("host-0.example")
+	require.NoError(t, err)
+	require.Equal(t, leaf, cert.Leaf)
+	_, err = p.certificate("llamas.example")
+	require.NoError(t, err)
+	require.Equal(t, mitmMaxCerts, len(p.certs))
+	require.Equal(t, mitmMaxCerts, p.lru.Len())
+	_, ok := p.certs["host-0.example"]
+	require.True(t, ok)
+	_, ok = p.certs["host-1.example"]
+	require.False(t, ok)
+
+	// certificates aren't generated faster than the rate limit
+	p.tokens = 0
+	_, err = p.certificate("alpacas.example")
+	require.Equal(t, errTooManyCerts, err)
+	_, err = p.certificate("llamas.example")
+	require.NoError(t, err)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newProxy returns the proxy to upstream selected by -origin or -upstream
+func newProxy(transport http.RoundTripper) (http.Handler, error) {
+	if origin != "" {
+		if upstream != defaultUpstream {
+			return nil, fmt.Errorf("-origin and -upstream can't be used together")
+		}
+		pool, err := newOriginPool("origin", splitOrigins(origin), balance, transport)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -origin: %s", err.Error())
+		}
+		return pool, nil
+	}
+
+	if err := checkURL(upstream); err != nil {
+		return nil, fmt.Errorf("invalid -upstream: %s", err.Error())
+	}
+	u, _ := url.Parse(upstream)
+	return newUpstreamProxy(u, newRetryTransport(measureOrigin(transport))), nil
+}
+
+// newUpstreamProxy returns a proxy that sends requests to upstream with the
+// Host header they were received with
+func newUpstreamProxy(upstream *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	return limitProxy(&httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = upstream.Scheme
+			r.URL.Host = upstream.Host
+		},
+		Transport: transport,
+	})
+}
+
+// newOriginProxy returns a reverse proxy to a single origin, which receives
+// requests as if they were made to it directly. The Host header is
+// rewritten to the origin's and the original is passed in X-Forwarded-Host.
+func newOriginProxy(origin *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(origin)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			r.Header.Set("X-Forwarded-Proto", "http")
+		}
+		director(r)
+		r.Host = origin.Host
+	}
+	proxy.Transport = transport
+	return limitProxy(proxy)
+}
+
+// newForwardProxy returns a proxy that sends requests to the host in their url
+func newForwardProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return limitProxy(&httputil.ReverseProxy{
+		Director:  func(r *http.Request) {},
+		Transport: transport,
+	})
+}
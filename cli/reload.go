@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/lox/httpcache"
+)
+
+// reloadableFlags can be changed by reloading the config file, changes to
+// any other flags require a restart
+var reloadableFlags = map[string]bool{
+	"upstream":                      true,
+	"origin":                        true,
+	"balance":                       true,
+	"retries":                       true,
+	"retry-backoff":                 true,
+	"retry-max-backoff":             true,
+	"error-pages":                   true,
+	"breaker-threshold":             true,
+	"breaker-min-requests":          true,
+	"breaker-window":                true,
+	"breaker-open-time":             true,
+	"health-path":                   true,
+	"health-interval":               true,
+	"health-healthy-threshold":      true,
+	"health-unhealthy-threshold":    true,
+	"upstream-ca":                   true,
+	"upstream-cert":                 true,
+	"upstream-key":                  true,
+	"upstream-insecure-skip-verify": true,
+	"upstream-h2c":                  true,
+	"private":                       true,
+	"serve-stale-on-error":          true,
+	"offline":                       true,
+	"serve-stale":                   true,
+	"maintenance":                   true,
+	"maintenance-page":              true,
+	"ttl-rules":                     true,
+	"cache-methods":                 true,
+	"authorization":                 true,
+	"partition-header":              true,
+	"never-cache":                   true,
+	"esi":                           true,
+	"cookie-rules":                  true,
+	"header-rules":                  true,
+	"rewrites":                      true,
+	"strip-query":                   true,
+	"strip-query-upstream":          true,
+	"key-rules":                     true,
+	"min-ttl":                       true,
+	"max-ttl":                       true,
+	"negative-ttl":                  true,
+	"vary-ignore":                   true,
+	"normalize-accept-encoding":     true,
+	"store-gzip":                    true,
+	"gzip-responses":                true,
+	"gzip-types":                    true,
+	"gzip-min-size":                 true,
+	"cache-partial":                 true,
+	"buffer-dir":                    true,
+	"max-object-size":               true,
+	"max-request-body":              true,
+	"max-response-size":             true,
+	"heuristic-percent":             true,
+	"heuristic-max":                 true,
+	"force-cache":                   true,
+	"force-cache-hosts":             true,
+	"revalidate-workers":            true,
+	"write-behind-bytes":            true,
+	"write-behind-workers":          true,
+	"purge-acl":                     true,
+	"peers":                         true,
+	"peer-self":                     true,
+	"v":                             true,
+	"dumphttp":                      true,
+	"dumphttp-redact":               true,
+	"dumphttp-dir":                  true,
+	"dumphttp-keep":                 true,
+	"dumphttp-har":                  true,
+	"mitm":                          true,
+	"ca-cert":                       true,
+	"ca-key":                        true,
+}
+
+// reloadHandler serves requests with the most recently loaded handler, so
+// that it can be replaced without interrupting requests in flight
+type reloadHandler struct {
+	handler atomic.Value
+
+	// mu serializes changes to the flags
+	mu sync.Mutex
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// reloadOnSignal reloads the config file whenever a SIGHUP is received
+func (h *reloadHandler) reloadOnSignal(cache httpcache.Cache) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		if err := h.reload(cache); err != nil {
+			log.Printf("error reloading config: %s", err.Error())
+		}
+	}
+}
+
+// reload re-reads the config file and replaces the handler, keeping the
+// existing cache. Flags that aren't reloadable keep their current values.
+func (h *reloadHandler) reload(cache httpcache.Cache) error {
+	if config == "" {
+		return errors.New("no -config file to reload")
+	}
+	log.Printf("reloading config from %s", config)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	before := flagValues()
+	beforeHosts, beforeRoutes, beforeResponses := hostRoutes, pathRoutes, syntheticResponses
+
+	// keys removed from the config file revert to their defaults
+	for _, name := range configKeys {
+		if f := flag.Lookup(name); f != nil && !cmdlineFlags[name] {
+			f.Value.Set(f.DefValue)
+		}
+	}
+
+	if err := loadConfig(config); err != nil {
+		setFlagValues(before)
+		hostRoutes, pathRoutes, syntheticResponses = beforeHosts, beforeRoutes, beforeResponses
+		return err
+	}
+
+	for name, value := range flagValues() {
+		if value != before[name] && !reloadableFlags[name] {
+			log.Printf("ignoring change to -%s, which requires a restart", name)
+			flag.Lookup(name).Value.Set(before[name])
+		}
+	}
+
+	handler, err := newHandler(cache)
+	if err != nil {
+		setFlagValues(before)
+		hostRoutes, pathRoutes, syntheticResponses = beforeHosts, beforeRoutes, beforeResponses
+		return err
+	}
+
+	httpcache.DebugLogging = verbose
+	h.handler.Store(handler)
+	activatePools()
+	return nil
+}
+
+// setFlags changes reloadable flags at runtime and replaces the handler,
+// leaving the flags unchanged if any value is invalid. The changes last until
+// the config file is next reloaded.
+func (h *reloadHandler) setFlags(cache httpcache.Cache, values map[string]string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag -%s", name)
+		}
+		if !reloadableFlags[name] {
+			return fmt.Errorf("-%s can't be changed without a restart", name)
+		}
+	}
+
+	before := flagValues()
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			setFlagValues(before)
+			return fmt.Errorf("invalid value %q for -%s: %s", value, name, err.Error())
+		}
+	}
+
+	handler, err := newHandler(cache)
+	if err != nil {
+		setFlagValues(before)
+		return err
+	}
+
+	for name, value := range values {
+		log.Printf("set -%s to %q", name, value)
+	}
+	httpcache.DebugLogging = verbose
+	h.handler.Store(handler)
+	activatePools()
+	return nil
+}
+
+// flags returns the current value of every flag
+func (h *reloadHandler) flags() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return flagValues()
+}
+
+// hasHostRoute returns whether requests for host are routed to their own
+// cache namespace
+func (h *reloadHandler) hasHostRoute(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := hostRoutes[strings.ToLower(host)]
+	return ok
+}
+
+func flagValues() map[string]string {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+func setFlagValues(values map[string]string) {
+	for name, value := range values {
+		flag.Lookup(name).Value.Set(value)
+	}
+}
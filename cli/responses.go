@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/lox/httpcache"
+	"gopkg.in/yaml.v3"
+)
+
+// syntheticResponses are read from the responses section of the config
+// file, served without reaching origins
+var syntheticResponses = []httpcache.SyntheticResponse{}
+
+// loadSyntheticResponses reads a list of responses, each with a path
+// pattern like /robots.txt and an optional host pattern, status, headers,
+// and a body or a file that is read as it is loaded, with a Content-Type
+// from its extension unless the headers have one
+func loadSyntheticResponses(path string, n *yaml.Node) error {
+	if n.Kind != yaml.SequenceNode {
+		return configError(path, n, "responses", "expected a list of responses")
+	}
+
+	for i, v := range n.Content {
+		prefix := fmt.Sprintf("responses.%d.", i)
+		if err := checkConfigKeys(path, prefix, v, "host", "path", "status", "headers", "body", "file"); err != nil {
+			return err
+		}
+
+		var r struct {
+			Host    string            `yaml:"host"`
+			Path    string            `yaml:"path"`
+			Status  int               `yaml:"status"`
+			Headers map[string]string `yaml:"headers"`
+			Body    *string           `yaml:"body"`
+			File    string            `yaml:"file"`
+		}
+		if err := v.Decode(&r); err != nil {
+			return configError(path, v, strings.TrimSuffix(prefix, "."), err.Error())
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return configError(path, v, prefix+"path", "expected a path starting with /")
+		}
+		if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+			return configError(path, v, prefix+"status", fmt.Sprintf("invalid status %d", r.Status))
+		}
+
+		s := httpcache.SyntheticResponse{Host: r.Host, Path: r.Path, Status: r.Status, Header: http.Header{}}
+		for key, value := range r.Headers {
+			s.Header.Set(key, value)
+		}
+		switch {
+		case r.Body != nil && r.File != "":
+			return configError(path, v, prefix+"file", "expected a body or a file, not both")
+		case r.Body != nil:
+			s.Body = []byte(*r.Body)
+		case r.File != "":
+			b, err := ioutil.ReadFile(r.File)
+			if err != nil {
+				return configError(path, v, prefix+"file", err.Error())
+			}
+			s.Body = b
+			if s.Header.Get("Content-Type") == "" {
+				if ctype := mime.TypeByExtension(filepath.Ext(r.File)); ctype != "" {
+					s.Header.Set("Content-Type", ctype)
+				}
+			}
+		}
+		syntheticResponses = append(syntheticResponses, s)
+	}
+	return nil
+}
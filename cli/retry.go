@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// retryMethods are safe to send to upstream more than once. PUT and DELETE
+// are idempotent too, but a request that failed may still have been acted on
+// and changed what a retry would do, such as by a conflicting write.
+var retryMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+}
+
+// retryableStatus are the responses from upstream that are worth retrying
+var retryableStatus = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// retryTransport retries GET, HEAD and OPTIONS requests that fail with a
+// connection error or a 502, 503 or 504, waiting an exponentially increasing time with
+// jitter between attempts
+type retryTransport struct {
+	next       http.RoundTripper
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// newRetryTransport wraps t to retry failed requests up to -retries times
+func newRetryTransport(t http.RoundTripper) http.RoundTripper {
+	if retries <= 0 {
+		return t
+	}
+	return &retryTransport{
+		next:       t,
+		retries:    retries,
+		backoff:    retryBackoff,
+		maxBackoff: retryMaxBackoff,
+	}
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// requests with a body can't be replayed
+	if !retryMethods[r.Method] || (r.Body != nil && r.Body != http.NoBody) {
+		return t.next.RoundTrip(r)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(r)
+		if attempt >= t.retries || (err == nil && !retryableStatus[resp.StatusCode]) || r.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+
+		wait := t.wait(attempt)
+		log.Printf("retrying %s %s in %s after %s", r.Method, r.URL.String(), wait, reason)
+
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// wait returns a random duration up to the backoff for an attempt, which
+// doubles with each attempt up to maxBackoff
+func (t *retryTransport) wait(attempt int) time.Duration {
+	backoff := t.backoff
+	for i := 0; i < attempt && backoff < t.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > t.maxBackoff {
+		backoff = t.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
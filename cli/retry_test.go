@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingTransport fails every request with status, or a connection error
+// if status is 0, counting the attempts
+func failingTransport(status int, attempts *int) roundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		*attempts++
+		if status == 0 {
+			return nil, errors.New("connection refused")
+		}
+		w := httptest.NewRecorder()
+		w.WriteHeader(status)
+		return w.Result(), nil
+	}
+}
+
+func TestRetryTransportRetries(t *testing.T) {
+	for _, test := range []struct {
+		method   string
+		body     string
+		status   int
+		attempts int
+	}{
+		{"GET", "", 0, 3},
+		{"GET", "", http.StatusBadGateway, 3},
+		{"HEAD", "", http.StatusServiceUnavailable, 3},
+		{"OPTIONS", "", http.StatusGatewayTimeout, 3},
+		// responses that aren't worth retrying are returned as they are
+		{"GET", "", http.StatusInternalServerError, 1},
+		{"GET", "", http.StatusNotFound, 1},
+		// as are requests that may not be safe to repeat
+		{"PUT", "", http.StatusBadGateway, 1},
+		{"DELETE", "", http.StatusBadGateway, 1},
+		{"POST", "", 0, 1},
+		{"GET", "llamas", http.StatusBadGateway, 1},
+	} {
+		var attempts int
+		transport := &retryTransport{next: failingTransport(test.status, &attempts), retries: 2}
+		r := httptest.NewRequest(test.method, "http://example.com/", nil)
+		if test.body != "" {
+			r = httptest.NewRequest(test.method, "http://example.com/", strings.NewReader(test.body))
+		}
+
+		resp, err := transport.RoundTrip(r)
+		if test.status == 0 {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, test.status, resp.StatusCode)
+		}
+		require.Equal(t, test.attempts, attempts, "%s with status %d", test.method, test.status)
+	}
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	transport := &retryTransport{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			wait := transport.wait(attempt)
+			require.True(t, wait >= max/2 && wait <= max, "attempt %d waited %s, expected up to %s", attempt, wait, max)
+		}
+	}
+
+	transport.backoff = 0
+	require.Equal(t, time.Duration(0), transport.wait(3))
+}
+
+func TestRetryTransportStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts int
+	transport := &retryTransport{
+		next: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			cancel()
+			return nil, r.Context().Err()
+		}),
+		retries: 5,
+	}
+	_, err := transport.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, attempts)
+
+	// or while waiting to retry
+	ctx, cancel = context.WithCancel(context.Background())
+	attempts = 0
+	transport = &retryTransport{next: failingTransport(http.StatusBadGateway, &attempts), retries: 5, backoff: time.Hour, maxBackoff: time.Hour}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = transport.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, attempts)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lox/httpcache"
+)
+
+// parseRewrites parses a comma separated list of rules such as
+// "^/v1/(.*)$ -> /api/$1" that rewrite the paths of requests matching a
+// regular expression, or "^/old/(.*)$ -> /new/$1 301" that redirect them
+// with a 301 or 302, optionally followed by host= with a pattern for the
+// hosts that the rule applies to. Expressions can't contain commas.
+func parseRewrites(rules string) ([]httpcache.RewriteRule, error) {
+	parsed := []httpcache.RewriteRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || fields[1] != "->" {
+			return nil, fmt.Errorf("invalid rule %q, expected a regular expression -> replacement", entry)
+		}
+
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", fields[0], err.Error())
+		}
+		rule := httpcache.RewriteRule{Pattern: re, Replacement: fields[2]}
+
+		for _, field := range fields[3:] {
+			switch {
+			case field == "301":
+				rule.Redirect = http.StatusMovedPermanently
+			case field == "302":
+				rule.Redirect = http.StatusFound
+			case strings.HasPrefix(field, "host=") && field != "host=":
+				rule.Host = strings.TrimPrefix(field, "host=")
+			default:
+				return nil, fmt.Errorf("invalid rule %q, unknown option %q", entry, field)
+			}
+		}
+		if rule.Redirect == 0 && !strings.HasPrefix(rule.Replacement, "/") {
+			return nil, fmt.Errorf("invalid rule %q, rewrites must replace the path with one starting with /", entry)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
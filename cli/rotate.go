@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is appended to the path of rotated files, sorting in the
+// order they were rotated
+const rotatedSuffix = ".2006-01-02T15-04-05.000"
+
+// rotatingFile is a file that is rotated once it grows beyond maxSize bytes
+// or has been written to for longer than interval, keeping the newest keep
+// rotated files
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+
+	sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openRotatingFile opens or creates the file at path to append to. A zero
+// maxSize or interval disables rotating by size or by time.
+func openRotatingFile(path string, maxSize int64, interval time.Duration, keep int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize) ||
+		(r.interval > 0 && time.Since(r.opened) >= r.interval)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file aside and opens a new one, removing the
+// oldest rotated files beyond keep, callers must hold the lock
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.path+time.Now().Format(rotatedSuffix)); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	rotated, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(rotated)
+	for len(rotated) > r.keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close closes the current file
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
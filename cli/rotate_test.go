@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRotatingFile(t *testing.T, maxSize int64, interval time.Duration, keep int) (*rotatingFile, func()) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	r, err := openRotatingFile(filepath.Join(dir, "logs", "access.log"), maxSize, interval, keep)
+	require.NoError(t, err)
+	return r, func() {
+		r.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// rotatedFiles returns the contents of the rotated files, oldest first
+func rotatedFiles(t *testing.T, r *rotatingFile) []string {
+	paths, err := filepath.Glob(r.path + ".*")
+	require.NoError(t, err)
+	sort.Strings(paths)
+	contents := []string{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func currentFile(t *testing.T, r *rotatingFile) string {
+	b, err := ioutil.ReadFile(r.path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// write writes s, waiting for the clock to move on so that files rotated
+// by consecutive writes are named apart
+func write(t *testing.T, r *rotatingFile, s string) {
+	time.Sleep(2 * time.Millisecond)
+	_, err := r.Write([]byte(s))
+	require.NoError(t, err)
+}
+
+func TestRotatingFileRotatesAtSize(t *testing.T) {
+	r, cleanup := newTestRotatingFile(t, 12, 0, 2)
+	defer cleanup()
+
+	write(t, r, "llamas\n")
+	write(t, r, "abc\n")
+	require.Equal(t, "llamas\nabc\n", currentFile(t, r))
+	require.Equal(t, []string{}, rotatedFiles(t, r))
+
+	// a write that takes the file past maxSize goes in a new file
+	write(t, r, "alpacas\n")
+	require.Equal(t, "alpacas\n", currentFile(t, r))
+	require.Equal(t, []string{"llamas\nabc\n"}, rotatedFiles(t, r))
+
+	// a write larger than maxSize still goes in one file
+	write(t, r, "vicuñas and guanacos\n")
+	require.Equal(t, "vicuñas and guanacos\n", currentFile(t, r))
+	require.Equal(t, []string{"llamas\nabc\n", "alpacas\n"}, rotatedFiles(t, r))
+
+	// only the newest keep rotated files are kept
+	write(t, r, "camels\n")
+	require.Equal(t, "camels\n", currentFile(t, r))
+	require.Equal(t, []string{"alpacas\n", "vicuñas and guanacos\n"}, rotatedFiles(t, r))
+}
+
+func TestRotatingFileRotatesAtAge(t *testing.T) {
+	r, cleanup := newTestRotatingFile(t, 0, time.Hour, 5)
+	defer cleanup()
+
+	write(t, r, "llamas\n")
+	write(t, r, "alpacas\n")
+	require.Equal(t, []string{}, rotatedFiles(t, r))
+
+	r.opened = r.opened.Add(-time.Hour)
+	write(t, r, "camels\n")
+	require.Equal(t, "camels\n", currentFile(t, r))
+	require.Equal(t, []string{"llamas\nalpacas\n"}, rotatedFiles(t, r))
+
+	// the new file is only as old as the rotation
+	write(t, r, "vicuñas\n")
+	require.Equal(t, "camels\nvicuñas\n", currentFile(t, r))
+	require.Equal(t, 1, len(rotatedFiles(t, r)))
+}
+
+func TestRotatingFileAppendsToExistingFile(t *testing.T) {
+	r, cleanup := newTestRotatingFile(t, 20, 0, 2)
+	defer cleanup()
+
+	write(t, r, "llamas\n")
+	require.NoError(t, r.Close())
+
+	// the size of an existing file counts towards maxSize
+	r, err := openRotatingFile(r.path, 20, 0, 2)
+	require.NoError(t, err)
+	write(t, r, "alpacas\n")
+	require.Equal(t, "llamas\nalpacas\n", currentFile(t, r))
+	write(t, r, "camels\n")
+	require.Equal(t, "camels\n", currentFile(t, r))
+	require.Equal(t, []string{"llamas\nalpacas\n"}, rotatedFiles(t, r))
+	require.NoError(t, r.Close())
+}
+
+func TestRotatingFileNeverRotatesEmptyFiles(t *testing.T) {
+	r, cleanup := newTestRotatingFile(t, 5, time.Hour, 2)
+	defer cleanup()
+
+	r.opened = r.opened.Add(-2 * time.Hour)
+	write(t, r, "llamas and alpacas\n")
+	require.Equal(t, "llamas and alpacas\n", currentFile(t, r))
+	require.Equal(t, []string{}, rotatedFiles(t, r))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lox/httpcache"
+	"gopkg.in/yaml.v3"
+)
+
+// route configures the origin that a set of requests are proxied to, which
+// may be a pool of replicas
+type route struct {
+	Origins []string          `yaml:"-"`
+	Balance string            `yaml:"balance"`
+	TLS     upstreamTLSConfig `yaml:"tls"`
+	TTL     time.Duration     `yaml:"-"`
+}
+
+// pathRoute is a route for requests with a path starting with Prefix
+type pathRoute struct {
+	Prefix string
+	route
+}
+
+var (
+	// hostRoutes are read from the hosts section of the config file, keyed
+	// by lower case hostname
+	hostRoutes = map[string]route{}
+
+	// pathRoutes are read from the routes section of the config file, with
+	// the longest prefixes first
+	pathRoutes = []pathRoute{}
+)
+
+// loadRoute reads the origin, balance, tls and ttl keys of a route, where
+// origin is a url or a list of replicas
+func loadRoute(path, prefix string, n *yaml.Node, extra ...string) (route, error) {
+	var r route
+
+	if err := checkConfigKeys(path, prefix, n, append(extra, "origin", "balance", "tls", "ttl")...); err != nil {
+		return r, err
+	}
+	r.Balance = roundRobin
+	if err := n.Decode(&r); err != nil {
+		return r, configError(path, n, strings.TrimSuffix(prefix, "."), err.Error())
+	}
+	if err := checkBalance(r.Balance); err != nil {
+		return r, configError(path, n, prefix+"balance", err.Error())
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		switch k.Value {
+		case "origin":
+			if err := v.Decode(&r.Origins); err != nil {
+				var origin string
+				v.Decode(&origin)
+				r.Origins = splitOrigins(origin)
+			}
+			for _, origin := range r.Origins {
+				if err := checkURL(origin); err != nil {
+					return r, configError(path, v, prefix+"origin", err.Error())
+				}
+			}
+		case "tls":
+			if err := checkConfigKeys(path, prefix+"tls.", v,
+				"ca", "cert", "key", "insecure-skip-verify", "h2c"); err != nil {
+				return r, err
+			}
+		case "ttl":
+			ttl, err := time.ParseDuration(v.Value)
+			if err != nil {
+				return r, configError(path, v, prefix+"ttl", err.Error())
+			}
+			r.TTL = ttl
+		}
+	}
+
+	if len(r.Origins) == 0 {
+		return r, configError(path, n, prefix+"origin", "an origin is required")
+	}
+	return r, nil
+}
+
+// loadHostRoutes reads a mapping of hostnames to routes
+func loadHostRoutes(path string, n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return configError(path, n, "hosts", "expected a mapping of hostnames")
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+
+		r, err := loadRoute(path, "hosts."+k.Value+".", v)
+		if err != nil {
+			return err
+		}
+		hostRoutes[strings.ToLower(k.Value)] = r
+	}
+
+	return nil
+}
+
+// loadPathRoutes reads a list of routes, each with a path prefix like /api/
+// or /api/*
+func loadPathRoutes(path string, n *yaml.Node) error {
+	if n.Kind != yaml.SequenceNode {
+		return configError(path, n, "routes", "expected a list of routes")
+	}
+
+	for i, v := range n.Content {
+		prefix := fmt.Sprintf("routes.%d.", i)
+
+		r, err := loadRoute(path, prefix, v, "path")
+		if err != nil {
+			return err
+		}
+
+		var p struct {
+			Path string `yaml:"path"`
+		}
+		v.Decode(&p)
+		if !strings.HasPrefix(p.Path, "/") {
+			return configError(path, v, prefix+"path", "expected a path starting with /")
+		}
+
+		pathRoutes = append(pathRoutes, pathRoute{
+			Prefix: strings.TrimSuffix(p.Path, "*"),
+			route:  r,
+		})
+	}
+
+	sort.SliceStable(pathRoutes, func(i, j int) bool {
+		return len(pathRoutes[i].Prefix) > len(pathRoutes[j].Prefix)
+	})
+	return nil
+}
+
+// newRouteHandler returns a caching handler that proxies to the origin of r
+func newRouteHandler(name string, cache httpcache.Cache, r route) (http.Handler, error) {
+	transport, err := newUpstreamTransport(r.TLS)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newOriginPool(name, r.Origins, r.Balance, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := newCacheHandler(cache, proxy)
+	if err != nil {
+		return nil, err
+	}
+	handler.TTL = r.TTL
+	return handler, nil
+}
+
+// hostRouter passes requests to a handler chosen by their Host header,
+// falling back to next for hosts without a route
+type hostRouter struct {
+	hosts map[string]http.Handler
+	next  http.Handler
+}
+
+// newHostRouter returns a router for hostRoutes, where each host has its
+// own caching handler and namespace within cache
+func newHostRouter(cache httpcache.Cache, next http.Handler) (*hostRouter, error) {
+	router := &hostRouter{hosts: map[string]http.Handler{}, next: next}
+
+	for host, r := range hostRoutes {
+		handler, err := newRouteHandler("hosts."+host, httpcache.NewNamespacedCache(host+"/", cache), r)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %s", host, err.Error())
+		}
+
+		log.Printf("routing requests for %s to %s", host, strings.Join(r.Origins, ", "))
+		router.hosts[host] = handler
+	}
+
+	return router, nil
+}
+
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	if handler, ok := h.hosts[host]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// pathRouter passes requests to the handler for the longest matching path
+// prefix, falling back to next for paths without a route
+type pathRouter struct {
+	prefixes []string
+	handlers []http.Handler
+	next     http.Handler
+}
+
+// newPathRouter returns a router for pathRoutes
+func newPathRouter(cache httpcache.Cache, next http.Handler) (*pathRouter, error) {
+	router := &pathRouter{next: next}
+
+	for _, r := range pathRoutes {
+		handler, err := newRouteHandler("routes."+r.Prefix, cache, r.route)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %s", r.Prefix, err.Error())
+		}
+
+		log.Printf("routing requests for %s* to %s", r.Prefix, strings.Join(r.Origins, ", "))
+		router.prefixes = append(router.prefixes, r.Prefix)
+		router.handlers = append(router.handlers, handler)
+	}
+
+	return router, nil
+}
+
+func (p *pathRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i, prefix := range p.prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			p.handlers[i].ServeHTTP(w, r)
+			return
+		}
+	}
+	p.next.ServeHTTP(w, r)
+}
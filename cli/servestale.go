@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/lox/httpcache"
+)
+
+// toggleServeStaleOnSignal turns -serve-stale on or off whenever a SIGUSR1
+// is received, until the config file is next reloaded
+func (h *reloadHandler) toggleServeStaleOnSignal(cache httpcache.Cache) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	for range c {
+		on, _ := strconv.ParseBool(h.flags()["serve-stale"])
+		if err := h.setFlags(cache, map[string]string{"serve-stale": strconv.FormatBool(!on)}); err != nil {
+			log.Printf("error toggling -serve-stale: %s", err.Error())
+		}
+	}
+}
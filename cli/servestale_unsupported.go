@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "github.com/lox/httpcache"
+
+// toggleServeStaleOnSignal does nothing without SIGUSR1, -serve-stale can
+// still be toggled with the admin api
+func (h *reloadHandler) toggleServeStaleOnSignal(cache httpcache.Cache) {}
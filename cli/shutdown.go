@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lox/httpcache"
+)
+
+// shutdownOnSignal shuts the servers down gracefully on SIGTERM or SIGINT,
+// giving requests in flight and pending cache writes up to -shutdown-timeout
+// to finish before saving -stats-file and closing the cache. The returned
+// channel is closed once the shutdown is complete.
+func shutdownOnSignal(cache *httpcache.IndexedCache, servers ...*http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-c
+		log.Printf("received %s, shutting down within %s", sig, shutdownTimeout)
+
+		// a second signal stops waiting
+		signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown(ctx, cache, servers)
+		close(done)
+	}()
+
+	return done
+}
+
+func shutdown(ctx context.Context, cache *httpcache.IndexedCache, servers []*http.Server) {
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error draining requests to %s: %s", server.Addr, err.Error())
+		}
+	}
+
+	written := make(chan struct{})
+	go func() {
+		httpcache.Writes.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		log.Printf("gave up waiting for cache writes to finish")
+	}
+
+	if statsFile != "" {
+		if err := saveStats(cache); err != nil {
+			log.Printf("error saving stats: %s", err.Error())
+		}
+	}
+
+	if err := cache.Close(); err != nil {
+		log.Printf("error closing cache: %s", err.Error())
+	}
+	if accessLogFile != nil {
+		accessLogFile.Close()
+	}
+	log.Printf("shut down")
+}
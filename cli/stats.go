@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lox/httpcache"
+)
+
+// topHosts is how many of the busiest hosts are shown in stats
+const topHosts = 10
+
+// statsInterval is how often stats are saved to -stats-file
+const statsInterval = time.Minute
+
+// cacheStats are shown on the admin api's /stats, saved to -stats-file and
+// printed by the stats command. Hits are requests served from the cache,
+// whether fresh, stale or revalidated.
+type cacheStats struct {
+	Keys      int         `json:"keys"`
+	Tags      int         `json:"tags"`
+	Bytes     int64       `json:"bytes,omitempty"`
+	MaxBytes  int64       `json:"max_bytes,omitempty"`
+	Evictions int64       `json:"evictions,omitempty"`
+	Eviction  string      `json:"eviction_policy,omitempty"`
+	Rejected  int64       `json:"admission_rejections,omitempty"`
+	Requests  int64       `json:"requests"`
+	Hits      int64       `json:"hits"`
+	HitRatio  float64     `json:"hit_ratio"`
+	Hosts     []hostStats `json:"hosts"`
+	Uptime    string      `json:"uptime"`
+	Time      time.Time   `json:"time"`
+}
+
+type hostStats struct {
+	Host     string  `json:"host"`
+	Requests int64   `json:"requests"`
+	Hits     int64   `json:"hits"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+func ratio(hits, requests int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(hits) / float64(requests)
+}
+
+// collectStats returns the stats of cache and of the requests counted in
+// metrics, with the busiest hosts first
+func collectStats(cache *httpcache.IndexedCache) cacheStats {
+	stats := cacheStats{
+		Uptime: time.Since(started).Round(time.Second).String(),
+		Time:   time.Now(),
+		Hosts:  []hostStats{},
+	}
+	stats.Keys, stats.Tags = cache.Len()
+	if s, ok := httpcache.Stats(cache); ok {
+		stats.Bytes, stats.MaxBytes = s.Bytes, s.MaxBytes
+		stats.Evictions, stats.Eviction = s.Evictions, s.EvictionPolicy
+		stats.Rejected = s.Rejections
+	}
+
+	metrics.Lock()
+	hosts := map[string]*hostStats{}
+	for labels, count := range metrics.requests {
+		h := hosts[labels.host]
+		if h == nil {
+			h = &hostStats{Host: labels.host}
+			hosts[labels.host] = h
+		}
+		h.Requests += count
+		if labels.cache != "miss" && labels.cache != "bypass" {
+			h.Hits += count
+		}
+	}
+	metrics.Unlock()
+
+	for _, h := range hosts {
+		h.HitRatio = ratio(h.Hits, h.Requests)
+		stats.Requests += h.Requests
+		stats.Hits += h.Hits
+		stats.Hosts = append(stats.Hosts, *h)
+	}
+	stats.HitRatio = ratio(stats.Hits, stats.Requests)
+
+	sort.Slice(stats.Hosts, func(i, j int) bool {
+		a, b := stats.Hosts[i], stats.Hosts[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Host < b.Host
+	})
+	if len(stats.Hosts) > topHosts {
+		stats.Hosts = stats.Hosts[:topHosts]
+	}
+	return stats
+}
+
+// saveStatsEvery saves the stats of cache to -stats-file every interval
+func saveStatsEvery(cache *httpcache.IndexedCache, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveStats(cache); err != nil {
+			log.Printf("error saving stats: %s", err.Error())
+		}
+	}
+}
+
+// saveStats writes the stats of cache to -stats-file, replacing it
+// atomically so that the stats command never reads a partial file
+func saveStats(cache *httpcache.IndexedCache) error {
+	b, err := json.MarshalIndent(collectStats(cache), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(statsFile), filepath.Base(statsFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), statsFile)
+}
+
+// statsCommand prints the stats of the running instance from its admin api,
+// or those last saved to -stats-file
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the stats as json")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] stats [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var stats cacheStats
+	switch {
+	case adminListen != "":
+		if err := adminRequest("GET", "/stats", nil, &stats); err != nil {
+			return err
+		}
+	case statsFile != "":
+		b, err := ioutil.ReadFile(statsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &stats); err != nil {
+			return fmt.Errorf("invalid -stats-file %s: %s", statsFile, err.Error())
+		}
+	default:
+		return fmt.Errorf("stats requires -admin-listen or -stats-file")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "uptime\t%s\n", stats.Uptime)
+	fmt.Fprintf(w, "requests\t%d\n", stats.Requests)
+	fmt.Fprintf(w, "hit ratio\t%.1f%%\n", stats.HitRatio*100)
+	fmt.Fprintf(w, "entries\t%d\n", stats.Keys)
+	fmt.Fprintf(w, "bytes\t%d\n", stats.Bytes)
+	if stats.MaxBytes > 0 {
+		fmt.Fprintf(w, "max bytes\t%d\n", stats.MaxBytes)
+	}
+	fmt.Fprintf(w, "evictions\t%d\n", stats.Evictions)
+	if stats.Eviction != "" {
+		fmt.Fprintf(w, "eviction policy\t%s\n", stats.Eviction)
+	}
+	if stats.Rejected > 0 {
+		fmt.Fprintf(w, "admission rejections\t%d\n", stats.Rejected)
+	}
+	if statsFile != "" && adminListen == "" {
+		fmt.Fprintf(w, "saved\t%s\n", stats.Time.Format(time.RFC3339))
+	}
+	if len(stats.Hosts) > 0 {
+		fmt.Fprintf(w, "\nhost\trequests\thit ratio\n")
+		for _, h := range stats.Hosts {
+			fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", h.Host, h.Requests, h.HitRatio*100)
+		}
+	}
+	return w.Flush()
+}
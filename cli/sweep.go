@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lox/httpcache"
+)
+
+// sweepEvery removes expired resources from cache every interval, counting
+// them and the bytes reclaimed in metrics
+func sweepEvery(cache *httpcache.IndexedCache, interval, grace time.Duration) {
+	if _, ok := httpcache.Sweep(cache, grace); !ok {
+		log.Printf("-sweep-interval isn't supported by the cache backend")
+		return
+	}
+	for range time.Tick(interval) {
+		t := time.Now()
+		stats, _ := httpcache.Sweep(cache, grace)
+		atomic.AddInt64(&metrics.swept, int64(stats.Removed))
+		atomic.AddInt64(&metrics.sweptBytes, stats.Bytes)
+		if stats.Removed > 0 {
+			log.Printf("swept %d expired resources, reclaiming %d bytes in %s", stats.Removed, stats.Bytes, time.Since(t))
+		}
+	}
+}
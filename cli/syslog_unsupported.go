@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// newSyslogWriter fails, as syslog isn't available on this platform
+func newSyslogWriter(facility, tag string) (io.Writer, error) {
+	return nil, errors.New("-log-syslog isn't supported on this platform")
+}
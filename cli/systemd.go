@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+var (
+	activated     map[string]net.Listener
+	activatedErr  error
+	activatedOnce sync.Once
+)
+
+// listenSocket returns the socket passed by systemd socket activation for
+// name, or listens on addr if there isn't one, returning nil if addr is
+// empty. A socket with a FileDescriptorName of admin serves the admin api,
+// and the first other socket serves -listen.
+func listenSocket(name, addr string) (net.Listener, error) {
+	activatedOnce.Do(func() {
+		activated, activatedErr = systemdListeners()
+	})
+	if activatedErr != nil {
+		return nil, activatedErr
+	}
+	if l, ok := activated[name]; ok {
+		log.Printf("using the %s socket %s passed by systemd", name, l.Addr())
+		return l, nil
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// systemdListeners returns the sockets passed in LISTEN_FDS, by whether
+// they serve the admin api or -listen
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the sockets aren't meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		name := "listen"
+		if i < len(names) && names[i] == "admin" {
+			name = "admin"
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %s", listenFDsStart+i, err.Error())
+		}
+
+		if _, ok := listeners[name]; ok {
+			log.Printf("ignoring extra %s socket %s passed by systemd", name, l.Addr())
+			l.Close()
+			continue
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
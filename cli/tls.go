@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// clientCNHeader is set on requests to the common name of the client
+// certificate when -tls-client-ca is used, so that upstream can vary
+// responses by client
+const clientCNHeader = "X-Client-Cn"
+
+// serve accepts connections on the server, terminating TLS if -tls-cert
+// and -tls-key or -acme are set
+func serve(server *http.Server) error {
+	server.Protocols = &http.Protocols{}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(http2)
+	server.Protocols.SetUnencryptedHTTP2(h2c)
+
+	if acme {
+		return serveACME(server)
+	}
+	if tlsCert == "" && tlsKey == "" {
+		if tlsCA != "" {
+			return fmt.Errorf("-tls-client-ca requires -tls-cert and -tls-key or -acme")
+		}
+		l, err := listenServer(server)
+		if err != nil {
+			return err
+		}
+		log.Printf("listening on http://%s", l.Addr())
+		return server.Serve(l)
+	}
+	if tlsCert == "" || tlsKey == "" {
+		return fmt.Errorf("-tls-cert and -tls-key must be used together")
+	}
+
+	server.TLSConfig = &tls.Config{}
+	if err := setClientCA(server.TLSConfig, tls.RequireAndVerifyClientCert); err != nil {
+		return err
+	}
+
+	l, err := listenServer(server)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on https://%s", l.Addr())
+	return server.ServeTLS(l, tlsCert, tlsKey)
+}
+
+// listenServer returns the socket to serve -listen on
+func listenServer(server *http.Server) (net.Listener, error) {
+	l, err := listenSocket("listen", server.Addr)
+	if err == nil && l == nil {
+		err = fmt.Errorf("-listen is required")
+	}
+	return l, err
+}
+
+// setClientCA configures verification of client certificates against
+// -tls-client-ca, if it is set
+func setClientCA(config *tls.Config, auth tls.ClientAuthType) error {
+	if tlsCA == "" {
+		return nil
+	}
+	pool, err := loadCertPool(tlsCA)
+	if err != nil {
+		return err
+	}
+	log.Printf("requiring client certificates signed by %s", tlsCA)
+	config.ClientCAs = pool
+	config.ClientAuth = auth
+	return nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// withClientCN rejects requests without a verified client certificate when
+// -tls-client-ca is set, and passes the certificate's common name upstream
+func withClientCN(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(clientCNHeader)
+		if tlsCA != "" {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				http.Error(w, "client certificate required", http.StatusForbidden)
+				return
+			}
+			r.Header.Set(clientCNHeader, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveACME serves https with certificates that are obtained and renewed
+// automatically from let's encrypt
+func serveACME(server *http.Server) error {
+	if tlsCert != "" || tlsKey != "" {
+		return fmt.Errorf("-acme can't be used with -tls-cert or -tls-key")
+	}
+	if acmeHosts == "" {
+		return fmt.Errorf("-acme requires -acme-hosts")
+	}
+
+	certDir := acmeDir
+	if certDir == "" {
+		certDir = filepath.Join(dir, "acme")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(acmeHosts, ",")...),
+		Cache:      autocert.DirCache(certDir),
+		Email:      acmeEmail,
+	}
+
+	if acmeHTTP != "" {
+		log.Printf("answering acme challenges on http://%s", acmeHTTP)
+		go func() {
+			log.Fatal(http.ListenAndServe(acmeHTTP, m.HTTPHandler(nil)))
+		}()
+	}
+
+	server.TLSConfig = m.TLSConfig()
+
+	// let's encrypt won't present a client certificate when validating
+	// tls-alpn-01 challenges, so they're enforced by withClientCN instead
+	if err := setClientCA(server.TLSConfig, tls.VerifyClientCertIfGiven); err != nil {
+		return err
+	}
+
+	l, err := listenServer(server)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on https://%s, storing certificates for %s in %s", l.Addr(), acmeHosts, certDir)
+	return server.ServeTLS(l, "", "")
+}
+
+// upstreamTLSConfig configures the connections made to an upstream
+type upstreamTLSConfig struct {
+	// CA is a pem encoded bundle to verify certificates with, instead of the
+	// system roots
+	CA string `yaml:"ca"`
+	// Cert and Key are a pem encoded client certificate and key to present
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// InsecureSkipVerify disables verification of certificates
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify"`
+	// H2C speaks HTTP/2 without TLS to http upstreams
+	H2C bool `yaml:"h2c"`
+}
+
+// newUpstreamTransport returns a transport for requests to an upstream
+func newUpstreamTransport(c upstreamTLSConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+
+	if c.CA != "" {
+		pool, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, fmt.Errorf("an upstream client certificate and key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.H2C {
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	if c.InsecureSkipVerify {
+		log.Printf("WARNING: not verifying upstream certificates, " +
+			"which should only be done for testing")
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lox/httpcache"
+)
+
+// parseTTLRules parses a comma separated list of rules such as
+// "example.com/api/* ttl=30s" or "*.cdn.net/* ttl=7d if-missing", where the
+// pattern is a host and path, or a path alone to match any host
+func parseTTLRules(rules string) ([]httpcache.TTLRule, error) {
+	parsed := []httpcache.TTLRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule := httpcache.TTLRule{Path: fields[0]}
+		if i := strings.Index(fields[0], "/"); i != 0 {
+			if i == -1 {
+				return nil, fmt.Errorf("invalid rule %q, expected a pattern of host/path or /path", entry)
+			}
+			rule.Host, rule.Path = fields[0][:i], fields[0][i:]
+		}
+
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "ttl="):
+				ttl, err := parseTTL(strings.TrimPrefix(field, "ttl="))
+				if err != nil {
+					return nil, fmt.Errorf("invalid rule %q: %s", entry, err.Error())
+				}
+				rule.TTL = ttl
+			case field == "if-missing":
+				rule.IfMissing = true
+			default:
+				return nil, fmt.Errorf("invalid rule %q, unknown option %q", entry, field)
+			}
+		}
+		if rule.TTL <= 0 {
+			return nil, fmt.Errorf("invalid rule %q, a ttl is required", entry)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// parseTTL parses a duration such as 30s or 1h, or a number of days such
+// as 7d
+func parseTTL(v string) (time.Duration, error) {
+	if strings.HasSuffix(v, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid ttl %q", v)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// varyRule ignores some Vary headers for hosts matching a pattern
+type varyRule struct {
+	host    string
+	headers []string
+}
+
+// parseVaryIgnore parses a comma separated list of rules such as
+// "* User-Agent" or "*.example.com Cookie Accept-Language", each a host
+// pattern followed by the Vary headers to ignore for matching hosts,
+// returning a function that gives the headers to ignore for a request
+func parseVaryIgnore(rules string) (func(r *http.Request) []string, error) {
+	parsed := []varyRule{}
+	for _, entry := range strings.Split(rules, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("invalid rule %q, expected a host pattern and headers", entry)
+		}
+		pattern := strings.ToLower(fields[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", fields[0])
+		}
+		parsed = append(parsed, varyRule{host: pattern, headers: fields[1:]})
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+
+	return func(r *http.Request) []string {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		headers := []string{}
+		for _, rule := range parsed {
+			if ok, _ := path.Match(rule.host, host); ok {
+				headers = append(headers, rule.headers...)
+			}
+		}
+		return headers
+	}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readURLs reads a list of urls, one per line, skipping blank lines and
+// comments starting with #
+func readURLs(path string) ([]*url.URL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	urls := []*url.URL{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		u, err := url.Parse(text)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("%s:%d: expected an absolute url, got %q", path, line, text)
+		}
+		urls = append(urls, u)
+	}
+	return urls, scanner.Err()
+}
+
+// warmUp requests every url in -warmup through handler, at most
+// -warmup-concurrency at a time, so that they are cached before the proxy
+// takes traffic
+func warmUp(handler http.Handler, path string, concurrency int) error {
+	urls, err := readURLs(path)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	log.Printf("warming up the cache with %d urls from %s", len(urls), path)
+	start := time.Now()
+
+	var failed int64
+	var wg sync.WaitGroup
+	queue := make(chan *url.URL)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				if status := warmURL(handler, u); status >= 400 {
+					log.Printf("warming up %s failed with %d", u, status)
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Printf("warmed up %d of %d urls in %s", len(urls)-int(failed), len(urls),
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// warmURL makes a GET request for u through handler as a client of the proxy
+// would, discarding the response and returning its status
+func warmURL(handler http.Handler, u *url.URL) int {
+	path := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if path.Path == "" {
+		path.Path = "/"
+	}
+	req, err := http.NewRequest("GET", path.String(), nil)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	req.Host = u.Host
+	req.RemoteAddr = "127.0.0.1:0"
+
+	w := &discardWriter{header: http.Header{}}
+	handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// discardWriter is a ResponseWriter that discards the body of a response
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,85 @@
+package httpcache
+
+import (
+	"net/http"
+	"sync"
+)
+
+// flightGroup tracks the requests that are being fetched from upstream after
+// a cache miss, so that concurrent requests for the same key can wait for
+// the first one rather than all going upstream
+type flightGroup struct {
+	sync.Mutex
+	flights map[string]chan struct{}
+}
+
+// join returns a channel that is closed when the fetch of key finishes, and
+// whether the caller is the leader that must fetch it and call finish
+func (g *flightGroup) join(key string) (<-chan struct{}, bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.flights == nil {
+		g.flights = map[string]chan struct{}{}
+	}
+	if done, ok := g.flights[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	g.flights[key] = done
+	return done, true
+}
+
+// finish wakes the requests waiting on the fetch of key
+func (g *flightGroup) finish(key string) {
+	g.Lock()
+	defer g.Unlock()
+
+	if done, ok := g.flights[key]; ok {
+		close(done)
+		delete(g.flights, key)
+	}
+}
+
+// passUpstreamOnce fetches a missing resource from upstream, unless the same
+// key is already being fetched, in which case it waits for that fetch and
+// returns the resource it stored for the caller to serve. It returns nil once
+// a response has been written.
+func (h *Handler) passUpstreamOnce(w http.ResponseWriter, r *cacheRequest) *Resource {
+	key := r.Key.String()
+	done, leader := h.flights.join(key)
+
+	if leader {
+		// deferred, as passUpstream panics if upstream aborts the response
+		var stored <-chan struct{}
+		defer func() {
+			if stored == nil {
+				h.flights.finish(key)
+				return
+			}
+			go func() {
+				<-stored
+				h.flights.finish(key)
+			}()
+		}()
+		stored = h.passUpstream(w, r, "not in cache")
+		return nil
+	}
+
+	debugf("waiting for %s to be fetched by another request", key)
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return nil
+	}
+
+	// the leader may still be closing the resource it served, which is safe
+	// as the cache opens and closes the files of a key under its lock
+	res, err := h.lookup(r)
+	if err != nil {
+		debugf("%s wasn't cached by the request it waited for", key)
+		h.passUpstream(w, r, "not stored by a concurrent request")
+		return nil
+	}
+	return res
+}
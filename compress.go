@@ -0,0 +1,78 @@
+package httpcache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// gzipLengthHeader is stored with the headers of resources in vfs caches
+// whose bodies are stored compressed, holding their uncompressed length
+const gzipLengthHeader = "X-Httpcache-Body-Gzip-Length"
+
+// DefaultCompressTypes are the content types that compress well, for
+// DiskCacheConfig.CompressTypes
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// compressible returns whether to compress a body with headers h at rest,
+// which is those with a Content-Type in types, or matching a type such as
+// text/*, that don't already have a Content-Encoding
+func compressible(types []string, h http.Header) bool {
+	if len(types) == 0 || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipReadSeeker decompresses a gzip compressed file of a known uncompressed
+// length, seeking by decompressing it again from the start
+type gzipReadSeeker struct {
+	*rangeReader
+	f ReadSeekCloser
+}
+
+func newGzipReadSeeker(f ReadSeekCloser, length int64) *gzipReadSeeker {
+	var zr *gzip.Reader
+	open := func(offset int64) (io.ReadCloser, error) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var err error
+		if zr == nil {
+			zr, err = gzip.NewReader(f)
+		} else {
+			err = zr.Reset(f)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, zr, offset); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(zr), nil
+	}
+	return &gzipReadSeeker{rangeReader: newRangeReader(nil, length, open), f: f}
+}
+
+func (r *gzipReadSeeker) Close() error {
+	r.rangeReader.Close()
+	return r.f.Close()
+}
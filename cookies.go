@@ -0,0 +1,49 @@
+package httpcache
+
+import "net/http"
+
+// CookieRule changes how requests whose Host and path match its patterns,
+// in which * matches anything, are cached by the cookies they carry
+type CookieRule struct {
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+
+	// Bypass are patterns for the names of cookies, such as the session
+	// cookies of logged in users, that make requests carrying them bypass
+	// the cache
+	Bypass []string
+
+	// Strip removes the cookies of requests before they are keyed or passed
+	// upstream, and Set-Cookie from the responses to them that are stored,
+	// so that static assets are cached regardless of cookies
+	Strip bool
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule CookieRule) Matches(r *http.Request) bool {
+	return matchHostPath(rule.Host, rule.Path, r)
+}
+
+// applyCookieRules applies the first of the CookieRules that matches a
+// request, before it is keyed
+func (h *Handler) applyCookieRules(r *cacheRequest) {
+	for _, rule := range h.CookieRules {
+		if !rule.Matches(r.Request) {
+			continue
+		}
+		for _, c := range r.Cookies() {
+			if matchesAny(rule.Bypass, c.Name) {
+				r.bypassCookie = c.Name
+				return
+			}
+		}
+		if rule.Strip && len(r.Header["Cookie"]) > 0 {
+			debugf("stripping cookies from request for %s", r.URL.String())
+			r.Header.Del("Cookie")
+			r.strippedCookies = true
+		}
+		return
+	}
+}
@@ -0,0 +1,83 @@
+package httpcache
+
+import pathutil "path"
+
+// blobID identifies the content of a stored body, which also depends on
+// whether it is stored compressed
+func blobID(body storedBody) string {
+	if body.gzipLength >= 0 {
+		return body.sum + ".gz"
+	}
+	return body.sum
+}
+
+// rememberBlob records that the body at path has the content of body, if no
+// other body with it is known
+func (c *cache) rememberBlob(path string, body storedBody) {
+	if c.link == nil || body.sum == "" {
+		return
+	}
+	c.blobsMu.Lock()
+	defer c.blobsMu.Unlock()
+
+	id := blobID(body)
+	if _, ok := c.blobs[id]; ok {
+		return
+	}
+	// the body at path may have had other content before
+	if old, ok := c.blobPaths[path]; ok && c.blobs[old] == path {
+		delete(c.blobs, old)
+	}
+	c.blobs[id] = path
+	c.blobPaths[path] = id
+}
+
+// forgetBlob forgets the body at path, which has been removed or replaced
+func (c *cache) forgetBlob(path string) {
+	if c.link == nil {
+		return
+	}
+	c.blobsMu.Lock()
+	defer c.blobsMu.Unlock()
+
+	if id, ok := c.blobPaths[path]; ok {
+		delete(c.blobPaths, path)
+		if c.blobs[id] == path {
+			delete(c.blobs, id)
+		}
+	}
+}
+
+// dedupe replaces the body just written to path with a link to a stored
+// body with the same content, if one is known, so that it is only stored
+// once. Known bodies that have since changed are forgotten.
+func (c *cache) dedupe(path string, body storedBody) {
+	if c.link == nil {
+		return
+	}
+	id := blobID(body)
+
+	c.blobsMu.Lock()
+	existing, ok := c.blobs[id]
+	c.blobsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	if c.linkBlob(existing, path, body) {
+		debugf("linked body %s to %s with the same content", path, existing)
+		return
+	}
+	c.forgetBlob(existing)
+}
+
+// linkBlob links path to the body at existing if it still has the content
+// of body, from the checksum stored with its header
+func (c *cache) linkBlob(existing, path string, body storedBody) bool {
+	hash := pathutil.Base(existing)
+	unlock := c.locks.lock(hash)
+	defer unlock()
+
+	_, stored, err := c.readStoredHeader(headerPrefix + formatPrefix + hash)
+	return err == nil && blobID(stored) == blobID(body) && c.link(existing, path) == nil
+}
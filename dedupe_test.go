@@ -0,0 +1,50 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskCacheForgetsEvictedBodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewLimitedDiskCache(dir, 4096, 0)
+	require.NoError(t, err)
+	c := cache.(*diskCache)
+	if c.link == nil {
+		t.Skip("bodies aren't deduplicated without hard links")
+	}
+	blobs := func() map[string]string {
+		c.blobsMu.Lock()
+		defer c.blobsMu.Unlock()
+		require.Equal(t, len(c.blobs), len(c.blobPaths))
+		blobs := map[string]string{}
+		for id, path := range c.blobs {
+			blobs[id] = path
+		}
+		return blobs
+	}
+
+	body := []byte(strings.Repeat("llamas", 100))
+	for _, key := range []string{"llamas", "alpacas"} {
+		require.NoError(t, cache.Store(NewResourceBytes(http.StatusOK, body, http.Header{}), key))
+	}
+	require.Equal(t, 1, len(blobs()))
+
+	// the deduplicated body is evicted to make room for another, and is
+	// forgotten with it
+	other := []byte(strings.Repeat("vicunas", 500))
+	require.NoError(t, cache.Store(NewResourceBytes(http.StatusOK, other, http.Header{}), "vicunas"))
+	_, err = cache.Retrieve("llamas")
+	require.Equal(t, ErrNotFoundInCache, err)
+	require.Equal(t, map[string]string{
+		blobID(storedBody{sum: hashKey(string(other)), gzipLength: -1}): bodyPrefix + formatPrefix + hashKey("vicunas"),
+	}, blobs())
+}
@@ -0,0 +1,438 @@
+package httpcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy is the order that a size limited disk cache evicts
+// resources in once it grows beyond its max size
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used resources first
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used resources first, counting
+	// uses since the cache was opened and breaking ties by recency
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictFIFO evicts the resources stored longest ago first, however
+	// recently they have been used
+	EvictFIFO EvictionPolicy = "fifo"
+	// EvictSize evicts the resources with the largest size multiplied by
+	// the time since they were last used first, so that a large resource
+	// goes before many small ones that were used as long ago
+	EvictSize EvictionPolicy = "size"
+)
+
+// EvictionPolicies are the policies that NewPolicyDiskCache supports
+var EvictionPolicies = []EvictionPolicy{EvictLRU, EvictLFU, EvictFIFO, EvictSize}
+
+// ParseEvictionPolicy returns the eviction policy with a name such as lru
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for _, policy := range EvictionPolicies {
+		if string(policy) == strings.ToLower(name) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// DiskCacheConfig limits the size of a disk cache
+type DiskCacheConfig struct {
+	// MaxSize is the most bytes to store before evicting resources, or 0 for
+	// no limit
+	MaxSize int64
+	// LowWater is the bytes to evict down to, which defaults to 90% of MaxSize
+	LowWater int64
+	// Eviction is the order to evict resources in, which defaults to EvictLRU
+	Eviction EvictionPolicy
+	// TinyLFU only admits new resources once the cache has filled up past
+	// LowWater if they have been requested more often recently than the
+	// next resource to be evicted, so that resources requested once, such as
+	// by crawlers, don't evict popular ones
+	TinyLFU bool
+	// VerifyChecksums reads bodies in full to check them against the
+	// checksums they were stored with before serving them, so that corrupt
+	// or truncated bodies are removed rather than served
+	VerifyChecksums bool
+	// EncryptionKey encrypts the headers and bodies of resources with AES-GCM
+	// if set, to a 16, 24 or 32 byte key. Resources that were stored without
+	// it, or with another key, are treated as not being in the cache.
+	EncryptionKey []byte
+	// CompressTypes are the content types, such as text/html or text/*, of
+	// bodies to compress with gzip, unless they already have a
+	// Content-Encoding. DefaultCompressTypes are those that compress well.
+	CompressTypes []string
+	// BloomFilter keeps a bloom filter of the keys that are stored in memory,
+	// filled from those on disk when the cache is opened, so that looking up
+	// a key that isn't stored doesn't touch the disk
+	BloomFilter bool
+}
+
+// diskCache is a disk-backed cache that evicts resources in the order of
+// its policy once it grows beyond maxSize, until it is below lowWater
+type diskCache struct {
+	*cache
+	dir      string
+	maxSize  int64
+	lowWater int64
+	policy   EvictionPolicy
+
+	sync.Mutex
+	size       int64
+	evictions  int64
+	rejections int64
+	// uses counts the retrievals of each resource by hash with EvictLFU
+	uses map[string]int64
+	// sketch estimates how often each hash has been requested with TinyLFU
+	sketch *frequencySketch
+	// victim is the hash of the next resource to be evicted, as of the last
+	// eviction
+	victim string
+}
+
+// NewLimitedDiskCache returns a disk-backed cache in dir that holds at most
+// maxSize bytes. When maxSize is exceeded, resources are evicted least
+// recently used first until the cache is below lowWater bytes, which defaults
+// to 90% of maxSize. A maxSize of 0 means no limit.
+func NewLimitedDiskCache(dir string, maxSize, lowWater int64) (Cache, error) {
+	return NewConfiguredDiskCache(dir, DiskCacheConfig{MaxSize: maxSize, LowWater: lowWater})
+}
+
+// NewPolicyDiskCache returns a disk-backed cache like NewLimitedDiskCache,
+// which evicts resources in the order of policy
+func NewPolicyDiskCache(dir string, maxSize, lowWater int64, policy EvictionPolicy) (Cache, error) {
+	return NewConfiguredDiskCache(dir, DiskCacheConfig{MaxSize: maxSize, LowWater: lowWater, Eviction: policy})
+}
+
+// NewConfiguredDiskCache returns a disk-backed cache in dir limited by config
+func NewConfiguredDiskCache(dir string, config DiskCacheConfig) (Cache, error) {
+	if config.Eviction == "" {
+		config.Eviction = EvictLRU
+	}
+	if _, err := ParseEvictionPolicy(string(config.Eviction)); err != nil {
+		return nil, err
+	}
+	cache, err := newDiskCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	cache.verify = config.VerifyChecksums
+	cache.compressTypes = config.CompressTypes
+	if config.BloomFilter {
+		cache.filter = newKeyFilter(cache.storedHashes)
+	}
+	if config.EncryptionKey != nil {
+		if _, err = newAEAD(config.EncryptionKey); err != nil {
+			return nil, err
+		}
+		cache.encryptionKey = config.EncryptionKey
+	}
+	maxSize, lowWater := config.MaxSize, config.LowWater
+	if maxSize <= 0 {
+		return cache, nil
+	}
+	if lowWater <= 0 || lowWater > maxSize {
+		lowWater = maxSize / 10 * 9
+	}
+
+	c := &diskCache{
+		cache:    cache,
+		dir:      dir,
+		maxSize:  maxSize,
+		lowWater: lowWater,
+		policy:   config.Eviction,
+		uses:     map[string]int64{},
+	}
+	if config.TinyLFU {
+		c.sketch = newFrequencySketch()
+	}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.size += f.size
+	}
+	debugf("disk cache in %s has %d bytes of %d, evicting by %s", dir, c.size, maxSize, c.policy)
+
+	return c, c.evict()
+}
+
+func (c *diskCache) headerPath(key string) string {
+	return filepath.Join(c.dir, headerPrefix+formatPrefix+hashKey(key))
+}
+
+func (c *diskCache) bodyPath(key string) string {
+	return filepath.Join(c.dir, bodyPrefix+formatPrefix+hashKey(key))
+}
+
+// Store a resource against a number of keys, evicting older resources if
+// the cache has grown too large
+func (c *diskCache) Store(res *Resource, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	c.Lock()
+	admitted := c.admit(keys[0])
+	c.Unlock()
+	if !admitted {
+		return nil
+	}
+
+	// the size is accounted while the keys are locked as they are linked to
+	// the streamed body, so that concurrent stores of the same keys don't
+	// each count the files the other replaced
+	err := c.cache.store(res, keys, func(tmp string, link func() error) error {
+		c.Lock()
+		defer c.Unlock()
+
+		tmp = filepath.Join(c.dir, filepath.FromSlash(tmp))
+		before := c.storedSize(keys, tmp)
+		err := link()
+		c.size += c.storedSize(keys, tmp) - before
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+// storedSize returns the bytes stored under keys in the same way as files
+// counts them, so that bodies linked to several keys count once, and those
+// also linked to by other keys don't count at all. Links from tmp, which is
+// about to be removed, don't count as other keys.
+func (c *diskCache) storedSize(keys []string, tmp string) int64 {
+	var size int64
+	bodies := map[fileVersion][]os.FileInfo{}
+	links := map[os.FileInfo]int{}
+	for _, key := range keys {
+		size += fileSize(c.headerPath(key))
+
+		info, err := os.Stat(c.bodyPath(key))
+		if err != nil {
+			continue
+		}
+		if !sameFileIn(bodies, info) {
+			links[info] = 0
+		}
+		for body := range links {
+			if os.SameFile(body, info) {
+				links[body]++
+			}
+		}
+	}
+	if info, err := os.Stat(tmp); err == nil {
+		for body := range links {
+			if os.SameFile(body, info) {
+				links[body]++
+			}
+		}
+	}
+	for body, n := range links {
+		if n >= linkCount(body) {
+			size += body.Size()
+		}
+	}
+	return size
+}
+
+// admit returns whether to store a resource under key. With TinyLFU, once
+// the cache has filled up past its low water mark a new resource must have
+// been requested more often recently than the next resource to be evicted.
+// It must be called with the lock held.
+func (c *diskCache) admit(key string) bool {
+	if c.sketch == nil {
+		return true
+	}
+	hash := hashKey(key)
+
+	if c.size <= c.lowWater || c.victim == "" || fileSize(c.headerPath(key)) > 0 {
+		return true
+	}
+	if freq, victimFreq := c.sketch.estimate(hash), c.sketch.estimate(c.victim); freq <= victimFreq {
+		debugf("not admitting %s to disk cache, requested %d times to %d", key, freq, victimFreq)
+		c.rejections++
+		return false
+	}
+	return true
+}
+
+// Retrieve returns a cached Resource for the given key, marking it as
+// recently used
+func (c *diskCache) Retrieve(key string) (*Resource, error) {
+	if c.sketch != nil {
+		c.Lock()
+		c.sketch.increment(hashKey(key))
+		c.Unlock()
+	}
+	res, err := c.cache.Retrieve(key)
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(c.headerPath(key), now, now)
+		if c.policy == EvictLFU {
+			c.Lock()
+			c.uses[hashKey(key)]++
+			c.Unlock()
+		}
+	}
+	return res, err
+}
+
+// Stats returns the size of the cache and how many resources it has evicted
+func (c *diskCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return CacheStats{
+		Bytes:          c.size,
+		MaxBytes:       c.maxSize,
+		Evictions:      c.evictions,
+		EvictionPolicy: string(c.policy),
+		Rejections:     c.rejections,
+	}
+}
+
+// diskFile is a resource stored in the cache. Its header is touched when
+// it is used, so the older of its files' times is when it was stored and the
+// newer is when it was last used.
+type diskFile struct {
+	hash     string
+	size     int64
+	stored   time.Time
+	accessed time.Time
+	uses     int64
+}
+
+// files returns the size and last use of each resource stored in the cache.
+// Bodies linked to by several resources are only counted in the size of one.
+func (c *diskCache) files() ([]diskFile, error) {
+	byHash := map[string]*diskFile{}
+	bodies := map[fileVersion][]os.FileInfo{}
+
+	for _, prefix := range []string{headerPrefix, bodyPrefix} {
+		matches, err := filepath.Glob(filepath.Join(c.dir, prefix+formatPrefix+"*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			hash := filepath.Base(path)
+			f, ok := byHash[hash]
+			if !ok {
+				f = &diskFile{hash: hash, stored: info.ModTime(), uses: c.uses[hash]}
+				byHash[hash] = f
+			}
+			if prefix == bodyPrefix && sameFileIn(bodies, info) {
+				continue
+			}
+			f.size += info.Size()
+			if info.ModTime().Before(f.stored) {
+				f.stored = info.ModTime()
+			}
+			if info.ModTime().After(f.accessed) {
+				f.accessed = info.ModTime()
+			}
+		}
+	}
+
+	files := []diskFile{}
+	for _, f := range byHash {
+		files = append(files, *f)
+	}
+	return files, nil
+}
+
+// evictsBefore returns whether the policy evicts a before b
+func (c *diskCache) evictsBefore(a, b diskFile, now time.Time) bool {
+	switch c.policy {
+	case EvictLFU:
+		if a.uses != b.uses {
+			return a.uses < b.uses
+		}
+	case EvictFIFO:
+		return a.stored.Before(b.stored)
+	case EvictSize:
+		return float64(a.size)*now.Sub(a.accessed).Seconds() > float64(b.size)*now.Sub(b.accessed).Seconds()
+	}
+	return a.accessed.Before(b.accessed)
+}
+
+// evict removes resources in the order of the eviction policy until the
+// cache is below the low water mark, if it has grown beyond the max size
+func (c *diskCache) evict() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.size <= c.maxSize {
+		return nil
+	}
+
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sort.Slice(files, func(i, j int) bool {
+		return c.evictsBefore(files[i], files[j], now)
+	})
+
+	c.size = 0
+	for _, f := range files {
+		c.size += f.size
+	}
+
+	c.victim = ""
+	for _, f := range files {
+		if c.size <= c.lowWater {
+			c.victim = f.hash
+			break
+		}
+		debugf("evicting %s from disk cache", f.hash)
+		os.Remove(filepath.Join(c.dir, headerPrefix+formatPrefix+f.hash))
+		os.Remove(filepath.Join(c.dir, bodyPrefix+formatPrefix+f.hash))
+		c.forgetBlob(bodyPrefix + formatPrefix + f.hash)
+		delete(c.uses, f.hash)
+		c.size -= f.size
+		c.evictions++
+	}
+
+	debugf("disk cache in %s is now %d bytes", c.dir, c.size)
+	return nil
+}
+
+// fileVersion narrows down the files that may be the same file
+type fileVersion struct {
+	size    int64
+	modTime int64
+}
+
+// sameFileIn returns whether info is the same file as one already seen,
+// adding it to seen if it isn't
+func sameFileIn(seen map[fileVersion][]os.FileInfo, info os.FileInfo) bool {
+	v := fileVersion{info.Size(), info.ModTime().UnixNano()}
+	for _, other := range seen[v] {
+		if os.SameFile(info, other) {
+			return true
+		}
+	}
+	seen[v] = append(seen[v], info)
+	return false
+}
+
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
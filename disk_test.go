@@ -0,0 +1,631 @@
+package httpcache_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewLimitedDiskCache(dir, 3000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(key string) {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(strings.Repeat(key, 800)), http.Header{})
+		require.NoError(t, cache.Store(res, key))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store("a")
+	store("b")
+	store("c")
+
+	res, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	res.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	store("d")
+
+	for key, exists := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		_, err := cache.Header(key)
+		if exists {
+			require.NoError(t, err, key)
+		} else {
+			require.Equal(t, httpcache.ErrNotFoundInCache, err, key)
+		}
+	}
+
+	// the size of existing entries is counted when reopened
+	cache, err = httpcache.NewLimitedDiskCache(dir, 1000, 950)
+	require.NoError(t, err)
+
+	_, err = cache.Header("a")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	_, err = cache.Header("d")
+	require.NoError(t, err)
+}
+
+func TestLimitedDiskCacheEvictionPolicies(t *testing.T) {
+	var cases = []struct {
+		policy    httpcache.EvictionPolicy
+		evicts    func(store func(key string, size int), retrieve func(key string))
+		exists    map[string]bool
+		evictions int64
+	}{
+		{
+			policy: httpcache.EvictFIFO,
+			evicts: func(store func(string, int), retrieve func(string)) {
+				store("a", 800)
+				store("b", 800)
+				store("c", 800)
+				retrieve("a")
+				store("d", 800)
+			},
+			exists:    map[string]bool{"a": false, "b": false, "c": true, "d": true},
+			evictions: 2,
+		},
+		{
+			policy: httpcache.EvictLFU,
+			evicts: func(store func(string, int), retrieve func(string)) {
+				store("a", 800)
+				store("b", 800)
+				store("c", 800)
+				retrieve("b")
+				retrieve("b")
+				retrieve("c")
+				store("d", 800)
+			},
+			exists:    map[string]bool{"a": false, "b": true, "c": true, "d": false},
+			evictions: 2,
+		},
+		{
+			policy: httpcache.EvictSize,
+			evicts: func(store func(string, int), retrieve func(string)) {
+				store("a", 500)
+				store("big", 1500)
+				store("b", 500)
+				store("c", 500)
+			},
+			exists:    map[string]bool{"a": true, "big": false, "b": true, "c": true},
+			evictions: 1,
+		},
+	}
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "httpcache")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		cache, err := httpcache.NewPolicyDiskCache(dir, 3000, 2000, c.policy)
+		require.NoError(t, err)
+
+		store := func(key string, size int) {
+			// bodies differ, as the same body is only stored once
+			res := httpcache.NewResourceBytes(http.StatusOK, []byte(strings.Repeat(key, size)[:size]), http.Header{})
+			require.NoError(t, cache.Store(res, key))
+			time.Sleep(10 * time.Millisecond)
+		}
+		retrieve := func(key string) {
+			res, err := cache.Retrieve(key)
+			require.NoError(t, err)
+			res.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.evicts(store, retrieve)
+
+		for key, exists := range c.exists {
+			_, err := cache.Header(key)
+			if exists {
+				require.NoError(t, err, "%s %s", c.policy, key)
+			} else {
+				require.Equal(t, httpcache.ErrNotFoundInCache, err, "%s %s", c.policy, key)
+			}
+		}
+
+		stats, ok := httpcache.Stats(cache)
+		require.True(t, ok)
+		require.Equal(t, c.evictions, stats.Evictions, string(c.policy))
+		require.Equal(t, string(c.policy), stats.EvictionPolicy)
+	}
+
+	_, err := httpcache.NewPolicyDiskCache(os.TempDir(), 3000, 2000, "random")
+	require.Error(t, err)
+}
+
+func TestLimitedDiskCacheTinyLFUAdmission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{
+		MaxSize:  3000,
+		LowWater: 2000,
+		TinyLFU:  true,
+	})
+	require.NoError(t, err)
+
+	// resources are requested, missing, before they are stored
+	request := func(key string, times int) {
+		for i := 0; i < times; i++ {
+			if res, err := cache.Retrieve(key); err == nil {
+				res.Close()
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	store := func(key string) {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(strings.Repeat(key, 800)), http.Header{})
+		require.NoError(t, cache.Store(res, key))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		request(key, 1)
+		store(key)
+	}
+	request("a", 3)
+	request("d", 1)
+	store("d")
+
+	// a is next to be evicted, and is requested more often than e and f,
+	// but e is admitted while the cache is below its low water mark
+	for _, key := range []string{"e", "f"} {
+		request(key, 1)
+		store(key)
+	}
+	request("g", 6)
+	store("g")
+
+	for key, exists := range map[string]bool{"e": true, "f": false, "g": true} {
+		_, err := cache.Header(key)
+		if exists {
+			require.NoError(t, err, key)
+		} else {
+			require.Equal(t, httpcache.ErrNotFoundInCache, err, key)
+		}
+	}
+
+	stats, ok := httpcache.Stats(cache)
+	require.True(t, ok)
+	require.Equal(t, int64(1), stats.Rejections)
+
+	// storing under no keys does nothing
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("alpacas rock"), http.Header{})
+	require.NoError(t, cache.Store(res))
+}
+
+func TestDiskCacheVerifiesChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{VerifyChecksums: true})
+	require.NoError(t, err)
+
+	for _, key := range []string{"llamas", "alpacas"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas rock"), http.Header{"Etag": {`"llamas"`}})
+		require.NoError(t, cache.Store(res, key))
+	}
+
+	res, err := cache.Retrieve("llamas")
+	require.NoError(t, err)
+	require.Equal(t, "llamas rock", readAllString(res))
+	require.Equal(t, http.Header{"Etag": {`"llamas"`}}, res.Header())
+
+	// truncate the bodies, as an interrupted write would
+	bodies, err := filepath.Glob(filepath.Join(dir, "body", "v1", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(bodies))
+	for _, body := range bodies {
+		if b, _ := ioutil.ReadFile(body); len(b) > 0 {
+			require.NoError(t, ioutil.WriteFile(body, b[:6], 0644))
+		}
+	}
+
+	for _, key := range []string{"llamas", "alpacas"} {
+		_, err = cache.Retrieve(key)
+		require.Equal(t, httpcache.ErrNotFoundInCache, err, key)
+		_, err = cache.Header(key)
+		require.Equal(t, httpcache.ErrNotFoundInCache, err, key)
+	}
+}
+
+func TestDiskCacheEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := []byte(strings.Repeat("k", 32))
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{EncryptionKey: key})
+	require.NoError(t, err)
+
+	// larger than a segment, so that reads and seeks cross segments
+	body := strings.Repeat("llamas rock ", 10000)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{"Etag": {`"llamas"`}})
+	require.NoError(t, cache.Store(res, "llamas", "alpacas"))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "v1", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(files))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.False(t, strings.Contains(string(b), "llamas"), file)
+	}
+
+	for _, key := range []string{"llamas", "alpacas"} {
+		res, err = cache.Retrieve(key)
+		require.NoError(t, err)
+		require.Equal(t, http.Header{"Etag": {`"llamas"`}}, res.Header())
+		require.Equal(t, body, readAllString(res))
+
+		_, err = res.Seek(70000, io.SeekStart)
+		require.NoError(t, err)
+		require.Equal(t, body[70000:], readAllString(res))
+	}
+
+	// resources can't be read without the key they were stored with
+	cache, err = httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{EncryptionKey: []byte(strings.Repeat("x", 32))})
+	require.NoError(t, err)
+	_, err = cache.Header("llamas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	_, err = cache.Retrieve("llamas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
+
+func TestDiskCacheEncryptedFilesCantBeSwapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{EncryptionKey: []byte(strings.Repeat("k", 32))})
+	require.NoError(t, err)
+	for _, key := range []string{"llamas", "alpacas"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key), http.Header{"Etag": {`"` + key + `"`}})
+		require.NoError(t, cache.Store(res, key))
+	}
+	path := func(kind, key string) string {
+		return filepath.Join(dir, kind, "v1", fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+	}
+	swap := func(kind string) {
+		b, err := ioutil.ReadFile(path(kind, "llamas"))
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(path(kind, "alpacas")))
+		require.NoError(t, ioutil.WriteFile(path(kind, "alpacas"), b, 0600))
+	}
+
+	// the body of another key isn't served with the headers of this one
+	swap("body")
+	_, err = cache.Retrieve("alpacas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	// nor are the headers of another key
+	swap("header")
+	_, err = cache.Header("alpacas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	res, err := cache.Retrieve("llamas")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(res))
+}
+
+func TestDiskCacheCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{
+		CompressTypes:   httpcache.DefaultCompressTypes,
+		VerifyChecksums: true,
+	})
+	require.NoError(t, err)
+
+	body := strings.Repeat("llamas rock ", 10000)
+	for _, contentType := range []string{"text/html; charset=utf-8", "image/png"} {
+		h := http.Header{"Content-Type": {contentType}}
+		require.NoError(t, cache.Store(httpcache.NewResourceBytes(http.StatusOK, []byte(body), h), contentType))
+
+		res, err := cache.Retrieve(contentType)
+		require.NoError(t, err)
+		require.Equal(t, h, res.Header())
+		require.Equal(t, body, readAllString(res))
+
+		size, err := res.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(body)), size)
+		_, err = res.Seek(70000, io.SeekStart)
+		require.NoError(t, err)
+		require.Equal(t, body[70000:], readAllString(res))
+		res.Close()
+	}
+
+	// only the html is compressed
+	bodies, err := filepath.Glob(filepath.Join(dir, "body", "v1", "*"))
+	require.NoError(t, err)
+	sizes := []int64{}
+	for _, body := range bodies {
+		info, err := os.Stat(body)
+		require.NoError(t, err)
+		sizes = append(sizes, info.Size())
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	require.Equal(t, 2, len(sizes))
+	require.True(t, sizes[0] < 1000, "compressed to %d bytes", sizes[0])
+	require.Equal(t, int64(len(body)), sizes[1])
+}
+
+func TestDiskCacheStoresBodiesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewLimitedDiskCache(dir, 1<<20, 0)
+	require.NoError(t, err)
+
+	body := strings.Repeat("llamas rock ", 100)
+	for _, key := range []string{"llamas", "alpacas"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{})
+		require.NoError(t, cache.Store(res, key))
+	}
+
+	bodies, err := filepath.Glob(filepath.Join(dir, "body", "v1", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(bodies))
+	infos := []os.FileInfo{}
+	for _, body := range bodies {
+		info, err := os.Stat(body)
+		require.NoError(t, err)
+		infos = append(infos, info)
+	}
+	require.True(t, os.SameFile(infos[0], infos[1]))
+
+	// the size of the body is only counted once
+	headers, err := filepath.Glob(filepath.Join(dir, "header", "v1", "*"))
+	require.NoError(t, err)
+	size := int64(len(body))
+	for _, header := range headers {
+		info, err := os.Stat(header)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	reopened, err := httpcache.NewLimitedDiskCache(dir, 1<<20, 0)
+	require.NoError(t, err)
+	stats, ok := httpcache.Stats(reopened)
+	require.True(t, ok)
+	require.Equal(t, size, stats.Bytes)
+
+	// storing another body doesn't change the linked ones
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas rule"), http.Header{})
+	require.NoError(t, cache.Store(res, "llamas"))
+	for key, expected := range map[string]string{"llamas": "llamas rule", "alpacas": body} {
+		res, err := cache.Retrieve(key)
+		require.NoError(t, err, key)
+		require.Equal(t, expected, readAllString(res), key)
+		res.Close()
+	}
+
+	// a body stored under several keys is written once
+	res = httpcache.NewResourceBytes(http.StatusOK, []byte("vicunas rock"), http.Header{})
+	require.NoError(t, cache.Store(res, "vicunas", "guanacos"))
+	bodies, err = filepath.Glob(filepath.Join(dir, "body", "v1", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(bodies))
+	files := []os.FileInfo{}
+	for _, body := range bodies {
+		info, err := os.Stat(body)
+		require.NoError(t, err)
+		if info.Size() == int64(len("vicunas rock")) {
+			files = append(files, info)
+		}
+	}
+	require.Equal(t, 2, len(files))
+	require.True(t, os.SameFile(files[0], files[1]))
+
+	// linked bodies are counted once as they are stored
+	stats, _ = httpcache.Stats(cache)
+	reopened, err = httpcache.NewLimitedDiskCache(dir, 1<<20, 0)
+	require.NoError(t, err)
+	reopenedStats, _ := httpcache.Stats(reopened)
+	require.Equal(t, reopenedStats.Bytes, stats.Bytes)
+}
+
+func TestDiskCacheConcurrentStoresAndRetrieves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{VerifyChecksums: true})
+	require.NoError(t, err)
+
+	store := func(body string) error {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{"X-Body": {body}})
+		return cache.Store(res, "llamas", "alpacas")
+	}
+	require.NoError(t, store("llamas"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*20*3)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := store(strings.Repeat(fmt.Sprintf("llamas-%d-%d.", i, j), 100)); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, key := range []string{"llamas", "alpacas"} {
+					res, err := cache.Retrieve(key)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					// the body is always that of the headers
+					if body := readAllString(res); body != res.Header().Get("X-Body") {
+						errs <- fmt.Errorf("%s has the body %q for the headers of %q", key, body, res.Header().Get("X-Body"))
+					}
+					res.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// pipeBody is a resource body that is written to as it is read
+type pipeBody struct {
+	*io.PipeReader
+}
+
+func (b pipeBody) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func TestLimitedDiskCacheStoresWhileAnotherBodyStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{MaxSize: 1 << 20, TinyLFU: true})
+	require.NoError(t, err)
+
+	r, w := io.Pipe()
+	streamed := make(chan error)
+	go func() {
+		streamed <- cache.Store(httpcache.NewResource(http.StatusOK, pipeBody{r}, http.Header{}), "llamas")
+	}()
+	w.Write([]byte("llamas "))
+
+	// the slow body doesn't hold up other stores and retrieves
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("alpacas"), http.Header{})
+	require.NoError(t, cache.Store(res, "alpacas"))
+	resOut, err := cache.Retrieve("alpacas")
+	require.NoError(t, err)
+	require.Equal(t, "alpacas", readAllString(resOut))
+	resOut.Close()
+
+	w.Write([]byte("rock"))
+	w.Close()
+	require.NoError(t, <-streamed)
+	resOut, err = cache.Retrieve("llamas")
+	require.NoError(t, err)
+	require.Equal(t, "llamas rock", readAllString(resOut))
+	resOut.Close()
+}
+
+func TestDiskCacheBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	unfiltered, err := httpcache.NewDiskCache(dir)
+	require.NoError(t, err)
+	store := func(cache httpcache.Cache, key string) {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key+" rock"), http.Header{})
+		require.NoError(t, cache.Store(res, key))
+	}
+	store(unfiltered, "llamas")
+
+	// keys already on disk are in the filter
+	cache, err := httpcache.NewConfiguredDiskCache(dir, httpcache.DiskCacheConfig{BloomFilter: true})
+	require.NoError(t, err)
+	res, err := cache.Retrieve("llamas")
+	require.NoError(t, err)
+	require.Equal(t, "llamas rock", readAllString(res))
+	res.Close()
+
+	// keys stored behind its back aren't looked up on disk
+	store(unfiltered, "alpacas")
+	_, err = cache.Header("alpacas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	_, err = cache.Retrieve("alpacas")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	store(cache, "alpacas")
+	_, err = cache.Header("alpacas")
+	require.NoError(t, err)
+}
+
+func TestDiskCacheServesFilesForSendfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("llamas", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Date", httpcache.Clock().Format(http.TimeFormat))
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := httpcache.NewHandler(cache, httputil.NewSingleHostReverseProxy(u))
+	handler.Shared = true
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/llamas")
+	require.NoError(t, err)
+	require.Equal(t, body, readAllString(resp.Body))
+	resp.Body.Close()
+	httpcache.Writes.Wait()
+
+	req, err := http.NewRequest("GET", server.URL+"/llamas", nil)
+	require.NoError(t, err)
+	res, err := cache.Retrieve("GET:/llamas")
+	require.NoError(t, err)
+	_, isFile := res.ReadSeekCloser.(*os.File)
+	res.Close()
+	require.True(t, isFile, "body of a plain resource on disk isn't a file")
+
+	req.Header.Set("Range", "bytes=5000-")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "HIT", resp.Header.Get(httpcache.CacheHeader))
+	require.Equal(t, body[5000:], readAllString(resp.Body))
+}
@@ -0,0 +1,268 @@
+package httpcache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// canonicalEncodings are the content codings that NormalizeAcceptEncoding
+// keeps, in order of preference
+var canonicalEncodings = []string{"br", "gzip"}
+
+// acceptedEncodings returns the q-values of the codings in an
+// Accept-Encoding header, with * standing for any other coding
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// acceptsEncoding returns whether an Accept-Encoding header allows a coding
+func acceptsEncoding(header, coding string) bool {
+	accepted := acceptedEncodings(header)
+	if q, ok := accepted[coding]; ok {
+		return q > 0
+	}
+	q, ok := accepted["*"]
+	return ok && q > 0
+}
+
+// normalizeAcceptEncoding reduces the Accept-Encoding header of a request to
+// the canonical codings that it accepts, so that the many combinations that
+// clients send are cached as a few variants. Requests that accept none of
+// them ask for identity, as no Accept-Encoding at all would allow any coding.
+func normalizeAcceptEncoding(h http.Header) {
+	header := strings.Join(h["Accept-Encoding"], ",")
+	codings := []string{}
+	for _, coding := range canonicalEncodings {
+		if acceptsEncoding(header, coding) {
+			codings = append(codings, coding)
+		}
+	}
+
+	if len(codings) == 0 {
+		codings = append(codings, "identity")
+	}
+	h.Set("Accept-Encoding", strings.Join(codings, ", "))
+}
+
+// gunzipWriter decodes gzip encoded responses as they are written, for
+// clients that don't accept gzip when responses are stored gzip encoded. Its
+// headers are kept apart from the client's, as they are stored with the
+// encoded response.
+type gunzipWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	pw          *io.PipeWriter
+	done        chan struct{}
+}
+
+func newGunzipWriter(w http.ResponseWriter) *gunzipWriter {
+	return &gunzipWriter{ResponseWriter: w, header: http.Header{}}
+}
+
+func (w *gunzipWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *gunzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		h[key] = values
+	}
+	encoded := strings.EqualFold(h.Get("Content-Encoding"), "gzip")
+	if !encoded || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	debugf("decoding gzip response for a client that doesn't accept it")
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(status)
+
+	pr, pw := io.Pipe()
+	w.pw, w.done = pw, make(chan struct{})
+	go func() {
+		defer close(w.done)
+		gz, err := gzip.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(w.ResponseWriter, gz)
+		}
+		if err != nil && err != io.EOF {
+			debugf("error decoding gzip response: %s", err.Error())
+		}
+		io.Copy(ioutil.Discard, pr)
+	}()
+}
+
+func (w *gunzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.pw != nil {
+		return w.pw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close finishes decoding the response
+func (w *gunzipWriter) Close() {
+	if w.pw != nil {
+		w.pw.Close()
+		<-w.done
+	}
+}
+
+// DefaultCompressMinSize is the smallest response that is worth compressing,
+// for Handler.CompressMinSize
+const DefaultCompressMinSize = 1024
+
+// compressUpstream wraps the upstream so that the uncompressed responses it
+// serves with one of CompressTypes are gzip encoded before they are stored
+func (h *Handler) compressUpstream(upstream http.Handler) http.Handler {
+	if len(h.CompressTypes) == 0 {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			upstream.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, types: h.CompressTypes, min: h.CompressMinSize}
+		upstream.ServeHTTP(gw, r)
+		// a panic leaves the response unfinished, as it should be
+		gw.Close()
+	})
+}
+
+// gzipWriter gzip encodes responses with compressible content types as they
+// are written, once they are known to be at least min bytes, buffering
+// their start until then if they don't have a Content-Length
+type gzipWriter struct {
+	http.ResponseWriter
+	types []string
+	min   int64
+
+	status int
+	// deciding is set while the start of a response is buffered in buf
+	deciding bool
+	buf      []byte
+	zw       *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	h := w.Header()
+	if status != http.StatusOK || !compressible(w.types, h) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		w.deciding = true
+	} else if length >= w.min {
+		w.encode()
+	} else {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// encode starts gzip encoding the response
+func (w *gzipWriter) encode() {
+	debugf("compressing response from upstream")
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	if !varies(h, "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.zw = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.deciding {
+		w.buf = append(w.buf, b...)
+		if int64(len(w.buf)) < w.min {
+			return len(b), nil
+		}
+		w.deciding = false
+		w.encode()
+		if _, err := w.zw.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+		return len(b), nil
+	}
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close writes a response too small to compress as it is, or finishes
+// encoding one
+func (w *gzipWriter) Close() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.deciding {
+		w.deciding = false
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(w.buf)
+		return err
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+// varies returns whether the Vary header of a response names a header
+func varies(h http.Header, name string) bool {
+	for _, value := range h["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
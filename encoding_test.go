@@ -0,0 +1,120 @@
+package httpcache_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeAcceptEncodingCollapsesVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Encoding"
+	client.cacheHandler.NormalizeAcceptEncoding = true
+
+	encodings := []string{}
+	upstream.assert(func(r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+	})
+
+	var cases = []struct {
+		acceptEncoding string
+		cacheStatus    string
+	}{
+		{"gzip, deflate, br", "MISS"},
+		{"br;q=0.9, gzip", "HIT"},
+		{"*", "HIT"},
+		{"gzip, deflate", "MISS"},
+		{"x-gzip, gzip;q=0.5", "HIT"},
+		{"deflate", "MISS"},
+		{"gzip;q=0, br;q=0", "HIT"},
+		{"", "HIT"},
+	}
+
+	for _, c := range cases {
+		r := client.get("/", "Accept-Encoding: "+c.acceptEncoding)
+		assert.Equal(t, c.cacheStatus, r.cacheStatus, c.acceptEncoding)
+	}
+	assert.Equal(t, []string{"br, gzip", "gzip", "identity"}, encodings)
+}
+
+func TestStoreGzipDecodesForClients(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Encoding"
+	upstream.Etag = `"llamas"`
+	upstream.Header = http.Header{"Content-Encoding": []string{"gzip"}}
+	client.cacheHandler.StoreGzip = true
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("llamas rock"))
+	gz.Close()
+	upstream.Body = buf.Bytes()
+	upstream.StatusCode = http.StatusOK
+
+	upstream.assert(func(r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+	})
+
+	r := client.get("/", "Accept-Encoding: identity")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "llamas rock", string(r.body))
+	assert.Equal(t, "", r.header.Get("Content-Encoding"))
+	assert.Equal(t, `W/"llamas"`, r.header.Get("ETag"))
+
+	r = client.get("/", "Accept-Encoding: gzip, br")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "gzip", r.header.Get("Content-Encoding"))
+	assert.Equal(t, upstream.Body, r.body)
+
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "llamas rock", string(r.body))
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestCompressTypesGzipsUpstreamResponses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Header = http.Header{"Content-Type": []string{"text/plain"}}
+	upstream.Body = bytes.Repeat([]byte("llamas rock "), 100)
+	client.cacheHandler.CompressTypes = []string{"text/*"}
+	client.cacheHandler.CompressMinSize = 1024
+
+	upstream.assert(func(r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+	})
+
+	r := client.get("/", "Accept-Encoding: gzip")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "gzip", r.header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", r.header.Get("Vary"))
+	zr, err := gzip.NewReader(bytes.NewReader(r.body))
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, upstream.Body, body)
+
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "", r.header.Get("Content-Encoding"))
+	assert.Equal(t, upstream.Body, r.body)
+	assert.Equal(t, 1, upstream.requests)
+
+	upstream.Body = []byte("llamas rock")
+	r = client.get("/small", "Accept-Encoding: gzip")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "", r.header.Get("Content-Encoding"))
+	assert.Equal(t, "llamas rock", string(r.body))
+
+	upstream.Header = http.Header{"Content-Type": []string{"image/png"}}
+	upstream.Body = bytes.Repeat([]byte("llamas rock "), 100)
+	r = client.get("/image", "Accept-Encoding: gzip")
+	assert.Equal(t, "", r.header.Get("Content-Encoding"))
+	assert.Equal(t, upstream.Body, r.body)
+}
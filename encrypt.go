@@ -0,0 +1,272 @@
+package httpcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// sealedSegmentSize is the plaintext bytes in each sealed segment of an
+	// encrypted file, so that files can be read and seeked without being
+	// decrypted in full
+	sealedSegmentSize = 64 * 1024
+	// sealedSaltSize is the random salt that encrypted files start with,
+	// which the key of the file is derived from
+	sealedSaltSize = 32
+	// fileKeyInfo is the HKDF info that keys of files are derived with
+	fileKeyInfo = "httpcache file key"
+	// saltHeader records the salt of an encrypted body in its headers, so
+	// that the body of another key can't be swapped in for it
+	saltHeader = "X-Httpcache-Body-Salt"
+)
+
+// errUndecryptable is returned for files that weren't encrypted with the
+// key of a cache, or have been modified since
+var errUndecryptable = errors.New("file can't be decrypted with the encryption key")
+
+// LoadEncryptionKey reads a 256 bit AES key from a file, either as the raw
+// 32 bytes or encoded in hex or base64, such as by openssl rand -hex 32
+func LoadEncryptionKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	text := string(bytes.TrimSpace(b))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key %s isn't 32 bytes, or 32 bytes in hex or base64", path)
+}
+
+// newAEAD returns AES-GCM with a 128, 192 or 256 bit key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileAEAD returns AES-GCM with the key of a single file, derived from the
+// key of the cache and the salt of the file with HKDF-SHA256, so that the
+// nonces of segments only need to be unique within a file
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(fileKeyInfo))
+	expand.Write([]byte{1})
+	return newAEAD(expand.Sum(nil)[:len(key)])
+}
+
+// sealedAAD returns the additional data that the segments of a file are
+// sealed with. Headers are bound to their path, and so to their key, while
+// bodies are written before being linked under their keys and are bound to
+// their headers by the salt recorded in them instead.
+func sealedAAD(path string) []byte {
+	if strings.HasPrefix(path, bodyPrefix) {
+		return nil
+	}
+	return []byte(path)
+}
+
+// segmentNonce returns the nonce of a segment of an encrypted file, which
+// marks the last segment so that truncated files can't be decrypted
+func segmentNonce(segment uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], segment)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealWriter encrypts what is written to it in segments, sealing the last
+// when it is closed, which must be done for the file to be readable
+type sealWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	aad     []byte
+	segment uint32
+	buf     []byte
+}
+
+// newSealWriter returns a writer that encrypts to w with a key derived from
+// key and a new salt, sealing segments with aad
+func newSealWriter(w io.WriteCloser, key, aad []byte) (*sealWriter, error) {
+	salt := make([]byte, sealedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, aad: aad, buf: make([]byte, 0, sealedSegmentSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only sealed once there is more to write, as
+		// the last one is sealed differently
+		if len(s.buf) == sealedSegmentSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sealedSegmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) seal(last bool) error {
+	sealed := s.aead.Seal(nil, segmentNonce(s.segment, last), s.buf, s.aad)
+	s.segment++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close seals the last segment and closes the underlying writer
+func (s *sealWriter) Close() error {
+	err := s.seal(true)
+	if closeErr := s.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openReader decrypts a file written by a sealWriter, a segment at a time
+type openReader struct {
+	f    ReadSeekCloser
+	aead cipher.AEAD
+	aad  []byte
+	salt []byte
+	// segments is the number of segments in the file, and size is the
+	// plaintext size of the file
+	segments int64
+	size     int64
+	pos      int64
+	// loaded is the index of the segment in buf, or -1
+	loaded int64
+	buf    []byte
+}
+
+// newOpenReader returns a reader of the plaintext of an encrypted file of
+// size bytes, sealed with key and aad, decrypting its first segment to check
+// that it can be
+func newOpenReader(f ReadSeekCloser, size int64, key, aad []byte) (*openReader, error) {
+	salt := make([]byte, sealedSaltSize)
+	if _, err := io.ReadFull(f, salt); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errUndecryptable
+		}
+		return nil, err
+	}
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	sealedSize := int64(sealedSegmentSize + aead.Overhead())
+	body := size - sealedSaltSize
+	if body < int64(aead.Overhead()) {
+		return nil, errUndecryptable
+	}
+	segments := (body + sealedSize - 1) / sealedSize
+
+	r := &openReader{
+		f:        f,
+		aead:     aead,
+		aad:      aad,
+		salt:     salt,
+		segments: segments,
+		size:     body - segments*int64(aead.Overhead()),
+		loaded:   -1,
+	}
+	if err := r.load(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load decrypts a segment into buf
+func (r *openReader) load(segment int64) error {
+	sealedSize := int64(sealedSegmentSize + r.aead.Overhead())
+	if _, err := r.f.Seek(sealedSaltSize+segment*sealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, sealedSize)
+	n, err := io.ReadFull(r.f, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := segment == r.segments-1
+	buf, err := r.aead.Open(r.buf[:0], segmentNonce(uint32(segment), last), sealed[:n], r.aad)
+	if err != nil {
+		r.loaded = -1
+		return errUndecryptable
+	}
+	r.buf, r.loaded = buf, segment
+	return nil
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	segment := r.pos / sealedSegmentSize
+	if segment != r.loaded {
+		if err := r.load(segment); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos%sealedSegmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *openReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *openReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,141 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+)
+
+// maxESIDepth is how deeply ESI includes are processed within fragments
+const maxESIDepth = 3
+
+var (
+	esiInclude = regexp.MustCompile(`<esi:include\s[^>]*?src=["']([^"']*)["'][^>]*?/?>(\s*</esi:include>)?`)
+	esiRemove  = regexp.MustCompile(`(?s)<esi:remove>.*?</esi:remove>`)
+	esiComment = regexp.MustCompile(`(?s)<!--esi(.*?)-->`)
+)
+
+type esiDepthKey struct{}
+
+// esiDepth returns how many includes deep a request is
+func esiDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(esiDepthKey{}).(int)
+	return depth
+}
+
+// esiWriter buffers uncompressed html responses so that their ESI can be
+// processed, passing everything else through
+type esiWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	buffering   bool
+	wroteHeader bool
+}
+
+func (w *esiWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if status == http.StatusOK && mediaType == "text/html" && w.Header().Get("Content-Encoding") == "" {
+		w.buffering = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *esiWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// serveESI serves a request, assembling html responses from the fragments
+// that their <esi:include> tags fetch through the handler, so that each is
+// cached for as long as it is fresh, and removing <esi:remove> blocks
+func (h *Handler) serveESI(w http.ResponseWriter, r *http.Request) {
+	ew := &esiWriter{ResponseWriter: w}
+	h.serveHTTP(ew, r)
+	if !ew.buffering {
+		return
+	}
+
+	body := ew.buf.Bytes()
+	if bytes.Contains(body, []byte("<esi:")) || bytes.Contains(body, []byte("<!--esi")) {
+		body = h.processESI(body, r)
+		// the assembled page changes with its fragments
+		for _, key := range []string{"Content-Length", "ETag", "Last-Modified", "Accept-Ranges"} {
+			w.Header().Del(key)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// processESI removes <esi:remove> blocks and replaces <esi:include> tags
+// with the fragments at their src, fetched concurrently
+func (h *Handler) processESI(body []byte, r *http.Request) []byte {
+	body = esiRemove.ReplaceAll(body, nil)
+	body = esiComment.ReplaceAll(body, []byte("$1"))
+
+	matches := esiInclude.FindAllSubmatch(body, -1)
+	fragments := make([][]byte, len(matches))
+	var wg sync.WaitGroup
+	for i, match := range matches {
+		wg.Add(1)
+		go func(i int, src string) {
+			defer wg.Done()
+			fragments[i] = h.fetchFragment(src, r)
+		}(i, html.UnescapeString(string(match[1])))
+	}
+	wg.Wait()
+
+	i := 0
+	return esiInclude.ReplaceAllFunc(body, func([]byte) []byte {
+		i++
+		return fragments[i-1]
+	})
+}
+
+// fetchFragment returns the body of the fragment at src relative to a
+// request through the handler, or nothing if it isn't a 200
+func (h *Handler) fetchFragment(src string, r *http.Request) []byte {
+	u, err := url.Parse(src)
+	if err != nil {
+		debugf("invalid esi include %q: %s", src, err.Error())
+		return nil
+	}
+
+	ctx := context.WithValue(r.Context(), esiDepthKey{}, esiDepth(r.Context())+1)
+	fr := r.Clone(ctx)
+	fr.Method = "GET"
+	fr.URL = r.URL.ResolveReference(u)
+	fr.RequestURI = fr.URL.RequestURI()
+	if fr.URL.Host != "" {
+		fr.Host = fr.URL.Host
+	}
+	fr.Body, fr.ContentLength = http.NoBody, 0
+	for _, key := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		fr.Header.Del(key)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, fr)
+	if rec.Code != http.StatusOK {
+		debugf("esi include %s failed with %d", fr.URL.String(), rec.Code)
+		return nil
+	}
+	return rec.Body.Bytes()
+}
@@ -0,0 +1,129 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CacheRevalidate is the Result of an Explanation when a cached response
+// must be validated, so whether it is served depends on the upstream
+const CacheRevalidate = "REVALIDATE"
+
+type explainKey struct{}
+
+// WithExplain returns a copy of ctx that makes a Handler respond to a request
+// with an Explanation as json, rather than serving it
+func WithExplain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, explainKey{}, true)
+}
+
+// Explaining returns whether requests with ctx are explained rather than
+// served
+func Explaining(ctx context.Context) bool {
+	explain, _ := ctx.Value(explainKey{}).(bool)
+	return explain
+}
+
+// Explanation describes how a Handler would serve a request from what is in
+// its cache, without contacting the upstream or counting the resource as
+// used
+type Explanation struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Key    string `json:"key"`
+	Cached bool   `json:"cached"`
+
+	// the stored response, if it is cached
+	Status       int    `json:"status,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Lifetime     string `json:"freshness_lifetime,omitempty"`
+	Age          string `json:"age,omitempty"`
+
+	// the request headers that responses vary by, and the keys of the
+	// variants that are cached
+	Vary     string   `json:"vary,omitempty"`
+	Variants []string `json:"variants,omitempty"`
+
+	// Result is the X-Cache-Status the request would be served with, or
+	// CacheRevalidate, and Reason is why
+	Result string `json:"result"`
+	Reason string `json:"reason"`
+}
+
+func (h *Handler) explain(w http.ResponseWriter, r *cacheRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(h.explanation(r))
+}
+
+// explanation decides how a request would be served in the same way as
+// ServeHTTP, but only from the cache
+func (h *Handler) explanation(r *cacheRequest) *Explanation {
+	e := &Explanation{
+		Method: r.Method,
+		URL:    r.URL.String(),
+		Key:    r.Key.String(),
+	}
+
+	if h.Offline && r.Method != "GET" && r.Method != "HEAD" {
+		e.Result, e.Reason = CacheBypass, "offline"
+		return e
+	} else if reason := r.bypassReason(); reason != "" && !h.Offline {
+		e.Result, e.Reason = CacheBypass, reason
+		return e
+	}
+
+	if header, err := h.cache.Header(e.Key); err == nil {
+		if e.Vary = h.vary(header.Header, r.Request); e.Vary != "" {
+			e.Variants = variants(h.cache, e.Key)
+			e.Key = r.Key.Vary(e.Vary, r.Request).String()
+		}
+	}
+
+	res, err := h.peekLookup(r)
+	if err != nil {
+		e.Result, e.Reason = CacheMiss, "not in cache"
+		if err != ErrNotFoundInCache {
+			e.Reason = "lookup error: " + err.Error()
+		}
+		return e
+	}
+	defer res.Close()
+
+	e.Cached = true
+	e.Status = res.Status()
+	e.ETag = res.Header().Get("ETag")
+	e.LastModified = res.Header().Get("Last-Modified")
+
+	age, err := res.Age()
+	if err == nil {
+		e.Age = age.Round(time.Second).String()
+	}
+	freshness, err := h.freshness(res, r)
+	if err == nil {
+		e.Lifetime = (freshness + age).Round(time.Second).String()
+	}
+
+	if h.needsValidation(res, r) {
+		if h.ServeStale {
+			e.Result, e.Reason = CacheStale, "serve-stale mode"
+		} else if h.Offline {
+			e.Result, e.Reason = CacheStale, "offline"
+		} else if h.staleWhileRevalidate(res, r) {
+			e.Result, e.Reason = CacheStale, "beyond max-age, swr used"
+		} else if res.MustValidate(h.Shared) {
+			e.Result, e.Reason = CacheRevalidate, "must be validated upstream"
+		} else {
+			e.Result, e.Reason = CacheRevalidate, "beyond max-age, would be validated upstream"
+		}
+	} else if err == nil && freshness <= 0 {
+		e.Result, e.Reason = CacheStale, "beyond max-age, max-stale used"
+	} else {
+		e.Result, e.Reason = CacheHit, "fresh"
+	}
+	return e
+}
@@ -0,0 +1,104 @@
+package httpcache_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainDoesNotContactUpstream(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.Vary = "Accept"
+
+	index := httpcache.NewIndexedCache(httpcache.NewMemoryCache())
+	handler := httpcache.NewHandler(index, upstream)
+	client.handler, client.cacheHandler = handler, handler
+
+	explain := func(method, path string, headers ...string) *httpcache.Explanation {
+		r := newRequest(method, "http://example.org"+path, headers...)
+		res := client.do(r.WithContext(httpcache.WithExplain(r.Context())))
+		assert.Equal(t, http.StatusOK, res.statusCode)
+
+		e := &httpcache.Explanation{}
+		assert.NoError(t, json.Unmarshal(res.body, e))
+		return e
+	}
+
+	e := explain("GET", "/")
+	assert.False(t, e.Cached)
+	assert.Equal(t, "MISS", e.Result)
+	assert.Equal(t, "not in cache", e.Reason)
+
+	client.get("/", "Accept: text/plain")
+	client.get("/", "Accept: text/html")
+	upstream.timeTravel(time.Second * 10)
+
+	e = explain("GET", "/", "Accept: text/plain")
+	assert.True(t, e.Cached)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, `"llamas"`, e.ETag)
+	assert.Equal(t, "Accept", e.Vary)
+	assert.Len(t, e.Variants, 2)
+	assert.Equal(t, "1m0s", e.Lifetime)
+	assert.Equal(t, "10s", e.Age)
+	assert.Equal(t, "HIT", e.Result)
+
+	e = explain("GET", "/", "Accept: image/png")
+	assert.False(t, e.Cached)
+	assert.Equal(t, "MISS", e.Result)
+
+	upstream.timeTravel(time.Minute)
+	e = explain("GET", "/", "Accept: text/plain")
+	assert.Equal(t, httpcache.CacheRevalidate, e.Result)
+	assert.Equal(t, "beyond max-age, would be validated upstream", e.Reason)
+
+	handler.ServeStale = true
+	e = explain("GET", "/", "Accept: text/plain")
+	assert.Equal(t, httpcache.CacheStale, e.Result)
+	assert.Equal(t, "serve-stale mode", e.Reason)
+	handler.ServeStale = false
+
+	e = explain("POST", "/")
+	assert.Equal(t, "BYPASS", e.Result)
+	assert.Equal(t, "method POST", e.Reason)
+
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestExplainDoesNotServeOrUseResources(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+
+	cache := httpcache.NewLimitedMemoryCache(0, 2)
+	handler := httpcache.NewHandler(cache, upstream)
+	handler.Synthetic = []httpcache.SyntheticResponse{{Path: "/robots.txt", Body: []byte("User-agent: *\n")}}
+	client.handler, client.cacheHandler = handler, handler
+
+	explain := func(path string) *httpcache.Explanation {
+		r := newRequest("GET", "http://example.org"+path)
+		res := client.do(r.WithContext(httpcache.WithExplain(r.Context())))
+		assert.Equal(t, "application/json", res.header.Get("Content-Type"))
+
+		e := &httpcache.Explanation{}
+		assert.NoError(t, json.Unmarshal(res.body, e))
+		return e
+	}
+
+	assert.Equal(t, "MISS", explain("/robots.txt").Result)
+
+	client.get("/llamas")
+	client.get("/alpacas")
+	assert.Equal(t, "HIT", explain("/llamas").Result)
+
+	// explaining /llamas didn't make it more recently used than /alpacas
+	client.get("/vicunas")
+	assert.Equal(t, "MISS", explain("/llamas").Result)
+	assert.Equal(t, "HIT", explain("/alpacas").Result)
+	assert.Equal(t, 3, upstream.requests)
+}
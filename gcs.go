@@ -0,0 +1,476 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataToken   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcsTokenURI        = "https://oauth2.googleapis.com/token"
+
+	gcsHeaderMeta = "X-Goog-Meta-Httpcache-Header"
+	gcsStaleMeta  = "X-Goog-Meta-Httpcache-Stale"
+)
+
+// GCSConfig describes a Google Cloud Storage bucket to store resources in
+type GCSConfig struct {
+	Bucket string
+	// Prefix is prepended to every object name
+	Prefix string
+	// Endpoint defaults to https://storage.googleapis.com
+	Endpoint string
+	// Client is used for all requests. If nil, a client authorized with
+	// Application Default Credentials is used.
+	Client *http.Client
+}
+
+// gcsCache stores each resource as a single object in a Google Cloud Storage
+// bucket, with the status and headers kept in the object's custom metadata
+type gcsCache struct {
+	GCSConfig
+}
+
+var _ Cache = (*gcsCache)(nil)
+
+// NewGCSCache returns a cache backed by a Google Cloud Storage bucket.
+// Credentials are discovered the same way as Application Default Credentials:
+// from GOOGLE_APPLICATION_CREDENTIALS, the gcloud well-known file, or the
+// GCE/GKE metadata server.
+func NewGCSCache(config GCSConfig) (Cache, error) {
+	if config.Endpoint == "" {
+		config.Endpoint = gcsDefaultEndpoint
+	}
+	if config.Client == nil {
+		tokens, err := defaultGoogleTokens()
+		if err != nil {
+			return nil, err
+		}
+		config.Client = &http.Client{Transport: &bearerTransport{
+			base:   http.DefaultTransport,
+			tokens: tokens,
+		}}
+	}
+	return &gcsCache{config}, nil
+}
+
+func (c *gcsCache) objectPath(key string) string {
+	return "/" + c.Bucket + "/" + c.Prefix + formatPrefix + hashKey(key)
+}
+
+// do sends a request, returning an error for any non-2xx response
+func (c *gcsCache) do(method, key string, h http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Endpoint, "/")+c.objectPath(key), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFoundInCache
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs %s %s failed with %s: %s", method, key, resp.Status, b)
+	}
+
+	return resp, nil
+}
+
+func gcsHeader(resp *http.Response) (Header, error) {
+	b, err := base64.StdEncoding.DecodeString(resp.Header.Get(gcsHeaderMeta))
+	if err != nil {
+		return Header{}, err
+	}
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *gcsCache) Header(key string) (Header, error) {
+	resp, err := c.do("HEAD", key, nil, nil, 0)
+	if err != nil {
+		return Header{}, err
+	}
+	resp.Body.Close()
+	return gcsHeader(resp)
+}
+
+// Store a resource against a number of keys. The body is streamed to the
+// object for the first key and copied server-side for the rest.
+func (c *gcsCache) Store(res *Resource, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var r io.Reader = res
+	length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+	if err == nil {
+		r = io.LimitReader(res, length)
+	} else {
+		length = -1
+	}
+
+	counter := &countingReader{Reader: r}
+	resp, err := c.do("PUT", keys[0], http.Header{
+		gcsHeaderMeta: {base64.StdEncoding.EncodeToString(headerBytes(res.Status(), res.Header()))},
+	}, counter, length)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if length >= 0 && counter.n != length {
+		c.delete(keys[0])
+		return io.ErrUnexpectedEOF
+	}
+
+	for _, key := range keys[1:] {
+		if err := c.copy(keys[0], key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copy copies the object for src to dst, replacing its metadata if meta
+// is provided
+func (c *gcsCache) copy(src, dst string, meta http.Header) error {
+	h := http.Header{"X-Goog-Copy-Source": {c.objectPath(src)}}
+	if meta != nil {
+		h.Set("X-Goog-Metadata-Directive", "REPLACE")
+		for k, v := range meta {
+			h[k] = v
+		}
+	}
+	resp, err := c.do("PUT", dst, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *gcsCache) delete(key string) {
+	if resp, err := c.do("DELETE", key, nil, nil, 0); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *gcsCache) Retrieve(key string) (*Resource, error) {
+	resp, err := c.do("GET", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := gcsHeader(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs returned no Content-Length for %s", key)
+	}
+
+	body := newRangeReader(resp.Body, resp.ContentLength, func(offset int64) (io.ReadCloser, error) {
+		resp, err := c.do("GET", key, http.Header{
+			"Range": {fmt.Sprintf("bytes=%d-", offset)},
+		}, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	})
+
+	res := NewResource(h.StatusCode, body, h.Header)
+	if stale := resp.Header.Get(gcsStaleMeta); stale != "" {
+		staleNano, err := strconv.ParseInt(stale, 10, 64)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		staleTime := time.Unix(0, staleNano).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	}
+
+	return res, nil
+}
+
+func (c *gcsCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+	for _, key := range keys {
+		resp, err := c.do("HEAD", key, nil, nil, 0)
+		if err == ErrNotFoundInCache {
+			continue
+		} else if err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+			continue
+		}
+		resp.Body.Close()
+
+		if err := c.copy(key, key, http.Header{
+			gcsHeaderMeta: {resp.Header.Get(gcsHeaderMeta)},
+			gcsStaleMeta:  {strconv.FormatInt(Clock().UnixNano(), 10)},
+		}); err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *gcsCache) Freshen(res *Resource, keys ...string) error {
+	for _, key := range keys {
+		if h, err := c.Header(key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				if err := c.copy(key, key, http.Header{
+					gcsHeaderMeta: {base64.StdEncoding.EncodeToString(headerBytes(h.StatusCode, res.Header()))},
+				}); err != nil {
+					return err
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// bearerTransport authorizes requests with an OAuth2 access token
+type bearerTransport struct {
+	base   http.RoundTripper
+	tokens *tokenSource
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.token()
+	if err != nil {
+		return nil, err
+	}
+	req2 := cloneRequest(req)
+	req2.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req2)
+}
+
+// tokenSource caches an access token until shortly before it expires
+type tokenSource struct {
+	sync.Mutex
+	fetch  func() (*tokenResponse, error)
+	access string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (s *tokenSource) token() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.access != "" && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.access, nil
+	}
+
+	t, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	s.access = t.AccessToken
+	s.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return s.access, nil
+}
+
+// defaultGoogleTokens finds credentials in the same order as Google's
+// Application Default Credentials
+func defaultGoogleTokens() (*tokenSource, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		wellKnown := filepath.Join(os.Getenv("HOME"), ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(wellKnown); err == nil {
+			path = wellKnown
+		}
+	}
+
+	if path == "" {
+		debugf("using credentials from the metadata server")
+		return &tokenSource{fetch: func() (*tokenResponse, error) {
+			req, err := http.NewRequest("GET", gcsMetadataToken, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return doTokenRequest(req)
+		}}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("error parsing credentials %s: %s", path, err.Error())
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = gcsTokenURI
+	}
+
+	debugf("using %s credentials from %s", creds.Type, path)
+
+	switch creds.Type {
+	case "service_account":
+		key, err := parseRSAPrivateKey(creds.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tokenSource{fetch: func() (*tokenResponse, error) {
+			assertion, err := signJWT(key, creds.ClientEmail, creds.TokenURI)
+			if err != nil {
+				return nil, err
+			}
+			return postTokenForm(creds.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}}, nil
+	case "authorized_user":
+		return &tokenSource{fetch: func() (*tokenResponse, error) {
+			return postTokenForm(creds.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+}
+
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("credentials contain no PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("credentials private key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signJWT returns an RS256 signed assertion for the OAuth2 JWT bearer flow
+func signJWT(key *rsa.PrivateKey, email, aud string) (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsScope,
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func postTokenForm(tokenURI string, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+func doTokenRequest(req *http.Request) (*tokenResponse, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token request to %s failed with %s: %s", req.URL.Host, resp.Status, b)
+	}
+
+	var t tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,137 @@
+package httpcache_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+type gcsObject struct {
+	meta http.Header
+	body []byte
+}
+
+// fakeGCS implements just enough of the GCS XML API to exercise the gcs backend
+type fakeGCS struct {
+	sync.Mutex
+	objects map[string]gcsObject
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		obj := gcsObject{meta: http.Header{}}
+		if src := r.Header.Get("X-Goog-Copy-Source"); src != "" {
+			srcObj, ok := s.objects[src]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			obj.body = srcObj.body
+			obj.meta = srcObj.meta
+			if r.Header.Get("X-Goog-Metadata-Directive") != "REPLACE" {
+				s.objects[r.URL.Path] = obj
+				return
+			}
+			obj.meta = http.Header{}
+		} else {
+			obj.body, _ = ioutil.ReadAll(r.Body)
+		}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Goog-Meta-") {
+				obj.meta[k] = v
+			}
+		}
+		s.objects[r.URL.Path] = obj
+	case "GET", "HEAD":
+		obj, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		if r.Method == "GET" {
+			w.Write(obj.body)
+		}
+	case "DELETE":
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestGCSCache(t *testing.T) (httpcache.Cache, func()) {
+	server := httptest.NewServer(&fakeGCS{objects: map[string]gcsObject{}})
+	cache, err := httpcache.NewGCSCache(httpcache.GCSConfig{
+		Endpoint: server.URL,
+		Bucket:   "llamas",
+		Client:   http.DefaultClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, server.Close
+}
+
+func TestGCSSaveResource(t *testing.T) {
+	cache, closer := newTestGCSCache(t)
+	defer closer()
+
+	var body = strings.Repeat("llamas", 5000)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas": []string{"true"},
+	})
+
+	if err := cache.Store(res, "gcs-testkey", "gcs-testkey-vary"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"gcs-testkey", "gcs-testkey-vary"} {
+		resOut, err := cache.Retrieve(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, res.Header(), resOut.Header())
+		require.Equal(t, body, readAllString(resOut))
+		resOut.Close()
+	}
+}
+
+func TestGCSInvalidateAndFreshen(t *testing.T) {
+	cache, closer := newTestGCSCache(t)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Date": []string{httpcache.Clock().Format(http.TimeFormat)},
+		"Etag": []string{`"llamas"`},
+	})
+	if err := cache.Store(res, "gcs-testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Invalidate("gcs-testkey")
+
+	resOut, err := cache.Retrieve("gcs-testkey")
+	require.NoError(t, err)
+	require.True(t, resOut.IsStale())
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	res.Header().Set("X-Llamas", "freshened")
+	require.NoError(t, cache.Freshen(res, "gcs-testkey"))
+
+	h, err := cache.Header("gcs-testkey")
+	require.NoError(t, err)
+	require.Equal(t, "freshened", h.Get("X-Llamas"))
+}
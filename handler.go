@@ -1,7 +1,6 @@
 package httpcache
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -9,20 +8,46 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/djherbis/stream.v1"
 )
 
 const (
-	CacheHeader     = "X-Cache"
-	ProxyDateHeader = "Proxy-Date"
+	CacheHeader       = "X-Cache"
+	CacheStatusHeader = "X-Cache-Status"
+	ForceCacheHeader  = "X-Cache-Forced"
+	ProxyDateHeader   = "Proxy-Date"
+)
+
+// The values of the X-Cache header, with the reason for them given in
+// X-Cache-Status
+const (
+	// CacheHit is a fresh response served from the cache
+	CacheHit = "HIT"
+	// CacheMiss is a response fetched from upstream and stored
+	CacheMiss = "MISS"
+	// CacheStale is a stale response served from the cache
+	CacheStale = "STALE"
+	// CacheRevalidated is a cached response that upstream confirmed is
+	// unchanged
+	CacheRevalidated = "REVALIDATED"
+	// CacheBypass is a response passed through from upstream without
+	// being stored
+	CacheBypass = "BYPASS"
 )
 
 var Writes sync.WaitGroup
 
+// DefaultHeuristicPercent is the percentage of the time since a response
+// without an explicit expiration was last modified that it is fresh for
+const DefaultHeuristicPercent = 100 / lastModDivisor
+
 var storeable = map[int]bool{
 	http.StatusOK:                   true,
 	http.StatusFound:                true,
@@ -33,6 +58,24 @@ var storeable = map[int]bool{
 	http.StatusNotFound:             true,
 }
 
+// errorStatus are the responses that stale-if-error applies to
+var errorStatus = map[int]bool{
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// negativeStatus are the error responses that NegativeTTL applies to
+var negativeStatus = map[int]bool{
+	http.StatusNotFound:            true,
+	http.StatusGone:                true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
 var cacheableByDefault = map[int]bool{
 	http.StatusOK:                   true,
 	http.StatusFound:                true,
@@ -45,10 +88,174 @@ var cacheableByDefault = map[int]bool{
 }
 
 type Handler struct {
-	Shared    bool
+	Shared bool
+
+	// TTL overrides the freshness lifetime of responses when it is non-zero,
+	// they are cached for TTL regardless of their expiration headers unless
+	// they forbid caching altogether
+	TTL time.Duration
+
+	// TTLRules override the freshness lifetime of responses to the requests
+	// that they match in the same way as TTL, the first that matches wins
+	TTLRules []TTLRule
+
+	// NegativeTTL caches 404, 410, 500, 502, 503 and 504 responses that don't
+	// have an explicit expiration for a duration when it is non-zero, so that
+	// requests for missing or failing resources don't all reach the upstream
+	NegativeTTL time.Duration
+
+	// MinTTL and MaxTTL clamp the freshness lifetime of responses when they
+	// are non-zero, after any TTL override
+	MinTTL, MaxTTL time.Duration
+
+	// HeuristicPercent is the percentage of the time since a response
+	// without an explicit expiration was last modified that it is fresh for,
+	// defaulting to DefaultHeuristicPercent, and HeuristicMax limits that
+	// freshness when it is non-zero. DisableHeuristic stops responses being
+	// given a heuristic freshness at all.
+	HeuristicPercent int
+	HeuristicMax     time.Duration
+	DisableHeuristic bool
+
+	// ServeStaleOnError serves stale resources when revalidating them fails
+	// with a 500, 502, 503 or 504, even without a stale-if-error directive
+	ServeStaleOnError bool
+
+	// RevalidateWorkers is the number of stale-while-revalidate revalidations
+	// that run in the background at once, defaulting to
+	// DefaultRevalidateWorkers
+	RevalidateWorkers int
+
+	// WriteBehindBytes stores responses once they have been written to
+	// clients, by a pool of WriteBehindWorkers, rather than as they are
+	// streamed, when it is non-zero. Responses wait to be stored in their
+	// buffers, and those that would take the buffered bytes waiting beyond
+	// WriteBehindBytes aren't stored, so that a slow cache can't hold on to
+	// unbounded memory. WriteBehindWorkers defaults to
+	// DefaultWriteBehindWorkers.
+	WriteBehindBytes   int64
+	WriteBehindWorkers int
+
+	// Offline serves requests from the cache alone without ever contacting
+	// the upstream. Stale resources are served with a Warning of 112, and
+	// requests for anything else fail with a 504, or are served by
+	// OfflinePage if it is set, such as with a maintenance page.
+	Offline     bool
+	OfflinePage http.Handler
+
+	// ServeStale serves every cached resource as if it were fresh, however
+	// stale and even with must-revalidate, with a Warning of 110, so that
+	// only misses and requests that bypass the cache reach the upstream
+	// during an incident
+	ServeStale bool
+
+	// ForceCache decides whether a response to a request is stored even if
+	// it has a no-cache or no-store directive, which isn't compliant with
+	// rfc7234. Stored responses are marked with an X-Cache-Forced header.
+	ForceCache func(r *http.Request) bool
+
+	// NormalizeAcceptEncoding reduces the Accept-Encoding header of requests
+	// to "br, gzip", "br", "gzip" or "identity" before they are keyed or
+	// passed upstream, so that responses varying by it have few variants
+	NormalizeAcceptEncoding bool
+
+	// StoreGzip asks the upstream for gzip encoded responses regardless of
+	// what clients accept, so that a single copy of each is cached, and
+	// decodes them for clients that don't accept gzip
+	StoreGzip bool
+
+	// CompressTypes gzip encodes uncompressed responses from upstream with
+	// one of the content types, such as text/*, before they are stored and
+	// served, when they are at least CompressMinSize bytes. A single copy of
+	// each response is cached and decoded for clients that don't accept
+	// gzip, as with StoreGzip.
+	CompressTypes   []string
+	CompressMinSize int64
+
+	// CachePartial stores the ranges of partial responses that carry a strong
+	// validator, and once they cover the whole response stores it assembled
+	// from them, so that responses fetched a range at a time are cached
+	CachePartial bool
+
+	// MaxObjectSize is the largest response in bytes that is stored, larger
+	// ones are passed through to clients. There is no limit if it is 0.
+	MaxObjectSize int64
+
+	// BufferDir is a directory that responses from upstream are buffered in
+	// as they are passed to clients and stored, rather than in memory, so
+	// that responses larger than memory can be cached
+	BufferDir string
+
+	// IgnoreVary returns the headers that responses to a request are cached
+	// without varying by, even if their Vary header names them
+	IgnoreVary func(r *http.Request) []string
+
+	// AuthPolicy is how a shared cache handles requests with an
+	// Authorization header, defaulting to AuthNever
+	AuthPolicy AuthPolicy
+
+	// PartitionHeader is a request header, such as X-User-Id, holding the
+	// user that AuthPolicy AuthPartition partitions the cache by instead of
+	// the Authorization header. It must be set by something trusted in
+	// front of the cache, such as an authenticating gateway.
+	PartitionHeader string
+
+	// NeverCache are the rules for requests, such as those for admin pages,
+	// that are never looked up in the cache or stored
+	NeverCache []BypassRule
+
+	// Rewrites rewrite the paths of requests before they are keyed and
+	// passed upstream, or redirect clients, the first that matches a
+	// request wins
+	Rewrites []RewriteRule
+
+	// Synthetic are fixed responses served for the requests they match,
+	// without looking them up or passing them upstream, the first that
+	// matches a request wins
+	Synthetic []SyntheticResponse
+
+	// HeaderRules add, set or remove the headers of matching requests and
+	// of the responses to them, all of the rules that match a request apply
+	HeaderRules []HeaderRule
+
+	// CookieRules cache requests by the cookies they carry, stripping them
+	// from requests for static assets or bypassing the cache for requests
+	// with session cookies, the first that matches a request wins
+	CookieRules []CookieRule
+
+	// StripQuery are patterns of query parameters, such as utm_*, that are
+	// removed from requests before they are keyed, so that urls with
+	// tracking parameters share cached responses. StripQueryUpstream removes
+	// them from requests passed upstream too.
+	StripQuery         []string
+	StripQueryUpstream bool
+
+	// KeyRules customize which parts of requests form their cache keys, the
+	// first that matches a request wins
+	KeyRules []KeyRule
+
+	// CacheMethods are the rules for caching responses to requests with
+	// methods other than GET and HEAD, such as POST to particular endpoints
+	CacheMethods []MethodRule
+
+	// ESI assembles html responses from the fragments that their
+	// <esi:include> tags fetch through the handler, so that fragments are
+	// cached for as long as each is fresh, and removes <esi:remove> blocks.
+	// Only uncompressed responses are processed.
+	ESI bool
+
+	// AllowPurge decides whether a PURGE request may invalidate the cached
+	// resource at its url. PURGE requests are passed upstream if it is nil.
+	AllowPurge func(r *http.Request) bool
+
 	upstream  http.Handler
 	validator *Validator
 	cache     Cache
+
+	revalidator revalidator
+	writeBehind writeBehind
+	flights     flightGroup
+	partials    partialSet
 }
 
 func NewHandler(cache Cache, upstream http.Handler) *Handler {
@@ -61,6 +268,42 @@ func NewHandler(cache Cache, upstream http.Handler) *Handler {
 }
 
 func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// explained requests are only looked up, without rewriting, redirecting
+	// or answering them
+	if Explaining(r.Context()) {
+		h.serveHTTP(rw, r)
+		return
+	}
+	if h.rewriteURL(rw, r) {
+		return
+	}
+	rw = h.rewriteHeaders(rw, r)
+	if h.serveSynthetic(rw, r) {
+		return
+	}
+	if h.ESI && r.Method == "GET" && esiDepth(r.Context()) < maxESIDepth {
+		h.serveESI(rw, r)
+		return
+	}
+	h.serveHTTP(rw, r)
+}
+
+func (h *Handler) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	if h.NormalizeAcceptEncoding {
+		normalizeAcceptEncoding(r.Header)
+	}
+
+	if h.StoreGzip || len(h.CompressTypes) > 0 {
+		if !acceptsEncoding(strings.Join(r.Header["Accept-Encoding"], ","), "gzip") {
+			// ranges of the encoded body can't be decoded
+			r.Header.Del("Range")
+			gw := newGunzipWriter(rw)
+			defer gw.Close()
+			rw = gw
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+
 	cReq, err := newCacheRequest(r)
 	if err != nil {
 		http.Error(rw, "invalid request: "+err.Error(),
@@ -68,9 +311,35 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !cReq.isCacheable() {
-		debugf("request not cacheable")
-		rw.Header().Set(CacheHeader, "SKIP")
+	cReq.neverCache = h.neverCached(r)
+	h.applyCookieRules(cReq)
+	h.stripTracking(cReq)
+	h.customKey(cReq)
+	h.partitionKey(cReq)
+	if err := h.keyBody(cReq); err != nil {
+		http.Error(rw, "error reading request body: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	if Explaining(r.Context()) {
+		h.explain(rw, cReq)
+		return
+	}
+
+	if r.Method == "PURGE" && h.AllowPurge != nil {
+		h.purge(rw, cReq)
+		return
+	}
+
+	if h.Offline {
+		h.serveOffline(rw, cReq)
+		return
+	}
+
+	if reason := cReq.bypassReason(); reason != "" {
+		debugf("request not cacheable, %s", reason)
+		setCacheStatus(rw.Header(), CacheBypass, reason)
 		h.pipeUpstream(rw, cReq)
 		return
 	}
@@ -87,6 +356,8 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		cacheType = "shared"
 	}
 
+	status, reason := CacheHit, "fresh"
+
 	if err == ErrNotFoundInCache {
 		if cReq.CacheControl.Has("only-if-cached") {
 			http.Error(rw, "key not in cache",
@@ -94,32 +365,47 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 		debugf("%s %s not in %s cache", r.Method, r.URL.String(), cacheType)
-		h.passUpstream(rw, cReq)
-		return
+		if res = h.passUpstreamOnce(rw, cReq); res == nil {
+			return
+		}
+		status, reason = CacheHit, "fetched by a concurrent request"
 	} else {
 		debugf("%s %s found in %s cache", r.Method, r.URL.String(), cacheType)
 	}
 
-	if h.needsValidation(res, cReq) {
+	if validate := h.needsValidation(res, cReq); validate && h.ServeStale {
+		debugf("serving stale response without revalidating it")
+		res.Header().Add("Warning", `110 - "Response is Stale"`)
+		status, reason = CacheStale, "serve-stale mode"
+	} else if validate {
 		if cReq.CacheControl.Has("only-if-cached") {
 			http.Error(rw, "key was in cache, but required validation",
 				http.StatusGatewayTimeout)
 			return
 		}
 
-		debugf("validating cached response")
-		if h.validator.Validate(r, res) {
+		if h.staleWhileRevalidate(res, cReq) && h.revalidateInBackground(cReq) {
+			debugf("serving stale response while revalidating in the background")
+			status, reason = CacheStale, "beyond max-age, swr used"
+		} else if valid, upstreamStatus := h.validator.validate(r, res); valid {
 			debugf("response is valid")
 			h.cache.Freshen(res, cReq.Key.String())
+			status, reason = CacheRevalidated, "not modified upstream"
+		} else if errorStatus[upstreamStatus] && h.staleIfError(res, cReq) {
+			debugf("validation failed with %d, serving stale response", upstreamStatus)
+			res.Header().Add("Warning", `111 - "Revalidation Failed"`)
+			status, reason = CacheStale, fmt.Sprintf("revalidation failed with %d, stale-if-error used", upstreamStatus)
 		} else {
 			debugf("response is changed")
-			h.passUpstream(rw, cReq)
+			h.passUpstream(rw, cReq, "changed upstream")
 			return
 		}
+	} else if freshness, err := h.freshness(res, cReq); err == nil && freshness <= 0 {
+		status, reason = CacheStale, "beyond max-age, max-stale used"
 	}
 
 	debugf("serving from cache")
-	res.Header().Set(CacheHeader, "HIT")
+	setCacheStatus(res.Header(), status, reason)
 	h.serveResource(res, rw, cReq)
 
 	if err := res.Close(); err != nil {
@@ -134,6 +420,34 @@ func (h *Handler) freshness(res *Resource, r *cacheRequest) (time.Duration, erro
 		return time.Duration(0), err
 	}
 
+	ttl := h.ttl(res, r)
+	if ttl > 0 {
+		debugf("using ttl override of %s", ttl.String())
+		maxAge = ttl
+	}
+
+	age, err := res.Age()
+	if err != nil {
+		return time.Duration(0), err
+	}
+
+	if res.IsStale() {
+		return time.Duration(0), nil
+	}
+
+	if hFresh := h.heuristicFreshness(res); hFresh > maxAge && ttl <= 0 {
+		debugf("using heuristic freshness of %q", hFresh)
+		maxAge = hFresh
+	}
+
+	if h.MaxTTL > 0 && maxAge > h.MaxTTL {
+		debugf("clamping freshness of %s to max ttl of %s", maxAge, h.MaxTTL)
+		maxAge = h.MaxTTL
+	} else if h.MinTTL > 0 && maxAge < h.MinTTL {
+		debugf("clamping freshness of %s to min ttl of %s", maxAge, h.MinTTL)
+		maxAge = h.MinTTL
+	}
+
 	if r.CacheControl.Has("max-age") {
 		reqMaxAge, err := r.CacheControl.Duration("max-age")
 		if err != nil {
@@ -146,21 +460,121 @@ func (h *Handler) freshness(res *Resource, r *cacheRequest) (time.Duration, erro
 		}
 	}
 
-	age, err := res.Age()
-	if err != nil {
-		return time.Duration(0), err
+	return maxAge - age, nil
+}
+
+// heuristicFreshness returns the freshness lifetime of a response without an
+// explicit expiration, from the time since it was last modified
+// http://httpwg.github.io/specs/rfc7234.html#heuristic.freshness
+func (h *Handler) heuristicFreshness(res *Resource) time.Duration {
+	if h.DisableHeuristic || res.HasExplicitExpiration() || res.Header().Get("Last-Modified") == "" {
+		return time.Duration(0)
 	}
 
-	if res.IsStale() {
-		return time.Duration(0), nil
+	percent := h.HeuristicPercent
+	if percent <= 0 {
+		percent = DefaultHeuristicPercent
+	}
+	fresh := Clock().Sub(res.LastModified()) / 100 * time.Duration(percent)
+	if h.HeuristicMax > 0 && fresh > h.HeuristicMax {
+		return h.HeuristicMax
 	}
+	return fresh
+}
 
-	if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
-		debugf("using heuristic freshness of %q", hFresh)
-		maxAge = hFresh
+// purge invalidates the resource at the url of a PURGE request and all of
+// its Vary variants, responding with a 404 if nothing was cached
+func (h *Handler) purge(w http.ResponseWriter, r *cacheRequest) {
+	if !h.AllowPurge(r.Request) {
+		http.Error(w, "purge not allowed", http.StatusForbidden)
+		return
 	}
 
-	return maxAge - age, nil
+	purged := 0
+	for _, method := range []string{"GET", "HEAD"} {
+		purged += purgeVariants(h.cache, r.Key.ForMethod(method).String())
+	}
+
+	debugf("purged %d keys for %s", purged, r.URL.String())
+	if purged == 0 {
+		http.Error(w, "not found in cache", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "purged %d keys\n", purged)
+}
+
+// serveOffline serves a request from the cache however stale the cached
+// resource is, responding with a 504 if it isn't cached
+func (h *Handler) serveOffline(w http.ResponseWriter, r *cacheRequest) {
+	if r.Method != "GET" && r.Method != "HEAD" && !r.cachedMethod {
+		setCacheStatus(w.Header(), CacheBypass, "offline")
+		h.serveOfflinePage(w, r, "offline, "+r.Method+" requests can't be served")
+		return
+	}
+
+	res, err := h.lookup(r)
+	if err == ErrNotFoundInCache {
+		setCacheStatus(w.Header(), CacheMiss, "offline")
+		h.serveOfflinePage(w, r, "offline, key not in cache")
+		return
+	} else if err != nil {
+		http.Error(w, "lookup error: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+	defer res.Close()
+
+	if h.needsValidation(res, r) {
+		debugf("serving stale response while offline")
+		res.Header().Add("Warning", `112 - "Disconnected Operation"`)
+		setCacheStatus(res.Header(), CacheStale, "offline")
+	} else {
+		setCacheStatus(res.Header(), CacheHit, "fresh")
+	}
+	h.serveResource(res, w, r)
+}
+
+// serveOfflinePage serves the OfflinePage for a request that can't be
+// served while offline, or a 504 with msg
+func (h *Handler) serveOfflinePage(w http.ResponseWriter, r *cacheRequest, msg string) {
+	if h.OfflinePage == nil {
+		http.Error(w, msg, http.StatusGatewayTimeout)
+		return
+	}
+	h.OfflinePage.ServeHTTP(w, r.Request)
+}
+
+// staleIfError returns whether a stale resource can be served after
+// revalidating it failed, which stale-if-error allows for a time
+// https://tools.ietf.org/html/rfc5861#section-4
+func (h *Handler) staleIfError(res *Resource, r *cacheRequest) bool {
+	if h.ServeStaleOnError {
+		return true
+	}
+
+	cc, err := res.cacheControl()
+	if err != nil {
+		return false
+	}
+	if cc.Has("must-revalidate") || (cc.Has("proxy-revalidate") && h.Shared) {
+		return false
+	}
+
+	for _, directives := range []CacheControl{r.CacheControl, cc} {
+		if !directives.Has("stale-if-error") {
+			continue
+		}
+		window, err := directives.Duration("stale-if-error")
+		if err != nil {
+			continue
+		}
+		freshness, err := h.freshness(res, r)
+		if err == nil && -freshness <= window {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Handler) needsValidation(res *Resource, r *cacheRequest) bool {
@@ -204,24 +618,31 @@ func (h *Handler) needsValidation(res *Resource, r *cacheRequest) bool {
 
 // pipeUpstream makes the request via the upstream handler, the response is not stored or modified
 func (h *Handler) pipeUpstream(w http.ResponseWriter, r *cacheRequest) {
-	rw := newResponseStreamer(w)
+	rw := h.newResponseStreamer(w)
+	defer rw.Remove()
 	rdr, err := rw.Stream.NextReader()
 	if err != nil {
 		debugf("error creating next stream reader: %v", err)
-		w.Header().Set(CacheHeader, "SKIP")
+		rw.Close()
+		setCacheStatus(w.Header(), CacheBypass, "error buffering response")
 		h.upstream.ServeHTTP(w, r.Request)
 		return
 	}
 	defer rdr.Close()
 
 	debugf("piping request upstream")
+	done := make(chan struct{})
 	go func() {
-		h.upstream.ServeHTTP(rw, r.Request)
-		rw.Stream.Close()
+		defer close(done)
+		rw.serve(h.upstream, r.Request)
+	}()
+	defer func() {
+		<-done
+		rw.rethrow()
 	}()
 	rw.WaitHeaders()
 
-	if r.Method != "HEAD" && !r.isStateChanging() {
+	if r.neverCache || r.Method != "HEAD" && !r.isStateChanging() {
 		return
 	}
 
@@ -235,45 +656,61 @@ func (h *Handler) pipeUpstream(w http.ResponseWriter, r *cacheRequest) {
 	}
 }
 
-// passUpstream makes the request via the upstream handler and stores the result
-func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
-	rw := newResponseStreamer(w)
+// passUpstream makes the request via the upstream handler and stores the
+// result, returning a channel that is closed once it is stored or nil if it
+// wasn't cacheable. The reason it missed the cache is given in
+// X-Cache-Status.
+func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest, reason string) <-chan struct{} {
+	rw := h.newResponseStreamer(w)
+	defer rw.Remove()
 	rdr, err := rw.Stream.NextReader()
 	if err != nil {
 		debugf("error creating next stream reader: %v", err)
-		w.Header().Set(CacheHeader, "SKIP")
+		rw.Close()
+		setCacheStatus(w.Header(), CacheBypass, "error buffering response")
 		h.upstream.ServeHTTP(w, r.Request)
-		return
+		return nil
 	}
 
 	t := Clock()
 	debugf("passing request upstream")
-	rw.Header().Set(CacheHeader, "MISS")
+	setCacheStatus(rw.Header(), CacheMiss, reason)
 
+	done := make(chan struct{})
 	go func() {
-		h.upstream.ServeHTTP(rw, r.Request)
-		rw.Stream.Close()
+		defer close(done)
+		rw.serve(h.compressUpstream(h.upstream), r.Request)
+	}()
+	defer func() {
+		<-done
+		debugf("full upstream response took %s", Clock().Sub(t).String())
+		rw.rethrow()
 	}()
 	rw.WaitHeaders()
 	debugf("upstream responded headers in %s", Clock().Sub(t).String())
 
+	if h.CachePartial && rw.StatusCode == http.StatusPartialContent {
+		h.passPartial(rdr, rw.header, r)
+		return nil
+	}
+
 	// just the headers!
-	res := NewResourceBytes(rw.StatusCode, nil, rw.Header())
-	if !h.isCacheable(res, r) {
+	res := NewResourceBytes(rw.StatusCode, nil, rw.header)
+	if reason := h.uncacheableReason(res, r); reason != "" {
 		rdr.Close()
-		debugf("resource is uncacheable")
-		rw.Header().Set(CacheHeader, "SKIP")
-		return
+		debugf("resource is uncacheable, %s", reason)
+		setCacheStatus(rw.Header(), CacheBypass, reason)
+		return nil
 	}
-	b, err := ioutil.ReadAll(rdr)
-	rdr.Close()
-	if err != nil {
-		debugf("error reading stream: %v", err)
-		rw.Header().Set(CacheHeader, "SKIP")
-		return
+	if directive := h.forcedDirective(res, r); directive != "" {
+		debugf("forcing response to be cached despite %s", directive)
+		res.Header().Set(ForceCacheHeader, "cached despite "+directive)
 	}
-	debugf("full upstream response took %s", Clock().Sub(t).String())
-	res.ReadSeekCloser = &byteReadSeekCloser{bytes.NewReader(b)}
+	if r.strippedCookies {
+		res.Header().Del("Set-Cookie")
+	}
+	// the body is stored as it is streamed to the client
+	res.ReadSeekCloser = &streamReadSeekCloser{Reader: rdr, max: h.MaxObjectSize, aborted: rw.aborted}
 
 	if age, err := correctedAge(res.Header(), t, Clock()); err == nil {
 		res.Header().Set("Age", strconv.Itoa(int(math.Ceil(age.Seconds()))))
@@ -281,8 +718,28 @@ func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
 		debugf("error calculating corrected age: %s", err.Error())
 	}
 
-	rw.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-	h.storeResource(res, r)
+	res.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+
+	updated := http.Header{}
+	for _, key := range []string{"Age", ProxyDateHeader, ForceCacheHeader} {
+		if v := res.Header().Get(key); v != "" {
+			updated.Set(key, v)
+		}
+	}
+	var stored <-chan struct{}
+	if h.WriteBehindBytes <= 0 {
+		stored = h.storeResource(res, r)
+	}
+
+	// update the client's headers too, once upstream is done with them
+	<-done
+	for key, values := range updated {
+		rw.Header()[key] = values
+	}
+	if h.WriteBehindBytes > 0 {
+		stored = h.storeBehind(res, r, rw.written, rw.aborted())
+	}
+	return stored
 }
 
 // correctedAge adjusts the age of a resource for clock skew and travel time
@@ -313,49 +770,96 @@ func correctedAge(h http.Header, reqTime, respTime time.Time) (time.Duration, er
 	return currentAge, nil
 }
 
-func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
+// uncacheableReason returns why a response can't be stored, or an empty
+// string if it can
+func (h *Handler) uncacheableReason(res *Resource, r *cacheRequest) string {
 	cc, err := res.cacheControl()
 	if err != nil {
 		errorf("Error parsing cache-control: %s", err.Error())
-		return false
+		return "invalid cache-control"
 	}
 
-	if cc.Has("no-cache") || cc.Has("no-store") {
-		return false
+	forced := h.forcedDirective(res, r) != ""
+	if cc.Has("no-cache") && !forced {
+		return "response no-cache"
+	}
+	if cc.Has("no-store") && !forced {
+		return "response no-store"
 	}
 
-	if cc.Has("private") && len(cc["private"]) == 0 && h.Shared {
-		return false
+	if cc.Has("private") && len(cc["private"]) == 0 && h.Shared && !r.partitioned {
+		return "response private"
 	}
 
-	if _, ok := storeable[res.Status()]; !ok {
-		return false
+	if _, ok := storeable[res.Status()]; !ok && !h.negative(res) {
+		return fmt.Sprintf("status %d not storable", res.Status())
 	}
 
-	if r.Header.Get("Authorization") != "" && h.Shared {
-		return false
+	if reason := h.authorizationReason(cc, r); reason != "" {
+		return reason
+	}
+
+	if h.MaxObjectSize > 0 {
+		length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+		if err == nil && length > h.MaxObjectSize {
+			return "larger than max object size"
+		}
 	}
 
 	if res.Header().Get("Authorization") != "" && h.Shared &&
 		!cc.Has("must-revalidate") && !cc.Has("s-maxage") {
-		return false
+		return "response authorization"
 	}
 
-	if res.HasExplicitExpiration() {
-		return true
+	if r.cachedMethod && !res.HasExplicitExpiration() {
+		return "method " + r.Method + " without explicit expiration"
+	}
+
+	if res.HasExplicitExpiration() || h.ttl(res, r) > 0 || h.MinTTL > 0 || forced {
+		return ""
 	}
 
 	if _, ok := cacheableByDefault[res.Status()]; !ok && !cc.Has("public") {
-		return false
+		return fmt.Sprintf("status %d not cacheable by default", res.Status())
 	}
 
 	if res.HasValidators() {
-		return true
-	} else if res.HeuristicFreshness() > 0 {
-		return true
+		return ""
+	} else if h.heuristicFreshness(res) > 0 {
+		return ""
 	}
 
-	return false
+	return "no freshness or validators"
+}
+
+// forcedDirective returns the directive that would stop a response being
+// stored if ForceCache didn't force it to be, or an empty string
+func (h *Handler) forcedDirective(res *Resource, r *cacheRequest) string {
+	if h.ForceCache == nil {
+		return ""
+	}
+	cc, err := res.cacheControl()
+	if err != nil {
+		return ""
+	}
+
+	directives := []string{}
+	for _, directive := range []string{"no-cache", "no-store"} {
+		if cc.Has(directive) {
+			directives = append(directives, directive)
+		}
+	}
+	if len(directives) == 0 || !h.ForceCache(r.Request) {
+		return ""
+	}
+	return strings.Join(directives, " and ")
+}
+
+// setCacheStatus sets X-Cache to the cache's decision for a response, and
+// X-Cache-Status to the reason for it
+func setCacheStatus(h http.Header, status, reason string) {
+	h.Set(CacheHeader, status)
+	h.Set(CacheStatusHeader, strings.ToLower(status)+": "+reason)
 }
 
 func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cacheRequest) {
@@ -373,7 +877,7 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 	}
 
 	// http://httpwg.github.io/specs/rfc7234.html#warn.113
-	if age > (time.Hour*24) && res.HeuristicFreshness() > (time.Hour*24) {
+	if age > (time.Hour*24) && h.heuristicFreshness(res) > (time.Hour*24) {
 		w.Header().Add("Warning", `113 - "Heuristic Expiration"`)
 	}
 
@@ -389,12 +893,17 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 	w.Header().Set("Age", fmt.Sprintf("%.f", math.Floor(age.Seconds())))
 	w.Header().Set("Via", res.Via())
 
+	// the body is served rather than the resource, so that bodies that are
+	// plain files on disk are sent to clients with sendfile rather than
+	// copied through userspace
+	body := res.ReadSeekCloser
+
 	// hacky handler for non-ok statuses
 	if res.Status() != http.StatusOK {
 		w.WriteHeader(res.Status())
-		io.Copy(w, res)
+		io.Copy(w, body)
 	} else {
-		http.ServeContent(w, req.Request, "", res.LastModified(), res)
+		http.ServeContent(w, req.Request, "", res.LastModified(), body)
 	}
 }
 
@@ -407,40 +916,87 @@ func (h *Handler) invalidateResource(res *Resource, r *cacheRequest) {
 	}()
 }
 
-func (h *Handler) storeResource(res *Resource, r *cacheRequest) {
+// storeResource stores a resource in the background, returning a channel
+// that is closed once it is stored
+func (h *Handler) storeResource(res *Resource, r *cacheRequest) <-chan struct{} {
 	Writes.Add(1)
+	stored := make(chan struct{})
 
 	go func() {
 		defer Writes.Done()
-		t := Clock()
-		keys := []string{r.Key.String()}
-		headers := res.Header()
+		defer close(stored)
+		h.store(res, r)
+	}()
 
-		if h.Shared {
-			res.RemovePrivateHeaders()
-		}
+	return stored
+}
 
-		// store a secondary vary version
-		if vary := headers.Get("Vary"); vary != "" {
-			keys = append(keys, r.Key.Vary(vary, r.Request).String())
-		}
+// store stores a resource under its key and any secondary vary key
+func (h *Handler) store(res *Resource, r *cacheRequest) {
+	t := Clock()
+	keys := []string{r.Key.String()}
+	headers := res.Header()
 
-		if err := h.cache.Store(res, keys...); err != nil {
-			errorf("storing resources %#v failed with error: %s", keys, err.Error())
-		}
+	if h.Shared && !r.partitioned {
+		res.RemovePrivateHeaders()
+	}
 
-		debugf("stored resources %+v in %s", keys, Clock().Sub(t))
-	}()
+	// store a secondary vary version
+	if vary := h.vary(headers, r.Request); vary != "" {
+		keys = append(keys, r.Key.Vary(vary, r.Request).String())
+	}
+
+	if err := h.cache.Store(res, keys...); err == errTooLarge {
+		debugf("not storing resources %#v, %s", keys, err.Error())
+	} else if err != nil {
+		errorf("storing resources %#v failed with error: %s", keys, err.Error())
+	}
+	res.Close()
+
+	debugf("stored resources %+v in %s", keys, Clock().Sub(t))
+}
+
+// vary returns the Vary header of a response without the headers that
+// IgnoreVary ignores for its request
+func (h *Handler) vary(header http.Header, r *http.Request) string {
+	vary := header.Get("Vary")
+	if vary == "" || h.IgnoreVary == nil {
+		return vary
+	}
+
+	ignored := map[string]bool{}
+	for _, name := range h.IgnoreVary(r) {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	names := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !ignored[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
 }
 
 // lookupResource finds the best matching Resource for the
 // request, or nil and ErrNotFoundInCache if none is found
 func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
-	res, err := h.cache.Retrieve(req.Key.String())
+	return h.lookupWith(h.cache.Retrieve, req)
+}
+
+// peekLookup looks up a resource like lookup, without counting it as used
+func (h *Handler) peekLookup(req *cacheRequest) (*Resource, error) {
+	return h.lookupWith(func(key string) (*Resource, error) {
+		return peek(h.cache, key)
+	}, req)
+}
+
+func (h *Handler) lookupWith(retrieve func(key string) (*Resource, error), req *cacheRequest) (*Resource, error) {
+	res, err := retrieve(req.Key.String())
 
 	// HEAD requests can possibly be served from GET
 	if err == ErrNotFoundInCache && req.Method == "HEAD" {
-		res, err = h.cache.Retrieve(req.Key.ForMethod("GET").String())
+		res, err = retrieve(req.Key.ForMethod("GET").String())
 		if err != nil {
 			return nil, err
 		}
@@ -449,6 +1005,7 @@ func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
 			debugf("using cached GET request for serving HEAD")
 			return res, nil
 		} else {
+			res.Close()
 			return nil, ErrNotFoundInCache
 		}
 	} else if err != nil {
@@ -456,8 +1013,9 @@ func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
 	}
 
 	// Secondary lookup for Vary
-	if vary := res.Header().Get("Vary"); vary != "" {
-		res, err = h.cache.Retrieve(req.Key.Vary(vary, req.Request).String())
+	if vary := h.vary(res.Header(), req.Request); vary != "" {
+		res.Close()
+		res, err = retrieve(req.Key.Vary(vary, req.Request).String())
 		if err != nil {
 			return res, err
 		}
@@ -466,11 +1024,49 @@ func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
 	return res, nil
 }
 
+// lookupHeader looks up the stored headers of the resource that lookup would
+// return, without opening its body
+func (h *Handler) lookupHeader(req *cacheRequest) (*Resource, error) {
+	header, err := h.cache.Header(req.Key.String())
+	if err == ErrNotFoundInCache && req.Method == "HEAD" {
+		if header, err = h.cache.Header(req.Key.ForMethod("GET").String()); err != nil {
+			return nil, err
+		}
+		res := NewResourceBytes(header.StatusCode, nil, header.Header)
+		if !res.HasExplicitExpiration() || !req.isCacheable() {
+			return nil, ErrNotFoundInCache
+		}
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Secondary lookup for Vary
+	if vary := h.vary(header.Header, req.Request); vary != "" {
+		if header, err = h.cache.Header(req.Key.Vary(vary, req.Request).String()); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewResourceBytes(header.StatusCode, nil, header.Header), nil
+}
+
 type cacheRequest struct {
 	*http.Request
 	Key          Key
 	Time         time.Time
 	CacheControl CacheControl
+	// cachedMethod is set for requests with a method other than GET and
+	// HEAD that is cached by a MethodRule
+	cachedMethod bool
+	// bypassCookie is the cookie that makes a request bypass the cache by
+	// a CookieRule, and strippedCookies is set if one stripped its cookies
+	bypassCookie    string
+	strippedCookies bool
+	// neverCache is set for requests that match one of the NeverCache rules
+	neverCache bool
+	// partitioned is set for requests keyed by their user with AuthPartition
+	partitioned bool
 }
 
 func newCacheRequest(r *http.Request) (*cacheRequest, error) {
@@ -500,31 +1096,64 @@ func (r *cacheRequest) isStateChanging() bool {
 }
 
 func (r *cacheRequest) isCacheable() bool {
-	if !(r.Method == "GET" || r.Method == "HEAD") {
-		return false
+	return r.bypassReason() == ""
+}
+
+// bypassReason returns why a request can't be served from the cache, or an
+// empty string if it can
+func (r *cacheRequest) bypassReason() string {
+	if !(r.Method == "GET" || r.Method == "HEAD" || r.cachedMethod) {
+		return "method " + r.Method
+	}
+
+	if r.neverCache {
+		return "never-cache rule"
+	}
+
+	if r.bypassCookie != "" {
+		return "request cookie " + r.bypassCookie
 	}
 
+	// If-Range is evaluated against cached responses by http.ServeContent
 	if r.Header.Get("If-Match") != "" ||
-		r.Header.Get("If-Unmodified-Since") != "" ||
-		r.Header.Get("If-Range") != "" {
-		return false
+		r.Header.Get("If-Unmodified-Since") != "" {
+		return "conditional request"
 	}
 
 	if maxAge, ok := r.CacheControl.Get("max-age"); ok && maxAge == "0" {
-		return false
+		return "request max-age=0"
 	}
 
-	if r.CacheControl.Has("no-store") || r.CacheControl.Has("no-cache") {
-		return false
+	if r.CacheControl.Has("no-store") {
+		return "request no-store"
+	}
+	if r.CacheControl.Has("no-cache") {
+		return "request no-cache"
 	}
 
-	return true
+	return ""
 }
 
-func newResponseStreamer(w http.ResponseWriter) *responseStreamer {
-	strm, err := stream.NewStream("responseBuffer", stream.NewMemFS())
-	if err != nil {
-		panic(err)
+// newResponseStreamer returns a responseStreamer that buffers the response
+// in a temporary file in BufferDir, or in memory if it isn't set
+func (h *Handler) newResponseStreamer(w http.ResponseWriter) *responseStreamer {
+	var strm *stream.Stream
+	if h.BufferDir != "" {
+		f, err := ioutil.TempFile(h.BufferDir, "response")
+		if err == nil {
+			f.Close()
+			strm, err = stream.NewStream(f.Name(), stream.StdFileSystem)
+		}
+		if err != nil {
+			errorf("error buffering response in %s, buffering in memory: %s", h.BufferDir, err.Error())
+			strm = nil
+		}
+	}
+	if strm == nil {
+		var err error
+		if strm, err = stream.NewStream("responseBuffer", stream.NewMemFS()); err != nil {
+			panic(err)
+		}
 	}
 	return &responseStreamer{
 		ResponseWriter: w,
@@ -536,9 +1165,18 @@ func newResponseStreamer(w http.ResponseWriter) *responseStreamer {
 type responseStreamer struct {
 	StatusCode int
 	http.ResponseWriter
+	// header is a copy of the headers as they were written, which the
+	// upstream may go on using while the response is stored
+	header http.Header
 	*stream.Stream
 	// C will be closed by WriteHeader to signal the headers' writing.
-	C chan struct{}
+	C    chan struct{}
+	once sync.Once
+	// panicked is what upstream panicked with, set before the stream is
+	// closed
+	panicked atomic.Value
+	// written is the bytes of the body written so far
+	written int64
 }
 
 // WaitHeaders returns iff and when WriteHeader has been called.
@@ -547,20 +1185,68 @@ func (rw *responseStreamer) WaitHeaders() {
 	}
 }
 
+// WriteHeader writes the status code on the first call, later calls are ignored
 func (rw *responseStreamer) WriteHeader(status int) {
-	defer close(rw.C)
-	rw.StatusCode = status
-	rw.ResponseWriter.WriteHeader(status)
+	rw.once.Do(func() {
+		defer close(rw.C)
+		rw.StatusCode = status
+		rw.header = rw.ResponseWriter.Header().Clone()
+		rw.ResponseWriter.WriteHeader(status)
+	})
 }
 
 func (rw *responseStreamer) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
 	rw.Stream.Write(b)
+	rw.written += int64(len(b))
 	return rw.ResponseWriter.Write(b)
 }
 func (rw *responseStreamer) Close() error {
 	return rw.Stream.Close()
 }
 
+// serve serves a request with upstream and closes the stream. Upstream
+// panics, such as http.ErrAbortHandler from a reverse proxy whose origin
+// fails part way through a response, are recovered so that they don't
+// crash the process from this goroutine, to be raised again by rethrow.
+func (rw *responseStreamer) serve(upstream http.Handler, r *http.Request) {
+	defer rw.Stream.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				errorf("upstream panicked: %v\n%s", err, debug.Stack())
+			}
+			rw.panicked.Store(err)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}()
+	upstream.ServeHTTP(rw, r)
+}
+
+// aborted returns whether upstream panicked rather than finishing the
+// response
+func (rw *responseStreamer) aborted() bool {
+	return rw.panicked.Load() != nil
+}
+
+// rethrow raises the panic that upstream panicked with in the handler's
+// goroutine, so that the server aborts the response, once serve has returned
+func (rw *responseStreamer) rethrow() {
+	if err := rw.panicked.Load(); err != nil {
+		panic(err)
+	}
+}
+
+// Remove deletes the buffer in the background, once the response has been
+// written and its readers are closed
+func (rw *responseStreamer) Remove() {
+	go func() {
+		if err := rw.Stream.Remove(); err != nil {
+			debugf("error removing response buffer: %s", err.Error())
+		}
+	}()
+}
+
 // Resource returns a copy of the responseStreamer as a Resource object
 func (rw *responseStreamer) Resource() *Resource {
 	r, err := rw.Stream.NextReader()
@@ -578,6 +1264,50 @@ func (rw *responseStreamer) Resource() *Resource {
 	}
 }
 
+// errTooLarge stops responses without a Content-Length that turn out to be
+// larger than MaxObjectSize from being stored
+var errTooLarge = errors.New("response is larger than max object size")
+
+// streamReadSeekCloser reads a response as it is streamed from upstream,
+// blocking until the part being read has been written, and failing once
+// more than max bytes have been read if it isn't 0, or at the end of a
+// response that upstream aborted
+type streamReadSeekCloser struct {
+	*stream.Reader
+	offset  int64
+	max     int64
+	aborted func() bool
+}
+
+func (s *streamReadSeekCloser) Read(p []byte) (int, error) {
+	n, err := s.Reader.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if s.max > 0 && s.offset > s.max {
+		return n, errTooLarge
+	}
+	if err == io.EOF && s.aborted != nil && s.aborted() {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek seeks relative to the start of the response or the current offset,
+// as its end isn't known until it has been streamed
+func (s *streamReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	default:
+		return s.offset, errors.New("can't seek from the end of a stream")
+	}
+	if offset < 0 {
+		return s.offset, errors.New("negative offset")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
 type errReadSeekCloser struct {
 	err error
 }
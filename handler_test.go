@@ -0,0 +1,843 @@
+package httpcache_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUncacheableResponseBodyIsPassedThrough(t *testing.T) {
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("llamas"))
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(" rock"))
+	}))
+	client := &client{handler, handler}
+
+	for _, r := range []*clientResponse{client.get("/"), client.post("/")} {
+		assert.Equal(t, http.StatusOK, r.statusCode)
+		assert.Equal(t, "llamas rock", string(r.body))
+	}
+}
+
+func TestUpstreamWithoutResponse(t *testing.T) {
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := &client{handler, handler}
+
+	r := client.get("/")
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, "", string(r.body))
+}
+
+func TestTTLOverridesFreshness(t *testing.T) {
+	var cases = []struct {
+		cacheControl   string
+		secondsElapsed time.Duration
+		requests       int
+	}{
+		{cacheControl: "max-age=5", secondsElapsed: 30, requests: 1},
+		{cacheControl: "max-age=600", secondsElapsed: 65, requests: 2},
+		{cacheControl: "", secondsElapsed: 30, requests: 1},
+		{cacheControl: "no-store", secondsElapsed: 0, requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.TTL = time.Minute
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestTTLRulesOverrideFreshness(t *testing.T) {
+	var cases = []struct {
+		path, cacheControl string
+		secondsElapsed     time.Duration
+		requests           int
+	}{
+		{path: "/api/1", cacheControl: "max-age=600", secondsElapsed: 65, requests: 2},
+		{path: "/api/1", cacheControl: "", secondsElapsed: 30, requests: 1},
+		{path: "/static/1", cacheControl: "max-age=600", secondsElapsed: 65, requests: 1},
+		{path: "/static/1", cacheControl: "", secondsElapsed: 3000, requests: 1},
+		{path: "/other", cacheControl: "max-age=5", secondsElapsed: 30, requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.TTLRules = []httpcache.TTLRule{
+			{Host: "*.org", Path: "/api/*", TTL: time.Minute},
+			{Path: "/static/*", TTL: time.Hour, IfMissing: true},
+		}
+
+		assert.Equal(t, http.StatusOK, client.get(c.path).Code)
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+
+		assert.Equal(t, http.StatusOK, client.get(c.path).Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestAuthPolicies(t *testing.T) {
+	var cases = []struct {
+		policy       httpcache.AuthPolicy
+		cacheControl string
+		requests     int
+	}{
+		{policy: "", cacheControl: "public, max-age=600", requests: 2},
+		{policy: httpcache.AuthNever, cacheControl: "public, max-age=600", requests: 2},
+		{policy: httpcache.AuthStrict, cacheControl: "max-age=600", requests: 2},
+		{policy: httpcache.AuthStrict, cacheControl: "public, max-age=600", requests: 1},
+		{policy: httpcache.AuthPartition, cacheControl: "max-age=600", requests: 1},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		client.cacheHandler.Shared = true
+		client.cacheHandler.AuthPolicy = c.policy
+		upstream.CacheControl = c.cacheControl
+
+		client.get("/", "Authorization: Bearer llamas")
+		client.get("/", "Authorization: Bearer llamas")
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+
+	client, upstream := testSetup()
+	client.cacheHandler.Shared = true
+	client.cacheHandler.AuthPolicy = httpcache.AuthPartition
+	upstream.CacheControl = "max-age=600"
+	assert.Equal(t, "MISS", client.get("/", "Authorization: Bearer llamas").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Authorization: Bearer alpacas").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Authorization: Bearer alpacas").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestPartitionHeaderCachesPrivateResponsesPerUser(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Shared = true
+	client.cacheHandler.AuthPolicy = httpcache.AuthPartition
+	client.cacheHandler.PartitionHeader = "X-User-Id"
+	upstream.CacheControl = "private, max-age=600"
+
+	assert.Equal(t, "MISS", client.get("/", "X-User-Id: llamas").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "X-User-Id: llamas").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "X-User-Id: alpacas").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+
+	// without a user private responses aren't stored
+	assert.Equal(t, "BYPASS", client.get("/").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/", "Authorization: Bearer llamas").cacheStatus)
+	assert.Equal(t, 4, upstream.requests)
+}
+
+func TestESIAssemblesFragments(t *testing.T) {
+	requests := map[string]int{}
+	var mu sync.Mutex
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+
+		w.Header().Set("Date", httpcache.Clock().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Cache-Control", "max-age=600")
+			w.Header().Set("ETag", `"page"`)
+			fmt.Fprint(w, `<html><esi:include src="/header"/><esi:remove>no esi</esi:remove>`+
+				`<!--esi <p>esi</p> --><esi:include src="counter?a=1&amp;b=2"></esi:include></html>`)
+		case "/header":
+			w.Header().Set("Cache-Control", "max-age=600")
+			fmt.Fprint(w, "<h1>llamas</h1>")
+		case "/counter":
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprintf(w, "%d %s", n, r.URL.RawQuery)
+		}
+	})
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+	handler.Shared = true
+	handler.ESI = true
+
+	for i := 1; i <= 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newRequest("GET", "http://example.org/page"))
+		httpcache.Writes.Wait()
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, fmt.Sprintf("<html><h1>llamas</h1> <p>esi</p> %d a=1&b=2</html>", i), rec.Body.String())
+		assert.Equal(t, "", rec.Header().Get("ETag"))
+	}
+	assert.Equal(t, map[string]int{"/page": 1, "/header": 1, "/counter": 2}, requests)
+}
+
+func TestNeverCacheRulesBypassCache(t *testing.T) {
+	var cases = []struct {
+		path     string
+		requests int
+	}{
+		{path: "/admin/users", requests: 2},
+		{path: "/users/12/settings", requests: 2},
+		{path: "/users/llamas/settings", requests: 1},
+		{path: "/api/auth/login", requests: 1},
+		{path: "/", requests: 1},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = "max-age=600"
+		client.cacheHandler.NeverCache = []httpcache.BypassRule{
+			{Path: "/admin/*"},
+			{PathRegexp: regexp.MustCompile(`^/users/[0-9]+/settings$`)},
+			{Host: "*.net", Path: "/api/auth/*"},
+		}
+
+		client.get(c.path)
+		r := client.get(c.path)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+		if c.requests == 2 {
+			assert.Equal(t, "bypass: never-cache rule", r.header.Get(httpcache.CacheStatusHeader))
+		}
+	}
+}
+
+func TestCookieRulesStripAndBypass(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=600"
+	upstream.Vary = "Cookie"
+	upstream.Header = http.Header{"Set-Cookie": []string{"tracking=1"}}
+	client.cacheHandler.CookieRules = []httpcache.CookieRule{
+		{Path: "/static/*", Strip: true},
+		{Bypass: []string{"session*"}},
+	}
+	cookies := []string{}
+	upstream.assert(func(r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+	})
+
+	assert.Equal(t, "MISS", client.get("/static/a.css", "Cookie: theme=dark").cacheStatus)
+	r := client.get("/static/a.css", "Cookie: theme=light")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "", r.header.Get("Set-Cookie"))
+	assert.Equal(t, []string{""}, cookies)
+
+	assert.Equal(t, "MISS", client.get("/account").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/account").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/account", "Cookie: sessionid=123").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+	assert.Equal(t, "sessionid=123", cookies[2])
+}
+
+func TestRewritesChangePathsBeforeKeying(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=600"
+	client.cacheHandler.Rewrites = []httpcache.RewriteRule{
+		{Pattern: regexp.MustCompile(`^/v1/(.*)$`), Replacement: "/api/$1"},
+		{Pattern: regexp.MustCompile(`^/old/(?P<name>.*)$`), Replacement: "/new/${name}", Redirect: http.StatusMovedPermanently},
+		{Host: "legacy.example.com", Pattern: regexp.MustCompile(`^/`), Replacement: "https://example.com/", Redirect: http.StatusFound},
+	}
+	paths := []string{}
+	upstream.assert(func(r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+	})
+
+	assert.Equal(t, "MISS", client.get("/v1/llamas?id=1").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/api/llamas?id=1").cacheStatus)
+	assert.Equal(t, []string{"/api/llamas?id=1"}, paths)
+
+	r := client.get("/old/alpacas?id=2")
+	assert.Equal(t, http.StatusMovedPermanently, r.Code)
+	assert.Equal(t, "/new/alpacas?id=2", r.header.Get("Location"))
+
+	r = client.do(newRequest("GET", "http://legacy.example.com/llamas"))
+	assert.Equal(t, http.StatusFound, r.Code)
+	assert.Equal(t, "https://example.com/", r.header.Get("Location"))
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSyntheticResponsesAreServedWithoutUpstream(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Synthetic = []httpcache.SyntheticResponse{
+		{Path: "/robots.txt", Header: http.Header{"Content-Type": []string{"text/plain"}}, Body: []byte("User-agent: *\nDisallow:\n")},
+		{Host: "old.example.com", Status: http.StatusGone, Body: []byte("gone")},
+	}
+
+	r := client.get("/robots.txt")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "text/plain", r.header.Get("Content-Type"))
+	assert.Equal(t, "User-agent: *\nDisallow:\n", string(r.body))
+	assert.Equal(t, "", r.cacheStatus)
+
+	r = client.get("/robots.txt", "Range: bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "User-agent", string(r.body))
+
+	r = client.do(newRequest("GET", "http://old.example.com/llamas"))
+	assert.Equal(t, http.StatusGone, r.Code)
+	assert.Equal(t, "gone", string(r.body))
+	assert.Equal(t, 0, upstream.requests)
+
+	assert.Equal(t, http.StatusOK, client.get("/llamas").Code)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestHeaderRulesRewriteRequestsAndResponses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=600"
+	upstream.Header = http.Header{"Server": []string{"llama/1.0"}}
+	client.cacheHandler.HeaderRules = []httpcache.HeaderRule{
+		{
+			Request:  []httpcache.HeaderChange{{Op: httpcache.HeaderSet, Name: "X-Forwarded-Proto", Value: "https"}},
+			Response: []httpcache.HeaderChange{{Op: httpcache.HeaderRemove, Name: "Server"}},
+		},
+		{
+			Path:     "/admin/*",
+			Request:  []httpcache.HeaderChange{{Op: httpcache.HeaderRemove, Name: "X-Debug"}},
+			Response: []httpcache.HeaderChange{{Op: httpcache.HeaderAdd, Name: "X-Frame-Options", Value: "DENY"}},
+		},
+	}
+	requests := []http.Header{}
+	upstream.assert(func(r *http.Request) {
+		requests = append(requests, r.Header)
+	})
+
+	r := client.get("/llamas", "X-Forwarded-Proto: http", "X-Debug: 1")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "", r.header.Get("Server"))
+	assert.Equal(t, "", r.header.Get("X-Frame-Options"))
+	assert.Equal(t, "https", requests[0].Get("X-Forwarded-Proto"))
+	assert.Equal(t, "1", requests[0].Get("X-Debug"))
+
+	r = client.get("/llamas")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "", r.header.Get("Server"))
+
+	r = client.get("/admin/llamas", "X-Debug: 1")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "DENY", r.header.Get("X-Frame-Options"))
+	assert.Equal(t, "", requests[1].Get("X-Debug"))
+
+	r = client.get("/admin/llamas")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, []string{"DENY"}, r.header["X-Frame-Options"])
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestStripQueryRemovesTrackingParameters(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=600"
+	client.cacheHandler.StripQuery = httpcache.DefaultStripQuery
+	queries := []string{}
+	upstream.assert(func(r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+	})
+
+	assert.Equal(t, http.StatusOK, client.get("/llamas?id=1&utm_source=news&fbclid=abc").Code)
+	assert.Equal(t, http.StatusOK, client.get("/llamas?gclid=xyz&id=1&utm_medium=email").Code)
+	assert.Equal(t, http.StatusOK, client.get("/llamas?id=1").Code)
+	assert.Equal(t, 1, upstream.requests)
+	assert.Equal(t, []string{"id=1&utm_source=news&fbclid=abc"}, queries)
+
+	client.cacheHandler.StripQueryUpstream = true
+	assert.Equal(t, http.StatusOK, client.get("/alpacas?utm_campaign=spring&id=2").Code)
+	assert.Equal(t, 2, upstream.requests)
+	assert.Equal(t, "id=2", queries[1])
+}
+
+func TestKeyRulesChooseKeyedParts(t *testing.T) {
+	var cases = []struct {
+		first, second []string
+		requests      int
+	}{
+		{first: []string{"/static/a.css?v=1"}, second: []string{"/static/a.css?v=2"}, requests: 1},
+		{first: []string{"/api/1?id=1&utm_source=x"}, second: []string{"/api/1?utm_source=y&id=1"}, requests: 1},
+		{first: []string{"/api/1?id=1"}, second: []string{"/api/1?id=2"}, requests: 2},
+		{first: []string{"/api/1", "Accept-Language: en"}, second: []string{"/api/1", "Accept-Language: fr"}, requests: 2},
+		{first: []string{"/shop", "Cookie: currency=usd; session=1"}, second: []string{"/shop", "Cookie: session=2; currency=usd"}, requests: 1},
+		{first: []string{"/shop", "Cookie: currency=usd"}, second: []string{"/shop", "Cookie: currency=eur"}, requests: 2},
+		{first: []string{"/other?v=1"}, second: []string{"/other?v=2"}, requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = "max-age=600"
+		client.cacheHandler.KeyRules = []httpcache.KeyRule{
+			{Path: "/static/*", IgnoreQuery: true},
+			{Host: "*.org", Path: "/api/*", Query: []string{"id"}, Headers: []string{"accept-language"}},
+			{Path: "/shop", Cookies: []string{"currency"}},
+		}
+
+		assert.Equal(t, http.StatusOK, client.get(c.first[0], c.first[1:]...).Code)
+		assert.Equal(t, http.StatusOK, client.get(c.second[0], c.second[1:]...).Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestCacheMethodsCachesResponsesByBody(t *testing.T) {
+	var cases = []struct {
+		method, path, body, cacheControl string
+		requests                         int
+	}{
+		{method: "POST", path: "/api/search", body: "llamas", cacheControl: "max-age=600", requests: 1},
+		{method: "POST", path: "/api/search", body: "llamas", cacheControl: "", requests: 2},
+		{method: "POST", path: "/api/other", body: "llamas", cacheControl: "max-age=600", requests: 2},
+		{method: "OPTIONS", path: "/", body: "", cacheControl: "max-age=600", requests: 1},
+		{method: "PUT", path: "/api/search", body: "llamas", cacheControl: "max-age=600", requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.CacheMethods = []httpcache.MethodRule{
+			{Method: "POST", Path: "/api/search"},
+			{Method: "OPTIONS"},
+		}
+		bodies := []string{}
+		upstream.assert(func(r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+		})
+
+		for i := 0; i < 2; i++ {
+			req := newRequest(c.method, "http://example.org"+c.path)
+			req.Body = ioutil.NopCloser(strings.NewReader(c.body))
+			assert.Equal(t, http.StatusOK, client.do(req).Code)
+		}
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+		for _, body := range bodies {
+			assert.Equal(t, c.body, body, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+		}
+	}
+
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=600"
+	client.cacheHandler.CacheMethods = []httpcache.MethodRule{{Method: "POST"}}
+	for _, body := range []string{"llamas", "alpacas", "llamas"} {
+		req := newRequest("POST", "http://example.org/")
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		client.do(req)
+	}
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestMinAndMaxTTLClampFreshness(t *testing.T) {
+	var cases = []struct {
+		cacheControl   string
+		secondsElapsed time.Duration
+		requests       int
+	}{
+		{cacheControl: "max-age=31536000", secondsElapsed: 3700, requests: 2},
+		{cacheControl: "max-age=31536000", secondsElapsed: 1800, requests: 1},
+		{cacheControl: "max-age=0", secondsElapsed: 5, requests: 1},
+		{cacheControl: "max-age=0", secondsElapsed: 15, requests: 2},
+		{cacheControl: "max-age=600", secondsElapsed: 300, requests: 1},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.MinTTL = time.Second * 10
+		client.cacheHandler.MaxTTL = time.Hour
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestHeuristicFreshnessIsConfigurable(t *testing.T) {
+	var cases = []struct {
+		percent        int
+		max            time.Duration
+		disable        bool
+		secondsElapsed time.Duration
+		requests       int
+	}{
+		{percent: 1, secondsElapsed: 48 * 3600, requests: 1},
+		{percent: 1, secondsElapsed: 96 * 3600, requests: 2},
+		{max: time.Hour * 24, secondsElapsed: 48 * 3600, requests: 2},
+		{disable: true, secondsElapsed: 60, requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.LastModified = upstream.Now.AddDate(-1, 0, 0)
+		client.cacheHandler.HeuristicPercent = c.percent
+		client.cacheHandler.HeuristicMax = c.max
+		client.cacheHandler.DisableHeuristic = c.disable
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestConcurrentMissesAreCoalesced(t *testing.T) {
+	var requests int32
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("llamas"))
+	}))
+	client := &client{handler, handler}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := client.get("/")
+			assert.Equal(t, http.StatusOK, r.statusCode)
+			assert.Equal(t, "llamas", string(r.body))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestBufferDirStreamsResponsesThroughFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("llamas"))
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(" rock"))
+	}))
+	handler.BufferDir = dir
+	client := &client{handler, handler}
+
+	r := client.get("/")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "llamas rock", string(r.body))
+
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "llamas rock", string(r.body))
+
+	// buffers are removed in the background
+	var files []os.FileInfo
+	for i := 0; i < 100; i++ {
+		if files, _ = ioutil.ReadDir(dir); len(files) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Empty(t, files)
+}
+
+func TestMaxObjectSizeBypassesLargeResponses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Body = []byte("llamas rock")
+	client.cacheHandler.MaxObjectSize = 6
+
+	r := client.get("/")
+	assert.Equal(t, "BYPASS", r.cacheStatus)
+	assert.Equal(t, "bypass: larger than max object size", r.header.Get(httpcache.CacheStatusHeader))
+	assert.Equal(t, "llamas rock", string(r.body))
+	assert.Equal(t, "BYPASS", client.get("/").cacheStatus)
+
+	upstream.Body = []byte("llamas")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestMaxObjectSizeWithoutContentLength(t *testing.T) {
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("llamas"))
+		w.Write([]byte(" rock"))
+	}))
+	handler.MaxObjectSize = 6
+	client := &client{handler, handler}
+
+	for i := 0; i < 2; i++ {
+		r := client.get("/")
+		assert.Equal(t, "MISS", r.cacheStatus)
+		assert.Equal(t, "llamas rock", string(r.body))
+	}
+}
+
+func TestAbortedResponsesAreNotStored(t *testing.T) {
+	var abort int32 = 1
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("llamas"))
+		if atomic.LoadInt32(&abort) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(" rock"))
+	}))
+	client := &client{handler, handler}
+
+	assert.Panics(t, func() { client.get("/") })
+	httpcache.Writes.Wait()
+
+	atomic.StoreInt32(&abort, 0)
+	r := client.get("/")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "llamas rock", string(r.body))
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+}
+
+func TestWriteBehindStoresResponses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Body = []byte("llamas rock")
+	client.cacheHandler.WriteBehindBytes = 16
+
+	assert.Equal(t, "MISS", client.get("/llamas").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/llamas").cacheStatus)
+
+	// responses larger than the queue aren't stored
+	upstream.Body = []byte("llamas rockllamas rock")
+	r := client.get("/alpacas")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "llamas rockllamas rock", string(r.body))
+	assert.Equal(t, "MISS", client.get("/alpacas").cacheStatus)
+}
+
+func TestConcurrentUncacheableMissesAreNotCoalesced(t *testing.T) {
+	var requests int32
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("llamas"))
+	}))
+	client := &client{handler, handler}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "llamas", string(client.get("/").body))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+}
+
+func TestPurgeInvalidatesVaryVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept"
+
+	index := httpcache.NewIndexedCache(httpcache.NewMemoryCache())
+	handler := httpcache.NewHandler(index, upstream)
+	handler.AllowPurge = func(r *http.Request) bool {
+		return r.Header.Get("X-Purge-Token") == "llamas"
+	}
+	client.handler, client.cacheHandler = handler, handler
+
+	client.get("/", "Accept: text/plain")
+	client.get("/", "Accept: text/html")
+	assert.Equal(t, "HIT", client.get("/", "Accept: text/plain").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+
+	purge := func(path string, headers ...string) *clientResponse {
+		return client.do(newRequest("PURGE", "http://example.org"+path, headers...))
+	}
+	assert.Equal(t, http.StatusForbidden, purge("/").statusCode)
+	assert.Equal(t, http.StatusOK, purge("/", "X-Purge-Token: llamas").statusCode)
+	assert.Equal(t, http.StatusNotFound, purge("/missing", "X-Purge-Token: llamas").statusCode)
+	assert.Equal(t, 2, upstream.requests)
+
+	// purged resources are revalidated
+	client.get("/", "Accept: text/html")
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestPurgeIsPassedUpstreamWithoutAllowPurge(t *testing.T) {
+	client, upstream := testSetup()
+	r := client.do(newRequest("PURGE", "http://example.org/"))
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestCacheStatusReasons(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+
+	var cases = []struct {
+		response     *clientResponse
+		cacheStatus  string
+		statusReason string
+	}{
+		{client.get("/"), "MISS", "miss: not in cache"},
+		{client.get("/"), "HIT", "hit: fresh"},
+		{client.post("/"), "BYPASS", "bypass: method POST"},
+		{client.get("/", "Cache-Control: no-store"), "BYPASS", "bypass: request no-store"},
+		{client.get("/", "If-Match: *"), "BYPASS", "bypass: conditional request"},
+	}
+
+	for idx, c := range cases {
+		assert.Equal(t, c.cacheStatus, c.response.cacheStatus, fmt.Sprintf("case #%d failed", idx+1))
+		assert.Equal(t, c.statusReason, c.response.header.Get(httpcache.CacheStatusHeader), fmt.Sprintf("case #%d failed", idx+1))
+	}
+
+	upstream.CacheControl = "no-store"
+	r := client.get("/uncacheable")
+	assert.Equal(t, "BYPASS", r.cacheStatus)
+	assert.Equal(t, "bypass: response no-store", r.header.Get(httpcache.CacheStatusHeader))
+}
+
+func TestOfflineNeverContactsUpstream(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	client.get("/")
+	client.cacheHandler.Offline = true
+
+	r := client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+
+	upstream.timeTravel(time.Minute * 2)
+	r = client.get("/", "Cache-Control: no-cache")
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, "STALE", r.cacheStatus)
+	assert.Contains(t, r.header["Warning"], `112 - "Disconnected Operation"`)
+
+	assert.Equal(t, http.StatusGatewayTimeout, client.get("/missing").statusCode)
+	assert.Equal(t, http.StatusGatewayTimeout, client.post("/").statusCode)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestOfflinePageIsServedForMisses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	client.get("/")
+	client.cacheHandler.Offline = true
+	client.cacheHandler.OfflinePage = httpcache.SyntheticResponse{
+		Status: http.StatusServiceUnavailable,
+		Header: http.Header{"Retry-After": []string{"300"}},
+		Body:   []byte("down for maintenance"),
+	}
+
+	upstream.timeTravel(time.Minute * 2)
+	r := client.get("/")
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, "STALE", r.cacheStatus)
+
+	r = client.get("/missing")
+	assert.Equal(t, http.StatusServiceUnavailable, r.statusCode)
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "300", r.header.Get("Retry-After"))
+	assert.Equal(t, "down for maintenance", string(r.body))
+
+	assert.Equal(t, http.StatusServiceUnavailable, client.post("/").statusCode)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestServeStaleNeverRevalidates(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, must-revalidate"
+	client.get("/")
+	client.cacheHandler.ServeStale = true
+
+	upstream.timeTravel(time.Hour)
+	r := client.get("/")
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, "STALE", r.cacheStatus)
+	assert.Contains(t, r.header["Warning"], `110 - "Response is Stale"`)
+	assert.Equal(t, "STALE", client.get("/", "Cache-Control: max-stale=0").cacheStatus)
+	assert.Equal(t, 1, upstream.requests)
+
+	assert.Equal(t, "MISS", client.get("/missing").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+
+	client.cacheHandler.ServeStale = false
+	assert.Equal(t, "REVALIDATED", client.get("/").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestForceCacheStoresNoStoreResponses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "no-store, no-cache"
+	client.cacheHandler.TTL = time.Minute
+	client.cacheHandler.ForceCache = func(r *http.Request) bool {
+		return r.URL.Path != "/compliant"
+	}
+
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	r := client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "cached despite no-cache and no-store", r.header.Get(httpcache.ForceCacheHeader))
+
+	assert.Equal(t, "BYPASS", client.get("/compliant").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/compliant").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestNegativeTTLCachesErrors(t *testing.T) {
+	var cases = []struct {
+		statusCode     int
+		cacheControl   string
+		secondsElapsed time.Duration
+		requests       int
+	}{
+		{statusCode: http.StatusNotFound, secondsElapsed: 5, requests: 1},
+		{statusCode: http.StatusNotFound, secondsElapsed: 15, requests: 2},
+		{statusCode: http.StatusServiceUnavailable, secondsElapsed: 5, requests: 1},
+		{statusCode: http.StatusServiceUnavailable, cacheControl: "no-store", secondsElapsed: 5, requests: 2},
+		{statusCode: http.StatusNotFound, cacheControl: "max-age=60", secondsElapsed: 30, requests: 1},
+		{statusCode: http.StatusForbidden, secondsElapsed: 5, requests: 2},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.StatusCode = c.statusCode
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.NegativeTTL = time.Second * 10
+
+		assert.Equal(t, c.statusCode, client.get("/").Code)
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+
+		assert.Equal(t, c.statusCode, client.get("/").Code)
+		assert.Equal(t, c.requests, upstream.requests, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+	}
+}
+
+func TestIgnoreVaryCachesOneVariant(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "User-Agent, Accept-Language"
+	client.cacheHandler.IgnoreVary = func(r *http.Request) []string {
+		return []string{"user-agent"}
+	}
+
+	assert.Equal(t, "MISS", client.get("/", "User-Agent: llama/1", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "User-Agent: alpaca/2", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "User-Agent: llama/1", "Accept-Language: fr").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+}
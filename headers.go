@@ -0,0 +1,110 @@
+package httpcache
+
+import (
+	"io"
+	"net/http"
+)
+
+// HeaderOp is how a HeaderChange changes a header
+type HeaderOp string
+
+const (
+	// HeaderAdd adds a value to a header, keeping any it already has
+	HeaderAdd HeaderOp = "add"
+	// HeaderSet replaces the values of a header
+	HeaderSet HeaderOp = "set"
+	// HeaderRemove removes a header
+	HeaderRemove HeaderOp = "remove"
+)
+
+// HeaderChange is a change to a header of requests or responses
+type HeaderChange struct {
+	Op    HeaderOp
+	Name  string
+	Value string
+}
+
+func (c HeaderChange) apply(h http.Header) {
+	switch c.Op {
+	case HeaderAdd:
+		h.Add(c.Name, c.Value)
+	case HeaderSet:
+		h.Set(c.Name, c.Value)
+	case HeaderRemove:
+		h.Del(c.Name)
+	}
+}
+
+// HeaderRule changes the headers of requests whose Host and path match its
+// patterns, in which * matches anything, and of the responses to them
+type HeaderRule struct {
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+
+	// Request are the changes to requests before they are keyed and passed
+	// upstream, such as setting X-Forwarded-Proto
+	Request []HeaderChange
+	// Response are the changes to responses as they are served, whether
+	// from the cache or upstream, such as removing Server. They aren't
+	// stored, so that changing them applies to cached responses too.
+	Response []HeaderChange
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule HeaderRule) Matches(r *http.Request) bool {
+	return matchHostPath(rule.Host, rule.Path, r)
+}
+
+// rewriteHeaders applies the request changes of all the HeaderRules that
+// match a request, in order, returning a writer that applies their
+// response changes
+func (h *Handler) rewriteHeaders(rw http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var changes []HeaderChange
+	for _, rule := range h.HeaderRules {
+		if !rule.Matches(r) {
+			continue
+		}
+		for _, change := range rule.Request {
+			change.apply(r.Header)
+		}
+		changes = append(changes, rule.Response...)
+	}
+	if len(changes) == 0 {
+		return rw
+	}
+	return &headerWriter{ResponseWriter: rw, changes: changes}
+}
+
+// headerWriter changes the headers of a response as it is written
+type headerWriter struct {
+	http.ResponseWriter
+	changes     []HeaderChange
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for _, change := range w.changes {
+			change.apply(w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sending files with sendfile
+func (w *headerWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
@@ -0,0 +1,184 @@
+package httplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pruneEvery is how many exchanges are dumped between removing old dumps
+const pruneEvery = 100
+
+// dumpSeq numbers dumps, so that exchanges started at once get their own
+// files
+var dumpSeq uint64
+
+// dumpToDir writes an exchange to a file of its own in DumpDir
+func (l *ResponseLogger) dumpToDir(req *http.Request, respWr *responseWriter) {
+	seq := atomic.AddUint64(&dumpSeq, 1)
+	name := fmt.Sprintf("%s-%06d", respWr.t.UTC().Format("20060102T150405.000"), seq%1000000)
+
+	var b []byte
+	if l.DumpHAR {
+		name += ".har"
+		b = l.har(req, respWr)
+	} else {
+		name += ".txt"
+		b = l.dumpText(req, respWr)
+	}
+
+	if err := os.MkdirAll(l.DumpDir, 0755); err != nil {
+		log.Printf("error dumping exchange: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.DumpDir, name), b, 0644); err != nil {
+		log.Printf("error dumping exchange: %s", err.Error())
+		return
+	}
+
+	if l.DumpKeep > 0 && seq%pruneEvery == 0 {
+		l.pruneDumps()
+	}
+}
+
+// pruneDumps removes the oldest dumps beyond DumpKeep
+func (l *ResponseLogger) pruneDumps() {
+	files, err := ioutil.ReadDir(l.DumpDir)
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for _, f := range files {
+		if ext := filepath.Ext(f.Name()); ext == ".txt" || ext == ".har" {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > l.DumpKeep {
+		os.Remove(filepath.Join(l.DumpDir, names[0]))
+		names = names[1:]
+	}
+}
+
+// dumpText returns the same dump of an exchange that is written to stderr
+func (l *ResponseLogger) dumpText(req *http.Request, respWr *responseWriter) []byte {
+	buf := &bytes.Buffer{}
+
+	if l.DumpRequests {
+		redacted := *req
+		redacted.Header = l.redact(req.Header)
+		b, _ := httputil.DumpRequest(&redacted, false)
+		buf.Write(b)
+	}
+	if l.DumpResponses {
+		buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n",
+			respWr.status, http.StatusText(respWr.status),
+		))
+		l.redact(respWr.Header()).Write(buf)
+		buf.WriteString("\r\n")
+	}
+	if l.DumpErrors && isError(respWr.status) {
+		buf.Write(respWr.errorOutput.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// harNameValue is a header or query parameter in a HAR archive
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// har returns an exchange as a HAR 1.2 archive of a single entry
+// http://www.softwareishard.com/blog/har-12-spec/
+func (l *ResponseLogger) har(req *http.Request, respWr *responseWriter) []byte {
+	u := *req.URL
+	if !u.IsAbs() {
+		u.Scheme, u.Host = "http", req.Host
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	query := []harNameValue{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query = append(query, harNameValue{name, value})
+		}
+	}
+
+	elapsed := float64(time.Since(respWr.t)) / float64(time.Millisecond)
+	status := respWr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	entry := map[string]interface{}{
+		"startedDateTime": respWr.t.Format(time.RFC3339Nano),
+		"time":            elapsed,
+		"request": map[string]interface{}{
+			"method":      req.Method,
+			"url":         u.String(),
+			"httpVersion": req.Proto,
+			"cookies":     []interface{}{},
+			"headers":     harHeaders(l.redact(req.Header)),
+			"queryString": query,
+			"headersSize": -1,
+			"bodySize":    -1,
+		},
+		"response": map[string]interface{}{
+			"status":      status,
+			"statusText":  http.StatusText(status),
+			"httpVersion": "HTTP/1.1",
+			"cookies":     []interface{}{},
+			"headers":     harHeaders(l.redact(respWr.Header())),
+			"content": map[string]interface{}{
+				"size":     respWr.size,
+				"mimeType": respWr.Header().Get("Content-Type"),
+				"text":     respWr.errorOutput.String(),
+			},
+			"redirectURL": respWr.Header().Get("Location"),
+			"headersSize": -1,
+			"bodySize":    respWr.size,
+		},
+		"cache": map[string]interface{}{},
+		"timings": map[string]interface{}{
+			"send":    0,
+			"wait":    elapsed,
+			"receive": 0,
+		},
+		"comment": respWr.Header().Get(CacheStatusHeader),
+	}
+
+	b, _ := json.MarshalIndent(map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "httpcache", "version": "1"},
+			"entries": []interface{}{entry},
+		},
+	}, "", "  ")
+	return b
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return strings.ToLower(headers[i].Name) < strings.ToLower(headers[j].Name)
+	})
+	return headers
+}
@@ -2,6 +2,7 @@ package httplog
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,13 @@ import (
 )
 
 const (
-	CacheHeader = "X-Cache"
+	CacheHeader       = "X-Cache"
+	CacheStatusHeader = "X-Cache-Status"
+
+	// FormatText logs requests as apache-like lines
+	FormatText = "text"
+	// FormatJSON logs each request as a json object on a line of its own
+	FormatJSON = "json"
 )
 
 type responseWriter struct {
@@ -40,6 +47,27 @@ func (l *responseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// ReadFrom lets the server send bodies that are files with sendfile, other
+// than those of errors, which are kept for dumps
+func (l *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	rf, ok := l.ResponseWriter.(io.ReaderFrom)
+	if !ok || isError(l.status) {
+		return io.Copy(writerOnly{l}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	l.size += int(n)
+	return n, err
+}
+
+// writerOnly hides the ReadFrom of a writer, so that io.Copy to it doesn't
+// call ReadFrom again
+type writerOnly struct {
+	io.Writer
+}
+
 func (l *responseWriter) WriteHeader(s int) {
 	l.ResponseWriter.WriteHeader(s)
 	l.status = s
@@ -53,18 +81,51 @@ func (l *responseWriter) Size() int {
 	return l.size
 }
 
+// DefaultRedactHeaders are the headers that hold credentials, whose values
+// are left out of dumps unless RedactHeaders is changed
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
 func NewResponseLogger(delegate http.Handler) *ResponseLogger {
-	return &ResponseLogger{Handler: delegate}
+	return &ResponseLogger{
+		Handler:       delegate,
+		RedactHeaders: append([]string(nil), DefaultRedactHeaders...),
+	}
 }
 
 type ResponseLogger struct {
 	http.Handler
 	DumpRequests, DumpErrors, DumpResponses bool
+
+	// RedactHeaders are the headers whose values are replaced in dumps
+	RedactHeaders []string
+
+	// DumpDir is a directory to dump each exchange to a file of its own in,
+	// rather than to stderr, keeping the newest DumpKeep files
+	DumpDir  string
+	DumpKeep int
+	// DumpHAR dumps to DumpDir as HAR archives rather than text
+	DumpHAR bool
+
+	// Format is how requests are logged, either FormatText or FormatJSON
+	Format string
+	// Output is where requests are logged, defaulting to the log package
+	// for FormatText and to stderr for FormatJSON
+	Output io.Writer
 }
 
 func (l *ResponseLogger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if l.DumpDir != "" {
+		respWr := &responseWriter{ResponseWriter: w, t: time.Now()}
+		l.Handler.ServeHTTP(respWr, req)
+		l.dumpToDir(req, respWr)
+		l.writeLog(req, respWr)
+		return
+	}
+
 	if l.DumpRequests {
-		b, _ := httputil.DumpRequest(req, false)
+		redacted := *req
+		redacted.Header = l.redact(req.Header)
+		b, _ := httputil.DumpRequest(&redacted, false)
 		writePrefixString(strings.TrimSpace(string(b)), ">> ", os.Stderr)
 	}
 
@@ -76,7 +137,7 @@ func (l *ResponseLogger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n",
 			respWr.status, http.StatusText(respWr.status),
 		))
-		respWr.Header().Write(buf)
+		l.redact(respWr.Header()).Write(buf)
 		writePrefixString(strings.TrimSpace(buf.String()), "<< ", os.Stderr)
 	}
 
@@ -87,23 +148,107 @@ func (l *ResponseLogger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	l.writeLog(req, respWr)
 }
 
+// cacheStatus returns whether a response was a HIT, MISS, STALE,
+// REVALIDATED or BYPASS of the cache
+func cacheStatus(h http.Header) string {
+	if status := h.Get(CacheHeader); status != "" {
+		return status
+	}
+	return "BYPASS"
+}
+
+// clientIP returns the address of a client without its port
+func clientIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if colon := strings.LastIndex(ip, ":"); colon != -1 {
+		ip = ip[:colon]
+	}
+	return ip
+}
+
+// clientCN returns the common name of a client's verified certificate
+func clientCN(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
+
+// record is a request logged with FormatJSON
+type record struct {
+	Time        string  `json:"time"`
+	ClientIP    string  `json:"client_ip"`
+	ClientCN    string  `json:"client_cn,omitempty"`
+	Method      string  `json:"method"`
+	URL         string  `json:"url"`
+	Host        string  `json:"host"`
+	Proto       string  `json:"proto"`
+	Status      int     `json:"status"`
+	Cache       string  `json:"cache"`
+	CacheStatus string  `json:"cache_status,omitempty"`
+	Bytes       int     `json:"bytes"`
+	DurationMS  float64 `json:"duration_ms"`
+}
+
+func (l *ResponseLogger) writeJSON(req *http.Request, respWr *responseWriter) {
+	status := respWr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	b, err := json.Marshal(record{
+		Time:        respWr.t.Format(time.RFC3339Nano),
+		ClientIP:    clientIP(req),
+		ClientCN:    clientCN(req),
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Host:        req.Host,
+		Proto:       req.Proto,
+		Status:      status,
+		Cache:       cacheStatus(respWr.Header()),
+		CacheStatus: respWr.Header().Get(CacheStatusHeader),
+		Bytes:       respWr.size,
+		DurationMS:  float64(time.Since(respWr.t)) / float64(time.Millisecond),
+	})
+	if err != nil {
+		log.Printf("error encoding access log record: %s", err.Error())
+		return
+	}
+
+	output := l.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	output.Write(append(b, '\n'))
+}
+
 func (l *ResponseLogger) writeLog(req *http.Request, respWr *responseWriter) {
-	cacheStatus := respWr.Header().Get(CacheHeader)
+	if l.Format == FormatJSON {
+		l.writeJSON(req, respWr)
+		return
+	}
 
-	if strings.HasPrefix(cacheStatus, "HIT") {
-		cacheStatus = "\x1b[32;1mHIT\x1b[0m"
-	} else if strings.HasPrefix(cacheStatus, "MISS") {
-		cacheStatus = "\x1b[31;1mMISS\x1b[0m"
-	} else {
-		cacheStatus = "\x1b[33;1mSKIP\x1b[0m"
+	// only colour the cache status for the terminal
+	cacheStatus := cacheStatus(respWr.Header())
+	if l.Output == nil {
+		switch cacheStatus {
+		case "HIT", "REVALIDATED":
+			cacheStatus = "\x1b[32;1m" + cacheStatus + "\x1b[0m"
+		case "MISS":
+			cacheStatus = "\x1b[31;1m" + cacheStatus + "\x1b[0m"
+		default:
+			cacheStatus = "\x1b[33;1m" + cacheStatus + "\x1b[0m"
+		}
 	}
 
-	clientIP := req.RemoteAddr
-	if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
-		clientIP = clientIP[:colon]
+	clientIP := clientIP(req)
+
+	// identify clients by the common name of their verified certificate
+	if cn := clientCN(req); cn != "" {
+		clientIP = fmt.Sprintf("%s (%s)", clientIP, cn)
 	}
 
-	log.Printf(
+	line := fmt.Sprintf(
 		"%s \"%s %s %s\" (%s) %d %s %s",
 		clientIP,
 		req.Method,
@@ -114,6 +259,25 @@ func (l *ResponseLogger) writeLog(req *http.Request, respWr *responseWriter) {
 		cacheStatus,
 		time.Now().Sub(respWr.t).String(),
 	)
+
+	if l.Output == nil {
+		log.Print(line)
+		return
+	}
+	fmt.Fprintf(l.Output, "%s %s\n", respWr.t.Format("2006/01/02 15:04:05"), line)
+}
+
+// redact returns a copy of h with the values of RedactHeaders replaced
+func (l *ResponseLogger) redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range l.RedactHeaders {
+		if values, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			for i := range values {
+				values[i] = "REDACTED"
+			}
+		}
+	}
+	return h
 }
 
 func isError(code int) bool {
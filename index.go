@@ -0,0 +1,283 @@
+package httpcache
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IndexedCache is a Cache that keeps an in-memory index of the keys stored
+// through it and of their surrogate keys, so that resources can be purged
+// by tag. Only resources stored since the index was created are indexed,
+// unless it is journaled.
+type IndexedCache struct {
+	Cache
+
+	sync.Mutex
+	keys map[string][]string
+	tags map[string]map[string]bool
+
+	// entries are the keys of a journaled index, with what it knows of them
+	entries map[string]IndexEntry
+	journal *indexJournal
+}
+
+// NewIndexedCache returns an IndexedCache that stores resources in cache
+func NewIndexedCache(cache Cache) *IndexedCache {
+	return &IndexedCache{
+		Cache: cache,
+		keys:  map[string][]string{},
+		tags:  map[string]map[string]bool{},
+	}
+}
+
+// NewJournaledIndexedCache returns an IndexedCache that persists its index
+// to a journal at path, so that keys stored before a restart stay indexed.
+// Entries recovered from the journal are verified against cache, dropping
+// those that are no longer stored, and the journal is compacted.
+func NewJournaledIndexedCache(cache Cache, path string) (*IndexedCache, error) {
+	j, entries, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewIndexedCache(cache)
+	c.entries = map[string]IndexEntry{}
+	for key, e := range entries {
+		h, err := cache.Header(key)
+		if err != nil {
+			debugf("dropping %s from the index, %s", key, err.Error())
+			continue
+		}
+		// the journal may have missed the last store of a key
+		if h.Get("ETag") != e.ETag || h.Get("Last-Modified") != e.LastModified {
+			e = newIndexEntry(key, h.StatusCode, h.Header)
+		}
+		c.entries[key] = e
+		c.indexTags(key, e.Tags)
+	}
+	debugf("recovered %d of %d keys from index journal %s", len(c.entries), len(entries), path)
+
+	if err := j.compact(c.entries); err != nil {
+		return nil, err
+	}
+	c.journal = j
+	return c, nil
+}
+
+// SurrogateKeys returns the tags of a response, from a space separated
+// Surrogate-Key header or a comma separated Cache-Tag header
+func SurrogateKeys(h http.Header) []string {
+	tags := []string{}
+	for _, v := range h["Surrogate-Key"] {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range h["Cache-Tag"] {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// Store a resource against a number of keys, indexing them by its tags
+func (c *IndexedCache) Store(res *Resource, keys ...string) error {
+	if err := c.Cache.Store(res, keys...); err != nil {
+		return err
+	}
+	c.index(res, keys)
+	return nil
+}
+
+func (c *IndexedCache) index(res *Resource, keys []string) {
+	tags := SurrogateKeys(res.Header())
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		c.indexTags(key, tags)
+		if c.journal != nil {
+			e := newIndexEntry(key, res.Status(), res.Header())
+			c.entries[key] = e
+			c.journal.append(e, c.entries)
+		}
+	}
+}
+
+// indexTags indexes a key by its tags, callers must hold the lock
+func (c *IndexedCache) indexTags(key string, tags []string) {
+	c.unindex(key)
+	c.keys[key] = tags
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = map[string]bool{}
+		}
+		c.tags[tag][key] = true
+	}
+}
+
+// unindex removes a key from the tags it was stored with, callers must hold
+// the lock
+func (c *IndexedCache) unindex(key string) {
+	for _, tag := range c.keys[key] {
+		delete(c.tags[tag], key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	delete(c.keys, key)
+}
+
+// PurgeTag invalidates every resource stored with a tag, returning the
+// number of keys that were invalidated
+func (c *IndexedCache) PurgeTag(tag string) int {
+	c.Lock()
+	keys := []string{}
+	for key := range c.tags[tag] {
+		keys = append(keys, key)
+	}
+	c.Unlock()
+
+	if len(keys) > 0 {
+		debugf("purging %d keys tagged %q", len(keys), tag)
+		c.Cache.Invalidate(keys...)
+	}
+	return len(keys)
+}
+
+// PurgeVariants invalidates a key and every Vary variant of it, returning the
+// number of keys that were invalidated
+func (c *IndexedCache) PurgeVariants(key string) int {
+	c.Lock()
+	keys := []string{}
+	for k := range c.keys {
+		if k == key || strings.HasPrefix(k, key+"::") {
+			keys = append(keys, k)
+		}
+	}
+	_, indexed := c.keys[key]
+	c.Unlock()
+
+	// the key may have been stored before the index was created
+	if !indexed {
+		if _, err := c.Cache.Header(key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) > 0 {
+		debugf("purging %d variants of %s", len(keys), key)
+		c.Cache.Invalidate(keys...)
+	}
+	return len(keys)
+}
+
+// variantPurger is implemented by caches that can find the Vary variants of
+// a key
+type variantPurger interface {
+	PurgeVariants(key string) int
+}
+
+// purgeVariants invalidates a key and, if the cache can find them, its Vary
+// variants, returning the number of keys that were invalidated
+func purgeVariants(cache Cache, key string) int {
+	if p, ok := cache.(variantPurger); ok {
+		return p.PurgeVariants(key)
+	}
+	if _, err := cache.Header(key); err != nil {
+		return 0
+	}
+	cache.Invalidate(key)
+	return 1
+}
+
+// Variants returns the sorted keys of the indexed Vary variants of a key
+func (c *IndexedCache) Variants(key string) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	keys := []string{}
+	for k := range c.keys {
+		if strings.HasPrefix(k, key+"::") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// variantLister is implemented by caches that can list the Vary variants of
+// a key
+type variantLister interface {
+	Variants(key string) []string
+}
+
+// variants returns the Vary variants of a key, if the cache can find them
+func variants(cache Cache, key string) []string {
+	if l, ok := cache.(variantLister); ok {
+		return l.Variants(key)
+	}
+	return nil
+}
+
+// PurgePrefix invalidates every indexed key that starts with prefix,
+// returning the number of keys that were invalidated
+func (c *IndexedCache) PurgePrefix(prefix string) int {
+	return c.PurgeMatching(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// PurgeMatching invalidates every indexed key that match returns true for,
+// returning the number of keys that were invalidated
+func (c *IndexedCache) PurgeMatching(match func(key string) bool) int {
+	c.Lock()
+	keys := []string{}
+	for key := range c.keys {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	c.Unlock()
+
+	if len(keys) > 0 {
+		debugf("purging %d matching keys", len(keys))
+		c.Cache.Invalidate(keys...)
+	}
+	return len(keys)
+}
+
+// Len returns the number of keys and tags in the index
+func (c *IndexedCache) Len() (keys int, tags int) {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.keys), len(c.tags)
+}
+
+// Entry returns what a journaled index knows of a key
+func (c *IndexedCache) Entry(key string) (IndexEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+// Close closes the journal of a journaled index, and the cache if it can be
+// closed
+func (c *IndexedCache) Close() error {
+	var err error
+	if c.journal != nil {
+		err = c.journal.Close()
+	}
+	if closer, ok := c.Cache.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
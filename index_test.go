@@ -0,0 +1,75 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSurrogateKeys(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c", "d"}, httpcache.SurrogateKeys(http.Header{
+		"Surrogate-Key": []string{"a  b"},
+		"Cache-Tag":     []string{"c, d,"},
+	}))
+	assert.Equal(t, []string{}, httpcache.SurrogateKeys(http.Header{}))
+}
+
+func TestIndexedCachePurgeTag(t *testing.T) {
+	cache := httpcache.NewIndexedCache(httpcache.NewMemoryCache())
+
+	store := func(key, tags string) {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key), http.Header{
+			"Date":          []string{httpcache.Clock().Format(http.TimeFormat)},
+			"Surrogate-Key": []string{tags},
+		})
+		require.NoError(t, cache.Store(res, key))
+	}
+	isStale := func(key string) bool {
+		res, err := cache.Retrieve(key)
+		require.NoError(t, err)
+		defer res.Close()
+		return res.IsStale()
+	}
+
+	store("llamas", "animals camelids")
+	store("alpacas", "animals")
+	store("cars", "vehicles")
+
+	assert.Equal(t, 2, cache.PurgeTag("animals"))
+	assert.True(t, isStale("llamas"))
+	assert.True(t, isStale("alpacas"))
+	assert.False(t, isStale("cars"))
+
+	assert.Equal(t, 0, cache.PurgeTag("unknown"))
+
+	// storing again replaces the tags of a key
+	store("cars", "toys")
+	assert.Equal(t, 0, cache.PurgeTag("vehicles"))
+	assert.Equal(t, 1, cache.PurgeTag("toys"))
+}
+
+func TestIndexedCachePurgePrefix(t *testing.T) {
+	cache := httpcache.NewIndexedCache(httpcache.NewMemoryCache())
+
+	for _, key := range []string{"GET:/llamas/1", "GET:/llamas/2", "GET:/alpacas/1"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key), http.Header{
+			"Date": []string{httpcache.Clock().Format(http.TimeFormat)},
+		})
+		require.NoError(t, cache.Store(res, key))
+	}
+
+	keys, tags := cache.Len()
+	assert.Equal(t, 3, keys)
+	assert.Equal(t, 0, tags)
+
+	assert.Equal(t, 2, cache.PurgePrefix("GET:/llamas/"))
+	assert.Equal(t, 0, cache.PurgePrefix("GET:/camels/"))
+
+	res, err := cache.Retrieve("GET:/alpacas/1")
+	require.NoError(t, err)
+	defer res.Close()
+	assert.False(t, res.IsStale())
+}
@@ -0,0 +1,175 @@
+package httpcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// minCompactRecords is the fewest records a journal has before it is
+// compacted, which it is once it has four times as many as live keys
+const minCompactRecords = 1024
+
+// IndexEntry is what a journaled index knows about a stored key
+type IndexEntry struct {
+	Key          string    `json:"key"`
+	File         string    `json:"file"`
+	Size         int64     `json:"size"`
+	Expires      time.Time `json:"expires"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+}
+
+// newIndexEntry returns the entry for a resource stored under key. Its size
+// is its Content-Length, or -1 if it doesn't have one.
+func newIndexEntry(key string, code int, h http.Header) IndexEntry {
+	res := NewResourceBytes(code, nil, h)
+	e := IndexEntry{
+		Key:          key,
+		File:         hashKey(key),
+		Size:         -1,
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+		Tags:         SurrogateKeys(h),
+	}
+	if size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		e.Size = size
+	}
+	if fresh, _, ok := freshUntil(res); ok {
+		e.Expires = fresh.UTC().Round(time.Second)
+	}
+	return e
+}
+
+// indexJournal persists the entries of an index as a file of json entries
+// appended as keys are stored, the last of each key winning. A partial last
+// line left by a crash is ignored.
+type indexJournal struct {
+	sync.Mutex
+	path    string
+	f       *os.File
+	records int
+}
+
+// openJournal replays the journal at path, if it exists, returning its
+// entries by key. The journal isn't open for writing until it's compacted.
+func openJournal(path string) (*indexJournal, map[string]IndexEntry, error) {
+	entries := map[string]IndexEntry{}
+	j := &indexJournal{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, entries, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			debugf("ignoring the rest of index journal %s after an invalid entry: %s", path, err.Error())
+			break
+		}
+		entries[e.Key] = e
+	}
+	return j, entries, nil
+}
+
+// append records an entry, compacting the journal to live once it has grown
+// much larger than it
+func (j *indexJournal) append(e IndexEntry, live map[string]IndexEntry) {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.f == nil {
+		return
+	}
+	if j.records >= minCompactRecords && j.records >= 4*len(live) {
+		if err := j.compactLocked(live); err != nil {
+			errorf("compacting index journal %s failed with error: %s", j.path, err.Error())
+		}
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		errorf("encoding index entry %s failed with error: %s", e.Key, err.Error())
+		return
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		errorf("writing index journal %s failed with error: %s", j.path, err.Error())
+		return
+	}
+	j.records++
+}
+
+// compact rewrites the journal with only the live entries, replacing it
+// atomically, and opens it for appending
+func (j *indexJournal) compact(live map[string]IndexEntry) error {
+	j.Lock()
+	defer j.Unlock()
+	return j.compactLocked(live)
+}
+
+func (j *indexJournal) compactLocked(live map[string]IndexEntry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range live {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	j.records = len(live)
+	return err
+}
+
+// Close syncs and closes the journal
+func (j *indexJournal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Sync()
+	if closeErr := j.f.Close(); err == nil {
+		err = closeErr
+	}
+	j.f = nil
+	return err
+}
@@ -0,0 +1,64 @@
+package httpcache_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournaledIndexRecoversKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := httpcache.NewDiskCache(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "index.journal")
+
+	cache, err := httpcache.NewJournaledIndexedCache(storage, path)
+	require.NoError(t, err)
+	for _, key := range []string{"llamas", "alpacas", "cars"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key), http.Header{
+			"Date":           []string{httpcache.Clock().Format(http.TimeFormat)},
+			"Cache-Control":  []string{"max-age=60"},
+			"Content-Length": []string{strconv.Itoa(len(key))},
+			"Etag":           []string{`"` + key + `"`},
+			"Surrogate-Key":  []string{"animals"},
+		})
+		require.NoError(t, cache.Store(res, key))
+	}
+	cars, ok := cache.Entry("cars")
+	require.True(t, ok)
+	require.NoError(t, cache.Close())
+
+	// a crash may leave a partial entry, and resources may be removed
+	// without the index knowing
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	f.Write([]byte(`{"key":"bicycles","fi`))
+	f.Close()
+	require.NoError(t, os.Remove(filepath.Join(dir, "cache", "header", "v1", cars.File)))
+
+	cache, err = httpcache.NewJournaledIndexedCache(storage, path)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	keys, tags := cache.Len()
+	require.Equal(t, 2, keys)
+	require.Equal(t, 1, tags)
+
+	e, ok := cache.Entry("llamas")
+	require.True(t, ok)
+	require.Equal(t, int64(6), e.Size)
+	require.Equal(t, `"llamas"`, e.ETag)
+	require.Equal(t, []string{"animals"}, e.Tags)
+	require.False(t, e.Expires.IsZero())
+
+	require.Equal(t, 2, cache.PurgeTag("animals"))
+}
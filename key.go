@@ -3,8 +3,11 @@ package httpcache
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -14,6 +17,11 @@ type Key struct {
 	header http.Header
 	u      url.URL
 	vary   []string
+	// body is the hash of the body of requests with methods such as POST
+	// that are cached, if it isn't empty
+	body string
+	// parts are the selected parts of requests that KeyRules add to keys
+	parts []string
 }
 
 // NewKey returns a new Key instance
@@ -52,21 +60,105 @@ func (k Key) ForMethod(method string) Key {
 	return k2
 }
 
-// Vary returns a Key that is varied on particular headers in a http.Request
+// ForBody returns a new Key for a request whose body has a given hash
+func (k Key) ForBody(hash string) Key {
+	k2 := k
+	k2.body = hash
+	return k2
+}
+
+// withQuery returns a new Key with the query string of its url replaced
+func (k Key) withQuery(rawQuery string) Key {
+	k2 := k
+	k2.u.RawQuery = rawQuery
+	return k2
+}
+
+// withParts returns a new Key that includes selected parts of a request
+func (k Key) withParts(parts []string) Key {
+	k2 := k
+	k2.parts = parts
+	return k2
+}
+
+// Vary returns a Key that is varied on particular headers in a http.Request.
+// The headers are sorted, and the values of content negotiation headers are
+// normalized, so that equivalent requests share a key.
 func (k Key) Vary(varyHeader string, r *http.Request) Key {
 	k2 := k
+	k2.vary = []string{}
 
-	for _, header := range strings.Split(varyHeader, ", ") {
-		k2.vary = append(k2.vary, header+"="+r.Header.Get(header))
+	headers := []string{}
+	for _, header := range strings.Split(varyHeader, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	sort.Strings(headers)
+
+	for i, header := range headers {
+		if i > 0 && header == headers[i-1] {
+			continue
+		}
+		value := strings.Join(r.Header[header], ", ")
+		if negotiationHeaders[header] {
+			value = normalizeList(value)
+		}
+		k2.vary = append(k2.vary, header+"="+value)
 	}
 
 	return k2
 }
 
+// negotiationHeaders are the request headers with case-insensitive lists of
+// values whose order doesn't matter, as each has a q-value for its preference
+var negotiationHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Charset":  true,
+	"Accept-Encoding": true,
+	"Accept-Language": true,
+}
+
+// normalizeList lowercases and sorts the elements of a comma separated list,
+// removing whitespace and the default q-value of 1 from their parameters,
+// so that "gzip, br" and "br,gzip;q=1" are the same
+func normalizeList(value string) string {
+	elements := []string{}
+	for _, element := range strings.Split(value, ",") {
+		params := []string{}
+		for i, param := range strings.Split(element, ";") {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if i > 0 {
+				param = strings.Replace(param, " ", "", -1)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					if err == nil && q == 1 {
+						continue
+					} else if err == nil {
+						param = "q=" + strconv.FormatFloat(q, 'g', -1, 64)
+					}
+				}
+			}
+			params = append(params, param)
+		}
+		if params[0] != "" {
+			elements = append(elements, strings.Join(params, ";"))
+		}
+	}
+	sort.Strings(elements)
+	return strings.Join(elements, ",")
+}
+
 func (k Key) String() string {
 	URL := strings.ToLower(canonicalURL(&k.u).String())
 	b := &bytes.Buffer{}
 	b.WriteString(fmt.Sprintf("%s:%s", k.method, URL))
+	if k.body != "" {
+		b.WriteString("#body=" + k.body)
+	}
+	for _, part := range k.parts {
+		b.WriteString("#" + part)
+	}
 
 	if len(k.vary) > 0 {
 		b.WriteString("::")
@@ -78,6 +170,72 @@ func (k Key) String() string {
 	return b.String()
 }
 
+// canonicalURL returns a url normalized so that equivalent urls are the
+// same, with a lowercase scheme and host without a default port, duplicate
+// slashes in its path collapsed, percent-escapes of unreserved characters
+// decoded, its query parameters sorted by name and without a fragment
 func canonicalURL(u *url.URL) *url.URL {
-	return u
+	u2 := *u
+	u2.Scheme = strings.ToLower(u.Scheme)
+	u2.Host = strings.ToLower(u.Host)
+	if host, port, err := net.SplitHostPort(u2.Host); err == nil &&
+		(port == "80" && u2.Scheme == "http" || port == "443" && u2.Scheme == "https") {
+		u2.Host = host
+		if strings.Contains(host, ":") {
+			u2.Host = "[" + host + "]"
+		}
+	}
+	u2.Fragment, u2.RawFragment = "", ""
+
+	escaped := decodeUnreserved(u.EscapedPath())
+	for strings.Contains(escaped, "//") {
+		escaped = strings.Replace(escaped, "//", "/", -1)
+	}
+	if path, err := url.PathUnescape(escaped); err == nil {
+		u2.Path, u2.RawPath = path, escaped
+	}
+
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			params[i] = decodeUnreserved(param)
+		}
+		name := func(param string) string {
+			if i := strings.Index(param, "="); i >= 0 {
+				return param[:i]
+			}
+			return param
+		}
+		// repeated parameters keep their order, which may matter
+		sort.SliceStable(params, func(i, j int) bool { return name(params[i]) < name(params[j]) })
+		u2.RawQuery = strings.Join(params, "&")
+	}
+	return &u2
+}
+
+// decodeUnreserved decodes the percent-escapes of letters, digits and
+// "-._~" in an escaped string, which mean the same unescaped
+func decodeUnreserved(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil && isUnreserved(byte(c)) {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// isUnreserved returns whether c is an unreserved character in urls
+// https://tools.ietf.org/html/rfc3986#section-2.3
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
 }
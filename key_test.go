@@ -58,3 +58,60 @@ func TestRequestKeyWithIllegalContentLocation(t *testing.T) {
 
 	assert.Equal(t, k1.String(), k2.String())
 }
+
+func TestVaryKeyIsNormalized(t *testing.T) {
+	key := func(vary string, headers ...string) string {
+		r := newRequest("GET", "http://x.org/test", headers...)
+		return httpcache.NewRequestKey(r).Vary(vary, r).String()
+	}
+
+	assert.Equal(t,
+		key("Accept-Encoding, Accept-Language", "Accept-Encoding: gzip, br", "Accept-Language: en-US"),
+		key("accept-language,accept-encoding", "Accept-Encoding: br,gzip;q=1.0", "Accept-Language: en-us"))
+	assert.Equal(t,
+		key("Accept", "Accept: text/html; q=0.50, */*"),
+		key("Accept", "Accept: */*, text/html;q=.5"))
+	assert.NotEqual(t,
+		key("Accept-Encoding", "Accept-Encoding: gzip"),
+		key("Accept-Encoding", "Accept-Encoding: gzip, br"))
+	assert.NotEqual(t,
+		key("Cookie", "Cookie: session=ABC"),
+		key("Cookie", "Cookie: session=abc"))
+}
+
+func TestEquivalentURLsShareKeys(t *testing.T) {
+	var cases = []struct {
+		u1, u2 string
+	}{
+		{"http://x.org/test?b=2&a=1", "http://x.org/test?a=1&b=2"},
+		{"http://x.org//test///llamas", "http://x.org/test/llamas"},
+		{"http://x.org/%7Etest/%6Clamas", "http://x.org/~test/llamas"},
+		{"HTTP://X.ORG:80/test", "http://x.org/test"},
+		{"https://x.org:443/test", "https://x.org/test"},
+		{"http://x.org/test?a=%41", "http://x.org/test?a=A"},
+		{"http://x.org/test#llamas", "http://x.org/test"},
+	}
+
+	for _, c := range cases {
+		k1 := httpcache.NewKey("GET", mustParseUrl(c.u1), nil)
+		k2 := httpcache.NewKey("GET", mustParseUrl(c.u2), nil)
+		assert.Equal(t, k1.String(), k2.String(), c.u1)
+	}
+}
+
+func TestDifferentURLsKeepDistinctKeys(t *testing.T) {
+	var cases = []struct {
+		u1, u2 string
+	}{
+		{"http://x.org/test?a=1&a=2", "http://x.org/test?a=2&a=1"},
+		{"http://x.org/a%2Fb", "http://x.org/a/b"},
+		{"http://x.org:8080/test", "http://x.org/test"},
+		{"https://x.org:80/test", "https://x.org/test"},
+	}
+
+	for _, c := range cases {
+		k1 := httpcache.NewKey("GET", mustParseUrl(c.u1), nil)
+		k2 := httpcache.NewKey("GET", mustParseUrl(c.u2), nil)
+		assert.NotEqual(t, k1.String(), k2.String(), c.u1)
+	}
+}
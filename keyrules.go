@@ -0,0 +1,75 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// KeyRule customizes which parts of requests whose Host and path match its
+// patterns form their cache keys, in which * matches anything
+type KeyRule struct {
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+
+	// IgnoreQuery leaves the query string out of keys altogether, and
+	// otherwise Query are the only query parameters kept in them if any
+	// are given
+	IgnoreQuery bool
+	Query       []string
+
+	// Headers and Cookies are the request headers and cookies whose values
+	// are added to keys, so that responses differ by them without a Vary
+	Headers []string
+	Cookies []string
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule KeyRule) Matches(r *http.Request) bool {
+	return matchHostPath(rule.Host, rule.Path, r)
+}
+
+// key returns the key of a request with the parts the rule selects
+func (rule KeyRule) key(k Key, r *http.Request) Key {
+	if rule.IgnoreQuery {
+		k = k.withQuery("")
+	} else if len(rule.Query) > 0 {
+		query := k.u.Query()
+		kept := url.Values{}
+		for _, name := range rule.Query {
+			if values, ok := query[name]; ok {
+				kept[name] = values
+			}
+		}
+		k = k.withQuery(kept.Encode())
+	}
+
+	parts := []string{}
+	for _, name := range rule.Headers {
+		name = http.CanonicalHeaderKey(name)
+		parts = append(parts, "header:"+name+"="+strings.Join(r.Header[name], ", "))
+	}
+	for _, name := range rule.Cookies {
+		value := ""
+		if c, err := r.Cookie(name); err == nil {
+			value = c.Value
+		}
+		parts = append(parts, "cookie:"+name+"="+value)
+	}
+	sort.Strings(parts)
+	return k.withParts(parts)
+}
+
+// customKey applies the first of the KeyRules that matches a request to
+// its key
+func (h *Handler) customKey(r *cacheRequest) {
+	for _, rule := range h.KeyRules {
+		if rule.Matches(r.Request) {
+			r.Key = rule.key(r.Key, r.Request)
+			return
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package httpcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links to a file
+func linkCount(info os.FileInfo) int {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Nlink)
+	}
+	return 1
+}
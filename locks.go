@@ -0,0 +1,64 @@
+package httpcache
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// keyLocks are locks striped by the hashes of keys, so that operations on
+// unrelated keys rarely wait on each other. They are held while the files of
+// a key are opened, written or closed, but not while an opened body is read,
+// as stores replace files rather than writing to them in place. Opening and
+// closing are exclusive too, as the open files of in-memory filesystems
+// share their data and write it back when they are closed.
+type keyLocks [256]sync.Mutex
+
+// stripe returns the lock of a key by its hash, from the hash's first byte
+func (l *keyLocks) stripe(hash string) *sync.Mutex {
+	i, _ := strconv.ParseUint(stripeOf(hash), 16, 8)
+	return &l[i]
+}
+
+// stripeOf returns the first byte of a hash in hex
+func stripeOf(hash string) string {
+	if len(hash) < 2 {
+		return "00"
+	}
+	return hash[:2]
+}
+
+// lock locks the stripes of several keys, in order so that it can't
+// deadlock with another, returning a func that unlocks them
+func (l *keyLocks) lock(hashes ...string) func() {
+	stripes := map[*sync.Mutex]string{}
+	for _, hash := range hashes {
+		stripes[l.stripe(hash)] = stripeOf(hash)
+	}
+	locked := make([]*sync.Mutex, 0, len(stripes))
+	for stripe := range stripes {
+		locked = append(locked, stripe)
+	}
+	sort.Slice(locked, func(i, j int) bool { return stripes[locked[i]] < stripes[locked[j]] })
+
+	for _, stripe := range locked {
+		stripe.Lock()
+	}
+	return func() {
+		for _, stripe := range locked {
+			stripe.Unlock()
+		}
+	}
+}
+
+// lockedCloser closes a file with the lock of its key held
+type lockedCloser struct {
+	ReadSeekCloser
+	lock sync.Locker
+}
+
+func (f *lockedCloser) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.ReadSeekCloser.Close()
+}
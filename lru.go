@@ -0,0 +1,225 @@
+package httpcache
+
+import (
+	"container/list"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lruCache is an in-memory cache that holds at most maxBytes of resources
+// under at most maxEntries keys, evicting the least recently used when it
+// runs out of space
+type lruCache struct {
+	sync.Mutex
+	maxBytes   int64
+	maxEntries int
+	size       int64
+	evictions  int64
+	ll         *list.List
+	entries    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	header Header
+	body   []byte
+	stale  time.Time
+	size   int64
+}
+
+var _ Cache = (*lruCache)(nil)
+
+// NewLRUCache returns an in-memory cache limited to maxBytes of headers
+// and bodies
+func NewLRUCache(maxBytes int64) Cache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// NewLimitedMemoryCache returns an in-memory cache limited to maxBytes of
+// headers and bodies stored under at most maxEntries keys, evicting the
+// least recently used when either is exceeded. A limit of 0 means no limit.
+func NewLimitedMemoryCache(maxBytes int64, maxEntries int) Cache {
+	if maxBytes <= 0 {
+		maxBytes = math.MaxInt64
+	}
+	return &lruCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *lruCache) Header(key string) (Header, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return Header{}, ErrNotFoundInCache
+	}
+
+	e := el.Value.(*lruEntry)
+	return Header{Header: cloneHeader(e.header.Header), StatusCode: e.header.StatusCode}, nil
+}
+
+// Store a resource against a number of keys
+func (c *lruCache) Store(res *Resource, keys ...string) error {
+	buf, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		c.add(&lruEntry{
+			key:    key,
+			header: Header{Header: cloneHeader(res.Header()), StatusCode: res.Status()},
+			body:   buf.Bytes(),
+			size:   int64(buf.Len() + len(headerBytes(res.Status(), res.Header()))),
+		})
+	}
+
+	return nil
+}
+
+func (c *lruCache) add(e *lruEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	if e.size > c.maxBytes {
+		debugf("%s is larger than the cache, not storing", e.key)
+		return
+	}
+
+	c.entries[e.key] = c.ll.PushFront(e)
+	c.size += e.size
+
+	for c.size > c.maxBytes || (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) {
+		el := c.ll.Back()
+		debugf("evicting %s from memory", el.Value.(*lruEntry).key)
+		c.remove(el)
+		c.evictions++
+	}
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// fits returns whether a resource of size bytes can be stored
+func (c *lruCache) fits(size int64) bool {
+	return size <= c.maxBytes
+}
+
+// removeKeys removes keys without counting them as evictions
+func (c *lruCache) removeKeys(keys ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// Stats returns the size of the cache and how many resources it has evicted
+func (c *lruCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := CacheStats{
+		Bytes:          c.size,
+		Entries:        int64(c.ll.Len()),
+		Evictions:      c.evictions,
+		EvictionPolicy: string(EvictLRU),
+	}
+	if c.maxBytes < math.MaxInt64 {
+		stats.MaxBytes = c.maxBytes
+	}
+	return stats
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *lruCache) Retrieve(key string) (*Resource, error) {
+	return c.retrieve(key, true)
+}
+
+// peek returns a cached Resource without marking it as recently used
+func (c *lruCache) peek(key string) (*Resource, error) {
+	return c.retrieve(key, false)
+}
+
+func (c *lruCache) retrieve(key string, use bool) (*Resource, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, ErrNotFoundInCache
+	}
+	if use {
+		c.ll.MoveToFront(el)
+	}
+
+	e := el.Value.(*lruEntry)
+	res := NewResourceBytes(e.header.StatusCode, e.body, cloneHeader(e.header.Header))
+	if !e.stale.IsZero() && !res.DateAfter(e.stale) {
+		log.Printf("stale marker of %s found", e.stale)
+		res.MarkStale()
+	}
+	return res, nil
+}
+
+func (c *lruCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			el.Value.(*lruEntry).stale = Clock()
+		}
+	}
+}
+
+func (c *lruCache) Freshen(res *Resource, keys ...string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			e := el.Value.(*lruEntry)
+			if e.header.StatusCode == res.Status() && headersEqual(e.header.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				e.header.Header = cloneHeader(res.Header())
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				e.stale = Clock()
+			}
+		}
+	}
+	return nil
+}
+
+// cloneHeader returns a copy of h that can be modified independently
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
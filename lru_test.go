@@ -0,0 +1,71 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var body = strings.Repeat("llamas", 100)
+	var cache = httpcache.NewLRUCache(1500)
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{})
+		if err := cache.Store(res, key); err != nil {
+			t.Fatal(err)
+		}
+
+		// keep key1 recently used
+		if _, err := cache.Retrieve("key1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := cache.Retrieve("key2")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	for _, key := range []string{"key1", "key3"} {
+		res, err := cache.Retrieve(key)
+		require.NoError(t, err)
+		require.Equal(t, body, readAllString(res))
+	}
+
+	stats, ok := httpcache.Stats(httpcache.NewIndexedCache(cache))
+	require.True(t, ok)
+	require.Equal(t, int64(1), stats.Evictions)
+	require.True(t, stats.Bytes > 1200 && stats.Bytes <= 1500)
+}
+
+func TestLRUCacheSkipsOversizedResources(t *testing.T) {
+	var cache = httpcache.NewLRUCache(100)
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(strings.Repeat("llamas", 100)), http.Header{})
+	if err := cache.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := cache.Retrieve("testkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
+
+func TestLimitedMemoryCacheEvictsByEntries(t *testing.T) {
+	var cache = httpcache.NewLimitedMemoryCache(0, 2)
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+		require.NoError(t, cache.Store(res, key))
+	}
+
+	_, err := cache.Retrieve("key1")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	stats, ok := httpcache.Stats(cache)
+	require.True(t, ok)
+	require.Equal(t, int64(2), stats.Entries)
+	require.Equal(t, int64(1), stats.Evictions)
+	require.Equal(t, int64(0), stats.MaxBytes)
+}
@@ -0,0 +1,194 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	memcachePrefix      = "httpcache/"
+	memcacheStalePrefix = "stale/"
+
+	// memcached refuses items over 1MB by default, bodies are split into
+	// chunks that leave room for the key and item overhead
+	memcacheChunkSize = 1000 * 1000
+)
+
+// memcacheCache stores resources in one or more memcached servers, with
+// bodies larger than a single item split across several keys
+type memcacheCache struct {
+	client *memcache.Client
+}
+
+var _ Cache = (*memcacheCache)(nil)
+
+// NewMemcacheCache returns a cache backed by the provided memcached servers
+func NewMemcacheCache(servers ...string) Cache {
+	return &memcacheCache{client: memcache.New(servers...)}
+}
+
+func memcacheKey(prefix, key string) string {
+	return memcachePrefix + prefix + formatPrefix + hashKey(key)
+}
+
+func memcacheChunkKey(key string, n int) string {
+	return fmt.Sprintf("%s/%d", memcacheKey(bodyPrefix, key), n)
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *memcacheCache) Header(key string) (Header, error) {
+	item, err := c.client.Get(memcacheKey(headerPrefix, key))
+	if err == memcache.ErrCacheMiss {
+		return Header{}, ErrNotFoundInCache
+	} else if err != nil {
+		return Header{}, err
+	}
+
+	return readHeaders(bufio.NewReader(bytes.NewReader(item.Value)))
+}
+
+// Store a resource against a number of keys
+func (c *memcacheCache) Store(res *Resource, keys ...string) error {
+	buf, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	chunks := (len(b) + memcacheChunkSize - 1) / memcacheChunkSize
+
+	for _, key := range keys {
+		if err := c.client.Delete(memcacheKey(memcacheStalePrefix, key)); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+
+		for n := 0; n < chunks; n++ {
+			end := (n + 1) * memcacheChunkSize
+			if end > len(b) {
+				end = len(b)
+			}
+			if err := c.client.Set(&memcache.Item{
+				Key:   memcacheChunkKey(key, n),
+				Value: b[n*memcacheChunkSize : end],
+			}); err != nil {
+				return err
+			}
+		}
+
+		// the chunk count is written last so that readers never see a
+		// partially stored body
+		if err := c.client.Set(&memcache.Item{
+			Key:   memcacheKey(bodyPrefix, key),
+			Value: []byte(strconv.Itoa(chunks)),
+		}); err != nil {
+			return err
+		}
+
+		if err := c.storeHeader(res.Status(), res.Header(), key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *memcacheCache) storeHeader(code int, h http.Header, key string) error {
+	return c.client.Set(&memcache.Item{
+		Key:   memcacheKey(headerPrefix, key),
+		Value: headerBytes(code, h),
+	})
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *memcacheCache) Retrieve(key string) (*Resource, error) {
+	item, err := c.client.Get(memcacheKey(bodyPrefix, key))
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrNotFoundInCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	chunks, err := strconv.Atoi(string(item.Value))
+	if err != nil {
+		return nil, fmt.Errorf("malformed chunk count for %s: %q", key, item.Value)
+	}
+
+	chunkKeys := make([]string, chunks)
+	for n := range chunkKeys {
+		chunkKeys[n] = memcacheChunkKey(key, n)
+	}
+
+	items, err := c.client.GetMulti(chunkKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	for _, chunkKey := range chunkKeys {
+		chunk, ok := items[chunkKey]
+		if !ok {
+			// one of the chunks has been evicted, the body is incomplete
+			return nil, ErrNotFoundInCache
+		}
+		body.Write(chunk.Value)
+	}
+
+	h, err := c.Header(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := NewResourceBytes(h.StatusCode, body.Bytes(), h.Header)
+
+	if item, err := c.client.Get(memcacheKey(memcacheStalePrefix, key)); err == nil {
+		staleNano, err := strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		staleTime := time.Unix(0, staleNano).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	} else if err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *memcacheCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+	for _, key := range keys {
+		if err := c.client.Set(&memcache.Item{
+			Key:   memcacheKey(memcacheStalePrefix, key),
+			Value: []byte(strconv.FormatInt(Clock().UnixNano(), 10)),
+		}); err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *memcacheCache) Freshen(res *Resource, keys ...string) error {
+	for _, key := range keys {
+		if h, err := c.Header(key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				if err := c.storeHeader(h.StatusCode, res.Header(), key); err != nil {
+					return err
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package httpcache_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+// memcachedMaxItemSize is the largest value memcached stores by default
+const memcachedMaxItemSize = 1024 * 1024
+
+// fakeMemcached implements just enough of the memcached text protocol to
+// exercise the memcached backend, refusing items that memcached would
+type fakeMemcached struct {
+	sync.Mutex
+	listener net.Listener
+	items    map[string][]byte
+}
+
+func newFakeMemcached() (*fakeMemcached, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeMemcached{listener: l, items: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// evict removes an item, as memcached does when it runs out of memory
+func (s *fakeMemcached) evict(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.items, key)
+}
+
+// keys returns the keys of the stored items that start with prefix
+func (s *fakeMemcached) keys(prefix string) []string {
+	s.Lock()
+	defer s.Unlock()
+	keys := []string{}
+	for key := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			return
+		}
+
+		switch args[0] {
+		case "get", "gets":
+			s.Lock()
+			for _, key := range args[1:] {
+				if v, ok := s.items[key]; ok {
+					fmt.Fprintf(w, "VALUE %s 0 %d 0\r\n%s\r\n", key, len(v), v)
+				}
+			}
+			s.Unlock()
+			io.WriteString(w, "END\r\n")
+		case "set":
+			if len(args) != 5 {
+				io.WriteString(w, "ERROR\r\n")
+				break
+			}
+			size, err := strconv.Atoi(args[4])
+			if err != nil {
+				io.WriteString(w, "CLIENT_ERROR bad data chunk\r\n")
+				break
+			}
+			b := make([]byte, size+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			if size > memcachedMaxItemSize {
+				io.WriteString(w, "SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			s.Lock()
+			s.items[args[1]] = b[:size]
+			s.Unlock()
+			io.WriteString(w, "STORED\r\n")
+		case "delete":
+			s.Lock()
+			_, ok := s.items[args[1]]
+			delete(s.items, args[1])
+			s.Unlock()
+			if ok {
+				io.WriteString(w, "DELETED\r\n")
+			} else {
+				io.WriteString(w, "NOT_FOUND\r\n")
+			}
+		default:
+			io.WriteString(w, "ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func newTestMemcacheCache(t *testing.T) (httpcache.Cache, *fakeMemcached, func()) {
+	server, err := newFakeMemcached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpcache.NewMemcacheCache(server.listener.Addr().String()), server, func() {
+		server.listener.Close()
+	}
+}
+
+func TestMemcacheSaveChunkedResource(t *testing.T) {
+	cache, server, closer := newTestMemcacheCache(t)
+	defer closer()
+
+	// bodies are split into chunks of 1,000,000 bytes, as larger items
+	// would be refused
+	for size, chunks := range map[int]int{6: 1, 1000 * 1000: 1, 1000*1000 + 1: 2, 3000 * 1000: 3} {
+		key := fmt.Sprintf("memcache-testkey-%d", size)
+		body := strings.Repeat("l", size)
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+			"Llamas": []string{"true"},
+		})
+
+		if err := cache.Store(res, key); err != nil {
+			t.Fatal(err)
+		}
+
+		resOut, err := cache.Retrieve(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		require.NotNil(t, resOut)
+		require.Equal(t, res.Header(), resOut.Header())
+		require.Equal(t, body, readAllString(resOut))
+		require.Equal(t, chunks+1, len(server.keys("httpcache/body/")))
+		for _, key := range server.keys("httpcache/body/") {
+			server.evict(key)
+		}
+	}
+}
+
+func TestMemcacheRetrieveWithEvictedChunk(t *testing.T) {
+	cache, server, closer := newTestMemcacheCache(t)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(strings.Repeat("llamas", 500000)), http.Header{})
+	require.NoError(t, cache.Store(res, "memcache-evictedkey"))
+
+	// one chunk of the body being evicted makes the whole resource a miss
+	for _, key := range server.keys("httpcache/body/") {
+		if strings.HasSuffix(key, "/1") {
+			server.evict(key)
+		}
+	}
+	_, err := cache.Retrieve("memcache-evictedkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
+
+func TestMemcacheInvalidateAndFreshen(t *testing.T) {
+	cache, _, closer := newTestMemcacheCache(t)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Date": []string{httpcache.Clock().Add(-time.Hour).Format(http.TimeFormat)},
+		"Etag": []string{`"llamas"`},
+	})
+	require.NoError(t, cache.Store(res, "memcache-freshkey"))
+
+	cache.Invalidate("memcache-freshkey")
+
+	resOut, err := cache.Retrieve("memcache-freshkey")
+	require.NoError(t, err)
+	require.True(t, resOut.IsStale())
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	res.Header().Set("X-Llamas", "freshened")
+	require.NoError(t, cache.Freshen(res, "memcache-freshkey"))
+
+	h, err := cache.Header("memcache-freshkey")
+	require.NoError(t, err)
+	require.Equal(t, "freshened", h.Get("X-Llamas"))
+
+	// a response with another validator invalidates it instead
+	changed := httpcache.NewResourceBytes(http.StatusOK, nil, http.Header{
+		"Date": []string{httpcache.Clock().Add(-time.Hour).Format(http.TimeFormat)},
+		"Etag": []string{`"alpacas"`},
+	})
+	require.NoError(t, cache.Freshen(changed, "memcache-freshkey"))
+	h, err = cache.Header("memcache-freshkey")
+	require.NoError(t, err)
+	require.Equal(t, `"llamas"`, h.Get("Etag"))
+}
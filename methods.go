@@ -0,0 +1,86 @@
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxKeyedBody is the largest request body that is hashed into the key of
+// a request whose method is cached by a MethodRule, requests with larger
+// bodies bypass the cache
+const maxKeyedBody = 1024 * 1024
+
+// MethodRule caches responses to requests with a method other than GET and
+// HEAD, such as POST or OPTIONS, whose Host and path match its patterns, in
+// which * matches anything. They are keyed by their method, url and a hash
+// of their body, and only stored if they have an explicit expiration, as
+// rfc7234 allows.
+type MethodRule struct {
+	Method string
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+}
+
+// Matches returns whether a request matches the method and patterns of the
+// rule
+func (rule MethodRule) Matches(r *http.Request) bool {
+	return strings.EqualFold(rule.Method, r.Method) && matchHostPath(rule.Host, rule.Path, r)
+}
+
+// cachesMethod returns whether a request's method is cached by one of the
+// MethodRules
+func (h *Handler) cachesMethod(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "PURGE" {
+		return false
+	}
+	for _, rule := range h.CacheMethods {
+		if rule.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyBody adds a hash of the body of a request whose method is cached to
+// its key, buffering the body so that it can still be sent upstream. Those
+// with bodies larger than maxKeyedBody are left to bypass the cache.
+func (h *Handler) keyBody(r *cacheRequest) error {
+	if r.neverCache || !h.cachesMethod(r.Request) {
+		return nil
+	}
+
+	var b []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if b, err = ioutil.ReadAll(io.LimitReader(r.Body, maxKeyedBody+1)); err != nil {
+			return err
+		}
+		if len(b) > maxKeyedBody {
+			debugf("%s body is too large to key, bypassing the cache", r.Method)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+			return nil
+		}
+		r.Body.Close()
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	if len(b) > 0 {
+		sum := sha256.Sum256(b)
+		r.Key = r.Key.ForBody(hex.EncodeToString(sum[:]))
+	}
+	r.cachedMethod = true
+	return nil
+}
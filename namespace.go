@@ -0,0 +1,65 @@
+package httpcache
+
+import "strings"
+
+// namespacedCache prefixes every key with a namespace, so that several
+// independent caches can share the same storage
+type namespacedCache struct {
+	namespace string
+	cache     Cache
+}
+
+var _ Cache = (*namespacedCache)(nil)
+
+// NewNamespacedCache returns a cache that stores resources in cache under
+// keys prefixed with namespace
+func NewNamespacedCache(namespace string, cache Cache) Cache {
+	return &namespacedCache{namespace: namespace, cache: cache}
+}
+
+func (c *namespacedCache) keys(keys []string) []string {
+	nsKeys := make([]string, len(keys))
+	for i, key := range keys {
+		nsKeys[i] = c.namespace + key
+	}
+	return nsKeys
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *namespacedCache) Header(key string) (Header, error) {
+	return c.cache.Header(c.namespace + key)
+}
+
+// Store a resource against a number of keys
+func (c *namespacedCache) Store(res *Resource, keys ...string) error {
+	return c.cache.Store(res, c.keys(keys)...)
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *namespacedCache) Retrieve(key string) (*Resource, error) {
+	return c.cache.Retrieve(c.namespace + key)
+}
+
+func (c *namespacedCache) Invalidate(keys ...string) {
+	c.cache.Invalidate(c.keys(keys)...)
+}
+
+func (c *namespacedCache) Freshen(res *Resource, keys ...string) error {
+	return c.cache.Freshen(res, c.keys(keys)...)
+}
+
+// PurgeVariants invalidates a key and its Vary variants, if the underlying
+// cache can find them
+func (c *namespacedCache) PurgeVariants(key string) int {
+	return purgeVariants(c.cache, c.namespace+key)
+}
+
+// Variants returns the Vary variants of a key, if the underlying cache can
+// find them
+func (c *namespacedCache) Variants(key string) []string {
+	keys := variants(c.cache, c.namespace+key)
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, c.namespace)
+	}
+	return keys
+}
@@ -0,0 +1,28 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedCachesAreIndependent(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	llamas := httpcache.NewNamespacedCache("llamas/", cache)
+	alpacas := httpcache.NewNamespacedCache("alpacas/", cache)
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+	require.NoError(t, llamas.Store(res, "GET:/"))
+
+	resOut, err := llamas.Retrieve("GET:/")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	_, err = alpacas.Retrieve("GET:/")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	_, err = cache.Header("llamas/GET:/")
+	require.NoError(t, err)
+}
@@ -0,0 +1,231 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPartials limits how many incomplete responses are tracked, so that
+// ranges of responses that are never completed don't accumulate
+const maxPartials = 1024
+
+// byteRange is an inclusive range of the bytes of a response
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) String() string {
+	return fmt.Sprintf("%d-%d", br.start, br.end)
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 0-99/1000",
+// which must give the complete length of the response
+func parseContentRange(v string) (byteRange, int64, error) {
+	var br byteRange
+	if !strings.HasPrefix(v, "bytes ") {
+		return br, 0, errors.New("invalid content-range " + v)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(v, "bytes "), "/", 2)
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(bounds) != 2 {
+		return br, 0, errors.New("invalid content-range " + v)
+	}
+
+	var err error
+	if br.start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return br, 0, errors.New("invalid content-range " + v)
+	}
+	if br.end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+		return br, 0, errors.New("invalid content-range " + v)
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return br, 0, errors.New("unknown length in content-range " + v)
+	}
+	if br.start < 0 || br.start > br.end || br.end >= total {
+		return br, 0, errors.New("invalid content-range " + v)
+	}
+	return br, total, nil
+}
+
+// partial is a response of which some ranges have been stored
+type partial struct {
+	validator string
+	total     int64
+	ranges    []byteRange
+}
+
+// complete returns whether the ranges cover the whole response
+func (p *partial) complete() bool {
+	var next int64
+	for _, br := range p.ranges {
+		if br.start > next {
+			return false
+		}
+		if br.end+1 > next {
+			next = br.end + 1
+		}
+	}
+	return next >= p.total
+}
+
+// partialSet tracks the ranges stored for each partially cached response
+type partialSet struct {
+	sync.Mutex
+	partials map[string]*partial
+}
+
+// add records that a range of the response stored under key has been
+// stored, returning the ranges to assemble once they cover all of it, in
+// order. Ranges of a response with another validator or length replace the
+// ones recorded before.
+func (s *partialSet) add(key, validator string, total int64, br byteRange) []byteRange {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.partials == nil {
+		s.partials = map[string]*partial{}
+	}
+	p, ok := s.partials[key]
+	if !ok || p.validator != validator || p.total != total {
+		if !ok && len(s.partials) >= maxPartials {
+			for k := range s.partials {
+				delete(s.partials, k)
+				break
+			}
+		}
+		p = &partial{validator: validator, total: total}
+		s.partials[key] = p
+	}
+
+	p.ranges = append(p.ranges, br)
+	sort.Slice(p.ranges, func(i, j int) bool {
+		return p.ranges[i].start < p.ranges[j].start
+	})
+	if !p.complete() {
+		return nil
+	}
+	delete(s.partials, key)
+	return p.ranges
+}
+
+// partialKey returns the key that a range of a response is stored under
+func partialKey(key string, br byteRange) string {
+	return key + "::bytes=" + br.String()
+}
+
+// partialValidator returns the strong validator that ranges of a response
+// must share to be assembled, or an empty string if it has none
+func partialValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// passPartial reads a partial response as it is passed to the client, and
+// stores it in the background
+func (h *Handler) passPartial(rdr io.ReadCloser, header http.Header, r *cacheRequest) {
+	b, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	if err != nil {
+		debugf("error reading stream: %v", err)
+		return
+	}
+
+	Writes.Add(1)
+	go func() {
+		defer Writes.Done()
+		h.storePartial(b, header, r)
+	}()
+}
+
+// storePartial stores a single range response to a request, and once the
+// ranges stored cover the whole response, assembles them and stores it
+func (h *Handler) storePartial(b []byte, header http.Header, r *cacheRequest) {
+	br, total, err := parseContentRange(header.Get("Content-Range"))
+	if err != nil {
+		debugf("not storing partial response, %s", err.Error())
+		return
+	}
+	if int64(len(b)) != br.end-br.start+1 {
+		debugf("not storing partial response, body doesn't match content-range")
+		return
+	}
+
+	// a response is cacheable if its whole would be
+	full := http.Header{}
+	for key, values := range header {
+		full[key] = values
+	}
+	full.Del("Content-Range")
+	full.Set("Content-Length", strconv.FormatInt(total, 10))
+	if reason := h.uncacheableReason(NewResourceBytes(http.StatusOK, nil, full), r); reason != "" {
+		debugf("not storing partial response, %s", reason)
+		return
+	}
+	validator := partialValidator(full)
+	if validator == "" {
+		debugf("not storing partial response without a strong validator")
+		return
+	}
+
+	key := r.Key.String()
+	if vary := h.vary(full, r.Request); vary != "" {
+		key = r.Key.Vary(vary, r.Request).String()
+	}
+	if err := h.cache.Store(NewResourceBytes(http.StatusPartialContent, b, header), partialKey(key, br)); err != nil {
+		errorf("storing partial response %s failed with error: %s", partialKey(key, br), err.Error())
+		return
+	}
+	debugf("stored bytes %s of %d of %s", br.String(), total, key)
+
+	ranges := h.partials.add(key, validator, total, br)
+	if ranges == nil {
+		return
+	}
+
+	body, err := h.assemblePartial(key, validator, ranges)
+	if err != nil {
+		debugf("error assembling partial response: %s", err.Error())
+		return
+	}
+	debugf("assembled %d ranges of %s", len(ranges), key)
+	<-h.storeResource(NewResourceBytes(http.StatusOK, body, full), r)
+}
+
+// assemblePartial reads the stored ranges of a response, which are in
+// order and cover all of it, into its body
+func (h *Handler) assemblePartial(key, validator string, ranges []byteRange) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, br := range ranges {
+		if br.end < int64(buf.Len()) {
+			continue
+		}
+		res, err := h.cache.Retrieve(partialKey(key, br))
+		if err != nil {
+			return nil, err
+		}
+		if partialValidator(res.Header()) != validator {
+			res.Close()
+			return nil, errors.New("range " + br.String() + " has changed")
+		}
+		_, err = res.Seek(int64(buf.Len())-br.start, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(buf, res, br.end+1-int64(buf.Len()))
+		}
+		res.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
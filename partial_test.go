@@ -0,0 +1,58 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePartialAssemblesRanges(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.Body = []byte("llamas rock")
+	client.cacheHandler.CachePartial = true
+
+	r := client.get("/", "Range: bytes=0-5")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "llamas", string(r.body))
+
+	r = client.get("/", "Range: bytes=4-")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "as rock", string(r.body))
+	assert.Equal(t, 2, upstream.requests)
+
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "llamas rock", string(r.body))
+	assert.Equal(t, "", r.header.Get("Content-Range"))
+
+	r = client.get("/", "Range: bytes=7-")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "rock", string(r.body))
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestCachePartialNeedsMatchingValidators(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Body = []byte("llamas rock")
+	client.cacheHandler.CachePartial = true
+
+	client.get("/", "Range: bytes=0-5")
+	client.get("/", "Range: bytes=6-")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	client, upstream = testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Body = []byte("llamas rock")
+	client.cacheHandler.CachePartial = true
+
+	upstream.Etag = `"llamas"`
+	client.get("/", "Range: bytes=0-5")
+	upstream.Etag = `"alpacas"`
+	client.get("/", "Range: bytes=6-")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+}
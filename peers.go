@@ -0,0 +1,158 @@
+package httpcache
+
+import (
+	"context"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	// PeerHeader is set on requests forwarded to a peer, which then fetches
+	// from the origin rather than forwarding them again, unless they don't
+	// come from a peer
+	PeerHeader = "X-Httpcache-Peer"
+
+	peerReplicas = 50
+)
+
+type peerContextKey struct{}
+
+// PeerPool is an upstream handler that forwards each request to the peer
+// that owns its URL on a consistent hash ring, so that each resource is
+// fetched from the origin and cached by a single instance. Requests owned by
+// this instance, forwarded by another peer, or whose peer is unreachable are
+// passed to the origin. Requests are only taken to have been forwarded by a
+// peer if they come from one of the addresses of the peer they name.
+type PeerPool struct {
+	self     string
+	ring     *hashRing
+	proxies  map[string]*httputil.ReverseProxy
+	upstream http.Handler
+}
+
+// NewPeerPool returns a PeerPool for the given peer base urls, one of which
+// should be self, in front of the origin upstream handler
+func NewPeerPool(self string, peers []string, upstream http.Handler) (*PeerPool, error) {
+	p := &PeerPool{
+		self:     self,
+		ring:     newHashRing(peerReplicas, peers...),
+		proxies:  map[string]*httputil.ReverseProxy{},
+		upstream: upstream,
+	}
+
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.ErrorHandler = func(w http.ResponseWriter, outreq *http.Request, err error) {
+			r := outreq.Context().Value(peerContextKey{}).(*http.Request)
+			errorf("error fetching %s from peer %s: %s", r.URL.String(), u.String(), err.Error())
+			p.upstream.ServeHTTP(w, r)
+		}
+		p.proxies[peer] = proxy
+	}
+
+	return p, nil
+}
+
+// Owner returns the base url of the peer that owns the request
+func (p *PeerPool) Owner(r *http.Request) string {
+	return p.ring.get(r.Host + r.URL.RequestURI())
+}
+
+func (p *PeerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(PeerHeader) != "" {
+		fromPeer := p.fromPeer(r)
+		r.Header.Del(PeerHeader)
+		if fromPeer {
+			p.upstream.ServeHTTP(w, r)
+			return
+		}
+		debugf("ignoring %s from %s, which isn't a peer", PeerHeader, r.RemoteAddr)
+	}
+
+	owner := p.Owner(r)
+	proxy, ok := p.proxies[owner]
+	if !ok {
+		p.upstream.ServeHTTP(w, r)
+		return
+	}
+
+	debugf("fetching %s from peer %s", r.URL.String(), owner)
+	outreq := r.WithContext(context.WithValue(r.Context(), peerContextKey{}, r))
+	outreq.Header = cloneHeader(r.Header)
+	outreq.Header.Set(PeerHeader, p.self)
+	proxy.ServeHTTP(w, outreq)
+}
+
+// fromPeer returns whether a request was forwarded by another peer, which
+// it is if it has a PeerHeader naming a peer and comes from that peer's
+// address, so that clients can't make requests skip their owner
+func (p *PeerPool) fromPeer(r *http.Request) bool {
+	peer := r.Header.Get(PeerHeader)
+	if _, ok := p.proxies[peer]; !ok {
+		return false
+	}
+	u, err := url.Parse(peer)
+	if err != nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	addrs, err := net.DefaultResolver.LookupHost(r.Context(), u.Hostname())
+	if err != nil {
+		errorf("error resolving peer %s: %s", peer, err.Error())
+		return false
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.Equal(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashRing maps keys to nodes with consistent hashing, so that adding or
+// removing a node only moves the keys that it owns
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing(replicas int, nodes ...string) *hashRing {
+	r := &hashRing{nodes: map[uint32]string{}}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
@@ -0,0 +1,134 @@
+package httpcache_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+type peer struct {
+	server *httptest.Server
+	pool   *httpcache.PeerPool
+}
+
+func TestPeersFetchFromOwner(t *testing.T) {
+	var originRequests int
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRequests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", httpcache.Clock().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "llamas")
+	})
+
+	var handlers [2]http.HandlerFunc
+	var peers [2]peer
+	var urls []string
+
+	for i := range peers {
+		i := i
+		peers[i].server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i](w, r)
+		}))
+		defer peers[i].server.Close()
+		urls = append(urls, peers[i].server.URL)
+	}
+
+	for i := range peers {
+		pool, err := httpcache.NewPeerPool(urls[i], urls, origin)
+		require.NoError(t, err)
+		peers[i].pool = pool
+		handlers[i] = httpcache.NewHandler(httpcache.NewMemoryCache(), pool).ServeHTTP
+	}
+
+	// find a path owned by the second peer
+	var path string
+	for n := 0; path == ""; n++ {
+		r := newRequest("GET", fmt.Sprintf("http://llamas.test/%d", n))
+		if peers[0].pool.Owner(r) == urls[1] {
+			path = r.URL.Path
+		}
+	}
+
+	for _, p := range []peer{peers[0], peers[1], peers[0]} {
+		req, err := http.NewRequest("GET", p.server.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = "llamas.test"
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, "llamas", readAllString(resp.Body))
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+	}
+
+	require.Equal(t, 1, originRequests)
+}
+
+func TestPeersFallBackToOrigin(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "llamas")
+	})
+
+	// the second peer isn't listening
+	pool, err := httpcache.NewPeerPool("http://self.test", []string{"http://self.test", "http://127.0.0.1:1"}, origin)
+	require.NoError(t, err)
+
+	var path string
+	for n := 0; path == ""; n++ {
+		r := newRequest("GET", fmt.Sprintf("http://llamas.test/%d", n))
+		if pool.Owner(r) == "http://127.0.0.1:1" {
+			path = r.URL.String()
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, newRequest("GET", path))
+	require.Equal(t, "llamas", rec.Body.String())
+}
+
+func TestPeersIgnorePeerHeaderFromClients(t *testing.T) {
+	var originRequests, peerRequests int
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRequests++
+		fmt.Fprint(w, "llamas")
+	})
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerRequests++
+		fmt.Fprint(w, "llamas")
+	}))
+	defer other.Close()
+
+	pool, err := httpcache.NewPeerPool("http://self.test", []string{"http://self.test", other.URL}, origin)
+	require.NoError(t, err)
+
+	var path string
+	for n := 0; path == ""; n++ {
+		r := newRequest("GET", fmt.Sprintf("http://llamas.test/%d", n))
+		if pool.Owner(r) == other.URL {
+			path = r.URL.String()
+		}
+	}
+
+	// a client claiming to be the other peer is forwarded to it
+	r := newRequest("GET", path, httpcache.PeerHeader+": "+other.URL)
+	r.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, r)
+	require.Equal(t, "llamas", rec.Body.String())
+	require.Equal(t, 1, peerRequests)
+	require.Equal(t, 0, originRequests)
+
+	// while the other peer itself is served from the origin
+	r = newRequest("GET", path, httpcache.PeerHeader+": "+other.URL)
+	r.RemoteAddr = "127.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	pool.ServeHTTP(rec, r)
+	require.Equal(t, "llamas", rec.Body.String())
+	require.Equal(t, 1, peerRequests)
+	require.Equal(t, 1, originRequests)
+}
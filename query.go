@@ -0,0 +1,65 @@
+package httpcache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DefaultStripQuery are the tracking query parameters that marketing urls
+// carry, for Handler.StripQuery
+var DefaultStripQuery = []string{"utm_*", "fbclid", "gclid"}
+
+// stripQuery removes the parameters whose names match one of patterns, in
+// which * matches anything, from a query string, keeping the others as
+// they are
+func stripQuery(rawQuery string, patterns []string) string {
+	if rawQuery == "" || len(patterns) == 0 {
+		return rawQuery
+	}
+
+	kept := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !matchesAny(patterns, name) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// matchesAny returns whether s matches one of patterns
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTracking removes the StripQuery parameters from the key of a
+// request, and from the request itself if they are stripped upstream too
+func (h *Handler) stripTracking(r *cacheRequest) {
+	if len(h.StripQuery) == 0 {
+		return
+	}
+	stripped := stripQuery(r.URL.RawQuery, h.StripQuery)
+	if stripped == r.URL.RawQuery {
+		return
+	}
+
+	debugf("stripping tracking parameters from %s", r.URL.String())
+	r.Key = r.Key.withQuery(stripped)
+	if h.StripQueryUpstream {
+		r.URL.RawQuery = stripped
+		if r.RequestURI != "" {
+			r.RequestURI = r.URL.RequestURI()
+		}
+	}
+}
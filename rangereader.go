@@ -0,0 +1,70 @@
+package httpcache
+
+import (
+	"errors"
+	"io"
+)
+
+// rangeReader is a ReadSeekCloser over a remote object that streams the
+// body, reopening it at the new offset with a ranged request after a seek
+type rangeReader struct {
+	open       func(offset int64) (io.ReadCloser, error)
+	body       io.ReadCloser
+	offset     int64
+	size       int64
+	bodyOffset int64
+}
+
+func newRangeReader(body io.ReadCloser, size int64, open func(offset int64) (io.ReadCloser, error)) *rangeReader {
+	return &rangeReader{open: open, body: body, size: size}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil || r.bodyOffset != r.offset {
+		if r.body != nil {
+			r.body.Close()
+			r.body = nil
+		}
+		body, err := r.open(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+		r.bodyOffset = r.offset
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.bodyOffset += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("rangeReader: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("rangeReader: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
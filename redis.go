@@ -0,0 +1,178 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisPrefix      = "httpcache:"
+	redisStalePrefix = "stale/"
+
+	redisMaxIdle     = 16
+	redisIdleTimeout = 4 * time.Minute
+)
+
+// redisCache stores resources in a redis server, allowing multiple
+// instances to share the same cache
+type redisCache struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+var _ Cache = (*redisCache)(nil)
+
+// NewRedisCache returns a cache backed by the redis server at addr. Entries
+// expire after ttl, or never if ttl is zero.
+func NewRedisCache(addr string, ttl time.Duration) Cache {
+	return &redisCache{
+		ttl: ttl,
+		pool: &redis.Pool{
+			MaxIdle:     redisMaxIdle,
+			IdleTimeout: redisIdleTimeout,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr)
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+	}
+}
+
+func redisKey(prefix, key string) string {
+	return redisPrefix + prefix + formatPrefix + hashKey(key)
+}
+
+// setArgs returns the arguments for a SET command that honors the ttl
+func (c *redisCache) setArgs(key string, val interface{}) []interface{} {
+	if c.ttl > 0 {
+		return []interface{}{key, val, "PX", int64(c.ttl / time.Millisecond)}
+	}
+	return []interface{}{key, val}
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *redisCache) Header(key string) (Header, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	return c.header(conn, key)
+}
+
+func (c *redisCache) header(conn redis.Conn, key string) (Header, error) {
+	b, err := redis.Bytes(conn.Do("GET", redisKey(headerPrefix, key)))
+	if err == redis.ErrNil {
+		return Header{}, ErrNotFoundInCache
+	} else if err != nil {
+		return Header{}, err
+	}
+
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// Store a resource against a number of keys
+func (c *redisCache) Store(res *Resource, keys ...string) error {
+	buf, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	hb := headerBytes(res.Status(), res.Header())
+
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("DEL", redisKey(redisStalePrefix, key))
+
+		conn.Send("SET", c.setArgs(redisKey(bodyPrefix, key), buf.Bytes())...)
+		conn.Send("SET", c.setArgs(redisKey(headerPrefix, key), hb)...)
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *redisCache) Retrieve(key string) (*Resource, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", redisKey(bodyPrefix, key)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFoundInCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	h, err := c.header(conn, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := NewResourceBytes(h.StatusCode, b, h.Header)
+
+	staleNano, err := redis.Int64(conn.Do("GET", redisKey(redisStalePrefix, key)))
+	if err == nil {
+		staleTime := time.Unix(0, staleNano).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	} else if err != redis.ErrNil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *redisCache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	for _, key := range keys {
+		args := c.setArgs(redisKey(redisStalePrefix, key), Clock().UnixNano())
+		if _, err := conn.Do("SET", args...); err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *redisCache) Freshen(res *Resource, keys ...string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	for _, key := range keys {
+		if h, err := c.header(conn, key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				args := c.setArgs(redisKey(headerPrefix, key), headerBytes(h.StatusCode, res.Header()))
+				if _, err := conn.Do("SET", args...); err != nil {
+					return err
+				}
+				// the body expires along with the freshened headers
+				if c.ttl > 0 {
+					if _, err := conn.Do("PEXPIRE", redisKey(bodyPrefix, key), int64(c.ttl/time.Millisecond)); err != nil {
+						return err
+					}
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package httpcache_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis implements just enough of the redis protocol to exercise the
+// redis backend, expiring keys by its own clock
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	values   map[string][]byte
+	expires  map[string]time.Time
+	now      time.Time
+}
+
+func newFakeRedis() (*fakeRedis, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeRedis{
+		listener: l,
+		values:   map[string][]byte{},
+		expires:  map[string]time.Time{},
+		now:      time.Now(),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// elapse moves the clock that keys expire by forward
+func (s *fakeRedis) elapse(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	var queued [][]string
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			queued, reply = [][]string{}, "+OK\r\n"
+		case cmd == "EXEC":
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, args := range queued {
+				reply += s.do(args)
+			}
+			queued = nil
+		case queued != nil:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			reply = s.do(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// do runs a command, returning its reply
+func (s *fakeRedis) do(args []string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	for key, expires := range s.expires {
+		if !s.now.Before(expires) {
+			delete(s.values, key)
+			delete(s.expires, key)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := s.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		s.values[args[1]] = []byte(args[2])
+		delete(s.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer\r\n"
+			}
+			s.expires[args[1]] = s.now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "PEXPIRE":
+		if _, ok := s.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		s.expires[args[1]] = s.now.Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "DEL":
+		var deleted int
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				delete(s.values, key)
+				delete(s.expires, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("malformed array length %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk string length %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func newTestRedisCache(t *testing.T, ttl time.Duration) (httpcache.Cache, *fakeRedis, func()) {
+	server, err := newFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpcache.NewRedisCache(server.listener.Addr().String(), ttl), server, func() {
+		server.listener.Close()
+	}
+}
+
+func TestRedisSaveResource(t *testing.T) {
+	var body = strings.Repeat("llamas", 5000)
+	cache, _, closer := newTestRedisCache(t, time.Minute)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas": []string{"true"},
+	})
+
+	if err := cache.Store(res, "redis-testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	resOut, err := cache.Retrieve("redis-testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.NotNil(t, resOut)
+	require.Equal(t, res.Header(), resOut.Header())
+	require.Equal(t, body, readAllString(resOut))
+	require.False(t, resOut.IsStale())
+}
+
+func TestRedisExpiresResourcesAfterTTL(t *testing.T) {
+	cache, server, closer := newTestRedisCache(t, time.Minute)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+	require.NoError(t, cache.Store(res, "redis-ttlkey"))
+
+	server.elapse(59 * time.Second)
+	resOut, err := cache.Retrieve("redis-ttlkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	server.elapse(time.Second)
+	_, err = cache.Retrieve("redis-ttlkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	_, err = cache.Header("redis-ttlkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	// without a ttl, resources are kept
+	cache = httpcache.NewRedisCache(server.listener.Addr().String(), 0)
+	require.NoError(t, cache.Store(res, "redis-ttlkey"))
+	server.elapse(24 * time.Hour)
+	_, err = cache.Retrieve("redis-ttlkey")
+	require.NoError(t, err)
+}
+
+func TestRedisInvalidate(t *testing.T) {
+	cache, _, closer := newTestRedisCache(t, time.Minute)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Date": []string{httpcache.Clock().Add(-time.Hour).Format(http.TimeFormat)},
+	})
+
+	if err := cache.Store(res, "redis-invalidkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Invalidate("redis-invalidkey")
+
+	resOut, err := cache.Retrieve("redis-invalidkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.True(t, resOut.IsStale())
+}
+
+func TestRedisFreshen(t *testing.T) {
+	cache, server, closer := newTestRedisCache(t, time.Minute)
+	defer closer()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Etag": []string{`"llamas"`},
+	})
+	require.NoError(t, cache.Store(res, "redis-freshkey"))
+
+	// freshening replaces the headers and restarts the ttl
+	server.elapse(30 * time.Second)
+	res.Header().Set("X-Llamas", "freshened")
+	require.NoError(t, cache.Freshen(res, "redis-freshkey"))
+	server.elapse(45 * time.Second)
+
+	resOut, err := cache.Retrieve("redis-freshkey")
+	require.NoError(t, err)
+	require.Equal(t, "freshened", resOut.Header().Get("X-Llamas"))
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	// a response with another validator invalidates it instead
+	changed := httpcache.NewResourceBytes(http.StatusOK, nil, http.Header{
+		"Etag": []string{`"alpacas"`},
+	})
+	require.NoError(t, cache.Freshen(changed, "redis-freshkey"))
+	resOut, err = cache.Retrieve("redis-freshkey")
+	require.NoError(t, err)
+	require.Equal(t, `"llamas"`, resOut.Header().Get("Etag"))
+	require.True(t, resOut.IsStale())
+}
@@ -0,0 +1,122 @@
+package httpcache
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+)
+
+// DefaultRevalidateWorkers is the number of background revalidations that
+// run at once when Handler.RevalidateWorkers isn't set
+const DefaultRevalidateWorkers = 4
+
+// revalidateQueueSize is how many background revalidations can wait for a
+// worker, beyond which stale resources are revalidated before being served
+const revalidateQueueSize = 100
+
+// revalidator runs background revalidations with a bounded pool of workers,
+// revalidating each key at most once at a time
+type revalidator struct {
+	once  sync.Once
+	queue chan *cacheRequest
+
+	sync.Mutex
+	pending map[string]bool
+}
+
+// staleWhileRevalidate returns whether a stale resource can be served while
+// it is revalidated in the background
+// https://tools.ietf.org/html/rfc5861#section-3
+func (h *Handler) staleWhileRevalidate(res *Resource, r *cacheRequest) bool {
+	cc, err := res.cacheControl()
+	if err != nil || !cc.Has("stale-while-revalidate") {
+		return false
+	}
+	if cc.Has("must-revalidate") || (cc.Has("proxy-revalidate") && h.Shared) {
+		return false
+	}
+
+	window, err := cc.Duration("stale-while-revalidate")
+	if err != nil {
+		return false
+	}
+	freshness, err := h.freshness(res, r)
+	return err == nil && -freshness <= window
+}
+
+// revalidateInBackground queues a request to be revalidated by a worker,
+// returning false if the queue is full
+func (h *Handler) revalidateInBackground(r *cacheRequest) bool {
+	rv := &h.revalidator
+	rv.once.Do(func() {
+		workers := h.RevalidateWorkers
+		if workers <= 0 {
+			workers = DefaultRevalidateWorkers
+		}
+		rv.queue = make(chan *cacheRequest, revalidateQueueSize)
+		rv.pending = map[string]bool{}
+		for i := 0; i < workers; i++ {
+			go h.revalidateWorker()
+		}
+	})
+
+	key := r.Key.String()
+
+	rv.Lock()
+	defer rv.Unlock()
+
+	if rv.pending[key] {
+		debugf("%s is already being revalidated", key)
+		return true
+	}
+
+	// the revalidation outlives the client's request
+	bg := *r
+	bg.Request = r.Request.WithContext(context.Background())
+
+	Writes.Add(1)
+	select {
+	case rv.queue <- &bg:
+		rv.pending[key] = true
+		return true
+	default:
+		Writes.Done()
+		return false
+	}
+}
+
+func (h *Handler) revalidateWorker() {
+	rv := &h.revalidator
+	for r := range rv.queue {
+		h.revalidate(r)
+
+		rv.Lock()
+		delete(rv.pending, r.Key.String())
+		rv.Unlock()
+		Writes.Done()
+	}
+}
+
+// revalidate freshens a cached resource if it is still valid, or replaces
+// it with upstream's response if it has changed. It only needs the stored
+// headers, so it doesn't open the body that the request which queued it may
+// still be serving.
+func (h *Handler) revalidate(r *cacheRequest) {
+	res, err := h.lookupHeader(r)
+	if err != nil {
+		debugf("error looking up %s to revalidate: %v", r.Key.String(), err)
+		return
+	}
+
+	valid, status := h.validator.validate(r.Request, res)
+	switch {
+	case valid:
+		debugf("background revalidation of %s found it valid", r.Key.String())
+		h.cache.Freshen(res, r.Key.String())
+	case errorStatus[status]:
+		debugf("background revalidation of %s failed with %d", r.Key.String(), status)
+	default:
+		debugf("background revalidation of %s found it changed", r.Key.String())
+		h.passUpstream(httptest.NewRecorder(), r, "changed upstream")
+	}
+}
@@ -0,0 +1,69 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// RewriteRule rewrites the paths of requests matching its Pattern before
+// they are keyed and passed upstream, or redirects clients to them without
+// reaching the upstream
+type RewriteRule struct {
+	// Host is a pattern for the Host of requests, in which * matches
+	// anything, matching any host if empty
+	Host string
+	// Pattern is matched against the paths of requests, and Replacement is
+	// what the path becomes, with $1 or ${name} expanded to the submatches
+	// of Pattern, such as /api/$1 for ^/v1/(.*)$. A Replacement with a
+	// query string replaces the query of requests.
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Redirect is the status, 301 or 302, of a redirect to the replacement,
+	// or 0 to rewrite the request instead. Redirects may replace the path
+	// with an absolute url.
+	Redirect int
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule RewriteRule) Matches(r *http.Request) bool {
+	return matchHostPath(rule.Host, "", r) && rule.Pattern.MatchString(r.URL.Path)
+}
+
+// expand returns the replacement for the path of a request that matches
+func (rule RewriteRule) expand(path string) string {
+	match := rule.Pattern.FindStringSubmatchIndex(path)
+	return string(rule.Pattern.ExpandString(nil, rule.Replacement, path, match))
+}
+
+// rewriteURL applies the first of the Rewrites that matches a request,
+// returning whether it redirected the client rather than rewriting it
+func (h *Handler) rewriteURL(rw http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range h.Rewrites {
+		if !rule.Matches(r) {
+			continue
+		}
+		target := rule.expand(r.URL.Path)
+		u, err := url.Parse(target)
+		if err != nil {
+			errorf("invalid rewrite of %s to %q: %s", r.URL.Path, target, err.Error())
+			return false
+		}
+		if u.RawQuery == "" {
+			u.RawQuery = r.URL.RawQuery
+		}
+
+		if rule.Redirect != 0 {
+			debugf("redirecting %s to %s", r.URL.String(), u.String())
+			http.Redirect(rw, r, u.String(), rule.Redirect)
+			return true
+		}
+		debugf("rewriting %s to %s", r.URL.Path, u.Path)
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+		if r.RequestURI != "" {
+			r.RequestURI = r.URL.RequestURI()
+		}
+		return false
+	}
+	return false
+}
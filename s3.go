@@ -0,0 +1,482 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3StalePrefix = "stale/"
+
+	// S3 requires every part of a multipart upload but the last to be at
+	// least 5MB, this is also the most body that is ever held in memory
+	s3PartSize = 5 * 1024 * 1024
+
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// S3Config describes an S3-compatible bucket to store resources in
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g https://s3.amazonaws.com
+	// or http://minio:9000. Buckets are addressed path-style.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object name
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// s3Cache stores resources as objects in an S3-compatible bucket, with bodies
+// streamed via multipart uploads so they never need to fit in memory
+type s3Cache struct {
+	S3Config
+	endpoint *url.URL
+}
+
+var _ Cache = (*s3Cache)(nil)
+
+// NewS3Cache returns a cache backed by an S3-compatible bucket
+func NewS3Cache(config S3Config) (Cache, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", err.Error())
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q, expected an absolute url", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &s3Cache{S3Config: config, endpoint: endpoint}, nil
+}
+
+func (c *s3Cache) objectName(prefix, key string) string {
+	return c.Prefix + prefix + formatPrefix + hashKey(key)
+}
+
+func (c *s3Cache) objectURL(name string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + name
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do signs and sends a request, returning an error for any non-2xx response
+func (c *s3Cache) do(method, name string, query url.Values, h http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(name, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	c.sign(req, body)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFoundInCache
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s failed with %s: %s", method, name, resp.Status, b)
+	}
+
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request
+// http://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *s3Cache) sign(req *http.Request, body []byte) {
+	t := time.Now().UTC()
+	payloadHash := s3UnsignedPayload
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+
+	req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if c.AccessKey == "" {
+		return
+	}
+
+	signedHeaders := []string{"host"}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			signedHeaders = append(signedHeaders, lk)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	canonicalHeaders := &bytes.Buffer{}
+	for _, k := range signedHeaders {
+		v := req.Host
+		if k != "host" {
+			v = strings.TrimSpace(req.Header.Get(k))
+		}
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, v)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	date := t.Format("20060102")
+	scope := strings.Join([]string{date, c.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		c.AccessKey, scope, strings.Join(signedHeaders, ";"),
+		hmacSHA256(key, stringToSign),
+	))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, data)
+	return h.Sum(nil)
+}
+
+func (c *s3Cache) get(name string) ([]byte, error) {
+	resp, err := c.do("GET", name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *s3Cache) put(name string, b []byte) error {
+	resp, err := c.do("PUT", name, nil, nil, b)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Cache) delete(name string) error {
+	resp, err := c.do("DELETE", name, nil, nil, nil)
+	if err == ErrNotFoundInCache {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *s3Cache) Header(key string) (Header, error) {
+	b, err := c.get(c.objectName(headerPrefix, key))
+	if err != nil {
+		return Header{}, err
+	}
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// Store a resource against a number of keys. The body is uploaded once for
+// the first key and copied server-side for the rest.
+func (c *s3Cache) Store(res *Resource, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var r io.Reader = res
+	length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+	if err == nil {
+		r = io.LimitReader(res, length)
+	} else {
+		length = -1
+	}
+
+	first := c.objectName(bodyPrefix, keys[0])
+	n, err := c.upload(first, r)
+	if err != nil {
+		return err
+	}
+	if length >= 0 && n != length {
+		c.delete(first)
+		return io.ErrUnexpectedEOF
+	}
+
+	for _, key := range keys {
+		if err := c.delete(c.objectName(s3StalePrefix, key)); err != nil {
+			return err
+		}
+
+		if name := c.objectName(bodyPrefix, key); name != first {
+			if err := c.copy(first, name); err != nil {
+				return err
+			}
+		}
+
+		if err := c.put(c.objectName(headerPrefix, key), headerBytes(res.Status(), res.Header())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *s3Cache) copy(src, dst string) error {
+	resp, err := c.do("PUT", dst, nil, http.Header{
+		"X-Amz-Copy-Source": {"/" + c.Bucket + "/" + src},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// upload streams r to an object, using a multipart upload if it doesn't
+// fit in a single part. The number of bytes uploaded is returned.
+func (c *s3Cache) upload(name string, r io.Reader) (int64, error) {
+	part := make([]byte, s3PartSize)
+
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), c.put(name, part[:n])
+	} else if err != nil {
+		return 0, err
+	}
+
+	uploadID, err := c.createMultipartUpload(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var etags []string
+	var total int64
+
+	for n > 0 {
+		etag, err := c.uploadPart(name, uploadID, len(etags)+1, part[:n])
+		if err != nil {
+			c.abortMultipartUpload(name, uploadID)
+			return 0, err
+		}
+		etags = append(etags, etag)
+		total += int64(n)
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.abortMultipartUpload(name, uploadID)
+			return 0, err
+		}
+	}
+
+	if err := c.completeMultipartUpload(name, uploadID, etags); err != nil {
+		c.abortMultipartUpload(name, uploadID)
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (c *s3Cache) createMultipartUpload(name string) (string, error) {
+	resp, err := c.do("POST", name, url.Values{"uploads": {""}}, nil, []byte{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", errors.New("s3 returned an empty upload id")
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Cache) uploadPart(name, uploadID string, num int, b []byte) (string, error) {
+	resp, err := c.do("PUT", name, url.Values{
+		"partNumber": {strconv.Itoa(num)},
+		"uploadId":   {uploadID},
+	}, nil, b)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Etag"), nil
+}
+
+func (c *s3Cache) completeMultipartUpload(name, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", name, url.Values{"uploadId": {uploadID}}, nil, b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// errors can be returned in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 multipart upload of %s failed: %s", name, result.Message)
+	}
+	return nil
+}
+
+func (c *s3Cache) abortMultipartUpload(name, uploadID string) {
+	resp, err := c.do("DELETE", name, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		errorf("error aborting upload of %s: %s", name, err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *s3Cache) Retrieve(key string) (*Resource, error) {
+	body, err := c.open(c.objectName(bodyPrefix, key))
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := c.Header(key)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	res := NewResource(h.StatusCode, body, h.Header)
+
+	if b, err := c.get(c.objectName(s3StalePrefix, key)); err == nil {
+		staleNano, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		staleTime := time.Unix(0, staleNano).UTC()
+		if !res.DateAfter(staleTime) {
+			log.Printf("stale marker of %s found", staleTime)
+			res.MarkStale()
+		}
+	} else if err != ErrNotFoundInCache {
+		body.Close()
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *s3Cache) Invalidate(keys ...string) {
+	log.Printf("invalidating %q", keys)
+	for _, key := range keys {
+		stale := []byte(strconv.FormatInt(Clock().UnixNano(), 10))
+		if err := c.put(c.objectName(s3StalePrefix, key), stale); err != nil {
+			errorf("error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *s3Cache) Freshen(res *Resource, keys ...string) error {
+	for _, key := range keys {
+		if h, err := c.Header(key); err == nil {
+			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
+				debugf("freshening key %s", key)
+				if err := c.put(c.objectName(headerPrefix, key), headerBytes(h.StatusCode, res.Header())); err != nil {
+					return err
+				}
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+				c.Invalidate(key)
+			}
+		}
+	}
+	return nil
+}
+
+// open returns a seekable reader over an object that streams the body,
+// issuing ranged requests when seeking
+func (c *s3Cache) open(name string) (*rangeReader, error) {
+	resp, err := c.do("GET", name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 returned no Content-Length for %s", name)
+	}
+	return newRangeReader(resp.Body, resp.ContentLength, func(offset int64) (io.ReadCloser, error) {
+		resp, err := c.do("GET", name, nil, http.Header{
+			"Range": {fmt.Sprintf("bytes=%d-", offset)},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}), nil
+}
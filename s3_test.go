@@ -0,0 +1,163 @@
+package httpcache_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 implements just enough of the S3 API to exercise the s3 backend
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte
+	uploads int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, parts: map[string]map[int][]byte{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := r.URL.Path
+
+	// bodies are written outside of the lock, as clients may hold a
+	// response open while making other requests
+	if r.Method == "GET" {
+		s.Lock()
+		b, ok := s.objects[name]
+		s.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			b = b[offset:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case r.Method == "POST" && q.Get("uploadId") == "" && q["uploads"] != nil:
+		s.uploads++
+		id := strconv.Itoa(s.uploads)
+		s.parts[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		num, _ := strconv.Atoi(q.Get("partNumber"))
+		b, _ := ioutil.ReadAll(r.Body)
+		s.parts[q.Get("uploadId")][num] = b
+		w.Header().Set("Etag", fmt.Sprintf(`"%d"`, num))
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		parts := s.parts[q.Get("uploadId")]
+		nums := []int{}
+		for num := range parts {
+			nums = append(nums, num)
+		}
+		sort.Ints(nums)
+		body := []byte{}
+		for _, num := range nums {
+			body = append(body, parts[num]...)
+		}
+		s.objects[name] = body
+		delete(s.parts, q.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(s.parts, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		b, ok := s.objects[r.Header.Get("X-Amz-Copy-Source")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.objects[name] = b
+	case r.Method == "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		s.objects[name] = b
+	case r.Method == "DELETE":
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func TestS3SaveMultipartResource(t *testing.T) {
+	s3 := newFakeS3()
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cache, err := httpcache.NewS3Cache(httpcache.S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "llamas",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+
+	// large enough to require a multipart upload
+	body := strings.Repeat("llamas", 2*1024*1024)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
+		"Llamas":         []string{"true"},
+		"Content-Length": []string{strconv.Itoa(len(body))},
+	})
+
+	if err := cache.Store(res, "s3-testkey", "s3-testkey-vary"); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, s3.uploads)
+
+	for _, key := range []string{"s3-testkey", "s3-testkey-vary"} {
+		resOut, err := cache.Retrieve(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, res.Header(), resOut.Header())
+		require.True(t, body == readAllString(resOut), "body of %s differs", key)
+
+		if _, err := resOut.Seek(-6, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, "llamas", readAllString(resOut))
+		resOut.Close()
+	}
+}
+
+func TestS3RetrieveMissing(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+
+	cache, err := httpcache.NewS3Cache(httpcache.S3Config{Endpoint: server.URL, Bucket: "llamas"})
+	require.NoError(t, err)
+
+	if _, err := cache.Retrieve("s3-missing"); err != httpcache.ErrNotFoundInCache {
+		t.Fatalf("expected ErrNotFoundInCache, got %v", err)
+	}
+}
+
+func TestS3InvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"http://[::1", "s3.amazonaws.com", ""} {
+		_, err := httpcache.NewS3Cache(httpcache.S3Config{Endpoint: endpoint, Bucket: "llamas"})
+		require.Error(t, err, endpoint)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,21 +56,21 @@ func TestSpecResponseCacheControl(t *testing.T) {
 		shared         bool
 	}{
 		{cacheControl: "", requests: 2},
-		{cacheControl: "no-cache", requests: 2, cacheStatus: "SKIP"},
-		{cacheControl: "no-store", requests: 2, cacheStatus: "SKIP"},
-		{cacheControl: "max-age=0, no-cache", requests: 2, cacheStatus: "SKIP"},
-		{cacheControl: "max-age=0", requests: 2, cacheStatus: "SKIP"},
-		{cacheControl: "s-maxage=0", requests: 2, cacheStatus: "SKIP", shared: true},
-		{cacheControl: "s-maxage=60", requests: 2, cacheStatus: "HIT", shared: true},
+		{cacheControl: "no-cache", requests: 2, cacheStatus: "BYPASS"},
+		{cacheControl: "no-store", requests: 2, cacheStatus: "BYPASS"},
+		{cacheControl: "max-age=0, no-cache", requests: 2, cacheStatus: "BYPASS"},
+		{cacheControl: "max-age=0", requests: 2, cacheStatus: "BYPASS"},
+		{cacheControl: "s-maxage=0", requests: 2, cacheStatus: "BYPASS", shared: true},
+		{cacheControl: "s-maxage=60", requests: 2, cacheStatus: "REVALIDATED", shared: true},
 		{cacheControl: "s-maxage=60", requests: 2, secondsElapsed: 65, shared: true},
 		{cacheControl: "max-age=60", requests: 1, cacheStatus: "HIT"},
 		{cacheControl: "max-age=60", requests: 1, secondsElapsed: 35, cacheStatus: "HIT"},
 		{cacheControl: "max-age=60", requests: 2, secondsElapsed: 65},
-		{cacheControl: "max-age=60, must-revalidate", requests: 2, cacheStatus: "HIT"},
+		{cacheControl: "max-age=60, must-revalidate", requests: 2, cacheStatus: "REVALIDATED"},
 		{cacheControl: "max-age=60, proxy-revalidate", requests: 1, cacheStatus: "HIT"},
-		{cacheControl: "max-age=60, proxy-revalidate", requests: 2, cacheStatus: "HIT", shared: true},
+		{cacheControl: "max-age=60, proxy-revalidate", requests: 2, cacheStatus: "REVALIDATED", shared: true},
 		{cacheControl: "private, max-age=60", requests: 1, cacheStatus: "HIT"},
-		{cacheControl: "private, max-age=60", requests: 2, cacheStatus: "SKIP", shared: true},
+		{cacheControl: "private, max-age=60", requests: 2, cacheStatus: "BYPASS", shared: true},
 	}
 
 	for idx, c := range cases {
@@ -127,7 +128,7 @@ func TestSpecResponseCacheControlWithAuthorizationHeaders(t *testing.T) {
 
 	r1 := client.get("/r1")
 	assert.Equal(t, http.StatusOK, r1.statusCode)
-	assert.Equal(t, "SKIP", r1.cacheStatus)
+	assert.Equal(t, "BYPASS", r1.cacheStatus)
 	assert.Equal(t, "fully", r1.HeaderMap.Get("Authorization"))
 	assert.Equal(t, 2, upstream.requests)
 
@@ -209,7 +210,7 @@ func TestSpecCachingStatusCodes(t *testing.T) {
 	upstream.StatusCode = http.StatusPaymentRequired
 	r3 := client.get("/r2")
 	assert.Equal(t, http.StatusPaymentRequired, r3.statusCode)
-	assert.Equal(t, "SKIP", r3.cacheStatus)
+	assert.Equal(t, "BYPASS", r3.cacheStatus)
 }
 
 func TestSpecConditionalCaching(t *testing.T) {
@@ -223,7 +224,34 @@ func TestSpecConditionalCaching(t *testing.T) {
 	r2 := client.get("/", `If-None-Match: "llamas"`)
 	assert.Equal(t, http.StatusNotModified, r2.Code)
 	assert.Equal(t, "", string(r2.body))
-	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "REVALIDATED", r2.cacheStatus)
+}
+
+func TestSpecConditionalRequestsServedFromCache(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.LastModified = upstream.Now.AddDate(0, 0, -1)
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	upstream.timeTravel(time.Second * 10)
+
+	for _, header := range []string{
+		`If-None-Match: "llamas"`,
+		`If-None-Match: "alpacas", W/"llamas"`,
+		"If-Modified-Since: " + upstream.Now.Format(http.TimeFormat),
+	} {
+		r := client.get("/", header)
+		assert.Equal(t, http.StatusNotModified, r.Code, header)
+		assert.Equal(t, "HIT", r.cacheStatus, header)
+		assert.Equal(t, "", string(r.body), header)
+		assert.Equal(t, time.Second*10, r.age, header)
+		assert.Equal(t, `"llamas"`, r.header.Get("ETag"), header)
+	}
+
+	r := client.get("/", `If-None-Match: "alpacas"`)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, string(upstream.Body), string(r.body))
+	assert.Equal(t, 1, upstream.requests)
 }
 
 func TestSpecRangeRequests(t *testing.T) {
@@ -231,8 +259,45 @@ func TestSpecRangeRequests(t *testing.T) {
 
 	r1 := client.get("/", "Range: bytes=0-3")
 	assert.Equal(t, http.StatusPartialContent, r1.Code)
-	assert.Equal(t, "SKIP", r1.cacheStatus)
+	assert.Equal(t, "BYPASS", r1.cacheStatus)
+	assert.Equal(t, string(upstream.Body[0:4]), string(r1.body))
+}
+
+func TestSpecRangeRequestsServedFromCache(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.assert(func(r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("Range"))
+	})
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	r1 := client.get("/", "Range: bytes=0-3")
+	assert.Equal(t, http.StatusPartialContent, r1.Code)
+	assert.Equal(t, "HIT", r1.cacheStatus)
+	assert.Equal(t, "bytes 0-3/6", r1.header.Get("Content-Range"))
 	assert.Equal(t, string(upstream.Body[0:4]), string(r1.body))
+
+	r2 := client.get("/", "Range: bytes=0-1,4-5")
+	assert.Equal(t, http.StatusPartialContent, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.True(t, strings.HasPrefix(r2.header.Get("Content-Type"), "multipart/byteranges"))
+	assert.Contains(t, string(r2.body), "Content-Range: bytes 4-5/6")
+
+	r3 := client.get("/", "Range: bytes=0-3", `If-Range: "llamas"`)
+	assert.Equal(t, http.StatusPartialContent, r3.Code)
+	assert.Equal(t, "HIT", r3.cacheStatus)
+
+	r4 := client.get("/", "Range: bytes=0-3", `If-Range: "alpacas"`)
+	assert.Equal(t, http.StatusOK, r4.Code)
+	assert.Equal(t, string(upstream.Body), string(r4.body))
+
+	upstream.timeTravel(time.Minute * 2)
+	r5 := client.get("/", "Range: bytes=2-")
+	assert.Equal(t, http.StatusPartialContent, r5.Code)
+	assert.Equal(t, "REVALIDATED", r5.cacheStatus)
+	assert.Equal(t, string(upstream.Body[2:]), string(r5.body))
+	assert.Equal(t, 2, upstream.requests)
 }
 
 func TestSpecHeuristicCaching(t *testing.T) {
@@ -256,7 +321,7 @@ func TestSpecCacheControlTrumpsExpires(t *testing.T) {
 	assert.Equal(t, 1, upstream.requests)
 
 	upstream.timeTravel(time.Hour * 48)
-	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	assert.Equal(t, "REVALIDATED", client.get("/").cacheStatus)
 	assert.Equal(t, 2, upstream.requests)
 }
 
@@ -265,8 +330,8 @@ func TestSpecNotCachedWithoutValidatorOrExpiration(t *testing.T) {
 	upstream.LastModified = time.Time{}
 	upstream.Etag = ""
 
-	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
-	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/").cacheStatus)
 	assert.Equal(t, 2, upstream.requests)
 }
 
@@ -275,7 +340,7 @@ func TestSpecNoCachingForInvalidExpires(t *testing.T) {
 	upstream.LastModified = time.Time{}
 	upstream.Header.Set("Expires", "-1")
 
-	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/").cacheStatus)
 }
 
 func TestSpecRequestsWithoutHostHeader(t *testing.T) {
@@ -298,7 +363,8 @@ func TestSpecCacheControlMaxStale(t *testing.T) {
 	upstream.timeTravel(time.Second * 90)
 	upstream.Body = []byte("brand new content")
 	r2 := client.get("/", "Cache-Control: max-stale=3600")
-	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "STALE", r2.cacheStatus)
+	assert.Equal(t, "stale: beyond max-age, max-stale used", r2.header.Get(httpcache.CacheStatusHeader))
 	assert.Equal(t, time.Second*90, r2.age)
 
 	upstream.timeTravel(time.Second * 90)
@@ -319,7 +385,41 @@ func TestSpecValidatingStaleResponsesUnchanged(t *testing.T) {
 	r2 := client.get("/")
 	assert.Equal(t, http.StatusOK, r2.Code)
 	assert.Equal(t, string(upstream.Body), string(r2.body))
-	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "REVALIDATED", r2.cacheStatus)
+}
+
+func TestSpecValidatingStaleResponsesWithLastModified(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.LastModified = upstream.Now.AddDate(0, 0, -1)
+	upstream.Header.Set("Content-Type", "application/x-llamas")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.CacheControl = "max-age=120"
+	upstream.assert(func(r *http.Request) {
+		assert.Equal(t, upstream.LastModified.Format(http.TimeFormat), r.Header.Get("If-Modified-Since"))
+		assert.Equal(t, "", r.Header.Get("If-None-Match"))
+	})
+
+	r2 := client.get("/")
+	assert.Equal(t, http.StatusOK, r2.Code)
+	assert.Equal(t, "REVALIDATED", r2.cacheStatus)
+	assert.Equal(t, string(upstream.Body), string(r2.body))
+	assert.Equal(t, "application/x-llamas", r2.header.Get("Content-Type"))
+
+	upstream.timeTravel(time.Second * 90)
+	r3 := client.get("/")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "max-age=120", r3.header.Get("Cache-Control"))
+	assert.Equal(t, "application/x-llamas", r3.header.Get("Content-Type"))
+	assert.Equal(t, string(upstream.Body), string(r3.body))
+
+	upstream.timeTravel(time.Second * 60)
+	r4 := client.get("/", `If-None-Match: "alpacas"`)
+	assert.Equal(t, http.StatusOK, r4.Code)
+	assert.Equal(t, "REVALIDATED", r4.cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
 }
 
 func TestSpecValidatingStaleResponsesWithNewContent(t *testing.T) {
@@ -430,9 +530,9 @@ func TestSpecHeadCanBeServedFromCacheOnlyWithExplicitFreshness(t *testing.T) {
 	assert.Equal(t, "HIT", client.head("/explicit").cacheStatus)
 
 	upstream.CacheControl = ""
-	assert.Equal(t, "SKIP", client.get("/implicit").cacheStatus)
-	assert.Equal(t, "SKIP", client.head("/implicit").cacheStatus)
-	assert.Equal(t, "SKIP", client.head("/implicit").cacheStatus)
+	assert.Equal(t, "BYPASS", client.get("/implicit").cacheStatus)
+	assert.Equal(t, "BYPASS", client.head("/implicit").cacheStatus)
+	assert.Equal(t, "BYPASS", client.head("/implicit").cacheStatus)
 }
 
 func TestSpecInvalidatingGetWithHeadRequest(t *testing.T) {
@@ -441,7 +541,7 @@ func TestSpecInvalidatingGetWithHeadRequest(t *testing.T) {
 	assert.Equal(t, "MISS", client.get("/explicit").cacheStatus)
 
 	upstream.Body = []byte("brand new content")
-	assert.Equal(t, "SKIP", client.head("/explicit", "Cache-Control: max-age=0").cacheStatus)
+	assert.Equal(t, "BYPASS", client.head("/explicit", "Cache-Control: max-age=0").cacheStatus)
 	assert.Equal(t, "MISS", client.get("/explicit").cacheStatus)
 }
 
@@ -454,7 +554,7 @@ func TestSpecFresheningGetWithHeadRequest(t *testing.T) {
 	assert.Equal(t, 10*time.Second, client.get("/explicit").age)
 
 	upstream.Header.Add("X-Llamas", "llamas")
-	assert.Equal(t, "SKIP", client.head("/explicit", "Cache-Control: max-age=0").cacheStatus)
+	assert.Equal(t, "BYPASS", client.head("/explicit", "Cache-Control: max-age=0").cacheStatus)
 
 	refreshed := client.get("/explicit")
 	assert.Equal(t, "HIT", refreshed.cacheStatus)
@@ -481,5 +581,71 @@ func TestSpecMultipleCacheControlHeaders(t *testing.T) {
 	upstream.Header.Add("Cache-Control", "no-cache")
 
 	r1 := client.get("/")
-	assert.Equal(t, "SKIP", r1.cacheStatus)
+	assert.Equal(t, "BYPASS", r1.cacheStatus)
+}
+
+func TestSpecStaleIfError(t *testing.T) {
+	var cases = []struct {
+		cacheControl      string
+		requestHeaders    []string
+		serveStaleOnError bool
+		secondsElapsed    time.Duration
+		statusCode        int
+	}{
+		{cacheControl: "max-age=60, stale-if-error=60", secondsElapsed: 90, statusCode: http.StatusOK},
+		{cacheControl: "max-age=60, stale-if-error=60", secondsElapsed: 150, statusCode: http.StatusServiceUnavailable},
+		{cacheControl: "max-age=60, stale-if-error=60, must-revalidate", secondsElapsed: 90, statusCode: http.StatusServiceUnavailable},
+		{cacheControl: "max-age=60", requestHeaders: []string{"Cache-Control: stale-if-error=60"}, secondsElapsed: 90, statusCode: http.StatusOK},
+		{cacheControl: "max-age=60", secondsElapsed: 90, statusCode: http.StatusServiceUnavailable},
+		{cacheControl: "max-age=60", serveStaleOnError: true, secondsElapsed: 900, statusCode: http.StatusOK},
+	}
+
+	for idx, c := range cases {
+		client, upstream := testSetup()
+		upstream.CacheControl = c.cacheControl
+		client.cacheHandler.ServeStaleOnError = c.serveStaleOnError
+		assert.Equal(t, http.StatusOK, client.get("/").Code)
+
+		upstream.timeTravel(time.Second * c.secondsElapsed)
+		upstream.StatusCode = http.StatusServiceUnavailable
+
+		r := client.get("/", c.requestHeaders...)
+		require.Equal(t, c.statusCode, r.statusCode, fmt.Sprintf("case #%d failed, %+v", idx+1, c))
+		if c.statusCode == http.StatusOK {
+			assert.Equal(t, "llamas", string(r.body))
+			assert.Equal(t, "STALE", r.cacheStatus)
+			assert.Equal(t, []string{`111 - "Revalidation Failed"`, `110 - "Response is Stale"`}, r.header["Warning"])
+		}
+	}
+}
+
+func TestSpecStaleWhileRevalidate(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-while-revalidate=60"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, http.StatusOK, client.get("/").Code)
+
+	// stale, but within stale-while-revalidate
+	upstream.timeTravel(time.Second * 90)
+	upstream.Body = []byte("alpacas")
+	upstream.Etag = `"alpacas"`
+
+	r := client.get("/")
+	assert.Equal(t, http.StatusOK, r.statusCode)
+	assert.Equal(t, "STALE", r.cacheStatus)
+	assert.Equal(t, "stale: beyond max-age, swr used", r.header.Get(httpcache.CacheStatusHeader))
+	assert.Equal(t, "llamas", string(r.body))
+	assert.Equal(t, `110 - "Response is Stale"`, r.header.Get("Warning"))
+
+	// the background revalidation replaced the changed resource
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "alpacas", string(r.body))
+	assert.Equal(t, "", r.header.Get("Warning"))
+
+	// beyond stale-while-revalidate the resource is revalidated first
+	upstream.timeTravel(time.Second * 150)
+	upstream.Body = []byte("vicunas")
+	upstream.Etag = `"vicunas"`
+	assert.Equal(t, "vicunas", string(client.get("/").body))
 }
@@ -0,0 +1,36 @@
+package httpcache
+
+// CacheStats are the size of a cache and its limit, and the number of
+// resources it has evicted to stay within it with the policy it evicted them
+// by. Entries is only counted by memory caches, and Rejections, of new
+// resources not admitted, by disk caches with TinyLFU.
+type CacheStats struct {
+	Bytes          int64
+	MaxBytes       int64
+	Entries        int64
+	Evictions      int64
+	EvictionPolicy string
+	Rejections     int64
+}
+
+// statsCache is implemented by caches that keep track of their size
+type statsCache interface {
+	Stats() CacheStats
+}
+
+// Stats returns the size and evictions of a cache, if it keeps track of
+// them. Only the size limited memory and disk caches do, and a tiered cache
+// reports the stats of its cold tier.
+func Stats(cache Cache) (CacheStats, bool) {
+	switch c := cache.(type) {
+	case *IndexedCache:
+		return Stats(c.Cache)
+	case *namespacedCache:
+		return Stats(c.cache)
+	case *tieredCache:
+		return Stats(c.cold)
+	case statsCache:
+		return c.Stats(), true
+	}
+	return CacheStats{}, false
+}
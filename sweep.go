@@ -0,0 +1,151 @@
+package httpcache
+
+import (
+	"os"
+	"time"
+)
+
+// SweepStats are the number of expired resources that Sweep removed from a
+// cache and the bytes that it reclaimed
+type SweepStats struct {
+	Removed int
+	Bytes   int64
+}
+
+// sweepCache is implemented by caches that can remove expired resources
+type sweepCache interface {
+	sweep(grace time.Duration) SweepStats
+}
+
+// Sweep removes the resources whose freshness lifetime, plus any
+// stale-while-revalidate or stale-if-error allowance and grace, has passed,
+// from caches that can list what they store. Only the memory and disk caches
+// can, and a tiered cache sweeps both of its tiers. Lifetimes are those the
+// responses give, so grace should be longer than any ttl overrides.
+func Sweep(cache Cache, grace time.Duration) (SweepStats, bool) {
+	switch c := cache.(type) {
+	case *IndexedCache:
+		return Sweep(c.Cache, grace)
+	case *namespacedCache:
+		return Sweep(c.cache, grace)
+	case *tieredCache:
+		hot, _ := Sweep(c.hot, grace)
+		cold, ok := Sweep(c.cold, grace)
+		return SweepStats{Removed: hot.Removed + cold.Removed, Bytes: hot.Bytes + cold.Bytes}, ok
+	case sweepCache:
+		return c.sweep(grace), true
+	}
+	return SweepStats{}, false
+}
+
+// freshUntil returns when a stored response stops being fresh, from the
+// lifetime it gives, and when it may be served stale until, with any
+// stale-while-revalidate or stale-if-error allowance. Responses without a
+// Date don't expire.
+func freshUntil(res *Resource) (fresh, stale time.Time, ok bool) {
+	age, err := res.Age()
+	if err != nil {
+		return fresh, stale, false
+	}
+	cc, err := res.cacheControl()
+	if err != nil {
+		return fresh, stale, false
+	}
+
+	now := Clock()
+	if maxAge, _ := res.MaxAge(true); cc.Has("s-maxage") || cc.Has("max-age") {
+		fresh = now.Add(maxAge - age)
+	} else if expires, err := res.Expires(); err == nil && !expires.IsZero() {
+		fresh = expires
+	} else {
+		fresh = now.Add(res.HeuristicFreshness() - age)
+	}
+
+	stale = fresh
+	for _, directive := range []string{"stale-while-revalidate", "stale-if-error"} {
+		if d, err := cc.Duration(directive); err == nil && fresh.Add(d).After(stale) {
+			stale = fresh.Add(d)
+		}
+	}
+	return fresh, stale, true
+}
+
+// expired returns whether a stored response has been stale for longer than
+// it may be served stale for plus grace
+func expired(res *Resource, grace time.Duration) bool {
+	_, stale, ok := freshUntil(res)
+	return ok && Clock().After(stale.Add(grace))
+}
+
+// sweep removes expired resources, skipping any stored again while they
+// were being checked
+func (c *cache) sweep(grace time.Duration) SweepStats {
+	var stats SweepStats
+
+	infos, err := c.fs.ReadDir(headerPrefix + formatPrefix)
+	if err != nil {
+		return stats
+	}
+	for _, info := range infos {
+		unlock := c.locks.lock(info.Name())
+		h, _, err := c.readStoredHeader(headerPrefix + formatPrefix + info.Name())
+		unlock()
+		if err != nil || !expired(NewResourceBytes(h.StatusCode, nil, h.Header), grace) {
+			continue
+		}
+
+		if c.remove(info, &stats) {
+			stats.Removed++
+		}
+	}
+	return stats
+}
+
+// remove removes a resource by its header file, unless it has been stored
+// again since, adding the bytes of its files to stats
+func (c *cache) remove(header os.FileInfo, stats *SweepStats) bool {
+	unlock := c.locks.lock(header.Name())
+	defer unlock()
+
+	path := headerPrefix + formatPrefix + header.Name()
+	if current, err := c.fs.Stat(path); err != nil || !current.ModTime().Equal(header.ModTime()) {
+		return false
+	}
+	body := bodyPrefix + formatPrefix + header.Name()
+	if info, err := c.fs.Stat(body); err == nil {
+		stats.Bytes += info.Size()
+	}
+	c.fs.Remove(path)
+	c.fs.Remove(body)
+	c.forgetBlob(body)
+	stats.Bytes += header.Size()
+	return true
+}
+
+// sweep removes expired resources, counting the bytes reclaimed against the
+// size of the cache
+func (c *diskCache) sweep(grace time.Duration) SweepStats {
+	stats := c.cache.sweep(grace)
+
+	c.Lock()
+	c.size -= stats.Bytes
+	c.Unlock()
+	return stats
+}
+
+// sweep removes expired resources
+func (c *lruCache) sweep(grace time.Duration) SweepStats {
+	c.Lock()
+	defer c.Unlock()
+
+	var stats SweepStats
+	for _, el := range c.entries {
+		e := el.Value.(*lruEntry)
+		if expired(NewResourceBytes(e.header.StatusCode, nil, e.header.Header), grace) {
+			c.remove(el)
+			stats.Removed++
+			stats.Bytes += e.size
+		}
+	}
+	return stats
+}
@@ -0,0 +1,72 @@
+package httpcache_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepRemovesExpiredResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	disk, err := httpcache.NewLimitedDiskCache(dir, 1000000, 0)
+	require.NoError(t, err)
+	memory := httpcache.NewLimitedMemoryCache(1000000, 0)
+
+	now := httpcache.Clock().UTC()
+	resources := map[string]http.Header{
+		"fresh": {
+			"Date":          {now.Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60"},
+		},
+		"expired": {
+			"Date":          {now.Add(-2 * time.Hour).Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60"},
+		},
+		"stale-while-revalidate": {
+			"Date":          {now.Add(-2 * time.Hour).Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60, stale-while-revalidate=86400"},
+		},
+		"expires": {
+			"Date":    {now.Add(-2 * time.Hour).Format(http.TimeFormat)},
+			"Expires": {now.Add(-90 * time.Minute).Format(http.TimeFormat)},
+		},
+		"grace": {
+			"Date":          {now.Add(-10 * time.Minute).Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60"},
+		},
+	}
+
+	for _, cache := range []httpcache.Cache{disk, memory} {
+		for key, header := range resources {
+			require.NoError(t, cache.Store(httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), header), key))
+		}
+		before, _ := httpcache.Stats(cache)
+
+		stats, ok := httpcache.Sweep(httpcache.NewIndexedCache(cache), time.Hour)
+		require.True(t, ok)
+		require.Equal(t, 2, stats.Removed)
+
+		after, _ := httpcache.Stats(cache)
+		require.Equal(t, before.Bytes-after.Bytes, stats.Bytes)
+
+		for key, exists := range map[string]bool{"fresh": true, "expired": false, "stale-while-revalidate": true, "expires": false, "grace": true} {
+			_, err := cache.Header(key)
+			if exists {
+				require.NoError(t, err, key)
+			} else {
+				require.Equal(t, httpcache.ErrNotFoundInCache, err, key)
+			}
+		}
+	}
+
+	_, ok := httpcache.Sweep(httpcache.NewMemcacheCache("localhost:11211"), time.Hour)
+	require.False(t, ok)
+}
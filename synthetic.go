@@ -0,0 +1,56 @@
+package httpcache
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+)
+
+// SyntheticResponse is a fixed response, such as a robots.txt, that is
+// served for requests whose Host and path match its patterns, in which *
+// matches anything, without looking them up or passing them upstream
+type SyntheticResponse struct {
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+
+	// Status is the status of the response, defaulting to 200
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Matches returns whether a request matches the patterns of the response
+func (s SyntheticResponse) Matches(r *http.Request) bool {
+	return matchHostPath(s.Host, s.Path, r)
+}
+
+// ServeHTTP serves the response, with ranges and conditional requests for
+// those with a 200
+func (s SyntheticResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for key, values := range s.Header {
+		w.Header()[key] = values
+	}
+	if s.Status == 0 || s.Status == http.StatusOK {
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(s.Body))
+		return
+	}
+	w.WriteHeader(s.Status)
+	if r.Method != "HEAD" {
+		w.Write(s.Body)
+	}
+}
+
+// serveSynthetic serves the first of the Synthetic responses that matches
+// a request, returning whether there was one
+func (h *Handler) serveSynthetic(rw http.ResponseWriter, r *http.Request) bool {
+	for _, s := range h.Synthetic {
+		if s.Matches(r) {
+			debugf("serving synthetic response for %s", r.URL.String())
+			s.ServeHTTP(rw, r)
+			return true
+		}
+	}
+	return false
+}
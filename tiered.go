@@ -0,0 +1,270 @@
+package httpcache
+
+import (
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TieredConfig configures when resources move between the tiers of a
+// tiered cache
+type TieredConfig struct {
+	// PromoteHits is how many times a resource must have been requested
+	// recently before it is copied from the cold cache into the hot one. At
+	// 1 or less, every resource is stored in both and promoted on its first
+	// hit in cold; otherwise resources are only stored in cold until they
+	// are requested often enough, so the long tail stays on disk. Requests
+	// are counted up to MaxPromoteHits, so higher values are treated as it.
+	PromoteHits int
+	// DemoteIdle removes resources from the hot cache that haven't been
+	// requested for this long, leaving them in the cold cache, or 0 to only
+	// evict them from the hot cache when it runs out of space
+	DemoteIdle time.Duration
+}
+
+// MaxPromoteHits is the most requests of a resource a tiered cache counts
+// before promoting it
+const MaxPromoteHits = sketchMax
+
+// keyRemover is implemented by caches that resources can be removed from
+// without invalidating them elsewhere
+type keyRemover interface {
+	removeKeys(keys ...string)
+}
+
+// tieredCache serves hot resources from a fast cache, falling through to a
+// larger, slower cache for everything else
+type tieredCache struct {
+	hot, cold Cache
+	config    TieredConfig
+
+	mu sync.Mutex
+	// hits counts how often keys have been requested recently, and lastHit
+	// is when each key in hot was last requested
+	hits       *frequencySketch
+	lastHit    map[string]time.Time
+	lastDemote time.Time
+}
+
+var _ Cache = (*tieredCache)(nil)
+
+// NewTieredCache returns a cache that writes through to both hot and cold,
+// serving from hot where possible and promoting resources found only in cold
+// into hot when they are retrieved.
+func NewTieredCache(hot, cold Cache) Cache {
+	return NewConfiguredTieredCache(hot, cold, TieredConfig{})
+}
+
+// NewConfiguredTieredCache returns a cache that serves from hot where
+// possible, promoting resources from cold into hot once they have been
+// requested config.PromoteHits times and demoting them after
+// config.DemoteIdle without a request. Resources are only removed from hot
+// without being evicted if it is a memory cache.
+func NewConfiguredTieredCache(hot, cold Cache, config TieredConfig) Cache {
+	if config.PromoteHits > MaxPromoteHits {
+		config.PromoteHits = MaxPromoteHits
+	}
+	return &tieredCache{
+		hot:        hot,
+		cold:       cold,
+		config:     config,
+		hits:       newFrequencySketch(),
+		lastHit:    map[string]time.Time{},
+		lastDemote: Clock(),
+	}
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *tieredCache) Header(key string) (Header, error) {
+	if h, err := c.hot.Header(key); err == nil {
+		return h, nil
+	}
+	return c.cold.Header(key)
+}
+
+// Store a resource against a number of keys, streaming its body into cold
+// and reading it back from there into hot if hot can hold it
+func (c *tieredCache) Store(res *Resource, keys ...string) error {
+	if err := c.cold.Store(res, keys...); err != nil {
+		return err
+	}
+
+	// once promotion takes more than one hit, only keys that are already
+	// hot are replaced in hot, so that they aren't left stale there
+	hotKeys := keys
+	if c.config.PromoteHits > 1 {
+		hotKeys = nil
+		for _, key := range keys {
+			if _, err := c.hot.Header(key); err == nil {
+				hotKeys = append(hotKeys, key)
+			}
+		}
+	}
+	if len(hotKeys) == 0 {
+		return nil
+	}
+
+	stored, err := peek(c.cold, hotKeys[0])
+	if err != nil {
+		// cold may not have admitted it
+		if err != ErrNotFoundInCache {
+			errorf("error reading %s back from cold cache: %s", hotKeys[0], err.Error())
+		}
+		c.demote(hotKeys...)
+		return nil
+	}
+	defer stored.Close()
+
+	if fits, err := c.fitsHot(stored); err != nil || !fits {
+		debugf("%s is too large to store in hot cache", hotKeys[0])
+		c.demote(hotKeys...)
+		return err
+	}
+	c.touch(hotKeys...)
+	return c.hot.Store(stored, hotKeys...)
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *tieredCache) Retrieve(key string) (*Resource, error) {
+	hits := c.hit(key)
+
+	if res, err := c.hot.Retrieve(key); err == nil {
+		c.touch(key)
+		return res, nil
+	} else if err != ErrNotFoundInCache {
+		errorf("error retrieving %s from hot cache: %s", key, err.Error())
+	}
+
+	res, err := c.cold.Retrieve(key)
+	if err != nil || res.IsStale() || hits < c.config.PromoteHits {
+		return res, err
+	}
+
+	// resources that hot can't hold are served from cold without being
+	// read into memory
+	if fits, err := c.fitsHot(res); err != nil {
+		res.Close()
+		return nil, err
+	} else if !fits {
+		debugf("%s is too large to promote to hot cache", key)
+		return res, nil
+	}
+
+	b, err := ioutil.ReadAll(res)
+	res.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("promoting %s to hot cache after %d hits", key, hits)
+	c.touch(key)
+	if err := c.hot.Store(NewResourceBytes(res.Status(), b, cloneHeader(res.Header())), key); err != nil {
+		errorf("error promoting %s: %s", key, err.Error())
+	}
+
+	return NewResourceBytes(res.Status(), b, res.Header()), nil
+}
+
+// sizeLimiter is implemented by caches that can't hold resources beyond a
+// size
+type sizeLimiter interface {
+	fits(size int64) bool
+}
+
+// fitsHot returns whether hot can hold res, leaving its body at its start
+func (c *tieredCache) fitsHot(res *Resource) (bool, error) {
+	l, ok := c.hot.(sizeLimiter)
+	if !ok {
+		return true, nil
+	}
+	size, err := bodySize(res)
+	if err != nil {
+		return false, err
+	}
+	return l.fits(size + int64(len(headerBytes(res.Status(), res.Header())))), nil
+}
+
+// bodySize returns the length of the body of res, leaving it at its start
+func bodySize(res *Resource) (int64, error) {
+	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
+		return length, nil
+	}
+	size, err := res.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = res.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// hit records a request for key, returning how many times it has been
+// requested recently, and demotes idle resources if it is time to
+func (c *tieredCache) hit(key string) int {
+	c.mu.Lock()
+	c.hits.increment(key)
+	hits := int(c.hits.estimate(key))
+
+	var idle []string
+	if c.config.DemoteIdle > 0 && Clock().Sub(c.lastDemote) >= c.config.DemoteIdle/4 {
+		idle = c.idleKeys()
+	}
+	c.mu.Unlock()
+
+	if len(idle) > 0 {
+		c.demote(idle...)
+	}
+	return hits
+}
+
+// touch records that keys in hot have just been requested or stored
+func (c *tieredCache) touch(keys ...string) {
+	if c.config.DemoteIdle <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := Clock()
+	for _, key := range keys {
+		c.lastHit[key] = now
+	}
+}
+
+// idleKeys returns and forgets the keys in hot that have been idle for
+// longer than DemoteIdle. It must be called with mu held.
+func (c *tieredCache) idleKeys() []string {
+	now := Clock()
+	c.lastDemote = now
+
+	var idle []string
+	for key, last := range c.lastHit {
+		if now.Sub(last) > c.config.DemoteIdle {
+			idle = append(idle, key)
+			delete(c.lastHit, key)
+		}
+	}
+	return idle
+}
+
+// demote removes keys from hot, leaving them in cold
+func (c *tieredCache) demote(keys ...string) {
+	r, ok := c.hot.(keyRemover)
+	if !ok {
+		return
+	}
+	debugf("demoting %d idle resources from hot cache", len(keys))
+	r.removeKeys(keys...)
+}
+
+func (c *tieredCache) Invalidate(keys ...string) {
+	c.hot.Invalidate(keys...)
+	c.cold.Invalidate(keys...)
+}
+
+func (c *tieredCache) Freshen(res *Resource, keys ...string) error {
+	if err := c.hot.Freshen(res, keys...); err != nil {
+		return err
+	}
+	return c.cold.Freshen(res, keys...)
+}
@@ -0,0 +1,194 @@
+package httpcache_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredCachePromotesOnHit(t *testing.T) {
+	hot := httpcache.NewLRUCache(1024 * 1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewTieredCache(hot, cold)
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Llamas": []string{"true"},
+	})
+	if err := cold.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := hot.Retrieve("testkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	resOut, err := cache.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	resOut, err = hot.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+	require.Equal(t, "true", resOut.Header().Get("Llamas"))
+}
+
+func TestTieredCacheWritesThrough(t *testing.T) {
+	hot := httpcache.NewLRUCache(1024 * 1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewTieredCache(hot, cold)
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+	if err := cache.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []httpcache.Cache{hot, cold} {
+		resOut, err := c.Retrieve("testkey")
+		require.NoError(t, err)
+		require.Equal(t, "llamas", readAllString(resOut))
+	}
+}
+
+func TestTieredCachePromotesAfterHits(t *testing.T) {
+	hot := httpcache.NewLRUCache(1024 * 1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewConfiguredTieredCache(hot, cold, httpcache.TieredConfig{
+		PromoteHits: 3,
+	})
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+	if err := cache.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resOut, err := cache.Retrieve("testkey")
+		require.NoError(t, err)
+		require.Equal(t, "llamas", readAllString(resOut))
+
+		_, err = hot.Retrieve("testkey")
+		require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	}
+
+	resOut, err := cache.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+
+	resOut, err = hot.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+}
+
+func TestTieredCachePromotesAfterAtMostMaxPromoteHits(t *testing.T) {
+	hot := httpcache.NewLRUCache(1024 * 1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewConfiguredTieredCache(hot, cold, httpcache.TieredConfig{
+		PromoteHits: 100,
+	})
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{})
+	if err := cache.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < httpcache.MaxPromoteHits; i++ {
+		resOut, err := cache.Retrieve("testkey")
+		require.NoError(t, err)
+		require.Equal(t, "llamas", readAllString(resOut))
+	}
+
+	_, err := hot.Retrieve("testkey")
+	require.NoError(t, err)
+}
+
+func TestTieredCacheDoesNotPromoteResourcesLargerThanHot(t *testing.T) {
+	hot := httpcache.NewLRUCache(64)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewTieredCache(hot, cold)
+
+	body := strings.Repeat("llamas", 100)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{})
+	if err := cold.Store(res, "testkey"); err != nil {
+		t.Fatal(err)
+	}
+
+	resOut, err := cache.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, body, readAllString(resOut))
+
+	_, err = hot.Retrieve("testkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
+
+func TestTieredCacheStreamsResourcesLargerThanHotIntoCold(t *testing.T) {
+	hot := httpcache.NewLRUCache(1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewTieredCache(hot, cold)
+
+	// the body is written to cold as it arrives rather than read in full
+	// first, and is only then found to be too large for hot
+	body := strings.Repeat("llamas", 1000)
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < 1000; i++ {
+			w.Write([]byte("llamas"))
+		}
+		w.Close()
+	}()
+	require.NoError(t, cache.Store(httpcache.NewResource(http.StatusOK, pipeBody{r}, http.Header{}), "testkey"))
+
+	resOut, err := cold.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, body, readAllString(resOut))
+	_, err = hot.Retrieve("testkey")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	// smaller ones are read back from cold into hot
+	require.NoError(t, cache.Store(httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{}), "testkey"))
+	resOut, err = hot.Retrieve("testkey")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resOut))
+}
+
+func TestTieredCacheDemotesIdleResources(t *testing.T) {
+	now := time.Now()
+	clock := httpcache.Clock
+	httpcache.Clock = func() time.Time { return now }
+	defer func() { httpcache.Clock = clock }()
+
+	hot := httpcache.NewLRUCache(1024 * 1024)
+	cold := httpcache.NewMemoryCache()
+	cache := httpcache.NewConfiguredTieredCache(hot, cold, httpcache.TieredConfig{
+		DemoteIdle: time.Minute,
+	})
+
+	for _, key := range []string{"idle", "busy"} {
+		res := httpcache.NewResourceBytes(http.StatusOK, []byte(key), http.Header{})
+		if err := cache.Store(res, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(50 * time.Second)
+	resOut, err := cache.Retrieve("busy")
+	require.NoError(t, err)
+	require.Equal(t, "busy", readAllString(resOut))
+
+	now = now.Add(20 * time.Second)
+	resOut, err = cache.Retrieve("busy")
+	require.NoError(t, err)
+	require.Equal(t, "busy", readAllString(resOut))
+
+	_, err = hot.Retrieve("idle")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+	_, err = hot.Retrieve("busy")
+	require.NoError(t, err)
+
+	resOut, err = cold.Retrieve("idle")
+	require.NoError(t, err)
+	require.Equal(t, "idle", readAllString(resOut))
+}
@@ -0,0 +1,80 @@
+package httpcache
+
+import "hash/fnv"
+
+const (
+	// sketchDepth is the number of rows of counters in a frequencySketch,
+	// each indexed by a different hash of a key
+	sketchDepth = 4
+	// sketchWidth is the number of counters in each row
+	sketchWidth = 1 << 16
+	// sketchMax is the most a counter counts to
+	sketchMax = 15
+)
+
+// frequencySketch is a count-min sketch estimating how often keys have been
+// requested recently, as used by the TinyLFU admission policy. Counters are
+// halved every ten times the width of additions, so that keys that were
+// popular once don't stay popular forever. It isn't safe for concurrent use.
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8
+	additions int
+}
+
+func newFrequencySketch() *frequencySketch {
+	s := &frequencySketch{}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, sketchWidth)
+	}
+	return s
+}
+
+// indexes returns the counter of key in each row, by double hashing
+func (s *frequencySketch) indexes(key string) [sketchDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	var idx [sketchDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return idx
+}
+
+// increment records a request for key
+func (s *frequencySketch) increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < sketchMax {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= 10*sketchWidth {
+		s.age()
+	}
+}
+
+// estimate returns how many times key has been requested recently, which
+// may be overestimated but never underestimated
+func (s *frequencySketch) estimate(key string) uint8 {
+	min := uint8(sketchMax)
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < min {
+			min = s.rows[i][idx]
+		}
+	}
+	return min
+}
+
+// age halves every counter
+func (s *frequencySketch) age() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	s.additions /= 2
+}
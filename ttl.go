@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TTLRule overrides the freshness lifetime of responses to requests whose
+// Host and path match its patterns, in which * matches anything
+type TTLRule struct {
+	// Host is a pattern for the Host of requests, matching any host if empty
+	Host string
+	// Path is a pattern for the path of requests, matching any path if empty
+	Path string
+	TTL  time.Duration
+
+	// IfMissing only applies the rule to responses that don't have an
+	// explicit expiration of their own
+	IfMissing bool
+}
+
+// Matches returns whether a request matches the patterns of the rule
+func (rule TTLRule) Matches(r *http.Request) bool {
+	return matchHostPath(rule.Host, rule.Path, r)
+}
+
+// matchHostPath returns whether the Host and path of a request match host
+// and path patterns, either of which matches anything if it is empty
+func matchHostPath(hostPattern, pathPattern string, r *http.Request) bool {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hostPattern != "" && !globMatch(strings.ToLower(hostPattern), host) {
+		return false
+	}
+	return pathPattern == "" || globMatch(pathPattern, r.URL.Path)
+}
+
+// ttl returns the duration that overrides the freshness lifetime of a
+// response, from the first TTLRule that matches its request, NegativeTTL for
+// errors or else TTL, or 0 if it isn't overridden
+func (h *Handler) ttl(res *Resource, r *cacheRequest) time.Duration {
+	for _, rule := range h.TTLRules {
+		if !rule.Matches(r.Request) {
+			continue
+		}
+		if rule.IfMissing && res.HasExplicitExpiration() {
+			return 0
+		}
+		return rule.TTL
+	}
+	if h.negative(res) {
+		return h.NegativeTTL
+	}
+	return h.TTL
+}
+
+// negative returns whether NegativeTTL applies to a response
+func (h *Handler) negative(res *Resource) bool {
+	return h.NegativeTTL > 0 && negativeStatus[res.Status()] && !res.HasExplicitExpiration()
+}
+
+// globMatch returns whether s matches pattern, in which * matches any
+// sequence of characters
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
@@ -11,12 +11,28 @@ type Validator struct {
 }
 
 func (v *Validator) Validate(req *http.Request, res *Resource) bool {
+	valid, _ := v.validate(req, res)
+	return valid
+}
+
+// validate makes a conditional request for a resource, returning whether it
+// is still valid and the status that upstream responded with
+func (v *Validator) validate(req *http.Request, res *Resource) (bool, int) {
+	debugf("validating cached response")
 	outreq := cloneRequest(req)
 	resHeaders := res.Header()
 
+	// validate the whole response, ranges of it are served from the cache
+	outreq.Header.Del("Range")
+	outreq.Header.Del("If-Range")
+
+	// with the validators of the cached response rather than the client's
+	outreq.Header.Del("If-None-Match")
+	outreq.Header.Del("If-Modified-Since")
 	if etag := resHeaders.Get("Etag"); etag != "" {
 		outreq.Header.Set("If-None-Match", etag)
-	} else if lastMod := resHeaders.Get("Last-Modified"); lastMod != "" {
+	}
+	if lastMod := resHeaders.Get("Last-Modified"); lastMod != "" {
 		outreq.Header.Set("If-Modified-Since", lastMod)
 	}
 
@@ -29,13 +45,18 @@ func (v *Validator) Validate(req *http.Request, res *Resource) bool {
 		resp.Header().Set("Age", fmt.Sprintf("%.f", age.Seconds()))
 	}
 
+	// errors say nothing about whether the resource has changed
+	if resp.Code >= 500 {
+		return false, resp.Code
+	}
+
 	if headersEqual(resHeaders, resp.HeaderMap) {
-		res.header = resp.HeaderMap
+		res.header = updateHeaders(resHeaders, resp.HeaderMap)
 		res.header.Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-		return true
+		return true, resp.Code
 	}
 
-	return false
+	return false, resp.Code
 }
 
 var validationHeaders = []string{"ETag", "Content-MD5", "Last-Modified", "Content-Length"}
@@ -53,6 +74,23 @@ func headersEqual(h1, h2 http.Header) bool {
 	return true
 }
 
+// updateHeaders returns the headers of a cached response updated with those
+// of the response that validated it, keeping the ones that it omits, as a 304
+// response doesn't describe the body. Content-Length is always kept.
+// https://httpwg.github.io/specs/rfc7234.html#freshening.responses
+func updateHeaders(cached, validated http.Header) http.Header {
+	h := http.Header{}
+	for key, values := range cached {
+		h[key] = values
+	}
+	for key, values := range validated {
+		if key != "Content-Length" {
+			h[key] = values
+		}
+	}
+	return h
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
@@ -62,5 +100,12 @@ func cloneRequest(r *http.Request) *http.Request {
 	for k, s := range r.Header {
 		r2.Header[k] = s
 	}
+	// the body of a request is read when it is sent, so a clone that is
+	// sent again needs a body of its own
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			r2.Body = body
+		}
+	}
 	return r2
 }
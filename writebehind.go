@@ -0,0 +1,88 @@
+package httpcache
+
+import "sync"
+
+// DefaultWriteBehindWorkers is the number of responses stored at once with
+// Handler.WriteBehindBytes when Handler.WriteBehindWorkers isn't set
+const DefaultWriteBehindWorkers = 4
+
+// writeBehindQueueSize is how many responses can wait to be stored,
+// however few bytes they are
+const writeBehindQueueSize = 1000
+
+// writeBehind stores responses with a bounded pool of workers once they have
+// been written to clients, from a queue bounded by the bytes waiting in it
+type writeBehind struct {
+	once  sync.Once
+	queue chan *pendingStore
+
+	sync.Mutex
+	bytes int64
+}
+
+// pendingStore is a response waiting to be stored
+type pendingStore struct {
+	res    *Resource
+	r      *cacheRequest
+	size   int64
+	stored chan struct{}
+}
+
+// storeBehind queues a response of size bytes that has been written to the
+// client to be stored by a worker, returning a channel that is closed once
+// it is stored, or isn't because the queue is full or it was aborted
+func (h *Handler) storeBehind(res *Resource, r *cacheRequest, size int64, aborted bool) <-chan struct{} {
+	wb := &h.writeBehind
+	wb.once.Do(func() {
+		workers := h.WriteBehindWorkers
+		if workers <= 0 {
+			workers = DefaultWriteBehindWorkers
+		}
+		wb.queue = make(chan *pendingStore, writeBehindQueueSize)
+		for i := 0; i < workers; i++ {
+			go h.writeBehindWorker()
+		}
+	})
+
+	p := &pendingStore{res: res, r: r, size: size, stored: make(chan struct{})}
+	if aborted {
+		res.Close()
+		close(p.stored)
+		return p.stored
+	}
+
+	wb.Lock()
+	defer wb.Unlock()
+
+	if wb.bytes+size > h.WriteBehindBytes {
+		debugf("not storing %s, %d bytes are already waiting to be stored", r.Key.String(), wb.bytes)
+		res.Close()
+		close(p.stored)
+		return p.stored
+	}
+
+	Writes.Add(1)
+	select {
+	case wb.queue <- p:
+		wb.bytes += size
+	default:
+		debugf("not storing %s, the write behind queue is full", r.Key.String())
+		Writes.Done()
+		res.Close()
+		close(p.stored)
+	}
+	return p.stored
+}
+
+func (h *Handler) writeBehindWorker() {
+	wb := &h.writeBehind
+	for p := range wb.queue {
+		h.store(p.res, p.r)
+
+		wb.Lock()
+		wb.bytes -= p.size
+		wb.Unlock()
+		close(p.stored)
+		Writes.Done()
+	}
+}